@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"rgehrsitz/rex/pkg/compiler"
 	"rgehrsitz/rex/pkg/logging"
@@ -35,6 +36,13 @@ type Config struct {
 	JSONFilePath string
 	LogLevel     string
 	LogOutput    string
+	Cycles       string
+	// Emit is what to generate: bytecode, or a Go package with go
+	Emit string
+	// OutputPath is the file to write, output.bytecode or rules.go if empty
+	OutputPath string
+	// PackageName is the name of the generated Go package
+	PackageName string
 }
 
 func parseFlags(args []string) (*Config, error) {
@@ -49,11 +57,16 @@ func parseFlags(args []string) (*Config, error) {
 		fs.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  rexc -rules input_rules.json -loglevel debug -logoutput file\n")
+		fmt.Fprintf(os.Stderr, "  rexc -rules input_rules.json -emit go -package rules -output rules/rules.go\n")
 	}
 
 	fs.StringVar(&config.JSONFilePath, "rules", "", "Path to the input JSON file (required)")
 	fs.StringVar(&config.LogLevel, "loglevel", "info", "Set log level: panic, fatal, error, warn, info, debug, trace")
 	fs.StringVar(&config.LogOutput, "logoutput", "console", "Set log output: console or file")
+	fs.StringVar(&config.Cycles, "cycles", "warn", "Set handling of rules that trigger each other in a loop: warn, error or ignore")
+	fs.StringVar(&config.Emit, "emit", "bytecode", "Set what to generate: bytecode, or a Go package of the rules' native conditions with go")
+	fs.StringVar(&config.OutputPath, "output", "", "Path to the output file (default output.bytecode, or rules.go with -emit go)")
+	fs.StringVar(&config.PackageName, "package", "rules", "Set the name of the Go package generated with -emit go")
 
 	err := fs.Parse(args)
 	if err != nil {
@@ -65,6 +78,18 @@ func parseFlags(args []string) (*Config, error) {
 		return nil, fmt.Errorf("input JSON file path is required (use -rules flag)")
 	}
 
+	switch config.Cycles {
+	case "warn", "error", "ignore":
+	default:
+		return nil, fmt.Errorf("invalid -cycles value %q: must be warn, error or ignore", config.Cycles)
+	}
+
+	switch config.Emit {
+	case "bytecode", "go":
+	default:
+		return nil, fmt.Errorf("invalid -emit value %q: must be bytecode or go", config.Emit)
+	}
+
 	return config, nil
 }
 
@@ -83,12 +108,19 @@ func run(config *Config) error {
 		return fmt.Errorf("failed to parse JSON file: %w", err)
 	}
 
+	if err := checkRuleCycles(ruleset, config.Cycles); err != nil {
+		return err
+	}
+
+	if config.Emit == "go" {
+		return emitGo(ruleset, config)
+	}
+
 	bytecodeFile := compiler.GenerateBytecode(ruleset)
 
 	fmt.Println("Generated Bytecode:")
 
-	outputFilename := "output.bytecode"
-	if err := compiler.WriteBytecodeToFile(outputFilename, bytecodeFile); err != nil {
+	if err := compiler.WriteBytecodeToFile(config.outputPath(), bytecodeFile); err != nil {
 		return fmt.Errorf("failed to write bytecode to file: %w", err)
 	}
 
@@ -96,6 +128,58 @@ func run(config *Config) error {
 	return nil
 }
 
+// emitGo writes the Go package generated from the ruleset.
+func emitGo(ruleset *compiler.Ruleset, config *Config) error {
+	source, err := compiler.GenerateGo(ruleset, config.PackageName)
+	if err != nil {
+		return fmt.Errorf("failed to generate Go: %w", err)
+	}
+	if err := os.WriteFile(config.outputPath(), source, 0644); err != nil {
+		return fmt.Errorf("failed to write Go to file: %w", err)
+	}
+
+	fmt.Printf("Successfully generated package %s and wrote to %s\n", config.PackageName, config.outputPath())
+	return nil
+}
+
+// outputPath returns the file to write what is generated to.
+func (c *Config) outputPath() string {
+	switch {
+	case c.OutputPath != "":
+		return c.OutputPath
+	case c.Emit == "go":
+		return "rules.go"
+	default:
+		return "output.bytecode"
+	}
+}
+
+// checkRuleCycles reports rules whose actions write facts that, directly or
+// through other rules, trigger the same rules again. Depending on mode the
+// cycles are logged as warnings, fail the compilation or are ignored.
+func checkRuleCycles(ruleset *compiler.Ruleset, mode string) error {
+	if mode == "ignore" {
+		return nil
+	}
+
+	cycles := compiler.FindRuleCycles(ruleset)
+	if len(cycles) == 0 {
+		return nil
+	}
+
+	formatted := make([]string, len(cycles))
+	for i, cycle := range cycles {
+		formatted[i] = compiler.FormatRuleCycle(cycle)
+	}
+	if mode == "error" {
+		return fmt.Errorf("rule cycles detected: %s", strings.Join(formatted, "; "))
+	}
+	for _, cycle := range formatted {
+		logging.Logger.Warn().Str("cycle", cycle).Msg("Rules can trigger each other in a loop")
+	}
+	return nil
+}
+
 func readJSONFile(filepath string) ([]byte, error) {
 	return os.ReadFile(filepath)
 }
@@ -5,9 +5,12 @@ package main
 import (
 	"bytes"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseFlags(t *testing.T) {
@@ -24,9 +27,50 @@ func TestParseFlags(t *testing.T) {
 				JSONFilePath: "test.json",
 				LogLevel:     "debug",
 				LogOutput:    "file",
+				Cycles:       "warn",
+				Emit:         "bytecode",
+				PackageName:  "rules",
 			},
 			expectError: false,
 		},
+		{
+			name: "Cycles flag",
+			args: []string{"-rules", "test.json", "-cycles", "error"},
+			expected: &Config{
+				JSONFilePath: "test.json",
+				LogLevel:     "info",
+				LogOutput:    "console",
+				Cycles:       "error",
+				Emit:         "bytecode",
+				PackageName:  "rules",
+			},
+			expectError: false,
+		},
+		{
+			name: "Emit go",
+			args: []string{"-rules", "test.json", "-emit", "go", "-package", "alarms"},
+			expected: &Config{
+				JSONFilePath: "test.json",
+				LogLevel:     "info",
+				LogOutput:    "console",
+				Cycles:       "warn",
+				Emit:         "go",
+				PackageName:  "alarms",
+			},
+			expectError: false,
+		},
+		{
+			name:        "Invalid emit flag",
+			args:        []string{"-rules", "test.json", "-emit", "wasm"},
+			expected:    nil,
+			expectError: true,
+		},
+		{
+			name:        "Invalid cycles flag",
+			args:        []string{"-rules", "test.json", "-cycles", "panic"},
+			expected:    nil,
+			expectError: true,
+		},
 		{
 			name:        "Missing rules flag",
 			args:        []string{"-loglevel", "info"},
@@ -219,3 +263,133 @@ func TestMainFunction(t *testing.T) {
 	assert.NoError(t, err, "output.bytecode file should exist")
 	defer os.Remove("output.bytecode")
 }
+
+// generatedTest is a test of a package generated from emitGoRuleset, which
+// checks that its native conditions update the store as the interpreted
+// bytecode does.
+const generatedTest = `package alarms
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/runtime"
+	"rgehrsitz/rex/pkg/store"
+)
+
+func TestNativeMatchesInterpreted(t *testing.T) {
+	interpretedRedis := miniredis.RunT(t)
+	nativeRedis := miniredis.RunT(t)
+	interpretedStore := store.NewRedisStore(interpretedRedis.Addr(), "", 0)
+	nativeStore := store.NewRedisStore(nativeRedis.Addr(), "", 0)
+
+	program, err := runtime.LoadProgramBytes(bytecode)
+	require.NoError(t, err)
+	interpreted, err := runtime.NewEngine(program, interpretedStore, runtime.WithLogger(zerolog.Nop()))
+	require.NoError(t, err)
+	native, err := NewEngine(nativeStore, runtime.WithLogger(zerolog.Nop()))
+	require.NoError(t, err)
+
+	updates := []struct {
+		fact  string
+		value interface{}
+	}{
+		{"temperature", 20.0}, {"zone:mode", "idle"}, {"door:open", false},
+		{"temperature", 35.0}, {"zone:mode", "heating"}, {"door:open", true},
+		{"temperature", 28.0}, {"zone:mode", "alarm"}, {"temperature", 41.0},
+		{"door:open", false}, {"zone:mode", "idle"}, {"temperature", 5.0},
+	}
+	for _, update := range updates {
+		require.NoError(t, interpretedStore.SetFact(update.fact, update.value))
+		require.NoError(t, nativeStore.SetFact(update.fact, update.value))
+		interpreted.ProcessFactUpdate(update.fact, update.value)
+		native.ProcessFactUpdate(update.fact, update.value)
+		require.Equal(t, interpretedRedis.Dump(), nativeRedis.Dump(), "%s = %v", update.fact, update.value)
+	}
+	require.True(t, nativeRedis.Exists("alerts:heat"))
+	require.True(t, nativeRedis.Exists("alerts:setpoint"))
+}
+`
+
+const emitGoRuleset = `{
+	"rules": [
+		{
+			"name": "heat",
+			"priority": 1,
+			"conditions": {
+				"all": [
+					{"fact": "temperature", "operator": "GT", "value": 30},
+					{"any": [
+						{"fact": "zone:mode", "operator": "NEQ", "value": "idle"},
+						{"fact": "door:open", "operator": "EQ", "value": true}
+					]}
+				]
+			},
+			"actions": [
+				{"type": "updateStore", "target": "alerts:heat", "value": "Temperature is ${temperature}"},
+				{"type": "updateStore", "target": "alerts:excess", "value": "{excess}"}
+			],
+			"scripts": {
+				"excess": {"params": ["temperature"], "body": "return temperature - 30;"}
+			}
+		},
+		{
+			"name": "alarm",
+			"priority": 2,
+			"conditions": {
+				"any": [
+					{"fact": "zone:mode", "operator": "CONTAINS", "value": "alarm"},
+					{"fact": "temperature", "operator": "GTE", "value": 40}
+				]
+			},
+			"actions": [
+				{"type": "updateStore", "target": "alerts:alarm", "value": true}
+			]
+		},
+		{
+			"name": "setpoint",
+			"priority": 3,
+			"conditions": {
+				"all": [
+					{"fact": "temperature", "operator": "EQ", "value": 28}
+				]
+			},
+			"actions": [
+				{"type": "updateStore", "target": "alerts:setpoint", "value": true}
+			]
+		}
+	]
+}`
+
+func TestRunEmitGo(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+
+	// The package is generated inside the module, so it can import the
+	// runtime. Directories starting with _ are left out of ./...
+	dir, err := os.MkdirTemp(".", "_generated")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rulesFile := filepath.Join(dir, "rules.json")
+	require.NoError(t, os.WriteFile(rulesFile, []byte(emitGoRuleset), 0644))
+	config := &Config{
+		JSONFilePath: rulesFile,
+		LogLevel:     "info",
+		LogOutput:    "console",
+		Cycles:       "warn",
+		Emit:         "go",
+		OutputPath:   filepath.Join(dir, "rules.go"),
+		PackageName:  "alarms",
+	}
+	require.NoError(t, run(config))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rules_test.go"), []byte(generatedTest), 0644))
+
+	out, err := exec.Command(goTool, "test", "-count=1", "./"+dir).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
@@ -0,0 +1,95 @@
+// rex/cmd/rexd/deadletters.go
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"rgehrsitz/rex/pkg/store"
+)
+
+// deadLettersCommand is the rexd subcommand that inspects and replays dead
+// letters:
+//
+//	rexd deadletters [-config file] list
+//	rexd deadletters [-config file] replay [id ...]
+const deadLettersCommand = "deadletters"
+
+// runDeadLetters runs the dead letters subcommand. args starts with the
+// subcommand name. The list command prints one JSON object per dead letter;
+// replay replays the dead letters with the given IDs, or all of them.
+func runDeadLetters(args []string, storeFactory StoreFactory, out io.Writer) error {
+	config, err := parseConfig(args)
+	if err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	if config.DeadLetterKey == "" {
+		return fmt.Errorf("no dead letter key configured")
+	}
+
+	rest := flag.CommandLine.Args()
+	if len(rest) == 0 {
+		return fmt.Errorf("missing command: expected list or replay")
+	}
+
+	redisStore, ok := storeFactory.NewStore(config.RedisAddress, config.RedisPassword, config.RedisDB).(*store.RedisStore)
+	if !ok {
+		return fmt.Errorf("store is not a RedisStore")
+	}
+
+	letters, err := redisStore.GetDeadLetters(config.DeadLetterKey)
+	if err != nil {
+		return fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	switch rest[0] {
+	case "list":
+		encoder := json.NewEncoder(out)
+		for _, letter := range letters {
+			if err := encoder.Encode(letter); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "replay":
+		filter := len(rest) > 1
+		selected := make(map[string]bool, len(rest)-1)
+		for _, id := range rest[1:] {
+			selected[id] = true
+		}
+
+		failed := 0
+		found := make(map[string]bool, len(selected))
+		for _, letter := range letters {
+			if filter && !selected[letter.ID] {
+				continue
+			}
+			found[letter.ID] = true
+			if err := redisStore.ReplayDeadLetter(config.DeadLetterKey, letter); err != nil {
+				fmt.Fprintf(out, "Failed to replay dead letter %s: %v\n", letter.ID, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(out, "Replayed dead letter %s\n", letter.ID)
+		}
+		for _, id := range rest[1:] {
+			if !found[id] {
+				fmt.Fprintf(out, "Dead letter %s not found\n", id)
+				found[id] = true
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d dead letters were not replayed", failed)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q: expected list or replay", rest[0])
+	}
+}
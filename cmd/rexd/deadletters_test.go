@@ -0,0 +1,118 @@
+// rex/cmd/rexd/deadletters_test.go
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/store"
+)
+
+// deadLettersRunner returns a function that runs the dead letters subcommand
+// against the Redis server at addr, returning its output.
+func deadLettersRunner(t *testing.T, addr string) func(command ...string) (string, error) {
+	configFile, err := os.CreateTemp("", "rex_config.json")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(configFile.Name()) })
+
+	configContent := fmt.Sprintf(`{
+		"redis.address": "%s"
+	}`, addr)
+	_, err = configFile.WriteString(configContent)
+	require.NoError(t, err)
+	configFile.Close()
+
+	return func(command ...string) (string, error) {
+		// Reset the flag set before each run
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		var out bytes.Buffer
+		args := append([]string{deadLettersCommand, "--config", configFile.Name()}, command...)
+		err := runDeadLetters(args, &MockStoreFactory{}, &out)
+		return out.String(), err
+	}
+}
+
+func TestRunDeadLetters(t *testing.T) {
+	mr := miniredis.RunT(t)
+	deadLetters := deadLettersRunner(t, mr.Addr())
+
+	redisStore := store.NewRedisStore(mr.Addr(), "", 0)
+	require.NoError(t, redisStore.AddDeadLetter(store.DefaultDeadLetterKey, store.DeadLetter{
+		Kind:      store.DeadLetterAction,
+		Rule:      "FanRule",
+		Updates:   []store.FactUpdate{{Key: "system:fan_speed", Value: 3.0}},
+		Error:     "connection refused",
+		Timestamp: time.Now(),
+	}))
+
+	out, err := deadLetters("list")
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+	assert.Contains(t, out, `"rule":"FanRule"`)
+	assert.Contains(t, out, `"error":"connection refused"`)
+
+	out, err = deadLetters("replay", "42")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Dead letter 42 not found")
+
+	out, err = deadLetters("replay")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Replayed dead letter 1")
+
+	speed, err := mr.Get("system:fan_speed")
+	require.NoError(t, err)
+	assert.Equal(t, "3", speed)
+
+	out, err = deadLetters("list")
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	_, err = deadLetters()
+	assert.Error(t, err)
+	_, err = deadLetters("purge")
+	assert.Error(t, err)
+}
+
+func TestReplaySelectedDeadLetters(t *testing.T) {
+	mr := miniredis.RunT(t)
+	deadLetters := deadLettersRunner(t, mr.Addr())
+
+	redisStore := store.NewRedisStore(mr.Addr(), "", 0)
+	for _, fact := range []string{"system:fan_speed", "system:pump_speed", "system:vent_speed"} {
+		require.NoError(t, redisStore.AddDeadLetter(store.DefaultDeadLetterKey, store.DeadLetter{
+			Kind:      store.DeadLetterAction,
+			Rule:      "SpeedRule",
+			Updates:   []store.FactUpdate{{Key: fact, Value: 3.0}},
+			Error:     "connection refused",
+			Timestamp: time.Now(),
+		}))
+	}
+
+	// Only the selected letter is replayed, including when it is the first
+	out, err := deadLetters("replay", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "Replayed dead letter 1\n", out)
+	assert.True(t, mr.Exists("system:fan_speed"))
+	assert.False(t, mr.Exists("system:pump_speed"))
+	assert.False(t, mr.Exists("system:vent_speed"))
+
+	out, err = deadLetters("replay", "3", "42")
+	assert.Error(t, err)
+	assert.Equal(t, "Replayed dead letter 3\nDead letter 42 not found\n", out)
+	assert.False(t, mr.Exists("system:pump_speed"))
+
+	out, err = deadLetters("list")
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+	assert.Contains(t, out, `"id":"2"`)
+}
@@ -4,16 +4,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 
@@ -33,12 +30,40 @@ type Config struct {
 	RedisDB           int
 	RedisChannels     []string
 	PriorityThreshold int
+	OnlyIfChanged     bool
+	MaxChainDepth     int
+	MaxCausationDepth int
+	ErrorPolicy       string
+	QuarantineAfter   int
+	ScriptTimeout     time.Duration
+	MissingFactPolicy string
+	ExecutionMode     string
+	DeadLetterKey     string
+	Workers           int
+	CoalesceWindow    time.Duration
+	QueueSize         int
+	OverflowPolicy    string
+	ShutdownTimeout   time.Duration
+	StoreRetry        store.RetryPolicy
+	StoreBreaker      store.BreakerPolicy
+	// ReloadWatchInterval is how often the bytecode file is checked for
+	// changes to reload. Zero disables watching.
+	ReloadWatchInterval time.Duration
+	// AdminChannel is the Redis channel admin commands, such as reload, are
+	// received on. Empty disables admin commands.
+	AdminChannel string
+	// MetricsInterval is how often the queue and store metrics are logged
+	// while rexd runs. Zero logs them only on shutdown.
+	MetricsInterval time.Duration
 }
 
 // RexDependencies represents the external dependencies of the application
 type RexDependencies struct {
-	Store  store.Store
-	Engine *runtime.Engine
+	Store store.Store
+	// EngineStore wraps Store for the engine's reads and writes, retrying
+	// transient errors and failing fast while Redis is unavailable.
+	EngineStore *store.ResilientStore
+	Engine      *runtime.Engine
 }
 
 // StoreFactory is an interface for creating a store
@@ -48,7 +73,7 @@ type StoreFactory interface {
 
 // EngineFactory is an interface for creating an engine
 type EngineFactory interface {
-	NewEngine(bytecodeFile string, store store.Store, priorityThreshold int) (*runtime.Engine, error)
+	NewEngine(bytecodeFile string, store store.Store, opts ...runtime.Option) (*runtime.Engine, error)
 }
 
 func main() {
@@ -61,6 +86,13 @@ func main() {
 }
 
 func run(ctx context.Context, args []string, storeFactory StoreFactory, engineFactory EngineFactory) error {
+	if len(args) > 1 && args[1] == deadLettersCommand {
+		return runDeadLetters(args[1:], storeFactory, os.Stdout)
+	}
+	if len(args) > 1 && args[1] == reloadCommand {
+		return runReload(args[1:], storeFactory, os.Stdout)
+	}
+
 	config, err := parseConfig(args)
 	if err != nil {
 		return fmt.Errorf("failed to parse configuration: %w", err)
@@ -75,7 +107,37 @@ func run(ctx context.Context, args []string, storeFactory StoreFactory, engineFa
 		return fmt.Errorf("failed to setup dependencies: %w", err)
 	}
 
-	return runMainLoop(ctx, deps, config)
+	err = runMainLoop(ctx, deps, config)
+	shutdown(deps, config)
+	return err
+}
+
+// defaultShutdownTimeout is how long rexd waits for queued updates to be
+// evaluated on shutdown, unless configured otherwise.
+const defaultShutdownTimeout = 10 * time.Second
+
+// defaultMetricsInterval is how often rexd logs its metrics while running,
+// unless configured otherwise.
+const defaultMetricsInterval = time.Minute
+
+// shutdown stops the engine, giving it up to the configured timeout to
+// evaluate the updates already received, then closes the store. A timeout of
+// zero waits for all of them.
+func shutdown(deps *RexDependencies, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.ShutdownTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	}
+	defer cancel()
+
+	if err := deps.Engine.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Engine did not finish evaluating queued updates before the shutdown timeout")
+	}
+	logMetrics(deps)
+
+	if err := deps.Store.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close store")
+	}
 }
 
 func parseConfig(args []string) (*Config, error) {
@@ -90,6 +152,28 @@ func parseConfig(args []string) (*Config, error) {
 	viper.SetDefault("redis.database", 0)
 	viper.SetDefault("redis.channels", []string{"rex_updates"})
 	viper.SetDefault("engine.priority_threshold", 1)
+	viper.SetDefault("engine.only_if_changed", false)
+	viper.SetDefault("engine.max_chain_depth", runtime.DefaultMaxChainDepth)
+	viper.SetDefault("engine.max_causation_depth", runtime.DefaultMaxCausationDepth)
+	viper.SetDefault("engine.error_policy", string(runtime.ErrorPolicyContinue))
+	viper.SetDefault("engine.quarantine_after", runtime.DefaultQuarantineAfter)
+	viper.SetDefault("engine.script_timeout_ms", runtime.DefaultScriptTimeout.Milliseconds())
+	viper.SetDefault("engine.missing_fact_policy", string(runtime.MissingFactSkip))
+	viper.SetDefault("engine.execution_mode", string(runtime.ExecutionInterpreted))
+	viper.SetDefault("engine.workers", runtime.DefaultWorkers)
+	viper.SetDefault("engine.coalesce_window_ms", 0)
+	viper.SetDefault("engine.queue_size", runtime.DefaultQueueSize)
+	viper.SetDefault("engine.overflow_policy", string(runtime.OverflowBlock))
+	viper.SetDefault("engine.shutdown_timeout_ms", defaultShutdownTimeout.Milliseconds())
+	viper.SetDefault("dead_letter.key", store.DefaultDeadLetterKey)
+	viper.SetDefault("store.retry.max_attempts", store.DefaultRetryPolicy.MaxAttempts)
+	viper.SetDefault("store.retry.initial_backoff_ms", store.DefaultRetryPolicy.InitialBackoff.Milliseconds())
+	viper.SetDefault("store.retry.max_backoff_ms", store.DefaultRetryPolicy.MaxBackoff.Milliseconds())
+	viper.SetDefault("store.breaker.failure_threshold", store.DefaultBreakerPolicy.FailureThreshold)
+	viper.SetDefault("store.breaker.reset_timeout_ms", store.DefaultBreakerPolicy.ResetTimeout.Milliseconds())
+	viper.SetDefault("reload.watch_interval_ms", 0)
+	viper.SetDefault("admin.channel", defaultAdminChannel)
+	viper.SetDefault("metrics.interval_ms", defaultMetricsInterval.Milliseconds())
 
 	if *configFile == "" {
 		viper.SetConfigName("rex_config")
@@ -117,20 +201,99 @@ func parseConfig(args []string) (*Config, error) {
 		RedisDB:           viper.GetInt("redis.database"),
 		RedisChannels:     viper.GetStringSlice("redis.channels"),
 		PriorityThreshold: viper.GetInt("engine.priority_threshold"),
+		OnlyIfChanged:     viper.GetBool("engine.only_if_changed"),
+		MaxChainDepth:     viper.GetInt("engine.max_chain_depth"),
+		MaxCausationDepth: viper.GetInt("engine.max_causation_depth"),
+		ErrorPolicy:       viper.GetString("engine.error_policy"),
+		QuarantineAfter:   viper.GetInt("engine.quarantine_after"),
+		ScriptTimeout:     time.Duration(viper.GetInt("engine.script_timeout_ms")) * time.Millisecond,
+		MissingFactPolicy: viper.GetString("engine.missing_fact_policy"),
+		ExecutionMode:     viper.GetString("engine.execution_mode"),
+		DeadLetterKey:     viper.GetString("dead_letter.key"),
+		Workers:           viper.GetInt("engine.workers"),
+		CoalesceWindow:    time.Duration(viper.GetInt("engine.coalesce_window_ms")) * time.Millisecond,
+		QueueSize:         viper.GetInt("engine.queue_size"),
+		OverflowPolicy:    viper.GetString("engine.overflow_policy"),
+		ShutdownTimeout:   time.Duration(viper.GetInt("engine.shutdown_timeout_ms")) * time.Millisecond,
+		StoreRetry: store.RetryPolicy{
+			MaxAttempts:    viper.GetInt("store.retry.max_attempts"),
+			InitialBackoff: time.Duration(viper.GetInt("store.retry.initial_backoff_ms")) * time.Millisecond,
+			MaxBackoff:     time.Duration(viper.GetInt("store.retry.max_backoff_ms")) * time.Millisecond,
+		},
+		StoreBreaker: store.BreakerPolicy{
+			FailureThreshold: viper.GetInt("store.breaker.failure_threshold"),
+			ResetTimeout:     time.Duration(viper.GetInt("store.breaker.reset_timeout_ms")) * time.Millisecond,
+		},
+		ReloadWatchInterval: time.Duration(viper.GetInt("reload.watch_interval_ms")) * time.Millisecond,
+		AdminChannel:        viper.GetString("admin.channel"),
+		MetricsInterval:     time.Duration(viper.GetInt("metrics.interval_ms")) * time.Millisecond,
 	}, nil
 }
 
 func setupDependencies(config *Config, storeFactory StoreFactory, engineFactory EngineFactory) (*RexDependencies, error) {
-	store := storeFactory.NewStore(config.RedisAddress, config.RedisPassword, config.RedisDB)
+	opts, err := engineOptions(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid engine configuration: %w", err)
+	}
+
+	factStore := storeFactory.NewStore(config.RedisAddress, config.RedisPassword, config.RedisDB)
+	engineStore := store.NewResilientStore(factStore, config.StoreRetry, config.StoreBreaker)
 
-	engine, err := engineFactory.NewEngine(config.BytecodeFile, store, config.PriorityThreshold)
+	engine, err := engineFactory.NewEngine(config.BytecodeFile, engineStore, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize engine: %w", err)
 	}
+	engine.Start()
 
 	return &RexDependencies{
-		Store:  store,
-		Engine: engine,
+		Store:       factStore,
+		EngineStore: engineStore,
+		Engine:      engine,
+	}, nil
+}
+
+// engineOptions maps the configuration onto engine options.
+func engineOptions(config *Config) ([]runtime.Option, error) {
+	errorPolicy, err := runtime.ParseErrorPolicy(config.ErrorPolicy)
+	if err != nil {
+		return nil, err
+	}
+	overflowPolicy, err := runtime.ParseOverflowPolicy(config.OverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	missingFactPolicy, err := runtime.ParseMissingFactPolicy(config.MissingFactPolicy)
+	if err != nil {
+		return nil, err
+	}
+	executionMode, err := runtime.ParseExecutionMode(config.ExecutionMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Updates are coalesced by the workers, so coalescing needs at least one
+	workers := config.Workers
+	if config.CoalesceWindow > 0 && workers < 1 {
+		workers = 1
+	}
+
+	// rexd subscribes to the configured channels itself, so the engine must
+	// not take in the same messages from a subscription of its own
+	return []runtime.Option{
+		runtime.WithOwnSubscription(),
+		runtime.WithLogger(logging.Logger),
+		runtime.WithPriorityThreshold(config.PriorityThreshold),
+		runtime.WithScriptTimeout(config.ScriptTimeout),
+		runtime.WithMissingFactPolicy(missingFactPolicy),
+		runtime.WithExecutionMode(executionMode),
+		runtime.WithOnlyIfChanged(config.OnlyIfChanged),
+		runtime.WithMaxChainDepth(config.MaxChainDepth),
+		runtime.WithMaxCausationDepth(config.MaxCausationDepth),
+		runtime.WithErrorPolicy(errorPolicy, config.QuarantineAfter),
+		runtime.WithDeadLetterKey(config.DeadLetterKey),
+		runtime.WithCoalesceWindow(config.CoalesceWindow),
+		runtime.WithQueue(config.QueueSize, overflowPolicy),
+		runtime.WithWorkers(workers),
 	}, nil
 }
 
@@ -143,20 +306,53 @@ func runMainLoop(ctx context.Context, deps *RexDependencies, config *Config) err
 		return fmt.Errorf("store is not a RedisStore")
 	}
 
-	pubsub := redisStore.Subscribe(config.RedisChannels...)
+	channels := config.RedisChannels
+	if config.AdminChannel != "" {
+		channels = append(channels[:len(channels):len(channels)], config.AdminChannel)
+	}
+	pubsub := redisStore.Subscribe(channels...)
 	defer pubsub.Close()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// SIGHUP and changes to the bytecode file reload the rules
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	defer signal.Stop(reloadSignals)
+	bytecodeChanged := make(chan struct{}, 1)
+	if config.ReloadWatchInterval > 0 {
+		go watchBytecodeFile(ctx, config.BytecodeFile, config.ReloadWatchInterval, bytecodeChanged)
+	}
+
+	// A nil channel never receives, so no metrics are logged until shutdown
+	var metricsTicks <-chan time.Time
+	if config.MetricsInterval > 0 {
+		ticker := time.NewTicker(config.MetricsInterval)
+		defer ticker.Stop()
+		metricsTicks = ticker.C
+	}
+
 	log.Info().Msg("REX runtime engine started")
 
 	for {
 		select {
 		case msg := <-pubsub.Channel():
-			if err := processMessage(deps.Engine, msg); err != nil {
+			if msg.Channel == config.AdminChannel {
+				handleAdminCommand(deps, config, msg.Payload)
+				continue
+			}
+			log.Info().Str("channel", msg.Channel).Str("payload", msg.Payload).Msg("Received message")
+			// Invalid messages are dead-lettered by the engine
+			if err := deps.Engine.IngestMessage(msg.Channel, msg.Payload); err != nil {
 				log.Error().Err(err).Msg("Failed to process message")
 			}
+		case <-reloadSignals:
+			reloadBytecode(deps.Engine, config, "SIGHUP")
+		case <-bytecodeChanged:
+			reloadBytecode(deps.Engine, config, "file change")
+		case <-metricsTicks:
+			logMetrics(deps)
 		case <-sigChan:
 			log.Info().Msg("Shutting down REX runtime engine")
 			return nil
@@ -166,40 +362,27 @@ func runMainLoop(ctx context.Context, deps *RexDependencies, config *Config) err
 	}
 }
 
-func processMessage(engine *runtime.Engine, msg *redis.Message) error {
-	log.Info().Str("channel", msg.Channel).Str("payload", msg.Payload).Msg("Received message")
-
-	// Try to parse the payload as JSON
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal([]byte(msg.Payload), &jsonData); err == nil {
-		// Handle JSON payload
-		for key, value := range jsonData {
-			// Process each key-value pair in the JSON object
-			engine.ProcessFactUpdate(key, value)
-		}
-		return nil
-	}
-
-	// If payload is not JSON, try to parse it as key=value
-	parts := strings.Split(msg.Payload, "=")
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid payload format: %s", msg.Payload)
-	}
-
-	key := parts[0]
-	value := parts[1]
-
-	var typedValue interface{}
-	if value == "true" || value == "false" {
-		typedValue = value == "true"
-	} else if num, err := strconv.ParseFloat(value, 64); err == nil {
-		typedValue = num
-	} else {
-		typedValue = value
+// logMetrics logs the ingestion queue counters of the engine and the retry
+// and circuit breaker counters of its store.
+func logMetrics(deps *RexDependencies) {
+	queue := deps.Engine.QueueStats()
+	log.Info().
+		Int("depth", queue.Depth).
+		Int("capacity", queue.Capacity).
+		Uint64("dropped", queue.Dropped).
+		Msg("Ingestion queue metrics")
+
+	if deps.EngineStore == nil {
+		return
 	}
-
-	engine.ProcessFactUpdate(key, typedValue)
-	return nil
+	metrics := deps.EngineStore.Metrics()
+	log.Info().
+		Str("breakerState", string(metrics.State)).
+		Uint64("retries", metrics.Retries).
+		Uint64("failures", metrics.Failures).
+		Uint64("rejected", metrics.Rejected).
+		Uint64("trips", metrics.Trips).
+		Msg("Store metrics")
 }
 
 // RealStoreFactory implements StoreFactory
@@ -212,6 +395,12 @@ func (f *RealStoreFactory) NewStore(addr, password string, db int) store.Store {
 // RealEngineFactory implements EngineFactory
 type RealEngineFactory struct{}
 
-func (f *RealEngineFactory) NewEngine(bytecodeFile string, store store.Store, priorityThreshold int) (*runtime.Engine, error) {
-	return runtime.NewEngineFromFile(bytecodeFile, store, priorityThreshold)
+// NewEngine loads the bytecode file and creates an engine for it, which
+// setupDependencies starts once it is configured.
+func (f *RealEngineFactory) NewEngine(bytecodeFile string, store store.Store, opts ...runtime.Option) (*runtime.Engine, error) {
+	program, err := runtime.LoadProgramFile(bytecodeFile)
+	if err != nil {
+		return nil, err
+	}
+	return runtime.NewEngine(program, store, opts...)
 }
@@ -0,0 +1,128 @@
+// rex/cmd/rexd/reload.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"rgehrsitz/rex/pkg/runtime"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// reloadCommand is the rexd subcommand that asks running rexd processes to
+// reload their bytecode file:
+//
+//	rexd reload [-config file]
+const reloadCommand = "reload"
+
+// adminReload is the admin channel message that reloads the bytecode file.
+const adminReload = "reload"
+
+// adminMetrics is the admin channel message that logs the queue and store
+// metrics.
+const adminMetrics = "metrics"
+
+// defaultAdminChannel is the Redis channel rexd listens on for admin
+// commands, unless configured otherwise.
+const defaultAdminChannel = "rex:admin"
+
+// runReload runs the reload subcommand. args starts with the subcommand name.
+// It publishes a reload command on the admin channel and fails if no rexd
+// process is listening.
+func runReload(args []string, storeFactory StoreFactory, out io.Writer) error {
+	config, err := parseConfig(args)
+	if err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	if config.AdminChannel == "" {
+		return fmt.Errorf("no admin channel configured")
+	}
+
+	redisStore, ok := storeFactory.NewStore(config.RedisAddress, config.RedisPassword, config.RedisDB).(*store.RedisStore)
+	if !ok {
+		return fmt.Errorf("store is not a RedisStore")
+	}
+	defer redisStore.Close()
+
+	receivers, err := redisStore.Publish(config.AdminChannel, adminReload)
+	if err != nil {
+		return fmt.Errorf("failed to publish reload command: %w", err)
+	}
+	if receivers == 0 {
+		return fmt.Errorf("no rexd is listening on admin channel %s", config.AdminChannel)
+	}
+	fmt.Fprintf(out, "Reload requested from %d rexd processes\n", receivers)
+	return nil
+}
+
+// handleAdminCommand runs a command received on the admin channel.
+func handleAdminCommand(deps *RexDependencies, config *Config, command string) {
+	switch command {
+	case adminReload:
+		reloadBytecode(deps.Engine, config, "admin command")
+	case adminMetrics:
+		logMetrics(deps)
+	default:
+		log.Warn().Str("command", command).Msg("Unknown admin command")
+	}
+}
+
+// reloadBytecode reloads the configured bytecode file into the engine. If the
+// file is invalid the engine keeps running the rules it has.
+func reloadBytecode(engine *runtime.Engine, config *Config, trigger string) {
+	log.Info().Str("file", config.BytecodeFile).Str("trigger", trigger).Msg("Reloading bytecode")
+	summary, err := engine.ReloadFromFile(config.BytecodeFile)
+	if err != nil {
+		log.Error().Err(err).Str("file", config.BytecodeFile).Msg("Failed to reload bytecode, keeping the running rules")
+		return
+	}
+	log.Info().
+		Int("added", len(summary.Added)).
+		Int("changed", len(summary.Changed)).
+		Int("removed", len(summary.Removed)).
+		Int("unchanged", len(summary.Unchanged)).
+		Msg("Bytecode reloaded")
+}
+
+// watchBytecodeFile polls a bytecode file every interval and signals changed
+// when its modification time or size changes, until ctx is done.
+func watchBytecodeFile(ctx context.Context, filename string, interval time.Duration, changed chan<- struct{}) {
+	var lastModTime time.Time
+	var lastSize int64
+	if info, err := os.Stat(filename); err == nil {
+		lastModTime, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			log.Debug().Err(err).Str("file", filename).Msg("Failed to stat bytecode file")
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+
+		log.Info().Str("file", filename).Msg("Bytecode file changed")
+		select {
+		case changed <- struct{}{}:
+		default:
+			// A reload is already pending and will read the new file
+		}
+	}
+}
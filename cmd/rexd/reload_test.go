@@ -0,0 +1,131 @@
+// rex/cmd/rexd/reload_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/runtime"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// writeAlertBytecode compiles a ruleset with a single rule that writes its
+// name to alerts:rule when temperature is above zero.
+func writeAlertBytecode(t *testing.T, filename, ruleName string) {
+	bytecode := compiler.GenerateBytecode(&compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name: ruleName,
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 0.0},
+					},
+				},
+				Actions: []compiler.Action{
+					{Type: "updateStore", Target: "alerts:rule", Value: ruleName},
+				},
+			},
+		},
+	})
+	require.NoError(t, compiler.WriteBytecodeToFile(filename, bytecode))
+}
+
+func TestRunReload(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	configFile, err := os.CreateTemp("", "rex_config.json")
+	require.NoError(t, err)
+	defer os.Remove(configFile.Name())
+	_, err = configFile.WriteString(fmt.Sprintf(`{"redis.address": "%s"}`, mr.Addr()))
+	require.NoError(t, err)
+	configFile.Close()
+
+	reload := func() (string, error) {
+		// Reset the flag set before each run
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		var out bytes.Buffer
+		err := runReload([]string{reloadCommand, "--config", configFile.Name()}, &MockStoreFactory{}, &out)
+		return out.String(), err
+	}
+
+	_, err = reload()
+	assert.Error(t, err, "no rexd is listening")
+
+	redisStore := store.NewRedisStore(mr.Addr(), "", 0)
+	pubsub := redisStore.Subscribe(defaultAdminChannel)
+	defer pubsub.Close()
+
+	out, err := reload()
+	require.NoError(t, err)
+	assert.Contains(t, out, "Reload requested from 1 rexd processes")
+
+	msg, err := pubsub.ReceiveMessage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, adminReload, msg.Payload)
+}
+
+func TestRunMainLoopReload(t *testing.T) {
+	testCases := []struct {
+		name    string
+		watch   time.Duration
+		trigger func(mr *miniredis.Miniredis)
+	}{
+		{"file change", 10 * time.Millisecond, func(*miniredis.Miniredis) {}},
+		{"admin command", 0, func(mr *miniredis.Miniredis) { mr.Publish(defaultAdminChannel, adminReload) }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr, err := miniredis.Run()
+			require.NoError(t, err)
+			defer mr.Close()
+
+			filename := filepath.Join(t.TempDir(), "rules.bytecode")
+			writeAlertBytecode(t, filename, "before")
+
+			redisStore := store.NewRedisStore(mr.Addr(), "", 0)
+			engine, err := runtime.NewEngineFromFile(filename, redisStore)
+			require.NoError(t, err)
+			defer engine.Shutdown(context.Background())
+
+			config := &Config{
+				BytecodeFile:        filename,
+				RedisChannels:       []string{"rex_updates"},
+				ReloadWatchInterval: tc.watch,
+				AdminChannel:        defaultAdminChannel,
+			}
+			deps := &RexDependencies{Store: redisStore, Engine: engine}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- runMainLoop(ctx, deps, config) }()
+
+			time.Sleep(100 * time.Millisecond)
+			writeAlertBytecode(t, filename, "after_reload")
+			tc.trigger(mr)
+
+			assert.Eventually(t, func() bool {
+				engine.ProcessFactUpdate("temperature", 25.0)
+				rule, err := mr.Get("alerts:rule")
+				return err == nil && rule == `"after_reload"`
+			}, 2*time.Second, 20*time.Millisecond)
+
+			cancel()
+			assert.NoError(t, <-done)
+		})
+	}
+}
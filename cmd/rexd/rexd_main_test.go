@@ -3,18 +3,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
-	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"rgehrsitz/rex/pkg/compiler"
 	"rgehrsitz/rex/pkg/runtime"
 	"rgehrsitz/rex/pkg/store"
 )
@@ -28,9 +35,9 @@ func (f *MockStoreFactory) NewStore(addr, password string, db int) store.Store {
 
 type MockEngineFactory struct{}
 
-func (f *MockEngineFactory) NewEngine(bytecodeFile string, store store.Store, priorityThreshold int) (*runtime.Engine, error) {
-	// Updated to include priorityThreshold parameter
-	return &runtime.Engine{Facts: make(map[string]interface{})}, nil
+func (f *MockEngineFactory) NewEngine(bytecodeFile string, store store.Store, opts ...runtime.Option) (*runtime.Engine, error) {
+	// An empty program has no rules to evaluate
+	return runtime.NewEngine(&runtime.Program{}, store, opts...)
 }
 
 func TestParseConfig(t *testing.T) {
@@ -51,9 +58,17 @@ func TestParseConfig(t *testing.T) {
 		"redis.database": 1,
 		"redis.channels": ["rex_updates"],
 		"engine.update_interval": 10,
+		"engine.script_timeout_ms": 250,
+		"engine.missing_fact_policy": "evaluate",
+		"engine.execution_mode": "compiled",
 		"dashboard.enabled": true,
 		"dashboard.port": 9090,
-		"dashboard.update_interval": 15
+		"dashboard.update_interval": 15,
+		"store.retry.max_attempts": 5,
+		"store.retry.initial_backoff_ms": 20,
+		"store.breaker.reset_timeout_ms": 3000,
+		"reload.watch_interval_ms": 500,
+		"metrics.interval_ms": 250
 	}`
 	_, err = configFile.WriteString(configContent)
 	require.NoError(t, err)
@@ -70,7 +85,15 @@ func TestParseConfig(t *testing.T) {
 	assert.Equal(t, "localhost:6379", config.RedisAddress)
 	assert.Equal(t, "password", config.RedisPassword)
 	assert.Equal(t, 1, config.RedisDB)
+	assert.Equal(t, 250*time.Millisecond, config.ScriptTimeout)
+	assert.Equal(t, "evaluate", config.MissingFactPolicy)
+	assert.Equal(t, "compiled", config.ExecutionMode)
 	assert.Equal(t, []string{"rex_updates"}, config.RedisChannels)
+	assert.Equal(t, store.RetryPolicy{MaxAttempts: 5, InitialBackoff: 20 * time.Millisecond, MaxBackoff: store.DefaultRetryPolicy.MaxBackoff}, config.StoreRetry)
+	assert.Equal(t, store.BreakerPolicy{FailureThreshold: store.DefaultBreakerPolicy.FailureThreshold, ResetTimeout: 3 * time.Second}, config.StoreBreaker)
+	assert.Equal(t, 500*time.Millisecond, config.ReloadWatchInterval)
+	assert.Equal(t, defaultAdminChannel, config.AdminChannel)
+	assert.Equal(t, 250*time.Millisecond, config.MetricsInterval)
 }
 
 func TestSetupDependencies(t *testing.T) {
@@ -87,6 +110,17 @@ func TestSetupDependencies(t *testing.T) {
 		RedisPassword:     "",
 		RedisDB:           0,
 		PriorityThreshold: 5, // Add PriorityThreshold to the config
+		OnlyIfChanged:     true,
+		MaxChainDepth:     3,
+		MaxCausationDepth: 7,
+		ErrorPolicy:       "quarantine",
+		QuarantineAfter:   2,
+		DeadLetterKey:     "rexd:dead_letters",
+		Workers:           0,
+		CoalesceWindow:    10 * time.Millisecond,
+		OverflowPolicy:    "drop-oldest",
+		StoreRetry:        store.RetryPolicy{MaxAttempts: 4},
+		StoreBreaker:      store.BreakerPolicy{FailureThreshold: 3},
 	}
 
 	deps, err := setupDependencies(config, &MockStoreFactory{}, &MockEngineFactory{})
@@ -94,6 +128,39 @@ func TestSetupDependencies(t *testing.T) {
 
 	assert.NotNil(t, deps.Store)
 	assert.NotNil(t, deps.Engine)
+	assert.True(t, deps.Engine.OnlyIfChanged)
+	assert.Equal(t, 3, deps.Engine.MaxChainDepth)
+	assert.Equal(t, 7, deps.Engine.MaxCausationDepth)
+	assert.Equal(t, runtime.ErrorPolicyQuarantine, deps.Engine.ErrorPolicy)
+	assert.Equal(t, 2, deps.Engine.QuarantineAfter)
+	assert.Equal(t, 10*time.Millisecond, deps.Engine.CoalesceWindow)
+	assert.Equal(t, "rexd:dead_letters", deps.Engine.DeadLetterKey)
+	deps.Engine.Submit("test:key", "value")
+	shutdown(deps, config)
+	value, _ := deps.Engine.Fact("test:key")
+	assert.Equal(t, "value", value)
+	if assert.NotNil(t, deps.EngineStore) {
+		assert.Equal(t, store.BreakerClosed, deps.EngineStore.Metrics().State)
+	}
+
+	config.ErrorPolicy = "ignore"
+	_, err = setupDependencies(config, &MockStoreFactory{}, &MockEngineFactory{})
+	assert.Error(t, err)
+
+	config.ErrorPolicy = "continue"
+	config.OverflowPolicy = "drop-all"
+	_, err = setupDependencies(config, &MockStoreFactory{}, &MockEngineFactory{})
+	assert.Error(t, err)
+
+	config.OverflowPolicy = "block"
+	config.MissingFactPolicy = "ignore"
+	_, err = setupDependencies(config, &MockStoreFactory{}, &MockEngineFactory{})
+	assert.Error(t, err)
+
+	config.MissingFactPolicy = "skip"
+	config.ExecutionMode = "jit"
+	_, err = setupDependencies(config, &MockStoreFactory{}, &MockEngineFactory{})
+	assert.Error(t, err)
 }
 
 func TestRunMainLoop(t *testing.T) {
@@ -127,27 +194,200 @@ func TestRunMainLoop(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestProcessMessage(t *testing.T) {
-	// Reset the flag set before each test run
-	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+// chainRule returns a rule that writes 1 to target whenever fact is above
+// zero.
+func chainRule(name, fact, target string) compiler.Rule {
+	return compiler.Rule{
+		Name: name,
+		Conditions: compiler.ConditionGroup{
+			All: []*compiler.ConditionOrGroup{{Fact: fact, Operator: "GT", Value: 0.0}},
+		},
+		Actions: []compiler.Action{{Type: "updateStore", Target: target, Value: 1.0}},
+	}
+}
 
+// startRexd compiles rules and runs rexd's main loop against mr, subscribed
+// to channels, until the returned function is called.
+func startRexd(t *testing.T, mr *miniredis.Miniredis, rules []compiler.Rule, configure func(*Config), channels ...string) (*RexDependencies, func()) {
+	filename := filepath.Join(t.TempDir(), "rules.bytecode")
+	require.NoError(t, compiler.WriteBytecodeToFile(filename, compiler.GenerateBytecode(&compiler.Ruleset{Rules: rules})))
+
+	config := &Config{
+		BytecodeFile:      filename,
+		RedisAddress:      mr.Addr(),
+		RedisChannels:     channels,
+		MaxChainDepth:     runtime.DefaultMaxChainDepth,
+		MaxCausationDepth: runtime.DefaultMaxCausationDepth,
+		DeadLetterKey:     store.DefaultDeadLetterKey,
+	}
+	if configure != nil {
+		configure(config)
+	}
+	deps, err := setupDependencies(config, &MockStoreFactory{}, &RealEngineFactory{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- runMainLoop(ctx, deps, config) }()
+	time.Sleep(100 * time.Millisecond)
+
+	return deps, func() {
+		cancel()
+		assert.NoError(t, <-done)
+		shutdown(deps, config)
+	}
+}
+
+// countPublished subscribes to channel and counts the messages published on
+// it.
+func countPublished(t *testing.T, mr *miniredis.Miniredis, channel string) *atomic.Int32 {
+	pubsub := store.NewRedisStore(mr.Addr(), "", 0).Subscribe(channel)
+	t.Cleanup(func() { pubsub.Close() })
+	var count atomic.Int32
+	go func() {
+		for range pubsub.Channel() {
+			count.Add(1)
+		}
+	}()
+	return &count
+}
+
+func TestRunMainLoopIngestsMessages(t *testing.T) {
 	mr, err := miniredis.Run()
 	require.NoError(t, err)
 	defer mr.Close()
 
-	engine := &runtime.Engine{
-		Facts: make(map[string]interface{}),
+	// The engine subscribes to "system" on its own unless rexd tells it not
+	// to, so every message would be taken in twice
+	deps, stop := startRexd(t, mr, []compiler.Rule{chainRule("fan", "system:temperature", "alerts:fan")}, nil, "system")
+	defer stop()
+
+	mr.Publish("system", `{"system:mode":"eco","system:fan_config":{"expr":"a=b"}}`)
+	mr.Publish("system", "garbage")
+	assert.Eventually(t, func() bool {
+		mode, _ := deps.Engine.Fact("system:mode")
+		return mode == "eco"
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	config, _ := deps.Engine.Fact("system:fan_config")
+	assert.Equal(t, map[string]interface{}{"expr": "a=b"}, config)
+	letters, err := deps.Store.(*store.RedisStore).GetDeadLetters(store.DefaultDeadLetterKey)
+	require.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "garbage", letters[0].Payload)
 	}
+}
 
-	msg := &redis.Message{
-		Channel: "rex_updates",
-		Payload: "test:key=value",
-	}
+// lockedBuffer is a buffer that logs can be written to and read from
+// concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRunMainLoopLogsMetrics(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	var logs lockedBuffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&logs)
+
+	_, stop := startRexd(t, mr, []compiler.Rule{chainRule("fan", "system:temperature", "alerts:fan")}, func(config *Config) {
+		config.MetricsInterval = 20 * time.Millisecond
+	}, "system")
+	defer stop()
+
+	// The metrics are logged while rexd runs, not only on shutdown
+	assert.Eventually(t, func() bool {
+		return strings.Count(logs.String(), `"message":"Store metrics"`) >= 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), `"breakerState":"closed"`)
+}
 
-	err = processMessage(engine, msg)
+func TestAdminMetricsCommand(t *testing.T) {
+	mr, err := miniredis.Run()
 	require.NoError(t, err)
+	defer mr.Close()
 
-	assert.Equal(t, "value", engine.Facts["test:key"])
+	var logs lockedBuffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&logs)
+
+	_, stop := startRexd(t, mr, []compiler.Rule{chainRule("fan", "system:temperature", "alerts:fan")}, func(config *Config) {
+		config.AdminChannel = defaultAdminChannel
+	}, "system")
+	defer stop()
+
+	assert.NotContains(t, logs.String(), `"message":"Ingestion queue metrics"`)
+	mr.Publish(defaultAdminChannel, adminMetrics)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), `"message":"Ingestion queue metrics"`)
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), `"dropped":0`)
+}
+
+func TestRunMainLoopChainsOnce(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	require.NoError(t, mr.Set("chain:a", "1"))
+
+	// step2 is chained in-process when step1 writes chain:b, so the update
+	// the store publishes for chain:b must not fire it again
+	_, stop := startRexd(t, mr, []compiler.Rule{
+		chainRule("step1", "chain:a", "chain:b"),
+		chainRule("step2", "chain:b", "chain:c"),
+	}, nil, "chain")
+	defer stop()
+	published := countPublished(t, mr, "chain")
+
+	mr.Publish("chain", "chain:a=1")
+	assert.Eventually(t, func() bool { return mr.Exists("chain:c") }, time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+
+	// chain:a, chain:b and chain:c, each once
+	assert.Equal(t, int32(3), published.Load())
+}
+
+func TestRunMainLoopStopsRunawayLoop(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	require.NoError(t, mr.Set("loop:a", "1"))
+
+	// Two rules that keep triggering each other through the store. With one
+	// level chained in-process, each round fires both rules and the echo of
+	// the second write starts the next round, until six rules fired in a row.
+	_, stop := startRexd(t, mr, []compiler.Rule{
+		chainRule("ping", "loop:a", "loop:b"),
+		chainRule("pong", "loop:b", "loop:a"),
+	}, func(config *Config) {
+		config.MaxChainDepth = 1
+		config.MaxCausationDepth = 6
+	}, "loop")
+	defer stop()
+	published := countPublished(t, mr, "loop")
+
+	mr.Publish("loop", "loop:a=1")
+	time.Sleep(500 * time.Millisecond)
+
+	// The external update and the writes of three rounds of both rules
+	assert.Equal(t, int32(7), published.Load())
 }
 
 func TestRun(t *testing.T) {
@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"rgehrsitz/rex/pkg/logging"
@@ -14,7 +15,7 @@ import (
 
 // Header information.
 const (
-	Version       = 1
+	Version       = 2
 	Checksum      = 0
 	ConstPoolSize = 0
 	HeaderSize    = 28
@@ -118,6 +119,25 @@ const (
 
 	SCRIPT_DEF
 	SCRIPT_CALL
+
+	ACTION_VALUE_TEMPLATE
+	ACTION_DELAY
+	RULE_FLAGS
+	ACTION_ONLY_IF_CHANGED
+	RULE_EXCLUSIVE_GROUP
+	RULE_GROUP
+
+	// CONDITION_NODE tags the condition that follows it with its node in
+	// the ruleset's condition network
+	CONDITION_NODE
+)
+
+// Rule flags carried by the RULE_FLAGS opcode.
+const (
+	// RuleFlagAtomic commits all of a rule's store writes in one transaction.
+	RuleFlagAtomic byte = 1 << iota
+	// RuleFlagStopProcessing skips the rest of a rule's group once it fires.
+	RuleFlagStopProcessing
 )
 
 // hasOperands returns true if the opcode requires operands.
@@ -127,7 +147,12 @@ func (op Opcode) HasOperands() bool {
 		LOAD_FACT_FLOAT, LOAD_FACT_STRING, LOAD_FACT_BOOL,
 		JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE, LABEL,
 		SEND_MESSAGE, TRIGGER_ACTION, UPDATE_FACT,
-		ACTION_START, RULE_START, PRIORITY, SCRIPT_DEF, SCRIPT_CALL:
+		RULE_START, PRIORITY, SCRIPT_DEF, SCRIPT_CALL,
+		ACTION_TYPE, ACTION_TARGET,
+		ACTION_VALUE_FLOAT, ACTION_VALUE_STRING, ACTION_VALUE_BOOL,
+		ACTION_VALUE_ARRAY, ACTION_VALUE_OBJECT, ACTION_VALUE_TEMPLATE,
+		ACTION_DELAY, RULE_FLAGS, ACTION_ONLY_IF_CHANGED, RULE_EXCLUSIVE_GROUP, RULE_GROUP,
+		CONDITION_NODE:
 		return true
 	default:
 		return false
@@ -164,6 +189,9 @@ func (op Opcode) String() string {
 		"ACTION_TYPE", "ACTION_TARGET", "ACTION_VALUE_FLOAT", "ACTION_VALUE_STRING", "ACTION_VALUE_BOOL", "ACTION_VALUE_ARRAY", "ACTION_VALUE_OBJECT", "ACTION_COMMAND",
 		"HEADER_START", "HEADER_END", "CHECKSUM", "VERSION", "NUM_RULES", "CONST_POOL_SIZE", "PRIORITY",
 		"SCRIPT_DEF", "SCRIPT_CALL",
+		"ACTION_VALUE_TEMPLATE", "ACTION_DELAY", "RULE_FLAGS", "ACTION_ONLY_IF_CHANGED",
+		"RULE_EXCLUSIVE_GROUP", "RULE_GROUP",
+		"CONDITION_NODE",
 	}
 	if op < EQ_FLOAT || op >= Opcode(len(names)) {
 		logging.Logger.Warn().Uint8("opcode", uint8(op)).Msg("Unknown opcode")
@@ -186,63 +214,87 @@ func formatOperands(operands []byte) string {
 }
 
 // WriteBytecodeToFile writes the given bytecode file to the specified filename.
-// It serializes the bytecode file into a buffer and then writes the buffer to the file.
+// It serializes the bytecode file with MarshalBytecode and then writes it to the file.
 // The function returns an error if any write operation fails.
 func WriteBytecodeToFile(filename string, bytecodeFile BytecodeFile) error {
+	data, err := MarshalBytecode(bytecodeFile)
+	if err != nil {
+		return err
+	}
+
+	// Write buffer to file
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+
+	logging.Logger.Info().Msgf("Successfully wrote bytecode file: %s", filename)
+	return nil
+}
+
+// MarshalBytecode serializes the given bytecode file into the bytes of a
+// bytecode file. The facts of the fact rule lookup index are written in
+// sorted order, so the same ruleset always serializes to the same bytes.
+func MarshalBytecode(bytecodeFile BytecodeFile) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
 	// Write header
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.Version); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.Checksum); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.ConstPoolSize); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.NumRules); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.RuleExecIndexOffset); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.FactRuleIndexOffset); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, bytecodeFile.Header.FactDepIndexOffset); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Write bytecode instructions
 	if _, err := buf.Write(bytecodeFile.Instructions); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Calculate and write the Rule Execution Index
 	bytecodeFile.Header.RuleExecIndexOffset = uint32(buf.Len())
 	for _, idx := range bytecodeFile.RuleExecIndex {
 		if err := writeString(buf, idx.RuleName); err != nil {
-			return err
+			return nil, err
 		}
 		if err := binary.Write(buf, binary.LittleEndian, uint32(idx.ByteOffset)); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	// Calculate and write the Fact Rule Lookup Index
 	bytecodeFile.Header.FactRuleIndexOffset = uint32(buf.Len())
-	for factName, rules := range bytecodeFile.FactRuleLookupIndex {
+	factNames := make([]string, 0, len(bytecodeFile.FactRuleLookupIndex))
+	for factName := range bytecodeFile.FactRuleLookupIndex {
+		factNames = append(factNames, factName)
+	}
+	sort.Strings(factNames)
+	for _, factName := range factNames {
+		rules := bytecodeFile.FactRuleLookupIndex[factName]
 		if err := writeString(buf, factName); err != nil {
-			return err
+			return nil, err
 		}
 		rulesCount := uint32(len(rules))
 		if err := binary.Write(buf, binary.LittleEndian, rulesCount); err != nil {
-			return err
+			return nil, err
 		}
 		for _, ruleName := range rules {
 			if err := writeString(buf, ruleName); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
@@ -251,15 +303,15 @@ func WriteBytecodeToFile(filename string, bytecodeFile BytecodeFile) error {
 	bytecodeFile.Header.FactDepIndexOffset = uint32(buf.Len())
 	for _, idx := range bytecodeFile.FactDependencyIndex {
 		if err := writeString(buf, idx.RuleName); err != nil {
-			return err
+			return nil, err
 		}
 		factsCount := uint32(len(idx.Facts))
 		if err := binary.Write(buf, binary.LittleEndian, factsCount); err != nil {
-			return err
+			return nil, err
 		}
 		for _, factName := range idx.Facts {
 			if err := writeString(buf, factName); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
@@ -267,37 +319,31 @@ func WriteBytecodeToFile(filename string, bytecodeFile BytecodeFile) error {
 	// Write the updated header with correct index offsets
 	headerBytes := new(bytes.Buffer)
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.Version); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.Checksum); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.ConstPoolSize); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.NumRules); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.RuleExecIndexOffset); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.FactRuleIndexOffset); err != nil {
-		return err
+		return nil, err
 	}
 	if err := binary.Write(headerBytes, binary.LittleEndian, bytecodeFile.Header.FactDepIndexOffset); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Update the header in the buffer
 	copy(buf.Bytes()[:HeaderSize], headerBytes.Bytes())
 
-	// Write buffer to file
-	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
-		return err
-	}
-
-	logging.Logger.Info().Msgf("Successfully wrote bytecode file: %s", filename)
-	return nil
+	return buf.Bytes(), nil
 }
 
 // writeString writes a string to the given buffer.
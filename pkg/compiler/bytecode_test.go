@@ -53,6 +53,12 @@ func TestOpcodeHasOperands(t *testing.T) {
 		{AND, false},
 		{OR, false},
 		{LABEL, true},
+		{ACTION_VALUE_ARRAY, true},
+		{ACTION_VALUE_OBJECT, true},
+		{ACTION_VALUE_TEMPLATE, true},
+		{ACTION_TYPE, true},
+		{ACTION_VALUE_STRING, true},
+		{ACTION_START, false},
 	}
 
 	for _, tc := range testCases {
@@ -4,10 +4,13 @@ package compiler
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"rgehrsitz/rex/pkg/logging"
 )
@@ -70,7 +73,20 @@ func RemoveLabels(instructions []Instruction) []Instruction {
 func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 	var bytecode []byte
 
-	for _, rule := range ruleset.Rules {
+	// Rules are emitted in evaluation order, which the rule execution index
+	// then records
+	rules, err := OrderRules(ruleset)
+	if err != nil {
+		logging.Logger.Error().Err(err).Msg("Failed to order rules, emitting them in ruleset order")
+		rules = ruleset.Rules
+	}
+
+	// Identical conditions share a node across rules, which the runtime
+	// caches the result of
+	network := BuildConditionNetwork(rules)
+	logging.Logger.Debug().Int("conditions", network.Conditions).Int("nodes", len(network.Nodes)).Msg("Built condition network")
+
+	for _, rule := range rules {
 
 		logging.Logger.Debug().
 			Str("ruleName", rule.Name).
@@ -98,8 +114,32 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 		binary.LittleEndian.PutUint32(priorityBytes, uint32(rule.Priority))
 		ruleBytecode = append(ruleBytecode, priorityBytes...)
 
-		// Add script definitions to bytecode
-		for scriptName, script := range rule.Scripts {
+		// Append the rule flags, if any are set
+		if flags := ruleFlags(rule); flags != 0 {
+			ruleBytecode = append(ruleBytecode, byte(RULE_FLAGS), flags)
+		}
+
+		// Append the rule's group, if it has one
+		if rule.Group != "" {
+			ruleBytecode = append(ruleBytecode, byte(RULE_GROUP), byte(len(rule.Group)))
+			ruleBytecode = append(ruleBytecode, []byte(rule.Group)...)
+		}
+
+		// Append the rule's exclusive group, if it has one
+		if group := exclusiveGroup(ruleset, rule); group != "" {
+			ruleBytecode = append(ruleBytecode, byte(RULE_EXCLUSIVE_GROUP), byte(len(group)))
+			ruleBytecode = append(ruleBytecode, []byte(group)...)
+		}
+
+		// Add script definitions to bytecode, in name order so that the same
+		// rule always compiles to the same bytecode
+		scriptNames := make([]string, 0, len(rule.Scripts))
+		for scriptName := range rule.Scripts {
+			scriptNames = append(scriptNames, scriptName)
+		}
+		sort.Strings(scriptNames)
+		for _, scriptName := range scriptNames {
+			script := rule.Scripts[scriptName]
 			ruleBytecode = append(ruleBytecode, byte(SCRIPT_DEF))
 			ruleBytecode = append(ruleBytecode, byte(len(scriptName)))
 			ruleBytecode = append(ruleBytecode, []byte(scriptName)...)
@@ -116,6 +156,7 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 		conditionNode := convertConditionGroupToNode(rule.Conditions)
 
 		// Generate instructions from the condition tree
+		resetLabels()
 		instructions := generateInstructions(conditionNode, "L")
 
 		// Optimize the generated instructions
@@ -138,73 +179,7 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 					logging.Logger.Debug().Msgf("Processing condition: fact=%s, operator=%s, value=%s, label=%s", fact, operator, value, label)
 
 					// Convert operator and value into appropriate opcodes and operands
-					var valueOpcode Opcode
-					var factOpcode Opcode
-					var valueBytes []byte
-					var comparisonOpcode Opcode
-
-					if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
-						factOpcode = LOAD_FACT_FLOAT
-						valueOpcode = LOAD_CONST_FLOAT
-						valueBytes = floatToBytes(floatValue)
-					} else if boolValue, err := strconv.ParseBool(value); err == nil {
-						factOpcode = LOAD_FACT_BOOL
-						valueOpcode = LOAD_CONST_BOOL
-						valueBytes = boolToBytes(boolValue)
-					} else {
-						factOpcode = LOAD_FACT_STRING
-						valueOpcode = LOAD_CONST_STRING
-						valueBytes = []byte(value)
-					}
-
-					switch operator {
-					case "GT":
-						switch factOpcode {
-						case LOAD_FACT_FLOAT:
-							comparisonOpcode = GT_FLOAT
-						}
-					case "EQ":
-						switch factOpcode {
-						case LOAD_FACT_FLOAT:
-							comparisonOpcode = EQ_FLOAT
-						case LOAD_FACT_STRING:
-							comparisonOpcode = EQ_STRING
-						case LOAD_FACT_BOOL:
-							comparisonOpcode = EQ_BOOL
-						}
-					case "NEQ":
-						switch factOpcode {
-						case LOAD_FACT_FLOAT:
-							comparisonOpcode = NEQ_FLOAT
-						case LOAD_FACT_STRING:
-							comparisonOpcode = NEQ_STRING
-						case LOAD_FACT_BOOL:
-							comparisonOpcode = NEQ_BOOL
-						}
-					case "LT":
-						switch factOpcode {
-						case LOAD_FACT_FLOAT:
-							comparisonOpcode = LT_FLOAT
-						}
-					case "LTE":
-						switch factOpcode {
-						case LOAD_FACT_FLOAT:
-							comparisonOpcode = LTE_FLOAT
-						}
-					case "GTE":
-						switch factOpcode {
-						case LOAD_FACT_FLOAT:
-							comparisonOpcode = GTE_FLOAT
-						}
-					case "CONTAINS":
-						if factOpcode == LOAD_FACT_STRING {
-							comparisonOpcode = CONTAINS_STRING
-						}
-					case "NOT_CONTAINS":
-						if factOpcode == LOAD_FACT_STRING {
-							comparisonOpcode = NOT_CONTAINS_STRING
-						}
-					}
+					factOpcode, valueOpcode, comparisonOpcode, valueBytes, _ := conditionOpcodes(operator, value)
 
 					// Check if the fact is actually a script call
 					if script, ok := rule.Scripts[fact]; ok {
@@ -217,6 +192,14 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 							ruleBytecode = append(ruleBytecode, []byte(param)...)
 						}
 					} else {
+						// Tag the condition with its shared node
+						if node, ok := network.Node(fact, operator, value); ok {
+							nodeBytes := make([]byte, 4)
+							binary.LittleEndian.PutUint32(nodeBytes, uint32(node.ID))
+							ruleBytecode = append(ruleBytecode, byte(CONDITION_NODE))
+							ruleBytecode = append(ruleBytecode, nodeBytes...)
+						}
+
 						// Append the separated instructions
 						ruleBytecode = append(ruleBytecode, byte(factOpcode))
 						ruleBytecode = append(ruleBytecode, byte(len(fact)))
@@ -250,6 +233,13 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 		actionBytecode := []byte{}
 		for _, action := range rule.Actions {
 			logging.Logger.Debug().Msgf("Processing action: %s", action.Type)
+
+			delay, err := parseActionDelay(action)
+			if err != nil {
+				logging.Logger.Error().Err(err).Str("ruleName", rule.Name).Str("target", action.Target).Msg("Invalid action delay")
+				continue
+			}
+
 			actionBytecode = append(actionBytecode, byte(ACTION_START))
 
 			// Append the action type
@@ -285,6 +275,10 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 							actionBytecode = append(actionBytecode, []byte(param)...)
 						}
 					}
+				} else if IsTemplate(v) {
+					// This is a template referencing facts, rendered at runtime
+					actionBytecode = append(actionBytecode, byte(ACTION_VALUE_TEMPLATE))
+					actionBytecode = append(actionBytecode, stringToLongBytes(v)...)
 				} else {
 					// This is a regular string value
 					actionBytecode = append(actionBytecode, byte(ACTION_VALUE_STRING))
@@ -298,11 +292,35 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 				} else {
 					actionBytecode = append(actionBytecode, byte(0))
 				}
+			case []interface{}, map[string]interface{}:
+				valueBytes, err := jsonValueToBytes(v)
+				if err != nil {
+					logging.Logger.Error().Err(err).Str("ruleName", rule.Name).Str("target", action.Target).Msg("Failed to encode structured action value")
+					continue
+				}
+				if _, ok := v.([]interface{}); ok {
+					actionBytecode = append(actionBytecode, byte(ACTION_VALUE_ARRAY))
+				} else {
+					actionBytecode = append(actionBytecode, byte(ACTION_VALUE_OBJECT))
+				}
+				actionBytecode = append(actionBytecode, valueBytes...)
 			default:
 				logging.Logger.Error().Msgf("Unsupported action value type: %T", v)
 				continue
 			}
 
+			// Append the onlyIfChanged override, if set
+			if action.OnlyIfChanged != nil {
+				actionBytecode = append(actionBytecode, byte(ACTION_ONLY_IF_CHANGED))
+				actionBytecode = append(actionBytecode, boolToBytes(*action.OnlyIfChanged)...)
+			}
+
+			// Append the delay for delayed actions
+			if delay > 0 {
+				actionBytecode = append(actionBytecode, byte(ACTION_DELAY))
+				actionBytecode = append(actionBytecode, delayToBytes(delay, action.CancelIfFalse)...)
+			}
+
 			actionBytecode = append(actionBytecode, byte(ACTION_END))
 		}
 
@@ -353,6 +371,43 @@ func GenerateBytecode(ruleset *Ruleset) BytecodeFile {
 	}
 }
 
+// comparisonOpcodes are the comparison opcodes of the condition operators,
+// by the fact opcode of the condition's type.
+var comparisonOpcodes = map[string]map[Opcode]Opcode{
+	"EQ":           {LOAD_FACT_FLOAT: EQ_FLOAT, LOAD_FACT_STRING: EQ_STRING, LOAD_FACT_BOOL: EQ_BOOL},
+	"NEQ":          {LOAD_FACT_FLOAT: NEQ_FLOAT, LOAD_FACT_STRING: NEQ_STRING, LOAD_FACT_BOOL: NEQ_BOOL},
+	"LT":           {LOAD_FACT_FLOAT: LT_FLOAT},
+	"LTE":          {LOAD_FACT_FLOAT: LTE_FLOAT},
+	"GT":           {LOAD_FACT_FLOAT: GT_FLOAT},
+	"GTE":          {LOAD_FACT_FLOAT: GTE_FLOAT},
+	"CONTAINS":     {LOAD_FACT_STRING: CONTAINS_STRING},
+	"NOT_CONTAINS": {LOAD_FACT_STRING: NOT_CONTAINS_STRING},
+}
+
+// conditionOpcodes returns the opcodes a condition compiles to, and the
+// operand of its constant. The condition's type is that of its value as text:
+// numbers are floats and true and false are bools, even if the ruleset gave
+// them as strings. ok is false if the operator does not apply to the type, in
+// which case the comparison opcode is 0.
+func conditionOpcodes(operator, value string) (factOpcode, valueOpcode, comparisonOpcode Opcode, valueBytes []byte, ok bool) {
+	if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+		factOpcode = LOAD_FACT_FLOAT
+		valueOpcode = LOAD_CONST_FLOAT
+		valueBytes = floatToBytes(floatValue)
+	} else if boolValue, err := strconv.ParseBool(value); err == nil {
+		factOpcode = LOAD_FACT_BOOL
+		valueOpcode = LOAD_CONST_BOOL
+		valueBytes = boolToBytes(boolValue)
+	} else {
+		factOpcode = LOAD_FACT_STRING
+		valueOpcode = LOAD_CONST_STRING
+		valueBytes = []byte(value)
+	}
+
+	comparisonOpcode, ok = comparisonOpcodes[operator][factOpcode]
+	return factOpcode, valueOpcode, comparisonOpcode, valueBytes, ok
+}
+
 // floatToBytes converts a float64 value to a byte slice.
 // It uses binary.LittleEndian to convert the float64 value to its binary representation.
 // The resulting byte slice has a length of 8 bytes.
@@ -372,6 +427,74 @@ func boolToBytes(b bool) []byte {
 	return []byte{0}
 }
 
+// jsonValueToBytes encodes a structured (array or object) value as JSON, prefixed
+// with its length as a 32-bit unsigned integer in little-endian format.
+// Structured values routinely exceed the 255 bytes a single length byte allows.
+func jsonValueToBytes(value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(b, uint32(len(data)))
+	return append(b, data...), nil
+}
+
+// stringToLongBytes converts a string to a byte slice prefixed with its length
+// as a 32-bit unsigned integer in little-endian format.
+func stringToLongBytes(s string) []byte {
+	b := make([]byte, 4, 4+len(s))
+	binary.LittleEndian.PutUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// ruleFlags returns the RULE_FLAGS bitmask for a rule.
+func ruleFlags(rule Rule) byte {
+	var flags byte
+	if rule.Atomic {
+		flags |= RuleFlagAtomic
+	}
+	if rule.StopProcessing {
+		flags |= RuleFlagStopProcessing
+	}
+	return flags
+}
+
+// exclusiveGroup returns the exclusive group a rule is compiled into. Under
+// the first-match strategy all rules share one group, so only the
+// highest-priority matching rule fires for an update.
+func exclusiveGroup(ruleset *Ruleset, rule Rule) string {
+	if ruleset.Strategy == StrategyFirstMatch {
+		return FirstMatchGroup
+	}
+	return rule.ExclusiveGroup
+}
+
+// parseActionDelay returns the delay of an action, or zero if the action runs
+// immediately. Delays must be positive Go durations such as "30s" or "10m".
+func parseActionDelay(action Action) (time.Duration, error) {
+	if action.Delay == "" {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(action.Delay)
+	if err != nil {
+		return 0, logging.NewError(logging.ErrorTypeCompile, "Invalid action delay", err, map[string]interface{}{"delay": action.Delay})
+	}
+	if delay <= 0 {
+		return 0, logging.NewError(logging.ErrorTypeCompile, "Action delay must be positive", nil, map[string]interface{}{"delay": action.Delay})
+	}
+	return delay, nil
+}
+
+// delayToBytes encodes an action delay as its nanoseconds in little-endian
+// format, followed by a flags byte that is 1 when the pending action should be
+// cancelled if the rule becomes false.
+func delayToBytes(delay time.Duration, cancelIfFalse bool) []byte {
+	b := make([]byte, 8, 9)
+	binary.LittleEndian.PutUint64(b, uint64(delay))
+	return append(b, boolToBytes(cancelIfFalse)...)
+}
+
 func GenerateIndices(bytecode []byte) ([]RuleExecutionIndex, map[string][]string, []FactDependencyIndex) {
 	logging.Logger.Debug().Msg("Starting GenerateIndices")
 	ruleExecIndex := []RuleExecutionIndex{}
@@ -436,10 +559,12 @@ func GenerateIndices(bytecode []byte) ([]RuleExecutionIndex, map[string][]string
 						uniqueFacts[fact] = struct{}{}
 					}
 
+					// Sorted, so the same ruleset always compiles to the same bytecode
 					factList := make([]string, 0, len(uniqueFacts))
 					for fact := range uniqueFacts {
 						factList = append(factList, fact)
 					}
+					sort.Strings(factList)
 
 					factDepIndex = append(factDepIndex, FactDependencyIndex{
 						RuleNameLength: uint32(ruleNameLength),
@@ -477,16 +602,17 @@ func GenerateIndices(bytecode []byte) ([]RuleExecutionIndex, map[string][]string
 // Helper function to determine the length of operands for a given opcode
 func determineOperandLength(opcode Opcode, operands []byte) int {
 	switch opcode {
-	case LOAD_CONST_FLOAT, LOAD_FACT_FLOAT:
+	case LOAD_CONST_FLOAT, LOAD_FACT_FLOAT, ACTION_VALUE_FLOAT:
 		logging.Logger.Debug().Str("opcode", opcode.String()).Msg("Returning operand length: 8")
 		return 8 // 8 bytes for int64 or float64
-	case LOAD_CONST_STRING, LOAD_FACT_STRING, SEND_MESSAGE, TRIGGER_ACTION, UPDATE_FACT, ACTION_START, RULE_START:
+	case LOAD_CONST_STRING, LOAD_FACT_STRING, SEND_MESSAGE, TRIGGER_ACTION, UPDATE_FACT, RULE_START,
+		ACTION_TYPE, ACTION_TARGET, ACTION_VALUE_STRING, RULE_EXCLUSIVE_GROUP, RULE_GROUP:
 		if len(operands) > 0 {
 			length := 1 + int(operands[0]) // 1 byte for length + length of the string
 			logging.Logger.Debug().Str("opcode", opcode.String()).Int("length", length).Msg("Returning operand length")
 			return length
 		}
-	case LOAD_CONST_BOOL, LOAD_FACT_BOOL:
+	case LOAD_CONST_BOOL, LOAD_FACT_BOOL, ACTION_VALUE_BOOL, RULE_FLAGS, ACTION_ONLY_IF_CHANGED:
 		logging.Logger.Debug().Str("opcode", opcode.String()).Msg("Returning operand length: 1")
 		return 1 // 1 byte for bool
 	case JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE:
@@ -498,6 +624,34 @@ func determineOperandLength(opcode Opcode, operands []byte) int {
 	case PRIORITY:
 		logging.Logger.Debug().Str("opcode", opcode.String()).Msg("Returning operand length: 4")
 		return 4 // 4 bytes for the priority
+	case CONDITION_NODE:
+		logging.Logger.Debug().Str("opcode", opcode.String()).Msg("Returning operand length: 4")
+		return 4 // 4 bytes for the node ID
+	case ACTION_DELAY:
+		logging.Logger.Debug().Str("opcode", opcode.String()).Msg("Returning operand length: 9")
+		return 9 // 8 bytes for the delay + 1 byte for the flags
+	case ACTION_VALUE_ARRAY, ACTION_VALUE_OBJECT, ACTION_VALUE_TEMPLATE:
+		if len(operands) >= 4 {
+			length := 4 + int(binary.LittleEndian.Uint32(operands[:4])) // 4 bytes for length + JSON payload
+			logging.Logger.Debug().Str("opcode", opcode.String()).Int("length", length).Msg("Returning operand length")
+			return length
+		}
+	case SCRIPT_CALL:
+		// Script name followed by a parameter count and length-prefixed parameter names
+		if len(operands) == 0 {
+			return 0
+		}
+		length := 1 + int(operands[0])
+		if length >= len(operands) {
+			return 0
+		}
+		paramsCount := int(operands[length])
+		length++
+		for j := 0; j < paramsCount && length < len(operands); j++ {
+			length += 1 + int(operands[length])
+		}
+		logging.Logger.Debug().Str("opcode", opcode.String()).Int("length", length).Msg("Returning operand length")
+		return length
 	default:
 		logging.Logger.Debug().Str("opcode", opcode.String()).Msg("Returning operand length: 0")
 		return 0
@@ -550,7 +704,26 @@ func collectFactsFromBytecode(bytecode []byte) []string {
 			logging.Logger.Debug().Str("fact", factName).Msg("Collected fact")
 			i += 2 + factLength
 		} else if opcode == SCRIPT_DEF {
-			// Process SCRIPT_DEF to collect script parameter facts
+			// Skip SCRIPT_DEF entirely; its parameters only become facts when the
+			// script is called, and its body is not bytecode
+			if i+1 >= len(bytecode) {
+				break
+			}
+			i += 2 + int(bytecode[i+1])
+			if i >= len(bytecode) {
+				break
+			}
+			paramsCount := int(bytecode[i])
+			i++
+			for j := 0; j < paramsCount && i < len(bytecode); j++ {
+				i += 1 + int(bytecode[i])
+			}
+			if i >= len(bytecode) {
+				break
+			}
+			i += 1 + int(bytecode[i])
+		} else if opcode == SCRIPT_CALL {
+			// Process SCRIPT_CALL to collect the facts passed to the script
 			if i+1 >= len(bytecode) {
 				break
 			}
@@ -578,6 +751,21 @@ func collectFactsFromBytecode(bytecode []byte) []string {
 				logging.Logger.Debug().Str("scriptParam", paramName).Msg("Collected script parameter as fact")
 				i += paramLength
 			}
+		} else if opcode == ACTION_VALUE_TEMPLATE {
+			// Process ACTION_VALUE_TEMPLATE to collect the facts the template references
+			operandLength := determineOperandLength(opcode, bytecode[i+1:])
+			if operandLength < 4 || i+1+operandLength > len(bytecode) {
+				break
+			}
+			parts, err := ParseTemplate(string(bytecode[i+5 : i+1+operandLength]))
+			if err != nil {
+				logging.Logger.Warn().Err(err).Msg("Skipping invalid template while collecting facts")
+			}
+			for _, fact := range TemplateFacts(parts) {
+				facts[fact] = struct{}{}
+				logging.Logger.Debug().Str("templateFact", fact).Msg("Collected template reference as fact")
+			}
+			i += 1 + operandLength
 		} else {
 			if opcode.HasOperands() {
 				operandLength := determineOperandLength(opcode, bytecode[i+1:])
@@ -6,7 +6,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -92,7 +94,7 @@ func TestGenerateBytecodeComplexNestedConditions(t *testing.T) {
 	}
 
 	// Check header
-	assert.Equal(t, uint32(1), bytecodeFile.Header.Version)
+	assert.Equal(t, uint32(2), bytecodeFile.Header.Version)
 	assert.Equal(t, uint32(1), bytecodeFile.Header.NumRules)
 
 	// Find RULE_START
@@ -443,7 +445,7 @@ func TestGenerateBytecodeSimpleRule(t *testing.T) {
 	bytecodeFile := GenerateBytecode(ruleset)
 
 	assert.NotNil(t, bytecodeFile)
-	assert.Equal(t, uint32(1), bytecodeFile.Header.Version)
+	assert.Equal(t, uint32(2), bytecodeFile.Header.Version)
 	assert.Equal(t, uint32(1), bytecodeFile.Header.NumRules)
 	assert.NotEmpty(t, bytecodeFile.Instructions)
 	assert.Len(t, bytecodeFile.RuleExecIndex, 1)
@@ -492,7 +494,7 @@ func TestGenerateBytecodeComplexRule(t *testing.T) {
 	bytecodeFile := GenerateBytecode(ruleset)
 
 	assert.NotNil(t, bytecodeFile)
-	assert.Equal(t, uint32(1), bytecodeFile.Header.Version)
+	assert.Equal(t, uint32(2), bytecodeFile.Header.Version)
 	assert.Equal(t, uint32(1), bytecodeFile.Header.NumRules)
 	assert.NotEmpty(t, bytecodeFile.Instructions)
 	assert.Len(t, bytecodeFile.RuleExecIndex, 1)
@@ -564,3 +566,284 @@ func TestGenerateBytecodeWithScripts(t *testing.T) {
 
 	// You can add more specific checks here, such as verifying the script name, params, and body in the bytecode
 }
+
+func TestGenerateBytecodeStructuredActionValues(t *testing.T) {
+	ruleset := &Ruleset{
+		Rules: []Rule{
+			{
+				Name: "StructuredRule",
+				Conditions: ConditionGroup{
+					All: []*ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 30.0},
+					},
+				},
+				Actions: []Action{
+					{
+						Type:   "updateStore",
+						Target: "fan_speeds",
+						Value:  []interface{}{1.0, 2.0, 3.0},
+					},
+					{
+						Type:   "updateStore",
+						Target: "fan_config",
+						Value:  map[string]interface{}{"mode": "eco", "enabled": true},
+					},
+				},
+			},
+		},
+	}
+
+	bytecodeFile := GenerateBytecode(ruleset)
+	instructions := bytecodeFile.Instructions
+
+	// readJSONOperand locates the given opcode and returns its length-prefixed JSON payload
+	readJSONOperand := func(op Opcode) string {
+		for i := 0; i < len(instructions)-4; i++ {
+			if Opcode(instructions[i]) != op {
+				continue
+			}
+			length := int(binary.LittleEndian.Uint32(instructions[i+1 : i+5]))
+			if i+5+length <= len(instructions) {
+				return string(instructions[i+5 : i+5+length])
+			}
+		}
+		return ""
+	}
+
+	assert.Equal(t, `[1,2,3]`, readJSONOperand(ACTION_VALUE_ARRAY))
+	assert.Equal(t, `{"enabled":true,"mode":"eco"}`, readJSONOperand(ACTION_VALUE_OBJECT))
+
+	// Both actions must be emitted, not silently dropped
+	assert.Equal(t, 2, bytes.Count(instructions, []byte{byte(ACTION_END)}))
+
+	// The JSON payloads must not leak into the fact dependency index
+	assert.Len(t, bytecodeFile.FactDependencyIndex, 1)
+	assert.ElementsMatch(t, []string{"temperature"}, bytecodeFile.FactDependencyIndex[0].Facts)
+}
+
+func TestGenerateBytecodeTemplateActionValue(t *testing.T) {
+	ruleset := &Ruleset{
+		Rules: []Rule{
+			{
+				Name: "TemplateRule",
+				Conditions: ConditionGroup{
+					All: []*ConditionOrGroup{
+						{Fact: "weather:temperature", Operator: "GT", Value: 30.0},
+					},
+				},
+				Actions: []Action{
+					{
+						Type:   "updateStore",
+						Target: "weather:summary",
+						Value:  "Temp is ${weather:temperature|%.1f}C at ${weather:station}",
+					},
+				},
+			},
+		},
+	}
+
+	bytecodeFile := GenerateBytecode(ruleset)
+
+	// The template is emitted verbatim behind its opcode
+	idx := bytes.IndexByte(bytecodeFile.Instructions, byte(ACTION_VALUE_TEMPLATE))
+	assert.NotEqual(t, -1, idx)
+	length := int(binary.LittleEndian.Uint32(bytecodeFile.Instructions[idx+1 : idx+5]))
+	assert.Equal(t, "Temp is ${weather:temperature|%.1f}C at ${weather:station}", string(bytecodeFile.Instructions[idx+5:idx+5+length]))
+
+	// Facts referenced only by the template enter the dependency and lookup indices
+	assert.Len(t, bytecodeFile.FactDependencyIndex, 1)
+	assert.ElementsMatch(t, []string{"weather:temperature", "weather:station"}, bytecodeFile.FactDependencyIndex[0].Facts)
+	assert.Equal(t, []string{"TemplateRule"}, bytecodeFile.FactRuleLookupIndex["weather:station"])
+}
+
+func TestGenerateBytecodeTemplateFactsAfterActionOperands(t *testing.T) {
+	// The fact scan skips the operands of the action instructions before a
+	// template. Targets of every length up to the largest opcode make sure a
+	// length byte is never read as an opcode.
+	for length := 1; length <= int(CONDITION_NODE); length++ {
+		ruleset := &Ruleset{
+			Rules: []Rule{
+				{
+					Name: "TemplateRule",
+					Conditions: ConditionGroup{
+						All: []*ConditionOrGroup{{Fact: "weather:temperature", Operator: "GT", Value: 30.0}},
+					},
+					Actions: []Action{
+						{Type: "updateStore", Target: "alerts:level", Value: 2.0},
+						{Type: "updateStore", Target: "alerts:active", Value: true},
+						{Type: "sendMessage", Target: strings.Repeat("a", length), Value: "Humidity is ${weather:humidity}"},
+					},
+				},
+			},
+		}
+
+		bytecodeFile := GenerateBytecode(ruleset)
+		assert.Equal(t, []string{"TemplateRule"}, bytecodeFile.FactRuleLookupIndex["weather:humidity"], "target length %d", length)
+	}
+}
+
+func TestGenerateBytecodeDelayedAction(t *testing.T) {
+	ruleset := &Ruleset{
+		Rules: []Rule{
+			{
+				Name: "FanOffRule",
+				Conditions: ConditionGroup{
+					All: []*ConditionOrGroup{
+						{Fact: "system:occupied", Operator: "EQ", Value: false},
+					},
+				},
+				Actions: []Action{
+					{Type: "updateStore", Target: "system:fan_speed", Value: 0.0, Delay: "10m", CancelIfFalse: true},
+					{Type: "updateStore", Target: "system:mode", Value: "idle"},
+				},
+			},
+		},
+	}
+
+	bytecodeFile := GenerateBytecode(ruleset)
+
+	// Only the delayed action carries a delay, placed right before its ACTION_END
+	assert.Equal(t, 1, bytes.Count(bytecodeFile.Instructions, []byte{byte(ACTION_DELAY)}))
+	idx := bytes.IndexByte(bytecodeFile.Instructions, byte(ACTION_DELAY))
+	assert.NotEqual(t, -1, idx)
+	delay := time.Duration(binary.LittleEndian.Uint64(bytecodeFile.Instructions[idx+1 : idx+9]))
+	assert.Equal(t, 10*time.Minute, delay)
+	assert.Equal(t, byte(1), bytecodeFile.Instructions[idx+9])
+	assert.Equal(t, byte(ACTION_END), bytecodeFile.Instructions[idx+10])
+}
+
+func TestGenerateBytecodeOnlyIfChanged(t *testing.T) {
+	always := true
+	ruleset := &Ruleset{
+		Rules: []Rule{
+			{
+				Name: "ModeRule",
+				Conditions: ConditionGroup{
+					All: []*ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 30.0},
+					},
+				},
+				Actions: []Action{
+					{Type: "updateStore", Target: "system:mode", Value: "cooling", OnlyIfChanged: &always},
+					{Type: "updateStore", Target: "system:alert", Value: true},
+				},
+			},
+		},
+	}
+
+	bytecodeFile := GenerateBytecode(ruleset)
+
+	// Only the action with an explicit setting carries the override, right
+	// before its ACTION_END
+	override := []byte{byte(ACTION_ONLY_IF_CHANGED), 1, byte(ACTION_END)}
+	assert.Equal(t, 1, bytes.Count(bytecodeFile.Instructions, override))
+	assert.Less(t, bytes.Index(bytecodeFile.Instructions, override), bytes.Index(bytecodeFile.Instructions, []byte("system:alert")))
+}
+
+func TestGenerateBytecodeScriptParamsCollectedFromCalls(t *testing.T) {
+	ruleset := &Ruleset{
+		Rules: []Rule{
+			{
+				Name: "HeatIndexRule",
+				Conditions: ConditionGroup{
+					All: []*ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 30.0},
+					},
+				},
+				Actions: []Action{
+					{Type: "updateStore", Target: "heat_index", Value: "{calculate_heat_index}"},
+				},
+				Scripts: map[string]Script{
+					"calculate_heat_index": {Params: []string{"temperature", "humidity"}, Body: "return adjust(temperature * 1.8 + 32, humidity);"},
+					"adjust":               {Params: []string{"base", "humidity"}, Body: "return base + (humidity / 100) * 10;"},
+				},
+			},
+		},
+	}
+
+	// Only the parameters of the called script are facts; those of the
+	// helper script it calls are not
+	bytecodeFile := GenerateBytecode(ruleset)
+	assert.Len(t, bytecodeFile.FactDependencyIndex, 1)
+	assert.ElementsMatch(t, []string{"temperature", "humidity"}, bytecodeFile.FactDependencyIndex[0].Facts)
+	assert.NotContains(t, bytecodeFile.FactRuleLookupIndex, "base")
+
+	// Script definitions are emitted in name order, so the bytecode does not
+	// depend on map iteration
+	adjust := bytes.Index(bytecodeFile.Instructions, []byte{byte(SCRIPT_DEF), 6, 'a', 'd', 'j', 'u', 's', 't'})
+	heatIndex := bytes.Index(bytecodeFile.Instructions, []byte{byte(SCRIPT_DEF), 20, 'c', 'a', 'l', 'c'})
+	assert.NotEqual(t, -1, adjust)
+	assert.Less(t, adjust, heatIndex)
+}
+
+func TestGenerateBytecodeRuleFlags(t *testing.T) {
+	rule := func(name string, atomic bool) Rule {
+		return Rule{
+			Name:       name,
+			Conditions: ConditionGroup{All: []*ConditionOrGroup{{Fact: "temperature", Operator: "GT", Value: 30.0}}},
+			Actions:    []Action{{Type: "updateStore", Target: "alert", Value: true}},
+			Atomic:     atomic,
+		}
+	}
+
+	// Rules without flags carry no RULE_FLAGS opcode
+	plain := GenerateBytecode(&Ruleset{Rules: []Rule{rule("PlainRule", false)}})
+	assert.NotContains(t, plain.Instructions, byte(RULE_FLAGS))
+
+	// Atomic rules carry the flag right after the priority
+	atomic := GenerateBytecode(&Ruleset{Rules: []Rule{rule("AtomicRule", true)}})
+	priorityIdx := bytes.IndexByte(atomic.Instructions, byte(PRIORITY))
+	assert.NotEqual(t, -1, priorityIdx)
+	assert.Equal(t, []byte{byte(RULE_FLAGS), RuleFlagAtomic}, atomic.Instructions[priorityIdx+5:priorityIdx+7])
+	assert.Equal(t, []string{"AtomicRule"}, atomic.FactRuleLookupIndex["temperature"])
+}
+
+func TestGenerateBytecodeExclusiveGroup(t *testing.T) {
+	rule := func(name, group string) Rule {
+		return Rule{
+			Name:           name,
+			Conditions:     ConditionGroup{All: []*ConditionOrGroup{{Fact: "temperature", Operator: "GT", Value: 30.0}}},
+			Actions:        []Action{{Type: "updateStore", Target: "alert", Value: true}},
+			ExclusiveGroup: group,
+		}
+	}
+	groupOf := func(instructions []byte) string {
+		idx := bytes.IndexByte(instructions, byte(RULE_EXCLUSIVE_GROUP))
+		if idx == -1 {
+			return ""
+		}
+		return string(instructions[idx+2 : idx+2+int(instructions[idx+1])])
+	}
+
+	// Rules outside a group carry no RULE_EXCLUSIVE_GROUP opcode
+	plain := GenerateBytecode(&Ruleset{Rules: []Rule{rule("PlainRule", "")}})
+	assert.Equal(t, "", groupOf(plain.Instructions))
+
+	grouped := GenerateBytecode(&Ruleset{Rules: []Rule{rule("GroupedRule", "alerts")}})
+	assert.Equal(t, "alerts", groupOf(grouped.Instructions))
+	assert.Equal(t, []string{"GroupedRule"}, grouped.FactRuleLookupIndex["temperature"])
+
+	// Under first-match every rule shares one group
+	firstMatch := GenerateBytecode(&Ruleset{Strategy: StrategyFirstMatch, Rules: []Rule{rule("GroupedRule", "alerts")}})
+	assert.Equal(t, FirstMatchGroup, groupOf(firstMatch.Instructions))
+}
+
+func TestGenerateBytecodeRuleGroup(t *testing.T) {
+	rule := Rule{
+		Name:           "AlarmRule",
+		Conditions:     ConditionGroup{All: []*ConditionOrGroup{{Fact: "temperature", Operator: "GT", Value: 50.0}}},
+		Actions:        []Action{{Type: "updateStore", Target: "alarm", Value: true}},
+		Group:          "safety",
+		StopProcessing: true,
+	}
+
+	bytecode := GenerateBytecode(&Ruleset{Rules: []Rule{rule}})
+	priorityIdx := bytes.IndexByte(bytecode.Instructions, byte(PRIORITY))
+	assert.NotEqual(t, -1, priorityIdx)
+
+	// The stop-processing flag follows the priority, then the group
+	header := bytecode.Instructions[priorityIdx+5:]
+	assert.Equal(t, []byte{byte(RULE_FLAGS), RuleFlagStopProcessing}, header[:2])
+	assert.Equal(t, append([]byte{byte(RULE_GROUP), 6}, "safety"...), header[2:10])
+	assert.Equal(t, []string{"AlarmRule"}, bytecode.FactRuleLookupIndex["temperature"])
+}
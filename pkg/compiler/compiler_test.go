@@ -109,7 +109,7 @@ func TestGenerateBytecode(t *testing.T) {
 func TestWriteBytecodeToFile(t *testing.T) {
 	bytecodeFile := BytecodeFile{
 		Header: Header{
-			Version:       1,
+			Version:       2,
 			Checksum:      0,
 			ConstPoolSize: 0,
 			NumRules:      1,
@@ -0,0 +1,177 @@
+// rex/pkg/compiler/cycles.go
+
+package compiler
+
+import (
+	"sort"
+	"strings"
+)
+
+// FindRuleCycles finds groups of rules that can trigger each other endlessly.
+// Rule A triggers rule B when one of A's updateStore actions writes a fact that
+// B reads, either in its conditions, in a template or as a script parameter.
+// Each returned cycle lists its rules in ruleset order; a rule that triggers
+// itself is returned as a cycle of one.
+func FindRuleCycles(ruleset *Ruleset) [][]string {
+	readers := make(map[string][]int)
+	for i, rule := range ruleset.Rules {
+		for _, fact := range ruleReads(rule) {
+			readers[fact] = append(readers[fact], i)
+		}
+	}
+
+	edges := make([][]int, len(ruleset.Rules))
+	for i, rule := range ruleset.Rules {
+		seen := make(map[int]struct{})
+		for _, fact := range ruleWrites(rule) {
+			for _, j := range readers[fact] {
+				if _, ok := seen[j]; !ok {
+					seen[j] = struct{}{}
+					edges[i] = append(edges[i], j)
+				}
+			}
+		}
+	}
+
+	var cycles [][]string
+	for _, component := range stronglyConnectedComponents(edges) {
+		if len(component) == 1 && !containsInt(edges[component[0]], component[0]) {
+			continue
+		}
+		names := make([]string, len(component))
+		for k, i := range component {
+			names[k] = ruleset.Rules[i].Name
+		}
+		cycles = append(cycles, names)
+	}
+	return cycles
+}
+
+// FormatRuleCycle renders a cycle as "a -> b -> a".
+func FormatRuleCycle(cycle []string) string {
+	return strings.Join(append(append([]string(nil), cycle...), cycle[0]), " -> ")
+}
+
+// ruleReads returns the facts a rule reads.
+func ruleReads(rule Rule) []string {
+	var facts []string
+	addScriptParams := func(name string) bool {
+		script, ok := rule.Scripts[name]
+		if ok {
+			facts = append(facts, script.Params...)
+		}
+		return ok
+	}
+
+	var walk func(cogs []*ConditionOrGroup)
+	walk = func(cogs []*ConditionOrGroup) {
+		for _, cog := range cogs {
+			if cog == nil {
+				continue
+			}
+			if cog.Fact != "" && !addScriptParams(cog.Fact) {
+				facts = append(facts, cog.Fact)
+			}
+			walk(cog.All)
+			walk(cog.Any)
+		}
+	}
+	walk(rule.Conditions.All)
+	walk(rule.Conditions.Any)
+
+	for _, action := range rule.Actions {
+		value, ok := action.Value.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+			addScriptParams(strings.Trim(value, "{}"))
+		} else if IsTemplate(value) {
+			if parts, err := ParseTemplate(value); err == nil {
+				facts = append(facts, TemplateFacts(parts)...)
+			}
+		}
+	}
+	return facts
+}
+
+// ruleWrites returns the facts a rule's actions write.
+func ruleWrites(rule Rule) []string {
+	var facts []string
+	for _, action := range rule.Actions {
+		if action.Type == "updateStore" {
+			facts = append(facts, action.Target)
+		}
+	}
+	return facts
+}
+
+// stronglyConnectedComponents returns the strongly connected components of a
+// graph given as adjacency lists, using Tarjan's algorithm. Components are
+// ordered by their lowest node, and nodes within a component ascend.
+func stronglyConnectedComponents(edges [][]int) [][]int {
+	index := 0
+	indices := make([]int, len(edges))
+	lowLinks := make([]int, len(edges))
+	onStack := make([]bool, len(edges))
+	for i := range indices {
+		indices[i] = -1
+	}
+	var stack []int
+	var components [][]int
+
+	var connect func(v int)
+	connect = func(v int) {
+		indices[v] = index
+		lowLinks[v] = index
+		index++
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, w := range edges[v] {
+			if indices[w] < 0 {
+				connect(w)
+				lowLinks[v] = min(lowLinks[v], lowLinks[w])
+			} else if onStack[w] {
+				lowLinks[v] = min(lowLinks[v], indices[w])
+			}
+		}
+
+		if lowLinks[v] == indices[v] {
+			var component []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				component = append(component, w)
+				if w == v {
+					break
+				}
+			}
+			components = append(components, component)
+		}
+	}
+
+	for v := range edges {
+		if indices[v] < 0 {
+			connect(v)
+		}
+	}
+
+	for _, component := range components {
+		sort.Ints(component)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		return components[i][0] < components[j][0]
+	})
+	return components
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// rex/pkg/compiler/cycles_test.go
+
+package compiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cycleRule(name, from, to string) Rule {
+	return Rule{
+		Name: name,
+		Conditions: ConditionGroup{
+			All: []*ConditionOrGroup{{Fact: from, Operator: "GT", Value: 0.0}},
+		},
+		Actions: []Action{{Type: "updateStore", Target: to, Value: 1.0}},
+	}
+}
+
+func TestFindRuleCycles(t *testing.T) {
+	// A rule that reads the fact it writes through a template
+	templated := cycleRule("templated", "t:in", "t:out")
+	templated.Actions[0].Value = "${t:out} again"
+
+	// A rule that reads the fact it writes through a script parameter
+	scripted := cycleRule("scripted", "s:in", "s:out")
+	scripted.Scripts = map[string]Script{"next": {Params: []string{"s:out"}, Body: "return s_out + 1"}}
+	scripted.Actions[0].Value = "{next}"
+
+	testCases := []struct {
+		name     string
+		rules    []Rule
+		expected [][]string
+	}{
+		{
+			name:     "No cycle",
+			rules:    []Rule{cycleRule("a", "x", "y"), cycleRule("b", "y", "z")},
+			expected: nil,
+		},
+		{
+			name:     "Self loop",
+			rules:    []Rule{cycleRule("a", "x", "y"), cycleRule("self", "z", "z")},
+			expected: [][]string{{"self"}},
+		},
+		{
+			name: "Indirect loop",
+			rules: []Rule{
+				cycleRule("c", "z", "x"),
+				cycleRule("outside", "x", "w"),
+				cycleRule("a", "x", "y"),
+				cycleRule("b", "y", "z"),
+			},
+			expected: [][]string{{"c", "a", "b"}},
+		},
+		{
+			name: "Separate loops",
+			rules: []Rule{
+				cycleRule("ping", "p", "q"),
+				cycleRule("self", "s", "s"),
+				cycleRule("pong", "q", "p"),
+			},
+			expected: [][]string{{"ping", "pong"}, {"self"}},
+		},
+		{
+			name:     "Loop through template",
+			rules:    []Rule{templated},
+			expected: [][]string{{"templated"}},
+		},
+		{
+			name:     "Loop through script parameter",
+			rules:    []Rule{scripted},
+			expected: [][]string{{"scripted"}},
+		},
+		{
+			name: "Actions that do not write facts",
+			rules: []Rule{{
+				Name:       "notify",
+				Conditions: ConditionGroup{All: []*ConditionOrGroup{{Fact: "x", Operator: "GT", Value: 0.0}}},
+				Actions:    []Action{{Type: "sendMessage", Target: "x", Value: "hi"}},
+			}},
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, FindRuleCycles(&Ruleset{Rules: tc.rules}))
+		})
+	}
+}
+
+func TestFormatRuleCycle(t *testing.T) {
+	assert.Equal(t, "a -> b -> a", FormatRuleCycle([]string{"a", "b"}))
+	assert.Equal(t, "self -> self", FormatRuleCycle([]string{"self"}))
+}
@@ -0,0 +1,238 @@
+// rex/pkg/compiler/gogen.go
+
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// goComparison is the Go helper a comparison opcode is generated as.
+type goComparison struct {
+	name        string
+	goType      string
+	description string
+	expression  string
+}
+
+var goComparisons = map[Opcode]goComparison{
+	EQ_FLOAT:            {"eqFloat", "float64", "a float equal to value", "v == value"},
+	NEQ_FLOAT:           {"neqFloat", "float64", "a float not equal to value", "v != value"},
+	LT_FLOAT:            {"ltFloat", "float64", "a float less than value", "v < value"},
+	LTE_FLOAT:           {"lteFloat", "float64", "a float less than or equal to value", "v <= value"},
+	GT_FLOAT:            {"gtFloat", "float64", "a float greater than value", "v > value"},
+	GTE_FLOAT:           {"gteFloat", "float64", "a float greater than or equal to value", "v >= value"},
+	EQ_STRING:           {"eqString", "string", "a string equal to value", "v == value"},
+	NEQ_STRING:          {"neqString", "string", "a string not equal to value", "v != value"},
+	CONTAINS_STRING:     {"containsString", "string", "a string containing value", "strings.Contains(v, value)"},
+	NOT_CONTAINS_STRING: {"notContainsString", "string", "a string not containing value", "!strings.Contains(v, value)"},
+	EQ_BOOL:             {"eqBool", "bool", "a bool equal to value", "v == value"},
+	NEQ_BOOL:            {"neqBool", "bool", "a bool not equal to value", "v != value"},
+}
+
+// goGenerator generates the Go source of a ruleset.
+type goGenerator struct {
+	// used are the comparison helpers the conditions call
+	used map[Opcode]bool
+}
+
+// GenerateGo generates the source of a Go package that runs the ruleset with
+// its conditions compiled to native Go functions. Only the conditions are
+// generated: the package embeds the ruleset's bytecode, which the engine
+// still runs the rules' actions from, and exports NewEngine and Program like
+// the runtime package's.
+//
+// Conditions are typed exactly as in the bytecode, and like the interpreter
+// do not hold for facts of another type. Conditions that call
+// scripts, empty condition groups, and facts or values containing spaces are
+// not supported.
+func GenerateGo(ruleset *Ruleset, packageName string) ([]byte, error) {
+	if !token.IsIdentifier(packageName) {
+		return nil, logging.NewError(logging.ErrorTypeCompile, "Invalid Go package name", nil, map[string]interface{}{"package": packageName})
+	}
+
+	rules, err := OrderRules(ruleset)
+	if err != nil {
+		return nil, err
+	}
+	bytecode, err := MarshalBytecode(GenerateBytecode(ruleset))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &goGenerator{used: make(map[Opcode]bool)}
+	var functions bytes.Buffer
+	names := make([]string, len(rules))
+	taken := make(map[string]bool)
+	for i, rule := range rules {
+		names[i] = goFunctionName(rule.Name, taken)
+		expression, err := g.expression(convertConditionGroupToNode(rule.Conditions), rule, true)
+		if err != nil {
+			return nil, logging.NewError(logging.ErrorTypeCompile, "Failed to generate Go for rule conditions", err, map[string]interface{}{"ruleName": rule.Name})
+		}
+		fmt.Fprintf(&functions, "\n// %s is the conditions of rule %s.\n", names[i], strconv.Quote(rule.Name))
+		fmt.Fprintf(&functions, "func %s(facts runtime.Facts) bool {\n\treturn %s\n}\n", names[i], expression)
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by rexc -emit go. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "// Package %s runs a ruleset compiled by rexc, with the conditions of its\n// rules compiled to Go functions.\n", packageName)
+	fmt.Fprintf(&src, "package %s\n\n", packageName)
+	src.WriteString("import (\n")
+	if g.used[CONTAINS_STRING] || g.used[NOT_CONTAINS_STRING] {
+		src.WriteString("\t\"strings\"\n\n")
+	}
+	src.WriteString("\t\"rgehrsitz/rex/pkg/runtime\"\n\t\"rgehrsitz/rex/pkg/store\"\n)\n\n")
+
+	src.WriteString(`// NewEngine creates an engine running the ruleset, like runtime.NewEngine.
+func NewEngine(factStore store.Store, opts ...runtime.Option) (*runtime.Engine, error) {
+	program, err := Program()
+	if err != nil {
+		return nil, err
+	}
+	return runtime.NewEngine(program, factStore, opts...)
+}
+
+// Program loads the ruleset's program with the native conditions below.
+func Program() (*runtime.Program, error) {
+	return runtime.LoadNativeProgram(bytecode, conditions)
+}
+
+// conditions are the native conditions of the rules, by rule name.
+var conditions = map[string]runtime.Condition{
+`)
+	for i, rule := range rules {
+		fmt.Fprintf(&src, "\t%s: %s,\n", strconv.Quote(rule.Name), names[i])
+	}
+	src.WriteString("}\n")
+	src.Write(functions.Bytes())
+
+	opcodes := make([]int, 0, len(g.used))
+	for opcode := range g.used {
+		opcodes = append(opcodes, int(opcode))
+	}
+	sort.Ints(opcodes)
+	for _, opcode := range opcodes {
+		c := goComparisons[Opcode(opcode)]
+		fmt.Fprintf(&src, "\n// %s reports whether a fact is %s.\n", c.name, c.description)
+		fmt.Fprintf(&src, "func %s(facts runtime.Facts, fact string, value %s) bool {\n", c.name, c.goType)
+		fmt.Fprintf(&src, "\tfactValue, _ := facts.Fact(fact)\n\tv, ok := factValue.(%s)\n\treturn ok && %s\n}\n", c.goType, c.expression)
+	}
+
+	src.WriteString("\n// bytecode is the ruleset compiled by rexc.\nvar bytecode = []byte{")
+	for i, b := range bytecode {
+		if i%16 == 0 {
+			src.WriteString("\n\t")
+		} else {
+			src.WriteString(" ")
+		}
+		fmt.Fprintf(&src, "0x%02x,", b)
+	}
+	src.WriteString("\n}\n")
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return nil, logging.NewError(logging.ErrorTypeCompile, "Failed to format generated Go", err, nil)
+	}
+	return formatted, nil
+}
+
+// expression returns the Go expression of a condition node. Like traverse,
+// a node's all conditions take precedence over its any conditions. Only the
+// root may be empty, which holds.
+func (g *goGenerator) expression(node Node, rule Rule, root bool) (string, error) {
+	var children []Node
+	var operator string
+	switch {
+	case len(node.All) > 0:
+		children, operator = node.All, " && "
+	case len(node.Any) > 0:
+		children, operator = node.Any, " || "
+	case node.Cond != nil:
+		return g.comparison(node.Cond, rule)
+	case root:
+		return "true", nil
+	default:
+		return "", fmt.Errorf("empty condition group")
+	}
+
+	operands := make([]string, len(children))
+	for i, child := range children {
+		operand, err := g.expression(child, rule, false)
+		if err != nil {
+			return "", err
+		}
+		// Groups of several conditions are parenthesized, whatever their
+		// operator, so the expression reads like the ruleset
+		if len(children) > 1 && (len(child.All) > 1 || len(child.All) == 0 && len(child.Any) > 1) {
+			operand = "(" + operand + ")"
+		}
+		operands[i] = operand
+	}
+	return strings.Join(operands, operator), nil
+}
+
+// comparison returns the Go expression of a condition, typed like the
+// condition's bytecode.
+func (g *goGenerator) comparison(cond *Condition, rule Rule) (string, error) {
+	if _, ok := rule.Scripts[cond.Fact]; ok {
+		return "", fmt.Errorf("condition on script %s is not supported", cond.Fact)
+	}
+	value := fmt.Sprintf("%v", cond.Value)
+	if strings.Contains(cond.Fact, " ") || strings.Contains(value, " ") {
+		return "", fmt.Errorf("condition %s %s %v contains a space", cond.Fact, cond.Operator, cond.Value)
+	}
+
+	factOpcode, _, comparisonOpcode, _, ok := conditionOpcodes(cond.Operator, value)
+	var constant, valueType string
+	switch factOpcode {
+	case LOAD_FACT_FLOAT:
+		f, _ := strconv.ParseFloat(value, 64)
+		constant, valueType = strconv.FormatFloat(f, 'g', -1, 64), "float"
+	case LOAD_FACT_BOOL:
+		b, _ := strconv.ParseBool(value)
+		constant, valueType = strconv.FormatBool(b), "bool"
+	default:
+		constant, valueType = strconv.Quote(value), "string"
+	}
+	if !ok {
+		return "", fmt.Errorf("operator %s does not apply to %s value %s", cond.Operator, valueType, value)
+	}
+	g.used[comparisonOpcode] = true
+	return fmt.Sprintf("%s(facts, %s, %s)", goComparisons[comparisonOpcode].name, strconv.Quote(cond.Fact), constant), nil
+}
+
+// goFunctionName returns the name of the function of a rule's conditions: the
+// rule name in camel case, prefixed with rule, and numbered if another rule
+// already has the name.
+func goFunctionName(ruleName string, taken map[string]bool) string {
+	var name strings.Builder
+	name.WriteString("rule")
+	upper := true
+	for _, r := range ruleName {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		name.WriteRune(r)
+	}
+
+	unique := name.String()
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name.String(), i)
+	}
+	taken[unique] = true
+	return unique
+}
@@ -0,0 +1,97 @@
+// rex/pkg/compiler/gogen_test.go
+
+package compiler
+
+import (
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateGo(t *testing.T) {
+	ruleset := &Ruleset{
+		Rules: []Rule{
+			{
+				Name: "comfort-alert",
+				Conditions: ConditionGroup{
+					All: []*ConditionOrGroup{
+						{Fact: "temperature", Operator: "GTE", Value: 21.5},
+						{Any: []*ConditionOrGroup{
+							{Fact: "zone:mode", Operator: "CONTAINS", Value: "heat"},
+							{Fact: "window:open", Operator: "EQ", Value: true},
+						}},
+					},
+				},
+				Actions: []Action{{Type: "updateStore", Target: "alerts:comfort", Value: true}},
+			},
+			{
+				// Numbers given as strings are floats, as in the bytecode
+				Name: "comfort_alert",
+				Conditions: ConditionGroup{
+					Any: []*ConditionOrGroup{
+						{Fact: "humidity", Operator: "LT", Value: "40"},
+						{Fact: "humidity:setpoint", Operator: "EQ", Value: 0.0},
+					},
+				},
+				Actions: []Action{{Type: "updateStore", Target: "alerts:dry", Value: true}},
+			},
+			{
+				Name:    "always",
+				Actions: []Action{{Type: "updateStore", Target: "seen", Value: true}},
+			},
+		},
+	}
+
+	source, err := GenerateGo(ruleset, "comfort")
+	require.NoError(t, err)
+	_, err = parser.ParseFile(token.NewFileSet(), "rules.go", source, parser.AllErrors)
+	require.NoError(t, err)
+
+	code := string(source)
+	assert.Contains(t, code, "// Code generated by rexc -emit go. DO NOT EDIT.")
+	assert.Contains(t, code, "package comfort")
+	assert.Contains(t, code, `"strings"`)
+	assert.Contains(t, code, `"comfort-alert": ruleComfortAlert,`)
+	assert.Contains(t, code, `"comfort_alert": ruleComfortAlert2,`)
+	assert.Contains(t, code, `return gteFloat(facts, "temperature", 21.5) && (containsString(facts, "zone:mode", "heat") || eqBool(facts, "window:open", true))`)
+	assert.Contains(t, code, `return ltFloat(facts, "humidity", 40) || eqFloat(facts, "humidity:setpoint", 0)`)
+	assert.Contains(t, code, "func ruleAlways(facts runtime.Facts) bool {\n\treturn true\n}")
+	assert.Contains(t, code, "func ltFloat(facts runtime.Facts, fact string, value float64) bool {")
+	assert.NotContains(t, code, "func gtFloat(")
+
+	// The same ruleset generates the same code
+	again, err := GenerateGo(ruleset, "comfort")
+	require.NoError(t, err)
+	assert.Equal(t, string(source), string(again))
+}
+
+func TestGenerateGoUnsupported(t *testing.T) {
+	rule := func(conditions ConditionGroup) *Ruleset {
+		return &Ruleset{Rules: []Rule{{
+			Name:       "unsupported",
+			Conditions: conditions,
+			Actions:    []Action{{Type: "updateStore", Target: "out", Value: true}},
+			Scripts:    map[string]Script{"double": {Params: []string{"x"}, Body: "return x * 2"}},
+		}}}
+	}
+
+	testCases := map[string]*Ruleset{
+		"operator of another type":   rule(ConditionGroup{All: []*ConditionOrGroup{{Fact: "mode", Operator: "GT", Value: "eco"}}}),
+		"float operator of a string": rule(ConditionGroup{All: []*ConditionOrGroup{{Fact: "level", Operator: "CONTAINS", Value: 4.0}}}),
+		"value with a space":         rule(ConditionGroup{All: []*ConditionOrGroup{{Fact: "mode", Operator: "EQ", Value: "eco mode"}}}),
+		"script condition":           rule(ConditionGroup{All: []*ConditionOrGroup{{Fact: "double", Operator: "GT", Value: 4.0}}}),
+		"empty group":                rule(ConditionGroup{All: []*ConditionOrGroup{{Fact: "x", Operator: "GT", Value: 1.0}, {}}}),
+	}
+	for name, ruleset := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := GenerateGo(ruleset, "rules")
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := GenerateGo(rule(ConditionGroup{}), "func")
+	assert.Error(t, err, "package names must be identifiers")
+}
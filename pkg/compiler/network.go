@@ -0,0 +1,97 @@
+// rex/pkg/compiler/network.go
+
+package compiler
+
+import (
+	"fmt"
+)
+
+// ConditionNode is a condition shared by every rule that tests it. Conditions
+// are identical if they compile to the same bytecode: the same fact, compared
+// with the same opcode against the same constant, so `temperature GT 30` and
+// `temperature GT 30.0` share a node.
+type ConditionNode struct {
+	ID       int
+	Fact     string
+	Operator string
+	Value    string
+	// Rules are the rules that test the condition, in evaluation order
+	Rules []string
+}
+
+// ConditionNetwork is the conditions of a ruleset, deduplicated across its
+// rules into shared nodes. The bytecode tags every condition with its node,
+// so the runtime evaluates each node once for every rule that tests it.
+type ConditionNetwork struct {
+	Nodes []*ConditionNode
+	// Conditions counts the conditions of the rules, shared or not
+	Conditions int
+
+	ids map[conditionKey]int
+}
+
+// conditionKey identifies a condition by the bytecode it compiles to.
+type conditionKey struct {
+	fact       string
+	factOpcode Opcode
+	comparison Opcode
+	value      string
+}
+
+// BuildConditionNetwork deduplicates the conditions of rules, given in
+// evaluation order, into shared nodes, numbered in the order they are first
+// tested. Conditions on a rule's scripts are not shared, since their results
+// depend on the rule's script definitions.
+func BuildConditionNetwork(rules []Rule) *ConditionNetwork {
+	network := &ConditionNetwork{ids: make(map[conditionKey]int)}
+	for _, rule := range rules {
+		network.addConditions(rule, convertConditionGroupToNode(rule.Conditions))
+	}
+	return network
+}
+
+// addConditions adds the conditions of a rule's condition tree.
+func (n *ConditionNetwork) addConditions(rule Rule, node Node) {
+	for _, child := range node.All {
+		n.addConditions(rule, child)
+	}
+	for _, child := range node.Any {
+		n.addConditions(rule, child)
+	}
+	if node.Cond == nil {
+		return
+	}
+	if _, ok := rule.Scripts[node.Cond.Fact]; ok {
+		return
+	}
+
+	n.Conditions++
+	value := fmt.Sprintf("%v", node.Cond.Value)
+	key := conditionKeyOf(node.Cond.Fact, node.Cond.Operator, value)
+	id, ok := n.ids[key]
+	if !ok {
+		id = len(n.Nodes)
+		n.ids[key] = id
+		n.Nodes = append(n.Nodes, &ConditionNode{ID: id, Fact: node.Cond.Fact, Operator: node.Cond.Operator, Value: value})
+	}
+	shared := n.Nodes[id]
+	if len(shared.Rules) == 0 || shared.Rules[len(shared.Rules)-1] != rule.Name {
+		shared.Rules = append(shared.Rules, rule.Name)
+	}
+}
+
+// Node returns the node of a condition, given as the text of its parts.
+func (n *ConditionNetwork) Node(fact, operator, value string) (*ConditionNode, bool) {
+	id, ok := n.ids[conditionKeyOf(fact, operator, value)]
+	if !ok {
+		return nil, false
+	}
+	return n.Nodes[id], true
+}
+
+// conditionKeyOf returns the key of a condition, given as the text of its
+// parts.
+func conditionKeyOf(fact, operator, value string) conditionKey {
+	factOpcode, _, comparison, valueBytes, _ := conditionOpcodes(operator, value)
+	return conditionKey{fact: fact, factOpcode: factOpcode, comparison: comparison, value: string(valueBytes)}
+}
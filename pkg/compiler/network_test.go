@@ -0,0 +1,75 @@
+// rex/pkg/compiler/network_test.go
+
+package compiler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildConditionNetwork(t *testing.T) {
+	rules := []Rule{
+		{
+			Name: "heat",
+			Conditions: ConditionGroup{
+				All: []*ConditionOrGroup{
+					{Fact: "weather:temperature", Operator: "GT", Value: 30.0},
+					{Any: []*ConditionOrGroup{
+						{Fact: "zone:mode", Operator: "EQ", Value: "cooling"},
+						{Fact: "weather:temperature", Operator: "GT", Value: 30.0},
+					}},
+				},
+			},
+		},
+		{
+			// The same conditions, with the value given as a string
+			Name: "fans",
+			Conditions: ConditionGroup{
+				Any: []*ConditionOrGroup{{Fact: "weather:temperature", Operator: "GT", Value: "30"}},
+			},
+		},
+		{
+			Name: "frost",
+			Conditions: ConditionGroup{
+				All: []*ConditionOrGroup{
+					{Fact: "weather:temperature", Operator: "LT", Value: 30.0},
+					{Fact: "dew_point", Operator: "GT", Value: 4.0},
+				},
+			},
+			Scripts: map[string]Script{"dew_point": {Params: []string{"weather:temperature"}, Body: "return 5"}},
+		},
+	}
+
+	network := BuildConditionNetwork(rules)
+	assert.Equal(t, 5, network.Conditions)
+	require.Len(t, network.Nodes, 3)
+
+	temperature, ok := network.Node("weather:temperature", "GT", "30")
+	require.True(t, ok)
+	assert.Equal(t, 0, temperature.ID)
+	assert.Equal(t, []string{"heat", "fans"}, temperature.Rules)
+
+	mode, ok := network.Node("zone:mode", "EQ", "cooling")
+	require.True(t, ok)
+	assert.Equal(t, []string{"heat"}, mode.Rules)
+
+	frost, ok := network.Node("weather:temperature", "LT", "30")
+	require.True(t, ok)
+	assert.Equal(t, []string{"frost"}, frost.Rules)
+
+	// Conditions on scripts are not shared
+	_, ok = network.Node("dew_point", "GT", "4")
+	assert.False(t, ok)
+
+	// The bytecode tags the condition with the same node in both rules
+	bytecode := GenerateBytecode(&Ruleset{Rules: rules}).Instructions
+	tag := func(id byte, load Opcode) []byte {
+		return []byte{byte(CONDITION_NODE), id, 0, 0, 0, byte(load)}
+	}
+	assert.Equal(t, 3, bytes.Count(bytecode, tag(0, LOAD_FACT_FLOAT)))
+	assert.Equal(t, 1, bytes.Count(bytecode, tag(1, LOAD_FACT_STRING)))
+	assert.Equal(t, 1, bytes.Count(bytecode, tag(2, LOAD_FACT_FLOAT)))
+}
@@ -0,0 +1,96 @@
+// rex/pkg/compiler/ordering.go
+
+package compiler
+
+import (
+	"container/heap"
+	"strings"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// OrderRules returns the rules in the order they are evaluated: every rule
+// comes after the rules named in its After field, and otherwise rules are
+// ordered by priority, lowest number first, then by their position in the
+// ruleset. It fails if a rule names an unknown rule or the After references
+// form a cycle.
+func OrderRules(ruleset *Ruleset) ([]Rule, error) {
+	positions := make(map[string]int, len(ruleset.Rules))
+	for i, rule := range ruleset.Rules {
+		positions[rule.Name] = i
+	}
+
+	dependents := make([][]int, len(ruleset.Rules))
+	waiting := make([]int, len(ruleset.Rules))
+	for i, rule := range ruleset.Rules {
+		seen := make(map[int]struct{}, len(rule.After))
+		for _, name := range rule.After {
+			j, ok := positions[name]
+			if !ok {
+				return nil, logging.NewError(logging.ErrorTypeCompile, "Rule must run after an unknown rule", nil, map[string]interface{}{"rule_name": rule.Name, "after": name})
+			}
+			if _, dup := seen[j]; dup {
+				continue
+			}
+			seen[j] = struct{}{}
+			dependents[j] = append(dependents[j], i)
+			waiting[i]++
+		}
+	}
+
+	ready := &ruleQueue{rules: ruleset.Rules}
+	for i := range ruleset.Rules {
+		if waiting[i] == 0 {
+			heap.Push(ready, i)
+		}
+	}
+
+	ordered := make([]Rule, 0, len(ruleset.Rules))
+	for ready.Len() > 0 {
+		i := heap.Pop(ready).(int)
+		ordered = append(ordered, ruleset.Rules[i])
+		for _, j := range dependents[i] {
+			waiting[j]--
+			if waiting[j] == 0 {
+				heap.Push(ready, j)
+			}
+		}
+	}
+
+	if len(ordered) < len(ruleset.Rules) {
+		var cyclic []string
+		for i, rule := range ruleset.Rules {
+			if waiting[i] > 0 {
+				cyclic = append(cyclic, rule.Name)
+			}
+		}
+		return nil, logging.NewError(logging.ErrorTypeCompile, "Rule after references form a cycle", nil, map[string]interface{}{"rules": strings.Join(cyclic, ", ")})
+	}
+	return ordered, nil
+}
+
+// ruleQueue is a heap of rule positions ordered by priority, then position.
+type ruleQueue struct {
+	rules     []Rule
+	positions []int
+}
+
+func (q *ruleQueue) Len() int { return len(q.positions) }
+
+func (q *ruleQueue) Less(i, j int) bool {
+	a, b := q.positions[i], q.positions[j]
+	if q.rules[a].Priority != q.rules[b].Priority {
+		return q.rules[a].Priority < q.rules[b].Priority
+	}
+	return a < b
+}
+
+func (q *ruleQueue) Swap(i, j int) { q.positions[i], q.positions[j] = q.positions[j], q.positions[i] }
+
+func (q *ruleQueue) Push(x interface{}) { q.positions = append(q.positions, x.(int)) }
+
+func (q *ruleQueue) Pop() interface{} {
+	last := q.positions[len(q.positions)-1]
+	q.positions = q.positions[:len(q.positions)-1]
+	return last
+}
@@ -0,0 +1,105 @@
+// rex/pkg/compiler/ordering_test.go
+
+package compiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func orderedNames(rules []Rule) []string {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.Name
+	}
+	return names
+}
+
+func TestOrderRules(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rules    []Rule
+		expected []string
+	}{
+		{
+			name:     "Priority then position",
+			rules:    []Rule{{Name: "c", Priority: 2}, {Name: "a", Priority: 1}, {Name: "b", Priority: 2}},
+			expected: []string{"a", "c", "b"},
+		},
+		{
+			name: "After overrides priority",
+			rules: []Rule{
+				{Name: "report", Priority: 1, After: []string{"compute"}},
+				{Name: "compute", Priority: 5},
+				{Name: "other", Priority: 3},
+			},
+			expected: []string{"other", "compute", "report"},
+		},
+		{
+			name: "Chained after",
+			rules: []Rule{
+				{Name: "c", After: []string{"b"}},
+				{Name: "b", After: []string{"a", "a"}},
+				{Name: "a"},
+			},
+			expected: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ordered, err := OrderRules(&Ruleset{Rules: tc.rules})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, orderedNames(ordered))
+		})
+	}
+}
+
+func TestOrderRulesErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules []Rule
+	}{
+		{"Unknown rule", []Rule{{Name: "a", After: []string{"missing"}}}},
+		{"Self reference", []Rule{{Name: "a", After: []string{"a"}}}},
+		{"Cycle", []Rule{
+			{Name: "a", After: []string{"c"}},
+			{Name: "b", After: []string{"a"}},
+			{Name: "c", After: []string{"b"}},
+			{Name: "d"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := OrderRules(&Ruleset{Rules: tc.rules})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGenerateBytecodeEmitsRulesInOrder(t *testing.T) {
+	rule := func(name string, priority int, after ...string) Rule {
+		return Rule{
+			Name:       name,
+			Priority:   priority,
+			Conditions: ConditionGroup{All: []*ConditionOrGroup{{Fact: "temperature", Operator: "GT", Value: 30.0}}},
+			Actions:    []Action{{Type: "updateStore", Target: "alert", Value: true}},
+			After:      after,
+		}
+	}
+
+	bytecode := GenerateBytecode(&Ruleset{Rules: []Rule{
+		rule("report", 1, "compute"),
+		rule("compute", 5),
+		rule("other", 3),
+	}})
+
+	var indexed []string
+	for _, entry := range bytecode.RuleExecIndex {
+		indexed = append(indexed, entry.RuleName)
+	}
+	assert.Equal(t, []string{"other", "compute", "report"}, indexed)
+	assert.Equal(t, []string{"other", "compute", "report"}, bytecode.FactRuleLookupIndex["temperature"])
+}
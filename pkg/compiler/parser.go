@@ -20,6 +20,11 @@ func Parse(jsonData []byte) (*Ruleset, error) {
 	if len(ruleset.Rules) == 0 {
 		return nil, logging.NewError(logging.ErrorTypeParse, "Missing rules field", nil, nil)
 	}
+	switch ruleset.Strategy {
+	case "", StrategyAllMatching, StrategyFirstMatch:
+	default:
+		return nil, logging.NewError(logging.ErrorTypeParse, "Unknown strategy", nil, map[string]interface{}{"strategy": ruleset.Strategy})
+	}
 	for i, rule := range ruleset.Rules {
 		if err := validateRule(&rule); err != nil {
 			return nil, logging.NewError(logging.ErrorTypeCompile, "Invalid rule", err, map[string]interface{}{"rule_name": rule.Name})
@@ -42,6 +47,10 @@ func Parse(jsonData []byte) (*Ruleset, error) {
 		}
 	}
 
+	if _, err := OrderRules(&ruleset); err != nil {
+		return nil, logging.NewError(logging.ErrorTypeCompile, "Invalid rule order", err, nil)
+	}
+
 	logging.Logger.Debug().Interface("ruleset", ruleset).Msg("Parsed JSON data")
 	return &ruleset, nil
 }
@@ -55,6 +64,12 @@ func validateRule(rule *Rule) error {
 	if rule.Priority < 0 {
 		return logging.NewError(logging.ErrorTypeCompile, "Rule priority must be non-negative", nil, map[string]interface{}{"rule_name": rule.Name})
 	}
+	if rule.ExclusiveGroup == FirstMatchGroup || len(rule.ExclusiveGroup) > 255 {
+		return logging.NewError(logging.ErrorTypeCompile, "Invalid exclusive group name", nil, map[string]interface{}{"rule_name": rule.Name, "exclusive_group": rule.ExclusiveGroup})
+	}
+	if len(rule.Group) > 255 {
+		return logging.NewError(logging.ErrorTypeCompile, "Invalid group name", nil, map[string]interface{}{"rule_name": rule.Name, "group": rule.Group})
+	}
 	if err := validateAndOrderConditionGroup(&rule.Conditions); err != nil {
 		return logging.NewError(logging.ErrorTypeCompile, "Invalid condition group", err, map[string]interface{}{"rule_name": rule.Name})
 	}
@@ -176,6 +191,17 @@ func validateAction(action *Action) error {
 	if !isActionValueValid(action.Type, action.Value) {
 		return logging.NewError(logging.ErrorTypeCompile, "Invalid action value for action type", nil, map[string]interface{}{"value": action.Value, "action_type": action.Type})
 	}
+	if value, ok := action.Value.(string); ok && IsTemplate(value) {
+		if _, err := ParseTemplate(value); err != nil {
+			return logging.NewError(logging.ErrorTypeCompile, "Invalid action value template", err, map[string]interface{}{"value": value})
+		}
+	}
+	if _, err := parseActionDelay(*action); err != nil {
+		return err
+	}
+	if action.CancelIfFalse && action.Delay == "" {
+		return logging.NewError(logging.ErrorTypeCompile, "cancelIfFalse requires a delay", nil, map[string]interface{}{"target": action.Target})
+	}
 	return nil
 }
 
@@ -249,6 +275,8 @@ func isActionValueValid(actionType string, value interface{}) bool {
 			return true
 		case bool:
 			return true
+		case []interface{}, map[string]interface{}:
+			return isStructuredValueValid(value)
 		default:
 			return false
 		}
@@ -257,6 +285,14 @@ func isActionValueValid(actionType string, value interface{}) bool {
 	}
 }
 
+// isStructuredValueValid checks that an array or object action value can be
+// stored as JSON. The compiler encodes these values with json.Marshal, so
+// anything json.Marshal rejects (e.g. NaN or channels nested inside) is invalid.
+func isStructuredValueValid(value interface{}) bool {
+	_, err := json.Marshal(value)
+	return err == nil
+}
+
 func validateAndCompileScript(name string, script Script) error {
 	// TODO: Implement script validation and compilation
 	// This could involve checking for syntax errors, disallowed operations, etc.
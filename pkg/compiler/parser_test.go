@@ -300,6 +300,74 @@ func TestInvalidPriority(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestStrategy(t *testing.T) {
+	ruleJSON := `{
+        "strategy": %q,
+        "rules": [
+            {
+                "name": "rule1",
+                "exclusiveGroup": %q,
+                "conditions": {"all": [{"fact": "temperature", "operator": "GT", "value": 30.0}]},
+                "actions": [{"type": "updateStore", "target": "temperature_status", "value": true}]
+            }
+        ]
+    }`
+
+	testCases := []struct {
+		strategy    string
+		group       string
+		expectError bool
+	}{
+		{"", "", false},
+		{StrategyAllMatching, "alerts", false},
+		{StrategyFirstMatch, "", false},
+		{"random", "", true},
+		{"", FirstMatchGroup, true},
+	}
+
+	for _, tc := range testCases {
+		ruleset, err := Parse([]byte(fmt.Sprintf(ruleJSON, tc.strategy, tc.group)))
+		if tc.expectError {
+			assert.Error(t, err, "strategy %q, group %q", tc.strategy, tc.group)
+			continue
+		}
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.strategy, ruleset.Strategy)
+			assert.Equal(t, tc.group, ruleset.Rules[0].ExclusiveGroup)
+		}
+	}
+}
+
+func TestAfter(t *testing.T) {
+	ruleJSON := `{
+        "rules": [
+            {
+                "name": "rule1",
+                "after": [%s],
+                "conditions": {"all": [{"fact": "temperature", "operator": "GT", "value": 30.0}]},
+                "actions": [{"type": "updateStore", "target": "temperature_status", "value": true}]
+            },
+            {
+                "name": "rule2",
+                "after": [%s],
+                "conditions": {"all": [{"fact": "temperature", "operator": "GT", "value": 40.0}]},
+                "actions": [{"type": "updateStore", "target": "temperature_status", "value": false}]
+            }
+        ]
+    }`
+
+	ruleset, err := Parse([]byte(fmt.Sprintf(ruleJSON, `"rule2"`, ``)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"rule2"}, ruleset.Rules[0].After)
+	}
+
+	_, err = Parse([]byte(fmt.Sprintf(ruleJSON, `"rule3"`, ``)))
+	assert.Error(t, err)
+
+	_, err = Parse([]byte(fmt.Sprintf(ruleJSON, `"rule2"`, `"rule1"`)))
+	assert.Error(t, err)
+}
+
 func TestInvalidConditionFact(t *testing.T) {
 	jsonData := []byte(`{
         "rules": [
@@ -771,6 +839,36 @@ func TestValidateAction(t *testing.T) {
 			action:         &Action{Type: "updateStore", Target: "alarm", Value: make(chan int)},
 			expectedErrMsg: "Invalid action value",
 		},
+		{
+			name:           "Valid Template",
+			action:         &Action{Type: "updateStore", Target: "summary", Value: "Temp is ${weather:temperature}C"},
+			expectedErrMsg: "",
+		},
+		{
+			name:           "Invalid Template",
+			action:         &Action{Type: "updateStore", Target: "summary", Value: "Temp is ${weather:temperature"},
+			expectedErrMsg: "Invalid action value template",
+		},
+		{
+			name:           "Valid Delay",
+			action:         &Action{Type: "updateStore", Target: "system:fan_speed", Value: 0.0, Delay: "10m", CancelIfFalse: true},
+			expectedErrMsg: "",
+		},
+		{
+			name:           "Invalid Delay",
+			action:         &Action{Type: "updateStore", Target: "system:fan_speed", Value: 0.0, Delay: "ten minutes"},
+			expectedErrMsg: "Invalid action delay",
+		},
+		{
+			name:           "Negative Delay",
+			action:         &Action{Type: "updateStore", Target: "system:fan_speed", Value: 0.0, Delay: "-5s"},
+			expectedErrMsg: "Action delay must be positive",
+		},
+		{
+			name:           "Cancel Without Delay",
+			action:         &Action{Type: "updateStore", Target: "system:fan_speed", Value: 0.0, CancelIfFalse: true},
+			expectedErrMsg: "cancelIfFalse requires a delay",
+		},
 	}
 
 	for _, tt := range tests {
@@ -844,6 +942,9 @@ func TestIsActionValueValid(t *testing.T) {
 		{"Invalid Type", "updateStore", make(chan int), false},
 		{"Invalid Action Type", "invalidType", "test", false},
 		{"Valid sendMessage", "sendMessage", "test message", true},
+		{"Valid Array", "updateStore", []interface{}{1.0, "two", true}, true},
+		{"Valid Object", "updateStore", map[string]interface{}{"mode": "eco", "level": 3.0}, true},
+		{"Invalid Nested Value", "updateStore", []interface{}{make(chan int)}, false},
 	}
 
 	for _, tt := range tests {
@@ -3,8 +3,23 @@ package compiler
 
 type Ruleset struct {
 	Rules []Rule `json:"rules"`
+	// Strategy decides which of the rules matching an update fire. Defaults
+	// to StrategyAllMatching.
+	Strategy string `json:"strategy,omitempty"`
 }
 
+// Conflict resolution strategies.
+const (
+	// StrategyAllMatching fires every matching rule, in priority order.
+	StrategyAllMatching = "all-matching"
+	// StrategyFirstMatch fires only the highest-priority matching rule.
+	StrategyFirstMatch = "first-match"
+)
+
+// FirstMatchGroup is the exclusive group every rule is compiled into under
+// StrategyFirstMatch.
+const FirstMatchGroup = "*"
+
 type Script struct {
 	Params []string `json:"params"`
 	Body   string   `json:"body"`
@@ -16,6 +31,21 @@ type Rule struct {
 	Conditions ConditionGroup    `json:"conditions"`
 	Actions    []Action          `json:"actions"`
 	Scripts    map[string]Script `json:"scripts,omitempty"`
+	// Atomic commits all of the rule's store writes in a single transaction
+	// and publishes them only once it succeeds.
+	Atomic bool `json:"atomic,omitempty"`
+	// ExclusiveGroup names a group of rules of which only the
+	// highest-priority matching one fires for an update.
+	ExclusiveGroup string `json:"exclusiveGroup,omitempty"`
+	// Group names the agenda a rule belongs to. Rules without a group share
+	// the default group.
+	Group string `json:"group,omitempty"`
+	// StopProcessing skips the rules after this one in its group, in
+	// priority order, once it fires for an update.
+	StopProcessing bool `json:"stopProcessing,omitempty"`
+	// After names rules that are evaluated before this one for the same
+	// update.
+	After []string `json:"after,omitempty"`
 }
 
 type ConditionGroup struct {
@@ -35,6 +65,13 @@ type Action struct {
 	Type   string      `json:"type"`
 	Target string      `json:"target"`
 	Value  interface{} `json:"value"`
+	// Delay postpones the action by a Go duration (e.g. "10m"). CancelIfFalse
+	// drops the pending action if the rule evaluates false before it runs.
+	Delay         string `json:"delay,omitempty"`
+	CancelIfFalse bool   `json:"cancelIfFalse,omitempty"`
+	// OnlyIfChanged skips the write when the target already holds the value.
+	// When unset, the engine default applies.
+	OnlyIfChanged *bool `json:"onlyIfChanged,omitempty"`
 }
 
 type Header struct {
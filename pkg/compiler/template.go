@@ -0,0 +1,126 @@
+// rex/pkg/compiler/template.go
+
+package compiler
+
+import (
+	"regexp"
+	"strings"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// TemplatePart is one segment of a templated action value. A part is either
+// literal text or a reference to a fact, optionally with a format.
+type TemplatePart struct {
+	Literal string
+	Fact    string
+	Format  string
+}
+
+// IsFactRef reports whether the part references a fact.
+func (p TemplatePart) IsFactRef() bool {
+	return p.Fact != ""
+}
+
+// IsTemplate reports whether the given action value uses the template syntax,
+// i.e. contains at least one "${...}" fact reference.
+func IsTemplate(value string) bool {
+	return strings.Contains(value, "${")
+}
+
+// ParseTemplate splits a templated string into literal text and fact references.
+//
+// Fact references are written as ${fact} or ${fact|format}. The format is either
+// a single printf-style verb, one of %f, %g, %e, %s, %v or %t with optional
+// flags, width and precision (e.g. "%.1f" for numbers), or a pair of labels
+// separated by '/' used for booleans (e.g. "on/off"). A literal '$' is
+// written as "$$".
+func ParseTemplate(template string) ([]TemplatePart, error) {
+	var parts []TemplatePart
+	var literal strings.Builder
+
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, TemplatePart{Literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '$' || i+1 >= len(template) {
+			literal.WriteByte(c)
+			continue
+		}
+
+		switch template[i+1] {
+		case '$':
+			literal.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(template[i+2:], '}')
+			if end < 0 {
+				return nil, logging.NewError(logging.ErrorTypeCompile, "Unterminated fact reference in template", nil, map[string]interface{}{"template": template})
+			}
+			ref := template[i+2 : i+2+end]
+			part, err := parseTemplateRef(ref)
+			if err != nil {
+				return nil, err
+			}
+			flushLiteral()
+			parts = append(parts, part)
+			i += 2 + end
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flushLiteral()
+
+	return parts, nil
+}
+
+// parseTemplateRef parses the contents of a ${...} fact reference.
+func parseTemplateRef(ref string) (TemplatePart, error) {
+	fact, format, _ := strings.Cut(ref, "|")
+	fact = strings.TrimSpace(fact)
+	if fact == "" || !isValidFactName(fact) {
+		return TemplatePart{}, logging.NewError(logging.ErrorTypeCompile, "Invalid fact reference in template", nil, map[string]interface{}{"reference": ref})
+	}
+	if format != "" && !isTemplateFormatValid(format) {
+		return TemplatePart{}, logging.NewError(logging.ErrorTypeCompile, "Unsupported template format", nil, map[string]interface{}{"reference": ref, "format": format})
+	}
+	return TemplatePart{Fact: fact, Format: format}, nil
+}
+
+// templateVerb matches a single printf-style verb, with optional flags, width
+// and precision. The verbs format fact values of one type: f, g and e
+// numbers, s strings and t bools, while v formats any value. The runtime
+// formats a value of another type than its verb's without the verb.
+var templateVerb = regexp.MustCompile(`^%[-+# 0]*[0-9]*(\.[0-9]*)?[fgestv]$`)
+
+// isTemplateFormatValid checks that a format is either a single printf-style
+// verb or a pair of boolean labels.
+func isTemplateFormatValid(format string) bool {
+	if strings.HasPrefix(format, "%") {
+		return templateVerb.MatchString(format)
+	}
+	trueLabel, falseLabel, ok := strings.Cut(format, "/")
+	return ok && !strings.Contains(falseLabel, "/") && (trueLabel != "" || falseLabel != "")
+}
+
+// TemplateFacts returns the facts referenced by the given template parts, in
+// order of first appearance.
+func TemplateFacts(parts []TemplatePart) []string {
+	seen := make(map[string]struct{})
+	var facts []string
+	for _, part := range parts {
+		if !part.IsFactRef() {
+			continue
+		}
+		if _, ok := seen[part.Fact]; !ok {
+			seen[part.Fact] = struct{}{}
+			facts = append(facts, part.Fact)
+		}
+	}
+	return facts
+}
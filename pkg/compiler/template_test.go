@@ -0,0 +1,95 @@
+// rex/pkg/compiler/template_test.go
+
+package compiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTemplate(t *testing.T) {
+	assert.True(t, IsTemplate("Temp is ${weather:temperature}C"))
+	assert.False(t, IsTemplate("plain value"))
+	assert.False(t, IsTemplate("{calculate_heat_index}"))
+}
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected []TemplatePart
+	}{
+		{
+			name:     "Literal and references",
+			template: "Temp is ${weather:temperature}C at ${weather:station}",
+			expected: []TemplatePart{
+				{Literal: "Temp is "},
+				{Fact: "weather:temperature"},
+				{Literal: "C at "},
+				{Fact: "weather:station"},
+			},
+		},
+		{
+			name:     "Number format",
+			template: "${weather:temperature|%.1f}",
+			expected: []TemplatePart{{Fact: "weather:temperature", Format: "%.1f"}},
+		},
+		{
+			name:     "Padded format",
+			template: "${zone:name|%-8s} ${weather:pressure|%+08.2e}",
+			expected: []TemplatePart{{Fact: "zone:name", Format: "%-8s"}, {Literal: " "}, {Fact: "weather:pressure", Format: "%+08.2e"}},
+		},
+		{
+			name:     "Boolean labels",
+			template: "Fan ${system:fan_on|on/off}",
+			expected: []TemplatePart{{Literal: "Fan "}, {Fact: "system:fan_on", Format: "on/off"}},
+		},
+		{
+			name:     "Escaped dollar",
+			template: "Cost $$${energy:cost}",
+			expected: []TemplatePart{{Literal: "Cost $"}, {Fact: "energy:cost"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := ParseTemplate(tt.template)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, parts)
+		})
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		template       string
+		expectedErrMsg string
+	}{
+		{"Unterminated reference", "Temp is ${weather:temperature", "Unterminated fact reference"},
+		{"Empty reference", "Temp is ${}", "Invalid fact reference"},
+		{"Invalid fact name", "Temp is ${weather temperature}", "Invalid fact reference"},
+		{"Unsupported format", "Temp is ${weather:temperature|round}", "Unsupported template format"},
+		{"Unsupported verb", "Temp is ${weather:temperature|%d}", "Unsupported template format"},
+		{"Hex verb", "Temp is ${weather:temperature|%x}", "Unsupported template format"},
+		{"Several verbs", "Temp is ${weather:temperature|%s %s}", "Unsupported template format"},
+		{"Text around verb", "Temp is ${weather:temperature|%.1f C}", "Unsupported template format"},
+		{"Literal percent", "Temp is ${weather:temperature|%%}", "Unsupported template format"},
+		{"Bare percent", "Temp is ${weather:temperature|%}", "Unsupported template format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTemplate(tt.template)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expectedErrMsg)
+		})
+	}
+}
+
+func TestTemplateFacts(t *testing.T) {
+	parts, err := ParseTemplate("${a:x} and ${b:y} and ${a:x|%.2f}")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:x", "b:y"}, TemplateFacts(parts))
+}
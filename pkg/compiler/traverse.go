@@ -126,6 +126,15 @@ func getNextLabel(prefix string) string {
 	return label
 }
 
+// resetLabels restarts the numbering of labels. Jumps are resolved within
+// each rule, so numbering restarts for every rule, which keeps label numbers
+// within the three digits a label has room for in the bytecode.
+func resetLabels() {
+	labelCounter = 0
+	usedLabels = map[string]bool{}
+	availableLabels = []string{}
+}
+
 // releaseLabel releases a label back to the pool of available labels.
 func releaseLabel(label string) {
 	if _, exists := usedLabels[label]; exists {
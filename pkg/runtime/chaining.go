@@ -0,0 +1,152 @@
+// rex/pkg/runtime/chaining.go
+
+package runtime
+
+import "encoding/json"
+
+// DefaultMaxChainDepth is the chain depth engines start with.
+const DefaultMaxChainDepth = 10
+
+// DefaultMaxCausationDepth is the causation depth engines start with.
+const DefaultMaxCausationDepth = 32
+
+// causation records why a fact update happened: the external fact update at
+// the root of the chain and the rules that fired, in order, to produce it.
+type causation struct {
+	root  string
+	rules []string
+}
+
+// then returns the causation of a write made by a rule fired by an update
+// with this causation.
+func (c causation) then(ruleName string) causation {
+	rules := make([]string, len(c.rules), len(c.rules)+1)
+	copy(rules, c.rules)
+	return causation{root: c.root, rules: append(rules, ruleName)}
+}
+
+// factWrite is a fact written by an action, along with the causation of the
+// write.
+type factWrite struct {
+	fact  string
+	cause causation
+}
+
+// evaluation is the state of evaluating the rules for one fact update: its
+// causation, the rule being evaluated and the facts the rules wrote so far.
+type evaluation struct {
+	cause  causation
+	rule   string
+	writes []factWrite
+	// chained is set when the facts the rules write will be chained
+	// in-process, so their echoes from the store are only applied
+	chained bool
+
+	// state is the state of the rule being evaluated
+	state ruleState
+}
+
+// recentWrite is the last value the engine wrote to a fact, kept until the
+// store publishes it back.
+type recentWrite struct {
+	value   string
+	cause   causation
+	chained bool
+}
+
+// expectEcho remembers the causation of a write an action is about to make,
+// and whether it will be chained, for when the store publishes it back. It
+// must be called before the write reaches the store, since the echo can be
+// taken in before the evaluation that made the write ends. Writes made
+// outside of an evaluation, when ev is nil, are not remembered.
+func (e *Engine) expectEcho(ev *evaluation, factName string, value interface{}) {
+	if ev == nil {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	e.recentMu.Lock()
+	defer e.recentMu.Unlock()
+	if e.recentWrites == nil {
+		e.recentWrites = make(map[string]recentWrite)
+	}
+	e.recentWrites[factName] = recentWrite{value: string(data), cause: ev.cause.then(ev.rule), chained: ev.chained}
+}
+
+// forgetEcho forgets the write of a fact expected to be published back, when
+// the write failed or was skipped.
+func (e *Engine) forgetEcho(factName string) {
+	e.recentMu.Lock()
+	defer e.recentMu.Unlock()
+	delete(e.recentWrites, factName)
+}
+
+// recordWrite notes a fact written by an action while rules are being
+// evaluated for an update, so the rules depending on it can be chained.
+// Writes made outside of an evaluation, when ev is nil, are not recorded.
+func (e *Engine) recordWrite(ev *evaluation, factName string) {
+	if ev == nil {
+		return
+	}
+	ev.writes = append(ev.writes, factWrite{fact: factName, cause: ev.cause.then(ev.rule)})
+}
+
+// attributeUpdate looks up the causation of a fact update received from the
+// store. If the update is the echo of one of the engine's own writes, it
+// carries the causation of that write, and chained reports whether the write
+// was already evaluated in-process. Any other update starts a new chain. Any
+// update for the fact clears the record, so only an update carrying the same
+// value is attributed to the write.
+func (e *Engine) attributeUpdate(factName string, value interface{}) (cause causation, chained bool) {
+	e.recentMu.Lock()
+	write, ok := e.recentWrites[factName]
+	delete(e.recentWrites, factName)
+	e.recentMu.Unlock()
+
+	fresh := causation{root: factName}
+	if !ok {
+		return fresh, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		e.log().Debug().Err(err).Str("factName", factName).Msg("Failed to encode received fact value")
+		return fresh, false
+	}
+	if string(data) != write.value {
+		return fresh, false
+	}
+	return write.cause, write.chained
+}
+
+// runawayChain reports whether evaluating rules for an update with the given
+// causation would fire more than MaxCausationDepth rules in a row, logging the
+// chain of rules that led to the update if so.
+func (e *Engine) runawayChain(factName string, cause causation) bool {
+	if e.MaxCausationDepth <= 0 || len(cause.rules) < e.MaxCausationDepth {
+		return false
+	}
+	e.log().Error().
+		Str("factName", factName).
+		Str("rootFact", cause.root).
+		Strs("rules", cause.rules).
+		Int("maxCausationDepth", e.MaxCausationDepth).
+		Msg("Runaway rule chain detected, not evaluating rules for the update; check the ruleset for rules that trigger each other in a loop")
+	return true
+}
+
+// uniqueWrites returns the writes with duplicate facts removed, keeping the
+// first write of each fact.
+func uniqueWrites(writes []factWrite) []factWrite {
+	seen := make(map[string]struct{}, len(writes))
+	var unique []factWrite
+	for _, write := range writes {
+		if _, ok := seen[write.fact]; !ok {
+			seen[write.fact] = struct{}{}
+			unique = append(unique, write)
+		}
+	}
+	return unique
+}
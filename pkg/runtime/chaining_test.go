@@ -0,0 +1,227 @@
+// rex/pkg/runtime/chaining_test.go
+
+package runtime
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// chainRule returns a rule that writes `to` when `from` is greater than zero.
+func chainRule(name, from, to string, value interface{}) compiler.Rule {
+	return compiler.Rule{
+		Name: name,
+		Conditions: compiler.ConditionGroup{
+			All: []*compiler.ConditionOrGroup{
+				{Fact: from, Operator: "GT", Value: 0.0},
+			},
+		},
+		Actions: []compiler.Action{
+			{Type: "updateStore", Target: to, Value: value},
+		},
+	}
+}
+
+func TestChainingDepth(t *testing.T) {
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			chainRule("step1", "chain:a", "chain:b", 1.0),
+			chainRule("step2", "chain:b", "chain:c", 1.0),
+			chainRule("step3", "chain:c", "chain:d", 1.0),
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		maxChainDepth int
+		written       []string
+		notWritten    []string
+	}{
+		{"Default", DefaultMaxChainDepth, []string{"chain:b", "chain:c", "chain:d"}, nil},
+		{"Limited", 1, []string{"chain:b", "chain:c"}, []string{"chain:d"}},
+		{"Disabled", 0, []string{"chain:b"}, []string{"chain:c", "chain:d"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, redisStore := setupMiniredis(t)
+			defer s.Close()
+
+			filename := createTestBytecodeFile(t, ruleset)
+			defer os.Remove(filename)
+
+			engine, err := NewEngineFromFile(filename, redisStore)
+			assert.NoError(t, err)
+			engine.MaxChainDepth = tc.maxChainDepth
+
+			engine.ProcessFactUpdate("chain:a", 1.0)
+
+			for _, fact := range tc.written {
+				assert.True(t, s.Exists(fact), "expected %s to be written", fact)
+			}
+			for _, fact := range tc.notWritten {
+				assert.False(t, s.Exists(fact), "expected %s not to be written", fact)
+			}
+		})
+	}
+}
+
+func TestChainingOrder(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// The first rule writes two facts; the rules chained from them run in
+	// write order, so the rule for the second fact has the last word
+	first := chainRule("fan_out", "chain:start", "chain:left", 1.0)
+	first.Actions = append(first.Actions, compiler.Action{Type: "updateStore", Target: "chain:right", Value: 1.0})
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			chainRule("from_right", "chain:right", "chain:last", "right"),
+			chainRule("from_left", "chain:left", "chain:last", "left"),
+			first,
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		engine.ProcessFactUpdate("chain:start", 1.0)
+
+		last, err := s.Get("chain:last")
+		assert.NoError(t, err)
+		assert.Equal(t, `"right"`, last)
+	}
+}
+
+func TestChainingKeepsFactRuleIndex(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// Rule "needs_b" depends on a fact that is missing from the store and
+	// gets pruned; pruning must not modify the fact rule index
+	needsB := chainRule("needs_b", "chain:a", "chain:x", 1.0)
+	needsB.Conditions.All = append(needsB.Conditions.All, &compiler.ConditionOrGroup{Fact: "chain:missing", Operator: "GT", Value: 0.0})
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			needsB,
+			chainRule("plain", "chain:a", "chain:y", 1.0),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	before := append([]string(nil), engine.factRuleIndex["chain:a"]...)
+
+	engine.ProcessFactUpdate("chain:a", 1.0)
+	engine.ProcessFactUpdate("chain:a", 2.0)
+
+	assert.Equal(t, before, engine.factRuleIndex["chain:a"])
+	assert.True(t, s.Exists("chain:y"))
+	assert.False(t, s.Exists("chain:x"))
+}
+
+func TestCausationDepth(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			chainRule("step1", "chain:a", "chain:b", 1.0),
+			chainRule("step2", "chain:b", "chain:c", 1.0),
+			chainRule("step3", "chain:c", "chain:d", 1.0),
+			chainRule("step4", "chain:d", "chain:e", 1.0),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	engine.MaxCausationDepth = 3
+
+	engine.ProcessFactUpdate("chain:a", 1.0)
+
+	// Three rules fire in a row; the fact the third one writes is not evaluated
+	assert.True(t, s.Exists("chain:d"))
+	assert.False(t, s.Exists("chain:e"))
+}
+
+func TestRunawayChainAcrossStore(t *testing.T) {
+	engine := &Engine{Facts: map[string]interface{}{}, MaxCausationDepth: 4}
+
+	// A rule that keeps rewriting its own condition fact, with every write
+	// coming back from the store as a new update
+	cause := causation{root: "counter"}
+	for i := 0; i < 10; i++ {
+		if engine.runawayChain("counter", cause) {
+			assert.Equal(t, 4, i)
+			assert.Equal(t, []string{"bump", "bump", "bump", "bump"}, cause.rules)
+			return
+		}
+		engine.expectEcho(&evaluation{cause: cause, rule: "bump"}, "counter", float64(i))
+
+		var chained bool
+		cause, chained = engine.attributeUpdate("counter", float64(i))
+		assert.False(t, chained)
+	}
+	t.Fatal("runaway chain was not detected")
+}
+
+func TestAttributeUpdate(t *testing.T) {
+	engine := &Engine{Facts: map[string]interface{}{"system:mode": "cooling"}}
+
+	// Nothing was written yet, so the update starts a new chain
+	cause, chained := engine.attributeUpdate("system:mode", "cooling")
+	assert.Equal(t, causation{root: "system:mode"}, cause)
+	assert.False(t, chained)
+
+	write := func(chained bool) {
+		ev := &evaluation{cause: causation{root: "system:temperature"}, rule: "ModeRule", chained: chained}
+		engine.expectEcho(ev, "system:mode", "cooling")
+	}
+
+	// The echo of a write carries its causation, once
+	write(false)
+	cause, chained = engine.attributeUpdate("system:mode", "cooling")
+	assert.Equal(t, causation{root: "system:temperature", rules: []string{"ModeRule"}}, cause)
+	assert.False(t, chained)
+	cause, _ = engine.attributeUpdate("system:mode", "cooling")
+	assert.Equal(t, causation{root: "system:mode"}, cause)
+
+	// The echo of a chained write is recognized
+	write(true)
+	_, chained = engine.attributeUpdate("system:mode", "cooling")
+	assert.True(t, chained)
+
+	// An update with a different value is not an echo, and clears the record
+	write(true)
+	cause, chained = engine.attributeUpdate("system:mode", "heating")
+	assert.Equal(t, causation{root: "system:mode"}, cause)
+	assert.False(t, chained)
+	_, chained = engine.attributeUpdate("system:mode", "cooling")
+	assert.False(t, chained)
+
+	// A write that failed or was skipped is not published back
+	write(true)
+	engine.forgetEcho("system:mode")
+	_, chained = engine.attributeUpdate("system:mode", "cooling")
+	assert.False(t, chained)
+}
+
+func TestUniqueWrites(t *testing.T) {
+	writes := []factWrite{{fact: "b"}, {fact: "a"}, {fact: "b", cause: causation{root: "x"}}, {fact: "c"}}
+	assert.Equal(t, []factWrite{{fact: "b"}, {fact: "a"}, {fact: "c"}}, uniqueWrites(writes))
+	assert.Nil(t, uniqueWrites(nil))
+}
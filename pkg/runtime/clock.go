@@ -0,0 +1,43 @@
+// rex/pkg/runtime/clock.go
+
+package runtime
+
+import "time"
+
+// Clock tells the engine the time and runs functions after a delay. Tests can
+// replace the system clock with WithClock to control when delayed actions run.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function scheduled by a Clock.
+type Timer interface {
+	// Stop prevents the function from running and reports whether it did.
+	Stop() bool
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// now returns the time of the engine's clock.
+func (e *Engine) now() time.Time {
+	return e.clockOrDefault().Now()
+}
+
+// clockOrDefault returns the engine's clock, or the system clock if none is
+// set.
+func (e *Engine) clockOrDefault() Clock {
+	if e.clock == nil {
+		return systemClock{}
+	}
+	return e.clock
+}
@@ -0,0 +1,87 @@
+// rex/pkg/runtime/coalescing.go
+
+package runtime
+
+import "time"
+
+// updateBatch is a set of updates merged per fact. The last update of a fact
+// replaces earlier ones but keeps the position of the first.
+type updateBatch struct {
+	updates []factUpdate
+	index   map[string]int
+}
+
+func (b *updateBatch) add(update factUpdate) {
+	if i, ok := b.index[update.fact]; ok {
+		b.updates[i] = update
+		return
+	}
+	if b.index == nil {
+		b.index = make(map[string]int)
+	}
+	b.index[update.fact] = len(b.updates)
+	b.updates = append(b.updates, update)
+}
+
+// collectBatch merges first and the updates that arrive within CoalesceWindow
+// after it. It stops early if the channel is closed.
+func (e *Engine) collectBatch(first factUpdate, updates <-chan factUpdate) []factUpdate {
+	var batch updateBatch
+	batch.add(first)
+
+	timer := time.NewTimer(e.CoalesceWindow)
+	defer timer.Stop()
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return batch.updates
+			}
+			batch.add(update)
+		case <-timer.C:
+			return batch.updates
+		}
+	}
+}
+
+// applyBatch applies a batch of updates to different facts and evaluates each
+// rule they affect once, in execution order, with a single query for the facts
+// the rules depend on. A rule's writes are attributed to the first update in
+// the batch that triggered it. The rules for the facts the rules write are
+// chained as usual.
+func (e *Engine) applyBatch(updates []factUpdate) {
+	if len(updates) == 1 {
+		e.applyUpdate(updates[0])
+		return
+	}
+	e.log().Debug().Int("count", len(updates)).Msg("Processing batch of fact updates")
+
+	e.programMu.RLock()
+	defer e.programMu.RUnlock()
+
+	updated := make(map[string]struct{}, len(updates))
+	causes := make(map[string]causation)
+	var ruleNames []string
+	for _, update := range updates {
+		e.setFact(update.fact, normalizeFactValue(update.value))
+		updated[update.fact] = struct{}{}
+		if update.chained || e.runawayChain(update.fact, update.cause) {
+			continue
+		}
+		for _, ruleName := range e.factRuleIndex[update.fact] {
+			if _, ok := causes[ruleName]; !ok {
+				causes[ruleName] = update.cause
+				ruleNames = append(ruleNames, ruleName)
+			}
+		}
+	}
+	if len(ruleNames) == 0 {
+		return
+	}
+	e.sortByExecutionOrder(ruleNames)
+
+	writes := e.evaluateRules(ruleNames, updated, func(ruleName string) causation {
+		return causes[ruleName]
+	}, e.MaxChainDepth > 0)
+	e.chainWrites(uniqueWrites(writes), 1)
+}
@@ -0,0 +1,96 @@
+// rex/pkg/runtime/coalescing_test.go
+
+package runtime
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// countingStore is a Redis store that counts fact queries and writes.
+type countingStore struct {
+	*store.RedisStore
+	mu     sync.Mutex
+	mgets  [][]string
+	writes int
+}
+
+func (s *countingStore) MGetFacts(keys ...string) (map[string]interface{}, error) {
+	s.mu.Lock()
+	s.mgets = append(s.mgets, keys)
+	s.mu.Unlock()
+	return s.RedisStore.MGetFacts(keys...)
+}
+
+func (s *countingStore) SetAndPublishFact(key string, value interface{}) error {
+	s.mu.Lock()
+	s.writes++
+	s.mu.Unlock()
+	return s.RedisStore.SetAndPublishFact(key, value)
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+	s.Set("pressure", "1013")
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name: "muggy",
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 30.0},
+						{Fact: "humidity", Operator: "GT", Value: 80.0},
+						{Fact: "pressure", Operator: "GT", Value: 1000.0},
+					},
+				},
+				Actions: []compiler.Action{
+					{Type: "updateStore", Target: "alerts:muggy", Value: true},
+				},
+			},
+		},
+	}
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	counting := &countingStore{RedisStore: redisStore}
+	engine, err := NewEngineFromFile(filename, counting)
+	assert.NoError(t, err)
+	engine.CoalesceWindow = 100 * time.Millisecond
+
+	engine.StartWorkers(1)
+	engine.Submit("temperature", 10.0)
+	engine.Submit("temperature", 20.0)
+	engine.Submit("humidity", 90.0)
+	engine.Submit("temperature", 35.0)
+	engine.StopWorkers()
+
+	// The updates were merged, and the rule evaluated once with the last
+	// temperature and a single query for the fact it also depends on
+	temperature, _ := engine.Fact("temperature")
+	assert.Equal(t, 35.0, temperature)
+	muggy, _ := engine.Fact("alerts:muggy")
+	assert.Equal(t, true, muggy)
+	assert.Equal(t, [][]string{{"pressure"}}, counting.mgets)
+	assert.Equal(t, 1, counting.writes)
+}
+
+func TestUpdateBatch(t *testing.T) {
+	var batch updateBatch
+	batch.add(factUpdate{fact: "temperature", value: 10.0})
+	batch.add(factUpdate{fact: "humidity", value: 50.0})
+	batch.add(factUpdate{fact: "temperature", value: 20.0, chained: true})
+
+	assert.Equal(t, []factUpdate{
+		{fact: "temperature", value: 20.0, chained: true},
+		{fact: "humidity", value: 50.0},
+	}, batch.updates)
+}
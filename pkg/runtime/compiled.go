@@ -0,0 +1,340 @@
+// rex/pkg/runtime/compiled.go
+
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// ExecutionMode decides how an engine runs the instructions of its rules.
+type ExecutionMode string
+
+const (
+	// ExecutionInterpreted interprets the decoded instructions of a rule on
+	// every evaluation.
+	ExecutionInterpreted ExecutionMode = "interpreted"
+	// ExecutionCompiled compiles every rule into Go closures when the program
+	// is loaded or reloaded, trading load time and memory for faster
+	// evaluation. The closures behave exactly like the interpreter.
+	ExecutionCompiled ExecutionMode = "compiled"
+)
+
+// ParseExecutionMode returns the execution mode with the given name. An empty
+// name selects ExecutionInterpreted.
+func ParseExecutionMode(name string) (ExecutionMode, error) {
+	switch mode := ExecutionMode(name); mode {
+	case "":
+		return ExecutionInterpreted, nil
+	case ExecutionInterpreted, ExecutionCompiled:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown execution mode %q: must be interpreted or compiled", name)
+	}
+}
+
+// step runs a block of a compiled rule and returns the index of the
+// instruction to run next.
+type step func(e *Engine, s *ruleState) (int, error)
+
+// compiledRule is a rule compiled into closures, indexed like its decoded
+// instructions. The instruction that starts a block has the block's step;
+// the other instructions of a block have none, since no jump targets them.
+type compiledRule []step
+
+// compileRules compiles every decoded rule of the program.
+func (p *program) compileRules() {
+	p.compiled = make([]compiledRule, len(p.rules))
+	for i := range p.rules {
+		p.compiled[i] = p.compileRule(&p.rules[i])
+	}
+}
+
+// compileRule compiles a rule into steps. A condition, which loads a fact and
+// a constant, compares them and jumps, or evaluates a shared condition and
+// jumps, becomes a single step with the constant and comparison built in, and
+// so does an action from ACTION_START to ACTION_END. RULE_END ends the rule directly, and any other instruction
+// runs through the interpreter.
+func (p *program) compileRule(rule *decodedRule) compiledRule {
+	targets := make(map[int]bool)
+	for _, in := range rule.instructions {
+		if in.opcode == compiler.JUMP_IF_FALSE || in.opcode == compiler.JUMP_IF_TRUE {
+			targets[in.target] = true
+		}
+	}
+	// entered reports whether execution can enter instructions from..to other
+	// than at from
+	entered := func(from, to int) bool {
+		for i := from + 1; i <= to; i++ {
+			if targets[i] {
+				return true
+			}
+		}
+		return false
+	}
+
+	steps := make(compiledRule, len(rule.instructions))
+	for pc := 0; pc < len(rule.instructions); {
+		if end, ok := p.conditionBlock(rule, pc); ok && !entered(pc, end) {
+			steps[pc] = p.compileCondition(rule, pc)
+			pc = end + 1
+			continue
+		}
+		if end, ok := actionBlock(rule, pc); ok && !entered(pc, end) {
+			steps[pc] = compileAction(rule, pc, end)
+			pc = end + 1
+			continue
+		}
+		if rule.instructions[pc].opcode == compiler.RULE_END {
+			steps[pc] = endRule(len(rule.instructions))
+		} else {
+			steps[pc] = interpret(pc)
+		}
+		pc++
+	}
+	return steps
+}
+
+// interpret returns a step that runs the instruction at pc through the
+// interpreter.
+func interpret(pc int) step {
+	return func(e *Engine, s *ruleState) (int, error) {
+		return e.execute(s, pc)
+	}
+}
+
+// endRule returns a step that ends the rule, like RULE_END.
+func endRule(end int) step {
+	return func(e *Engine, s *ruleState) (int, error) {
+		return end, e.endRule(s)
+	}
+}
+
+// conditionBlock reports whether the instructions at pc are a condition: a
+// fact load, a constant load, a comparison and a jump, or a shared condition
+// and a jump. It returns the index of the jump.
+func (p *program) conditionBlock(rule *decodedRule, pc int) (int, bool) {
+	if rule.instructions[pc].opcode == compiler.CONDITION_NODE {
+		if pc+1 >= len(rule.instructions) {
+			return 0, false
+		}
+		if jump := rule.instructions[pc+1]; jump.opcode != compiler.JUMP_IF_FALSE && jump.opcode != compiler.JUMP_IF_TRUE {
+			return 0, false
+		}
+		return pc + 1, true
+	}
+	if pc+3 >= len(rule.instructions) {
+		return 0, false
+	}
+	load, constant, comparison, jump := rule.instructions[pc], rule.instructions[pc+1], rule.instructions[pc+2], rule.instructions[pc+3]
+	switch load.opcode {
+	case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL:
+	default:
+		return 0, false
+	}
+	switch constant.opcode {
+	case compiler.LOAD_CONST_FLOAT, compiler.LOAD_CONST_STRING, compiler.LOAD_CONST_BOOL:
+	default:
+		return 0, false
+	}
+	if comparator(comparison.opcode, constant.value) == nil {
+		return 0, false
+	}
+	if jump.opcode != compiler.JUMP_IF_FALSE && jump.opcode != compiler.JUMP_IF_TRUE {
+		return 0, false
+	}
+	return pc + 3, true
+}
+
+// compileCondition compiles the condition at pc into a step.
+func (p *program) compileCondition(rule *decodedRule, pc int) step {
+	if rule.instructions[pc].opcode == compiler.CONDITION_NODE {
+		node := rule.instructions[pc].node
+		jumpIf := rule.instructions[pc+1].opcode == compiler.JUMP_IF_TRUE
+		target := rule.instructions[pc+1].target
+		next := pc + 2
+
+		return func(e *Engine, s *ruleState) (int, error) {
+			s.comparisonResult = e.evaluateCondition(node)
+			if s.comparisonResult {
+				s.ruleTriggered = true
+			}
+			if s.comparisonResult == jumpIf {
+				return target, nil
+			}
+			return next, nil
+		}
+	}
+
+	fact := p.facts[rule.instructions[pc].slot]
+	constValue := rule.instructions[pc+1].value
+	compare := comparator(rule.instructions[pc+2].opcode, constValue)
+	jumpIf := rule.instructions[pc+3].opcode == compiler.JUMP_IF_TRUE
+	target := rule.instructions[pc+3].target
+	next := pc + 4
+
+	return func(e *Engine, s *ruleState) (int, error) {
+		s.factValue, _ = e.Fact(fact)
+		s.constValue = constValue
+		s.comparisonResult = compare(e, s.factValue)
+		if s.comparisonResult {
+			s.ruleTriggered = true
+		}
+		if s.comparisonResult == jumpIf {
+			return target, nil
+		}
+		return next, nil
+	}
+}
+
+// comparator returns a function comparing a fact value against a constant
+// with a comparison opcode. Values of an unexpected type, and nil, are left to
+// Engine.compare, so they are handled exactly as the interpreter handles
+// them. It returns nil if the opcode is not a comparison of the constant's
+// type.
+func comparator(opcode compiler.Opcode, constValue interface{}) func(e *Engine, factValue interface{}) bool {
+	fallback := func(e *Engine, factValue interface{}) bool {
+		return e.compare(factValue, constValue, opcode)
+	}
+
+	switch c := constValue.(type) {
+	case float64:
+		var holds func(v float64) bool
+		switch opcode {
+		case compiler.EQ_FLOAT:
+			holds = func(v float64) bool { return v == c }
+		case compiler.NEQ_FLOAT:
+			holds = func(v float64) bool { return v != c }
+		case compiler.LT_FLOAT:
+			holds = func(v float64) bool { return v < c }
+		case compiler.LTE_FLOAT:
+			holds = func(v float64) bool { return v <= c }
+		case compiler.GT_FLOAT:
+			holds = func(v float64) bool { return v > c }
+		case compiler.GTE_FLOAT:
+			holds = func(v float64) bool { return v >= c }
+		default:
+			return nil
+		}
+		return func(e *Engine, factValue interface{}) bool {
+			if v, ok := factValue.(float64); ok {
+				return holds(v)
+			}
+			return fallback(e, factValue)
+		}
+
+	case string:
+		var holds func(v string) bool
+		switch opcode {
+		case compiler.EQ_STRING:
+			holds = func(v string) bool { return v == c }
+		case compiler.NEQ_STRING:
+			holds = func(v string) bool { return v != c }
+		case compiler.CONTAINS_STRING:
+			holds = func(v string) bool { return strings.Contains(v, c) }
+		case compiler.NOT_CONTAINS_STRING:
+			holds = func(v string) bool { return !strings.Contains(v, c) }
+		default:
+			return nil
+		}
+		return func(e *Engine, factValue interface{}) bool {
+			if v, ok := factValue.(string); ok {
+				return holds(v)
+			}
+			return fallback(e, factValue)
+		}
+
+	case bool:
+		var holds func(v bool) bool
+		switch opcode {
+		case compiler.EQ_BOOL:
+			holds = func(v bool) bool { return v == c }
+		case compiler.NEQ_BOOL:
+			holds = func(v bool) bool { return v != c }
+		default:
+			return nil
+		}
+		return func(e *Engine, factValue interface{}) bool {
+			if v, ok := factValue.(bool); ok {
+				return holds(v)
+			}
+			return fallback(e, factValue)
+		}
+	}
+	return nil
+}
+
+// actionBlock reports whether the instructions at pc are an action: an
+// ACTION_START, the operands of the action and an ACTION_END. It returns the
+// index of the ACTION_END.
+func actionBlock(rule *decodedRule, pc int) (int, bool) {
+	if rule.instructions[pc].opcode != compiler.ACTION_START {
+		return 0, false
+	}
+	for i := pc + 1; i < len(rule.instructions); i++ {
+		switch rule.instructions[i].opcode {
+		case compiler.ACTION_END:
+			return i, true
+		case compiler.ACTION_TYPE, compiler.ACTION_TARGET,
+			compiler.ACTION_VALUE_FLOAT, compiler.ACTION_VALUE_STRING, compiler.ACTION_VALUE_BOOL,
+			compiler.ACTION_VALUE_ARRAY, compiler.ACTION_VALUE_OBJECT, compiler.ACTION_VALUE_TEMPLATE,
+			compiler.SCRIPT_CALL, compiler.ACTION_DELAY, compiler.ACTION_ONLY_IF_CHANGED:
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// compileAction compiles the action from start to end into a step. The
+// action's type, target, delay and onlyIfChanged override are fixed, so only
+// its value is computed when the step runs.
+func compileAction(rule *decodedRule, start, end int) step {
+	var template compiler.Action
+	var delay *instruction
+	var onlyIfChanged *instruction
+	var value *instruction
+	for i := start + 1; i < end; i++ {
+		in := &rule.instructions[i]
+		switch in.opcode {
+		case compiler.ACTION_TYPE:
+			template.Type = in.str
+		case compiler.ACTION_TARGET:
+			template.Target = in.str
+		case compiler.ACTION_DELAY:
+			delay = in
+		case compiler.ACTION_ONLY_IF_CHANGED:
+			onlyIfChanged = in
+		default:
+			value = in
+		}
+	}
+	next := end + 1
+
+	return func(e *Engine, s *ruleState) (int, error) {
+		s.startAction()
+		s.action.Type = template.Type
+		s.action.Target = template.Target
+		if value != nil {
+			v, err := e.actionValue(s, value)
+			if err != nil {
+				return 0, err
+			}
+			s.action.Value = v
+		}
+		if onlyIfChanged != nil {
+			flag := onlyIfChanged.flag
+			s.action.OnlyIfChanged = &flag
+		}
+		if delay != nil {
+			s.actionDelay = delay.delay
+			s.cancelIfFalse = delay.flag
+		}
+		if err := e.endAction(s); err != nil {
+			return 0, err
+		}
+		return next, nil
+	}
+}
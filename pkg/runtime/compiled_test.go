@@ -0,0 +1,275 @@
+// rex/pkg/runtime/compiled_test.go
+
+package runtime
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+func TestParseExecutionMode(t *testing.T) {
+	for name, expected := range map[string]ExecutionMode{
+		"":            ExecutionInterpreted,
+		"interpreted": ExecutionInterpreted,
+		"compiled":    ExecutionCompiled,
+	} {
+		mode, err := ParseExecutionMode(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, mode)
+	}
+
+	_, err := ParseExecutionMode("jit")
+	assert.Error(t, err)
+}
+
+// loadTestProgram compiles and loads a ruleset.
+func loadTestProgram(t *testing.T, ruleset *compiler.Ruleset) *Program {
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+	return program
+}
+
+// randomRuleset generates rules over a small set of float, string and bool
+// facts, so that conditions overlap and actions chain into other rules.
+type randomRuleset struct {
+	rng     *rand.Rand
+	floats  []string
+	strings []string
+	bools   []string
+}
+
+func newRandomRuleset(seed int64) *randomRuleset {
+	return &randomRuleset{
+		rng:     rand.New(rand.NewSource(seed)),
+		floats:  []string{"temperature", "humidity", "pressure"},
+		strings: []string{"zone:mode", "zone:state"},
+		bools:   []string{"door:open", "alarm:armed"},
+	}
+}
+
+func (g *randomRuleset) pick(names []string) string {
+	return names[g.rng.Intn(len(names))]
+}
+
+func (g *randomRuleset) floatValue() float64 {
+	return float64(g.rng.Intn(10) * 10)
+}
+
+func (g *randomRuleset) stringValue() string {
+	return []string{"idle", "heating", "cooling", "alarm"}[g.rng.Intn(4)]
+}
+
+func (g *randomRuleset) condition(depth int) *compiler.ConditionOrGroup {
+	if depth > 0 && g.rng.Intn(3) == 0 {
+		group := &compiler.ConditionOrGroup{}
+		children := make([]*compiler.ConditionOrGroup, 1+g.rng.Intn(3))
+		for i := range children {
+			children[i] = g.condition(depth - 1)
+		}
+		if g.rng.Intn(2) == 0 {
+			group.All = children
+		} else {
+			group.Any = children
+		}
+		return group
+	}
+
+	switch g.rng.Intn(3) {
+	case 0:
+		operators := []string{"EQ", "NEQ", "LT", "LTE", "GT", "GTE"}
+		return &compiler.ConditionOrGroup{Fact: g.pick(g.floats), Operator: g.pick(operators), Value: g.floatValue()}
+	case 1:
+		operators := []string{"EQ", "NEQ", "CONTAINS", "NOT_CONTAINS"}
+		value := g.stringValue()
+		if g.rng.Intn(2) == 0 {
+			value = value[:2]
+		}
+		return &compiler.ConditionOrGroup{Fact: g.pick(g.strings), Operator: g.pick(operators), Value: value}
+	default:
+		operators := []string{"EQ", "NEQ"}
+		return &compiler.ConditionOrGroup{Fact: g.pick(g.bools), Operator: g.pick(operators), Value: g.rng.Intn(2) == 0}
+	}
+}
+
+func (g *randomRuleset) action(index int) compiler.Action {
+	action := compiler.Action{Type: "updateStore", Target: fmt.Sprintf("out:%d", index)}
+	switch g.rng.Intn(8) {
+	case 0:
+		action.Value = g.floatValue()
+	case 1:
+		action.Value = g.stringValue()
+	case 2:
+		action.Value = g.rng.Intn(2) == 0
+	case 3:
+		action.Value = fmt.Sprintf("${%s} in ${%s}", g.pick(g.floats), g.pick(g.strings))
+	case 4:
+		action.Value = []interface{}{g.floatValue(), g.stringValue()}
+	case 5:
+		action.Value = map[string]interface{}{"level": g.floatValue(), "mode": g.stringValue()}
+	case 6:
+		// Chain into the conditions of other rules
+		action.Target = g.pick(g.floats)
+		action.Value = g.floatValue()
+	default:
+		action.Target = g.pick(g.strings)
+		action.Value = g.stringValue()
+	}
+	if g.rng.Intn(4) == 0 {
+		onlyIfChanged := g.rng.Intn(2) == 0
+		action.OnlyIfChanged = &onlyIfChanged
+	}
+	return action
+}
+
+func (g *randomRuleset) ruleset(rules int) *compiler.Ruleset {
+	ruleset := &compiler.Ruleset{}
+	for i := 0; i < rules; i++ {
+		rule := compiler.Rule{
+			Name:     fmt.Sprintf("rule_%d", i),
+			Priority: g.rng.Intn(5),
+			Atomic:   g.rng.Intn(4) == 0,
+		}
+		conditions := make([]*compiler.ConditionOrGroup, 1+g.rng.Intn(3))
+		for j := range conditions {
+			conditions[j] = g.condition(2)
+		}
+		if g.rng.Intn(2) == 0 {
+			rule.Conditions.All = conditions
+		} else {
+			rule.Conditions.Any = conditions
+		}
+		for j := 0; j < 1+g.rng.Intn(3); j++ {
+			rule.Actions = append(rule.Actions, g.action(i))
+		}
+		if g.rng.Intn(6) == 0 {
+			rule.Actions[0].Target = fmt.Sprintf("out:%d", i)
+			rule.Actions[0].Value = "{scaled}"
+			rule.Scripts = map[string]compiler.Script{
+				"scaled": {Params: []string{"temperature"}, Body: "return temperature * 2;"},
+			}
+		}
+		ruleset.Rules = append(ruleset.Rules, rule)
+	}
+	return ruleset
+}
+
+// updates returns an update of every fact, followed by random updates of
+// single facts. Rules are skipped until the facts they depend on are set, so
+// every fact is set first.
+func (g *randomRuleset) updates(n int) []factUpdate {
+	var updates []factUpdate
+	for _, fact := range g.floats {
+		updates = append(updates, factUpdate{fact: fact, value: g.floatValue()})
+	}
+	for _, fact := range g.strings {
+		updates = append(updates, factUpdate{fact: fact, value: g.stringValue()})
+	}
+	for _, fact := range g.bools {
+		updates = append(updates, factUpdate{fact: fact, value: g.rng.Intn(2) == 0})
+	}
+	for i := 0; i < n; i++ {
+		fact, value := g.update()
+		updates = append(updates, factUpdate{fact: fact, value: value})
+	}
+	return updates
+}
+
+// mismatchedUpdates returns n random updates of the facts with values of any
+// type, so conditions also compare facts of another type than their value.
+func (g *randomRuleset) mismatchedUpdates(n int) []factUpdate {
+	facts := append(append(append([]string(nil), g.floats...), g.strings...), g.bools...)
+	updates := make([]factUpdate, n)
+	for i := range updates {
+		_, value := g.update()
+		updates[i] = factUpdate{fact: g.pick(facts), value: value}
+	}
+	return updates
+}
+
+// update returns a random update of one of the facts.
+func (g *randomRuleset) update() (string, interface{}) {
+	switch g.rng.Intn(3) {
+	case 0:
+		return g.pick(g.floats), g.floatValue()
+	case 1:
+		return g.pick(g.strings), g.stringValue()
+	default:
+		return g.pick(g.bools), g.rng.Intn(2) == 0
+	}
+}
+
+// TestCompiledMatchesInterpreted runs random rulesets in both execution modes
+// and checks that every update leaves the same store behind.
+func TestCompiledMatchesInterpreted(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			g := newRandomRuleset(seed)
+			program := loadTestProgram(t, g.ruleset(5+g.rng.Intn(20)))
+
+			interpretedRedis, interpretedStore := setupMiniredis(t)
+			defer interpretedRedis.Close()
+			compiledRedis, compiledStore := setupMiniredis(t)
+			defer compiledRedis.Close()
+
+			// Actions chain into each other's conditions, so keep loops short
+			opts := []Option{WithLogger(zerolog.Nop()), WithMaxChainDepth(3)}
+			interpreted, err := NewEngine(program, interpretedStore, opts...)
+			require.NoError(t, err)
+			compiled, err := NewEngine(program, compiledStore, append(opts, WithExecutionMode(ExecutionCompiled))...)
+			require.NoError(t, err)
+
+			for i, update := range append(g.updates(50), g.mismatchedUpdates(25)...) {
+				// Publishers write facts to the store before announcing them
+				require.NoError(t, interpretedStore.SetFact(update.fact, update.value))
+				require.NoError(t, compiledStore.SetFact(update.fact, update.value))
+				interpreted.ProcessFactUpdate(update.fact, update.value)
+				compiled.ProcessFactUpdate(update.fact, update.value)
+
+				require.Equal(t, interpretedRedis.Dump(), compiledRedis.Dump(), "update %d: %s = %v", i, update.fact, update.value)
+				require.Equal(t, interpreted.RuleErrorCounts(), compiled.RuleErrorCounts(), "update %d: %s = %v", i, update.fact, update.value)
+			}
+			assert.NotEmpty(t, interpretedRedis.Keys())
+		})
+	}
+}
+
+func TestCompiledReload(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	before := loadTestProgram(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("before", 1, "temperature", 0, "result")},
+	})
+	engine, err := NewEngine(before, redisStore, WithExecutionMode(ExecutionCompiled))
+	require.NoError(t, err)
+
+	engine.ProcessFactUpdate("temperature", 25.0)
+	value, err := s.Get("result")
+	require.NoError(t, err)
+	assert.Equal(t, `"before"`, value)
+
+	engine.ReloadProgram(loadTestProgram(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("after", 1, "temperature", 30, "result")},
+	}))
+	assert.Len(t, engine.compiled, 1)
+
+	engine.ProcessFactUpdate("temperature", 20.0)
+	value, err = s.Get("result")
+	require.NoError(t, err)
+	assert.Equal(t, `"before"`, value)
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+	value, err = s.Get("result")
+	require.NoError(t, err)
+	assert.Equal(t, `"after"`, value)
+}
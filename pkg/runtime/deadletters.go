@@ -0,0 +1,40 @@
+// rex/pkg/runtime/deadletters.go
+
+package runtime
+
+import "rgehrsitz/rex/pkg/store"
+
+// deadLetterMessage records a received message that could not be processed.
+func (e *Engine) deadLetterMessage(channel, payload string, err error) {
+	e.addDeadLetter(store.DeadLetter{
+		Kind:    store.DeadLetterMessage,
+		Channel: channel,
+		Payload: payload,
+		Error:   err.Error(),
+	})
+}
+
+// deadLetterWrite records the store writes of a rule's action, or of all
+// actions of an atomic rule, that failed.
+func (e *Engine) deadLetterWrite(ruleName string, updates []store.FactUpdate, err error) {
+	e.addDeadLetter(store.DeadLetter{
+		Kind:    store.DeadLetterAction,
+		Rule:    ruleName,
+		Updates: updates,
+		Error:   err.Error(),
+	})
+}
+
+// addDeadLetter timestamps a dead letter and writes it to DeadLetterKey.
+// Nothing is written when no key is configured.
+func (e *Engine) addDeadLetter(letter store.DeadLetter) {
+	if e.DeadLetterKey == "" {
+		return
+	}
+	letter.Timestamp = e.now()
+	if err := e.store.AddDeadLetter(e.DeadLetterKey, letter); err != nil {
+		e.log().Error().Err(err).Str("kind", letter.Kind).Str("deadLetterError", letter.Error).Msg("Failed to write dead letter")
+		return
+	}
+	e.log().Warn().Str("kind", letter.Kind).Str("key", e.DeadLetterKey).Str("deadLetterError", letter.Error).Msg("Wrote dead letter")
+}
@@ -0,0 +1,156 @@
+// rex/pkg/runtime/deadletters_test.go
+
+package runtime
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// failingWriteStore is a Redis store whose fact writes always fail.
+type failingWriteStore struct {
+	*store.RedisStore
+}
+
+func (s failingWriteStore) SetAndPublishFact(key string, value interface{}) error {
+	return errors.New("connection refused")
+}
+
+func (s failingWriteStore) SetAndPublishFacts(updates []store.FactUpdate) error {
+	return errors.New("connection refused")
+}
+
+func TestFailedWritesDeadLettered(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	atomic := priorityRule("atomic", 2, "temperature", 0, "system:mode")
+	atomic.Atomic = true
+	atomic.Actions = append(atomic.Actions, compiler.Action{Type: "updateStore", Target: "system:fan_speed", Value: 3.0})
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("plain", 1, "temperature", 0, "system:alert"),
+			atomic,
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, failingWriteStore{redisStore})
+	assert.NoError(t, err)
+
+	engine.ProcessFactUpdate("temperature", 30.0)
+
+	letters, err := redisStore.GetDeadLetters(store.DefaultDeadLetterKey)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, store.DeadLetterAction, letters[0].Kind)
+		assert.Equal(t, "plain", letters[0].Rule)
+		assert.Equal(t, []store.FactUpdate{{Key: "system:alert", Value: "plain"}}, letters[0].Updates)
+		assert.Equal(t, "connection refused", letters[0].Error)
+		assert.False(t, letters[0].Timestamp.IsZero())
+
+		// The writes of an atomic rule are dead-lettered together
+		assert.Equal(t, "atomic", letters[1].Rule)
+		assert.Equal(t, []store.FactUpdate{{Key: "system:mode", Value: "atomic"}, {Key: "system:fan_speed", Value: 3.0}}, letters[1].Updates)
+	}
+}
+
+// unpublishedStore is a Redis store whose transactions commit but are never
+// published.
+type unpublishedStore struct {
+	*store.RedisStore
+}
+
+func (s unpublishedStore) SetAndPublishFacts(updates []store.FactUpdate) error {
+	for _, update := range updates {
+		if err := s.SetFact(update.Key, update.Value); err != nil {
+			return err
+		}
+	}
+	return &store.PublishError{Err: errors.New("connection reset")}
+}
+
+func (s unpublishedStore) SetAndPublishFact(key string, value interface{}) error {
+	return s.SetAndPublishFacts([]store.FactUpdate{{Key: key, Value: value}})
+}
+
+func TestUnpublishedCommitNotDeadLettered(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	atomic := priorityRule("atomic", 1, "temperature", 0, "system:mode")
+	atomic.Atomic = true
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{Rules: []compiler.Rule{
+		atomic,
+		priorityRule("plain", 2, "temperature", 0, "system:alert"),
+	}})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, unpublishedStore{redisStore})
+	assert.NoError(t, err)
+	engine.ProcessFactUpdate("temperature", 30.0)
+
+	// The writes took effect, so they are applied locally and not
+	// dead-lettered
+	value, _ := engine.Fact("system:mode")
+	assert.Equal(t, "atomic", value)
+	value, _ = engine.Fact("system:alert")
+	assert.Equal(t, "plain", value)
+	assert.False(t, s.Exists(store.DefaultDeadLetterKey))
+	assert.Empty(t, engine.RuleErrorCounts())
+}
+
+func TestDeadLetteringDisabled(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("plain", 1, "temperature", 0, "system:alert")},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, failingWriteStore{redisStore})
+	assert.NoError(t, err)
+	engine.DeadLetterKey = ""
+
+	engine.ProcessFactUpdate("temperature", 30.0)
+	assert.False(t, s.Exists(store.DefaultDeadLetterKey))
+}
+
+func TestInvalidMessageDeadLettered(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("plain", 1, "temperature", 0, "system:alert")},
+	})
+	defer os.Remove(filename)
+
+	_, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	// Wait for the engine to subscribe before publishing
+	assert.Eventually(t, func() bool {
+		return s.PubSubNumSub("system")["system"] > 0
+	}, time.Second, 10*time.Millisecond)
+	s.Publish("system", "garbage")
+
+	assert.Eventually(t, func() bool {
+		letters, err := redisStore.GetDeadLetters(store.DefaultDeadLetterKey)
+		return err == nil && len(letters) == 1 &&
+			letters[0].Kind == store.DeadLetterMessage &&
+			letters[0].Channel == "system" &&
+			letters[0].Payload == "garbage"
+	}, time.Second, 10*time.Millisecond)
+}
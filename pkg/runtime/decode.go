@@ -0,0 +1,371 @@
+// rex/pkg/runtime/decode.go
+
+package runtime
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// decodedRule is a rule's bytecode decoded at load time, so evaluating the
+// rule does not parse bytes. The opcodes of the rule header are folded into
+// its fields and labels are dropped.
+type decodedRule struct {
+	priority     int
+	atomic       bool
+	instructions []instruction
+
+	// facts are the slots of the facts the rule's conditions load
+	facts []int
+	// dependencies are the facts the rule depends on, from the fact
+	// dependency index
+	dependencies []string
+	// native replaces the rule's conditions, if the program was loaded with
+	// LoadNativeProgram
+	native *nativeRule
+}
+
+// instruction is a decoded bytecode instruction. Fact names are replaced by
+// slots in the program's fact table, constants are decoded and interned, and
+// jumps hold the index of the instruction they jump to.
+type instruction struct {
+	opcode compiler.Opcode
+
+	// slot is the fact table slot of LOAD_FACT_* instructions
+	slot int
+	// target is the instruction JUMP_IF_* instructions jump to
+	target int
+	// str is the operand of ACTION_TYPE and ACTION_TARGET
+	str string
+	// value is the constant of LOAD_CONST_* and scalar ACTION_VALUE_*
+	// instructions
+	value interface{}
+	// raw is the JSON of ACTION_VALUE_ARRAY and ACTION_VALUE_OBJECT. It is
+	// decoded on every evaluation, so actions never share a value.
+	raw []byte
+	// template is the parsed template of ACTION_VALUE_TEMPLATE
+	template []compiler.TemplatePart
+	// delay, and flag for whether to cancel it, are the operands of
+	// ACTION_DELAY; flag alone is the operand of ACTION_ONLY_IF_CHANGED
+	delay time.Duration
+	flag  bool
+	// script is the operand of SCRIPT_DEF and SCRIPT_CALL
+	script *scriptOperand
+	// node is the index in the program's conditions of the shared condition
+	// of a CONDITION_NODE
+	node int
+}
+
+// scriptOperand is a script defined or called by a rule.
+type scriptOperand struct {
+	name       string
+	definition compiler.Script
+	// params are the fact table slots of the parameters of a call
+	params []int
+}
+
+// decoder decodes the rules of a program, filling in its fact table and its
+// shared conditions.
+type decoder struct {
+	p       *program
+	slots   map[string]int
+	strings map[string]string
+	// nodes maps the node IDs of the bytecode to the program's conditions
+	nodes map[int]int
+}
+
+// decodeRules decodes every rule of the program, in execution order.
+func (p *program) decodeRules() error {
+	d := &decoder{
+		p:       p,
+		slots:   make(map[string]int),
+		strings: make(map[string]string),
+		nodes:   make(map[int]int),
+	}
+	p.facts = nil
+	p.conditions = nil
+	p.rules = make([]decodedRule, len(p.ruleExecutionIndex))
+	for i, rule := range p.ruleExecutionIndex {
+		decoded, err := d.decodeRule(rule)
+		if err != nil {
+			return err
+		}
+		p.rules[i] = decoded
+	}
+	logging.Logger.Debug().Int("rules", len(p.rules)).Int("facts", len(p.facts)).Int("conditions", len(p.conditions)).Msg("Decoded rules")
+	return nil
+}
+
+// slot returns the fact table slot of a fact, adding the fact if it is new.
+func (d *decoder) slot(name string) int {
+	if slot, ok := d.slots[name]; ok {
+		return slot
+	}
+	slot := len(d.p.facts)
+	d.p.facts = append(d.p.facts, name)
+	d.slots[name] = slot
+	return slot
+}
+
+// intern returns the copy of s shared by every instruction of the program.
+func (d *decoder) intern(s string) string {
+	if interned, ok := d.strings[s]; ok {
+		return interned
+	}
+	d.strings[s] = s
+	return s
+}
+
+// decodeRule decodes the instructions of a rule, from its RULE_START to its
+// RULE_END.
+func (d *decoder) decodeRule(rule compiler.RuleExecutionIndex) (decodedRule, error) {
+	decoded := decodedRule{priority: rule.Priority}
+	fields := func(offset int) map[string]interface{} {
+		return map[string]interface{}{"ruleName": rule.RuleName, "offset": offset}
+	}
+
+	// Jumps are resolved once the whole rule is decoded. starts maps the
+	// offset of every opcode to the index of the instruction that runs when
+	// execution reaches it, which for dropped opcodes is the next one.
+	starts := make(map[int]int)
+	jumps := make(map[int]int)
+	loaded := make(map[int]bool)
+
+	r := &indexReader{bytecode: d.p.bytecode[:d.p.instructionsEnd], offset: rule.ByteOffset}
+	for r.offset < d.p.instructionsEnd {
+		start := r.offset
+		starts[start] = len(decoded.instructions)
+		opcode := compiler.Opcode(r.byte("opcode"))
+		in := instruction{opcode: opcode}
+
+		switch opcode {
+		case compiler.RULE_START:
+			r.shortString("rule name")
+			continue
+
+		case compiler.PRIORITY:
+			decoded.priority = r.uint32("priority")
+			continue
+
+		case compiler.RULE_FLAGS:
+			decoded.atomic = r.byte("rule flags")&compiler.RuleFlagAtomic != 0
+			continue
+
+		case compiler.RULE_GROUP, compiler.RULE_EXCLUSIVE_GROUP:
+			r.shortString("rule group")
+			continue
+
+		case compiler.LABEL:
+			r.bytes(4, "label")
+			continue
+
+		case compiler.RULE_END:
+			if r.err != nil {
+				return decodedRule{}, r.err
+			}
+			decoded.instructions = append(decoded.instructions, in)
+			for index, target := range jumps {
+				next, ok := starts[target]
+				if !ok {
+					return decodedRule{}, logging.NewError(logging.ErrorTypeRuntime, "Jump target is not an instruction of the rule", nil, fields(target))
+				}
+				decoded.instructions[index].target = next
+			}
+			return decoded, nil
+
+		case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL:
+			in.slot = d.slot(r.shortString("fact name"))
+			if !loaded[in.slot] {
+				loaded[in.slot] = true
+				decoded.facts = append(decoded.facts, in.slot)
+			}
+
+		case compiler.CONDITION_NODE:
+			var slot int
+			var err error
+			if in.node, slot, err = d.conditionNode(r); err != nil {
+				return decodedRule{}, logging.NewError(logging.ErrorTypeRuntime, "Invalid shared condition", err, fields(start))
+			}
+			if r.err == nil && !loaded[slot] {
+				loaded[slot] = true
+				decoded.facts = append(decoded.facts, slot)
+			}
+
+		case compiler.LOAD_CONST_FLOAT, compiler.ACTION_VALUE_FLOAT,
+			compiler.LOAD_CONST_STRING, compiler.ACTION_VALUE_STRING,
+			compiler.LOAD_CONST_BOOL, compiler.ACTION_VALUE_BOOL:
+			in.value = d.constant(r, opcode)
+
+		case compiler.EQ_FLOAT, compiler.EQ_STRING, compiler.EQ_BOOL,
+			compiler.NEQ_FLOAT, compiler.NEQ_STRING, compiler.NEQ_BOOL,
+			compiler.LT_FLOAT, compiler.LTE_FLOAT, compiler.GT_FLOAT, compiler.GTE_FLOAT,
+			compiler.CONTAINS_STRING, compiler.NOT_CONTAINS_STRING,
+			compiler.ACTION_START, compiler.ACTION_END:
+
+		case compiler.JUMP_IF_FALSE, compiler.JUMP_IF_TRUE:
+			jumpOffset := r.uint32("jump offset")
+			jumps[len(decoded.instructions)] = r.offset + jumpOffset
+
+		case compiler.ACTION_VALUE_ARRAY, compiler.ACTION_VALUE_OBJECT:
+			in.raw = r.bytes(r.uint32("structured value length"), "structured value")
+			if r.err == nil {
+				var value interface{}
+				if err := json.Unmarshal(in.raw, &value); err != nil {
+					return decodedRule{}, logging.NewError(logging.ErrorTypeRuntime, "Failed to decode structured action value", err, fields(start))
+				}
+			}
+
+		case compiler.ACTION_VALUE_TEMPLATE:
+			template := string(r.bytes(r.uint32("template length"), "template"))
+			if r.err == nil {
+				parts, err := compiler.ParseTemplate(template)
+				if err != nil {
+					return decodedRule{}, logging.NewError(logging.ErrorTypeRuntime, "Failed to parse action value template", err, map[string]interface{}{"ruleName": rule.RuleName, "template": template})
+				}
+				in.template = parts
+			}
+
+		case compiler.ACTION_DELAY:
+			in.delay = time.Duration(r.uint64("action delay"))
+			in.flag = r.byte("action delay") == 1
+
+		case compiler.ACTION_ONLY_IF_CHANGED:
+			in.flag = r.byte("onlyIfChanged") == 1
+
+		case compiler.ACTION_TYPE:
+			in.str = d.intern(r.shortString("action type"))
+
+		case compiler.ACTION_TARGET:
+			in.str = d.intern(r.shortString("action target"))
+
+		case compiler.SCRIPT_DEF:
+			script := &scriptOperand{name: d.intern(r.shortString("script name"))}
+			params := make([]string, r.byte("script parameters"))
+			for i := range params {
+				params[i] = d.intern(r.shortString("script parameter"))
+			}
+			script.definition = compiler.Script{Params: params, Body: r.shortString("script body")}
+			in.script = script
+
+		case compiler.SCRIPT_CALL:
+			script := &scriptOperand{name: d.intern(r.shortString("script name"))}
+			script.params = make([]int, r.byte("script parameters"))
+			for i := range script.params {
+				script.params[i] = d.slot(r.shortString("script parameter"))
+			}
+			in.script = script
+
+		default:
+			return decodedRule{}, logging.NewError(logging.ErrorTypeRuntime, "Unknown opcode encountered", nil, map[string]interface{}{"ruleName": rule.RuleName, "opcode": opcode, "offset": start})
+		}
+
+		if r.err != nil {
+			return decodedRule{}, r.err
+		}
+		decoded.instructions = append(decoded.instructions, in)
+	}
+
+	if r.err != nil {
+		return decodedRule{}, r.err
+	}
+	return decodedRule{}, logging.NewError(logging.ErrorTypeRuntime, "Rule has no RULE_END", nil, fields(rule.ByteOffset))
+}
+
+// constant reads the operand of a LOAD_CONST_* or scalar ACTION_VALUE_*
+// opcode.
+func (d *decoder) constant(r *indexReader, opcode compiler.Opcode) interface{} {
+	switch opcode {
+	case compiler.LOAD_CONST_FLOAT, compiler.ACTION_VALUE_FLOAT:
+		return math.Float64frombits(r.uint64("float constant"))
+	case compiler.LOAD_CONST_STRING, compiler.ACTION_VALUE_STRING:
+		return d.intern(r.shortString("string constant"))
+	default:
+		return r.byte("bool constant") == 1
+	}
+}
+
+// conditionNode reads the operand of a CONDITION_NODE and the condition it
+// tags: a fact load, a constant load and a comparison, which are folded into
+// the node. It returns the index of the node in the program's conditions and
+// the slot of the node's fact. Every condition tagged with a node ID must be
+// the same.
+func (d *decoder) conditionNode(r *indexReader) (int, int, error) {
+	id := r.uint32("condition node")
+
+	load := compiler.Opcode(r.byte("condition node fact"))
+	switch load {
+	case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL:
+	default:
+		return 0, 0, fmt.Errorf("condition node %d tags a %s instead of a fact load", id, load)
+	}
+	slot := d.slot(r.shortString("fact name"))
+
+	constant := compiler.Opcode(r.byte("condition node constant"))
+	switch constant {
+	case compiler.LOAD_CONST_FLOAT, compiler.LOAD_CONST_STRING, compiler.LOAD_CONST_BOOL:
+	default:
+		return 0, 0, fmt.Errorf("condition node %d loads a %s instead of a constant", id, constant)
+	}
+	node := conditionNode{slot: slot, value: d.constant(r, constant), opcode: compiler.Opcode(r.byte("condition node comparison"))}
+	if r.err != nil {
+		return 0, 0, nil
+	}
+	if node.opcode > compiler.NEQ_BOOL {
+		return 0, 0, fmt.Errorf("condition node %d compares with a %s", id, node.opcode)
+	}
+
+	index, ok := d.nodes[id]
+	if !ok {
+		index = len(d.p.conditions)
+		d.nodes[id] = index
+		d.p.conditions = append(d.p.conditions, newConditionNode(node))
+		return index, slot, nil
+	}
+	if shared := d.p.conditions[index]; shared.slot != node.slot || !sameConstant(shared.value, node.value) || shared.opcode != node.opcode {
+		return 0, 0, fmt.Errorf("condition node %d tags different conditions", id)
+	}
+	return index, slot, nil
+}
+
+// byte reads a single byte operand.
+func (r *indexReader) byte(what string) byte {
+	b := r.bytes(1, what)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// uint64 reads a little-endian 8 byte operand.
+func (r *indexReader) uint64(what string) uint64 {
+	b := r.bytes(8, what)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// shortString reads a string prefixed with its length in a single byte.
+func (r *indexReader) shortString(what string) string {
+	return string(r.bytes(int(r.byte(what)), what))
+}
+
+// bytes reads n bytes, sharing them with the bytecode.
+func (r *indexReader) bytes(n int, what string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.offset+n > len(r.bytecode) {
+		r.err = logging.NewError(logging.ErrorTypeRuntime, "Unexpected end of bytecode while reading "+what, nil, map[string]interface{}{"offset": r.offset})
+		return nil
+	}
+	b := r.bytecode[r.offset : r.offset+n]
+	r.offset += n
+	return b
+}
@@ -0,0 +1,69 @@
+// rex/pkg/runtime/decode_test.go
+
+package runtime
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+func TestDecodeRules(t *testing.T) {
+	comfort := compiler.Rule{
+		Name:     "comfort",
+		Priority: 3,
+		Atomic:   true,
+		Conditions: compiler.ConditionGroup{
+			Any: []*compiler.ConditionOrGroup{
+				{Fact: "temperature", Operator: "GT", Value: 20.0},
+				{Fact: "humidity", Operator: "GT", Value: 60.0},
+			},
+		},
+		Actions: []compiler.Action{
+			{Type: "updateStore", Target: "comfort", Value: "Temperature is ${temperature}"},
+		},
+	}
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{comfort, priorityRule("heat", 1, "temperature", 30, "alerts:heat")},
+	})
+	defer os.Remove(filename)
+	bytecode, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	program, err := LoadProgramBytes(bytecode)
+	require.NoError(t, err)
+	require.Len(t, program.rules, 2)
+
+	// Facts loaded by several rules share a slot
+	assert.ElementsMatch(t, []string{"temperature", "humidity"}, program.facts)
+
+	rule := program.rules[program.rulePositions["comfort"]]
+	assert.Equal(t, 3, rule.priority)
+	assert.True(t, rule.atomic)
+	assert.Len(t, rule.facts, 2)
+
+	var template []compiler.TemplatePart
+	for i, in := range rule.instructions {
+		switch in.opcode {
+		case compiler.RULE_START, compiler.PRIORITY, compiler.RULE_FLAGS, compiler.LABEL:
+			t.Errorf("instruction %d is a %s, which should have been dropped", i, in.opcode)
+		case compiler.JUMP_IF_FALSE, compiler.JUMP_IF_TRUE:
+			assert.Greater(t, in.target, i)
+			assert.Less(t, in.target, len(rule.instructions))
+		case compiler.ACTION_VALUE_TEMPLATE:
+			template = in.template
+		}
+	}
+	assert.Equal(t, compiler.RULE_END, rule.instructions[len(rule.instructions)-1].opcode)
+	assert.Len(t, template, 2)
+
+	// A rule that runs into the indices is rejected at load time
+	corrupt := append([]byte(nil), bytecode...)
+	corrupt[program.instructionsEnd-1] = byte(compiler.ACTION_START)
+	_, err = LoadProgramBytes(corrupt)
+	assert.Error(t, err)
+}
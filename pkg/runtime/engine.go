@@ -3,188 +3,329 @@
 package runtime
 
 import (
-	"encoding/binary"
-	"math"
-	"os"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
 	"rgehrsitz/rex/pkg/compiler"
 	"rgehrsitz/rex/pkg/scripting"
 	"rgehrsitz/rex/pkg/store"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/rs/zerolog"
+
 	"rgehrsitz/rex/pkg/logging"
 )
 
-type Engine struct {
-	bytecode            []byte
-	ruleExecutionIndex  []compiler.RuleExecutionIndex
-	factRuleIndex       map[string][]string
-	factDependencyIndex []compiler.FactDependencyIndex
-	Facts               map[string]interface{}
-	store               store.Store
-	priorityThreshold   int
-	ScriptEngine        *scripting.SafeVM
+// scriptCall is the action value produced by a SCRIPT_CALL opcode. It is
+// resolved to the script's result when the action is executed. A dedicated
+// type keeps it distinct from object action values, which are plain maps.
+type scriptCall struct {
+	name   string
+	params map[string]interface{}
 }
 
-// New method to create an engine from a file
-func NewEngineFromFile(filename string, store store.Store, priorityThreshold int) (*Engine, error) {
+type Engine struct {
+	// program is the running bytecode. Evaluations hold programMu for
+	// reading, so Reload swaps it between evaluations.
+	program
+	programMu sync.RWMutex
+
+	// Facts holds the engine's local copy of fact values. While the engine
+	// processes updates it must only be read through Fact. factVersions
+	// counts the changes of each fact, which the results of shared conditions
+	// are cached by, so Facts must not be written once the engine has
+	// evaluated rules.
+	Facts        map[string]interface{}
+	factVersions map[string]uint64
+	factsMu      sync.RWMutex
+
+	store             store.Store
+	priorityThreshold int
+	ScriptEngine      *scripting.SafeVM
+
+	// OnlyIfChanged makes updateStore actions skip the write and publish when
+	// the target already holds the value. Actions can override it.
+	OnlyIfChanged bool
+
+	// MaxChainDepth limits how many levels of rules are chained in-process
+	// from a single fact update. Zero disables chaining.
+	MaxChainDepth int
+
+	// MaxCausationDepth limits how many rules may fire in a row as a result
+	// of a single external fact update, counting both in-process chaining and
+	// updates the engine's own writes cause when the store publishes them
+	// back. Longer chains are stopped as runaway loops. Zero disables the
+	// guard.
+	MaxCausationDepth int
+
+	// ErrorPolicy decides what happens when a rule fails to evaluate, and
+	// QuarantineAfter after how many errors ErrorPolicyQuarantine quarantines
+	// the rule.
+	ErrorPolicy     ErrorPolicy
+	QuarantineAfter int
+
+	// Settings without a field of their own, made with options
+	logger            *zerolog.Logger
+	clock             Clock
+	scriptTimeout     time.Duration
+	missingFactPolicy MissingFactPolicy
+	executionMode     ExecutionMode
+	actionHandlers    map[string]ActionHandler
+	workerCount       int
+	// ownSubscription is set when the embedder subscribes to the store
+	// itself and passes its messages to IngestMessage
+	ownSubscription bool
+
+	// DeadLetterKey is the Redis list that unprocessable messages and failed
+	// action writes are recorded in. Empty disables dead-lettering.
+	DeadLetterKey string
+
+	// CoalesceWindow makes each worker merge the updates it receives within
+	// the window, keeping the last value of each fact, and evaluate the rules
+	// they affect once per batch. Zero evaluates every update on its own.
+	CoalesceWindow time.Duration
+
+	errorsMu         sync.Mutex
+	ruleErrors       map[string]int
+	quarantinedRules map[string]struct{}
+
+	recentMu     sync.Mutex
+	recentWrites map[string]recentWrite
+
+	queue *updateQueue
+
+	// started is set once Start has started the fact processing loop and
+	// the dispatcher
+	startOnce sync.Once
+	started   atomic.Bool
+
+	// stop is closed to stop the fact processing loop; loopDone and
+	// dispatchDone are closed when the loop and the dispatcher have returned
+	stop         chan struct{}
+	stopOnce     sync.Once
+	loopDone     chan struct{}
+	dispatchDone chan struct{}
+
+	workersMu sync.RWMutex
+	workers   []chan factUpdate
+	workersWG sync.WaitGroup
+	// discarding makes the workers drop the updates they have not started on
+	discarding atomic.Bool
+
+	// pendingActions are the delayed actions scheduled by ID, and
+	// pendingByRule the same actions by rule then ID
+	pendingMu      sync.Mutex
+	pendingActions map[string]*pendingAction
+	pendingByRule  map[string]map[string]*pendingAction
+	// pendingStopped is set on shutdown, after which delayed actions are no
+	// longer armed or run, and pendingRuns tracks the ones already running
+	pendingStopped bool
+	pendingRuns    sync.WaitGroup
+}
 
-	bytecode, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, logging.NewError(logging.ErrorTypeRuntime, "Failed to read bytecode file", err, map[string]interface{}{"filename": filename})
+// NewEngine creates an engine that evaluates program against the facts in
+// factStore. The engine does not take in fact updates or restore the delayed
+// actions persisted by a previous run until Start is called, so it can be
+// configured first.
+func NewEngine(program *Program, factStore store.Store, opts ...Option) (*Engine, error) {
+	if program == nil {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Engine requires a program", nil, nil)
 	}
-	logging.Logger.Debug().Int("bytecodeLength", len(bytecode)).Msg("Read bytecode file")
 
 	engine := &Engine{
-		bytecode:            bytecode,
-		ruleExecutionIndex:  make([]compiler.RuleExecutionIndex, 0),
-		factRuleIndex:       make(map[string][]string),
-		factDependencyIndex: make([]compiler.FactDependencyIndex, 0),
-		Facts:               make(map[string]interface{}),
-		store:               store,
-		priorityThreshold:   priorityThreshold,
-		ScriptEngine:        scripting.NewSafeVM(),
-	}
-
-	offset := 0
-
-	// Read header
-	if offset+28 > len(bytecode) {
-		return nil, logging.NewError(logging.ErrorTypeRuntime, "Bytecode file too short for header", nil, nil)
-	}
-	version := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("version", version).Msg("Read bytecode version")
-	offset += 4
-	checksum := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("checksum", checksum).Msg("Read bytecode checksum")
-	offset += 4
-	constPoolSize := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("constPoolSize", constPoolSize).Msg("Read constant pool size")
-	offset += 4
-	numRules := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("numRules", numRules).Msg("Read number of rules")
-	offset += 4
-	ruleExecIndexOffset := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("ruleExecIndexOffset", ruleExecIndexOffset).Msg("Read rule execution index offset")
-	offset += 4
-	factRuleIndexOffset := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("factRuleIndexOffset", factRuleIndexOffset).Msg("Read fact rule index offset")
-	offset += 4
-	factDepIndexOffset := binary.LittleEndian.Uint32(bytecode[offset:])
-	logging.Logger.Debug().Uint32("factDepIndexOffset", factDepIndexOffset).Msg("Read fact dependency index offset")
-	offset += 4
-
-	// Read rule execution index
-	offset = int(ruleExecIndexOffset)
-	logging.Logger.Debug().Int("offset", offset).Msg("Starting to read rule execution index")
-	for i := 0; i < int(numRules); i++ {
-		if offset+4 > len(bytecode) {
-			return nil, logging.NewError(logging.ErrorTypeRuntime, "Unexpected end of bytecode while reading rule execution index", nil, nil)
-		}
-		nameLen := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-		offset += 4
-		if offset+nameLen+4 > len(bytecode) {
-			return nil, logging.NewError(logging.ErrorTypeRuntime, "Unexpected end of bytecode while reading rule name", nil, nil)
-		}
-		name := string(bytecode[offset : offset+nameLen])
-		offset += nameLen
-		byteOffset := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-		offset += 4
-
-		// Adjust the byte offset by adding the size of the header
-		adjustedByteOffset := byteOffset + compiler.HeaderSize
-
-		engine.ruleExecutionIndex = append(engine.ruleExecutionIndex, compiler.RuleExecutionIndex{
-			RuleName:   name,
-			ByteOffset: adjustedByteOffset,
-		})
-		logging.Logger.Debug().Str("ruleName", name).Int("byteOffset", adjustedByteOffset).Msg("Read rule execution index entry")
-	}
-
-	// Read fact rule index
-	offset = int(factRuleIndexOffset)
-	for offset < int(factDepIndexOffset) {
-		factLen := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-		offset += 4
-		fact := string(bytecode[offset : offset+factLen])
-		offset += factLen
-		rulesCount := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-		offset += 4
-		var rules []string
-		for j := 0; j < rulesCount; j++ {
-			ruleLen := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-			offset += 4
-			rule := string(bytecode[offset : offset+ruleLen])
-			offset += ruleLen
-			rules = append(rules, rule)
-		}
-		engine.factRuleIndex[fact] = rules
-		logging.Logger.Debug().Str("fact", fact).Strs("rules", rules).Msg("Read fact rule index entry")
-	}
-
-	// Read fact dependency index
-	offset = int(factDepIndexOffset)
-	for offset < len(bytecode) {
-		ruleLen := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-		offset += 4
-		rule := string(bytecode[offset : offset+ruleLen])
-		offset += ruleLen
-		factsCount := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-		offset += 4
-		var facts []string
-		for j := 0; j < factsCount; j++ {
-			factLen := int(binary.LittleEndian.Uint32(bytecode[offset:]))
-			offset += 4
-			fact := string(bytecode[offset : offset+factLen])
-			offset += factLen
-			facts = append(facts, fact)
-		}
-		engine.factDependencyIndex = append(engine.factDependencyIndex, compiler.FactDependencyIndex{
-			RuleName: rule,
-			Facts:    facts,
-		})
-		logging.Logger.Debug().Str("rule", rule).Strs("facts", facts).Msg("Read fact dependency index entry")
-	}
-
-	go engine.StartFactProcessing()
-
-	logging.Logger.Info().Msg("Engine initialized from bytecode")
+		program:           program.program,
+		Facts:             make(map[string]interface{}),
+		factVersions:      make(map[string]uint64),
+		store:             factStore,
+		ScriptEngine:      scripting.NewSafeVM(),
+		MaxChainDepth:     DefaultMaxChainDepth,
+		MaxCausationDepth: DefaultMaxCausationDepth,
+		ErrorPolicy:       ErrorPolicyContinue,
+		QuarantineAfter:   DefaultQuarantineAfter,
+		DeadLetterKey:     store.DefaultDeadLetterKey,
+		recentWrites:      make(map[string]recentWrite),
+		pendingActions:    make(map[string]*pendingAction),
+		pendingByRule:     make(map[string]map[string]*pendingAction),
+		queue:             newUpdateQueue(DefaultQueueSize, OverflowBlock),
+		stop:              make(chan struct{}),
+		loopDone:          make(chan struct{}),
+		dispatchDone:      make(chan struct{}),
+		clock:             systemClock{},
+		scriptTimeout:     DefaultScriptTimeout,
+		missingFactPolicy: MissingFactSkip,
+		executionMode:     ExecutionInterpreted,
+	}
+	for _, opt := range opts {
+		opt(engine)
+	}
+	if engine.executionMode == ExecutionCompiled {
+		engine.compileRules()
+	}
+	engine.conditionResults = make([]atomic.Uint64, len(engine.conditions))
+	engine.queue.logger = engine.log()
+	engine.queue.clock = engine.clock
+
+	engine.log().Info().Int("rules", len(engine.ruleExecutionIndex)).Msg("Engine initialized from bytecode")
+	return engine, nil
+}
+
+// NewEngineFromFile loads the program in a bytecode file, creates an engine
+// for it with the given options and starts it.
+func NewEngineFromFile(filename string, factStore store.Store, opts ...Option) (*Engine, error) {
+	program, err := LoadProgramFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
+	engine, err := NewEngine(program, factStore, opts...)
+	if err != nil {
+		return nil, err
+	}
+	engine.Start()
 	return engine, nil
 }
 
+// Start restores the delayed actions persisted in the store, starts the
+// workers set with WithWorkers, and starts taking in the fact updates
+// published to the store, unless WithOwnSubscription was given, and those
+// passed to Enqueue and IngestMessage.
+// Calls after the first do nothing. Start must not be called after Shutdown.
+func (e *Engine) Start() {
+	e.startOnce.Do(func() {
+		if err := e.restorePendingActions(); err != nil {
+			e.log().Error().Err(err).Msg("Failed to restore pending actions")
+		}
+
+		if e.workerCount > 0 {
+			e.StartWorkers(e.workerCount)
+		}
+		e.started.Store(true)
+		go func() {
+			defer close(e.loopDone)
+			if !e.ownSubscription {
+				e.StartFactProcessing()
+			}
+		}()
+		go func() {
+			defer close(e.dispatchDone)
+			e.dispatchUpdates()
+		}()
+	})
+}
+
+// ProcessFactUpdate applies a fact update and evaluates the rules that
+// reference the fact. Facts written by those rules' actions are chained:
+// the rules depending on them are evaluated in-process in the same cycle,
+// level by level, up to MaxChainDepth levels deep. Within a level, facts are
+// processed in the order they were written and rules in index order.
+// ProcessFactUpdate is safe for concurrent use, but concurrent updates to the
+// same fact are applied in no particular order; use Submit to keep them in
+// order.
 func (e *Engine) ProcessFactUpdate(factName string, factValue interface{}) {
-	logging.Logger.Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Processing fact update")
+	e.processFactUpdate(factName, factValue, causation{root: factName})
+}
 
-	// Update the fact value in the store
-	if num, ok := factValue.(int); ok {
-		e.Facts[factName] = float64(num)
-	} else if num, ok := factValue.(float32); ok {
-		e.Facts[factName] = float64(num)
-	} else {
-		e.Facts[factName] = factValue
+// processFactUpdate is ProcessFactUpdate for an update with a known
+// causation. Updates, and chained writes, whose causation exceeds
+// MaxCausationDepth are not evaluated.
+func (e *Engine) processFactUpdate(factName string, factValue interface{}, cause causation) {
+	e.log().Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Processing fact update")
+
+	// Update the fact value in the local fact store
+	e.setFact(factName, normalizeFactValue(factValue))
+
+	e.programMu.RLock()
+	defer e.programMu.RUnlock()
+	e.chainWrites([]factWrite{{fact: factName, cause: cause}}, 0)
+
+	e.log().Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Finished processing fact update")
+}
+
+// normalizeFactValue converts integer fact values to float64, the type rules
+// compare numbers as.
+func normalizeFactValue(value interface{}) interface{} {
+	switch num := value.(type) {
+	case int:
+		return float64(num)
+	case float32:
+		return float64(num)
+	}
+	return value
+}
+
+// chainWrites evaluates the rules for facts written at the given chain depth,
+// then the rules for the facts those rules write, level by level, until no
+// more facts are written or MaxChainDepth is reached. Depth 0 is the external
+// update itself.
+func (e *Engine) chainWrites(writes []factWrite, depth int) {
+	for ; len(writes) > 0; depth++ {
+		if depth > e.MaxChainDepth {
+			if depth > 1 {
+				facts := make([]string, len(writes))
+				for i, write := range writes {
+					facts[i] = write.fact
+				}
+				e.log().Warn().Int("maxChainDepth", e.MaxChainDepth).Strs("facts", facts).Msg("Maximum chain depth reached, not evaluating rules for chained facts")
+			}
+			break
+		}
+
+		var written []factWrite
+		for _, write := range writes {
+			if e.runawayChain(write.fact, write.cause) {
+				continue
+			}
+			if depth > 0 {
+				e.log().Debug().Str("factName", write.fact).Int("depth", depth).Msg("Chaining rules for fact written by an action")
+			}
+			written = append(written, e.evaluateRulesForFact(write.fact, write.cause, depth < e.MaxChainDepth)...)
+		}
+		writes = uniqueWrites(written)
 	}
+}
 
+// evaluateRulesForFact evaluates the rules that reference a fact whose value
+// has just changed, and returns the facts their actions wrote, in order.
+// The writes are attributed to the update's causation followed by the rule
+// that made them; chained tells whether they will be chained in-process.
+func (e *Engine) evaluateRulesForFact(factName string, cause causation, chained bool) []factWrite {
 	// Find all rules that reference the updated fact
 	ruleNames, ok := e.factRuleIndex[factName]
 	if !ok {
-		logging.Logger.Debug().Str("factName", factName).Msg("No rules found for the updated fact")
-		return
+		e.log().Debug().Str("factName", factName).Msg("No rules found for the updated fact")
+		return nil
 	}
 
-	logging.Logger.Debug().Str("factName", factName).Strs("ruleNames", ruleNames).Msg("Found rules referencing the updated fact")
+	e.log().Debug().Str("factName", factName).Strs("ruleNames", ruleNames).Msg("Found rules referencing the updated fact")
 
-	// Create a set of all facts that need to be queried (excluding the fact that triggered the update)
+	updated := map[string]struct{}{factName: {}}
+	return e.evaluateRules(ruleNames, updated, func(string) causation { return cause }, chained)
+}
+
+// evaluateRules evaluates rules in the order given and returns the facts
+// their actions wrote, in order. The facts the rules depend on, apart from the
+// updated ones, are first refreshed from the store in a single query. causeOf
+// returns the causation of the update that triggered a rule; its writes are
+// attributed to that causation followed by the rule, and chained tells
+// whether they will be chained in-process.
+func (e *Engine) evaluateRules(ruleNames []string, updated map[string]struct{}, causeOf func(ruleName string) causation, chained bool) []factWrite {
+	ev := &evaluation{chained: chained}
+
+	// Create a set of all facts that need to be queried (excluding the facts that triggered the update)
 	factsToQuery := make(map[string]struct{})
 	for _, ruleName := range ruleNames {
-		for _, dep := range e.factDependencyIndex {
-			if dep.RuleName == ruleName {
-				for _, fact := range dep.Facts {
-					if fact != factName {
-						factsToQuery[fact] = struct{}{}
-					}
-				}
+		rule, ok := e.rule(ruleName)
+		if !ok {
+			continue
+		}
+		for _, fact := range rule.dependencies {
+			if _, ok := updated[fact]; !ok {
+				factsToQuery[fact] = struct{}{}
 			}
 		}
 	}
@@ -200,324 +341,346 @@ func (e *Engine) ProcessFactUpdate(factName string, factValue interface{}) {
 	// Query the KV store for the required facts
 	if len(factKeys) > 0 {
 		factValues, err = e.store.MGetFacts(factKeys...)
-		logging.Logger.Debug().Strs("facts", factKeys).Interface("values", factValues).Msg("Retrieved facts from KV store")
+		e.log().Debug().Strs("facts", factKeys).Interface("values", factValues).Msg("Retrieved facts from KV store")
 		if err != nil {
-			logging.Logger.Error().Err(err).Msg("Failed to retrieve facts from KV store")
+			e.log().Error().Err(err).Msg("Failed to retrieve facts from KV store")
 		}
 	}
 
 	// Update local fact store with retrieved facts
 	var missingFacts []string
+	e.factsMu.Lock()
 	for fact, value := range factValues {
 		if value != nil {
-			e.Facts[fact] = value
+			e.setFactLocked(fact, value)
 		} else {
 			// Fact does not exist in the store
-			logging.Logger.Warn().Str("fact", fact).Msg("Fact not found in store")
-			delete(e.Facts, fact)
+			e.log().Warn().Str("fact", fact).Msg("Fact not found in store")
+			e.deleteFactLocked(fact)
 			missingFacts = append(missingFacts, fact)
 		}
 	}
+	e.factsMu.Unlock()
 
-	// Remove rules that depend on missing facts from ruleNames
-	for _, missingFact := range missingFacts {
-		for i := 0; i < len(ruleNames); i++ {
-			ruleName := ruleNames[i]
-			for _, dep := range e.factDependencyIndex {
-				if dep.RuleName == ruleName {
-					for _, fact := range dep.Facts {
-						if fact == missingFact {
-							// Remove the rule from ruleNames
-							ruleNames = append(ruleNames[:i], ruleNames[i+1:]...)
-							i--
-							logging.Logger.Warn().
-								Str("ruleName", ruleName).
-								Str("missingFact", missingFact).
-								Msg("Removing rule due to missing fact")
-							break
-						}
-					}
-					if len(ruleNames) == 0 {
-						break
-					}
-				}
-			}
-		}
+	ruleNames, proceed := e.applyMissingFactPolicy(ruleNames, missingFacts)
+	if !proceed {
+		return nil
 	}
 
-	// Evaluate each rule
+	// Evaluate each rule in priority order. Once a rule of an exclusive group
+	// fires, the group's other rules are skipped for this update, and once a
+	// rule that stops processing fires, so are the rules after it in its group
+	firedGroups := make(map[string]struct{})
+	stoppedGroups := make(map[string]struct{})
 	for _, ruleName := range ruleNames {
-		logging.Logger.Debug().Str("ruleName", ruleName).Msg("Evaluating rule")
-		err := e.evaluateRule(ruleName)
-		if err != nil {
-			logging.Logger.Error().Err(err).Str("ruleName", ruleName).Msg("Failed to evaluate rule")
-			// Handle the error as needed, e.g., stop processing further rules
-			return
+		if e.isQuarantined(ruleName) {
+			e.log().Debug().Str("ruleName", ruleName).Msg("Skipping quarantined rule")
+			continue
+		}
+		header := e.ruleHeaders[ruleName]
+		if _, ok := stoppedGroups[header.group]; ok {
+			e.log().Debug().Str("ruleName", ruleName).Str("group", header.group).Msg("Skipping rule, a rule of its group stopped processing")
+			continue
+		}
+		if _, ok := firedGroups[header.exclusiveGroup]; ok {
+			e.log().Debug().Str("ruleName", ruleName).Str("exclusiveGroup", header.exclusiveGroup).Msg("Skipping rule, another rule of its exclusive group fired")
+			continue
+		}
+
+		e.log().Debug().Str("ruleName", ruleName).Msg("Evaluating rule")
+		ev.cause = causeOf(ruleName)
+		ev.rule = ruleName
+		fired, err := e.evaluateRule(ev, ruleName)
+		if fired && header.exclusiveGroup != "" {
+			firedGroups[header.exclusiveGroup] = struct{}{}
+		}
+		if fired && header.stopProcessing {
+			e.log().Debug().Str("ruleName", ruleName).Str("group", header.group).Msg("Rule stopped processing of its group")
+			stoppedGroups[header.group] = struct{}{}
+		}
+		if err != nil && e.handleRuleError(ruleName, err) {
+			return ev.writes
 		}
 	}
 
-	logging.Logger.Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Finished processing fact update")
+	return ev.writes
+}
+
+// ruleState holds the registers a rule's instructions work on while the rule
+// is evaluated.
+type ruleState struct {
+	ev       *evaluation
+	ruleName string
+	rule     *decodedRule
+
+	factValue        interface{}
+	constValue       interface{}
+	comparisonResult bool
+	ruleTriggered    bool
+
+	action        compiler.Action
+	actionDelay   time.Duration
+	cancelIfFalse bool
+	actionIndex   int
+
+	// Store writes of atomic rules are batched and committed at RULE_END
+	batch []store.FactUpdate
 }
 
-func (e *Engine) evaluateRule(ruleName string) error {
-	logging.Logger.Debug().
+// evaluateRule evaluates a rule and reports whether the rule fired, that is
+// whether its conditions held and its actions ran. The facts its actions
+// write are recorded in ev. A rule with a native condition runs it in place
+// of its conditions. Otherwise the rule's closures run if the engine compiled
+// them, and its decoded instructions are interpreted if it did not.
+func (e *Engine) evaluateRule(ev *evaluation, ruleName string) (bool, error) {
+	e.log().Debug().
 		Str("ruleName", ruleName).
 		Msg("Starting rule evaluation")
-	logging.Logger.Debug().
-		Interface("facts", e.Facts).
-		Msg("Current facts")
-
-	var ruleOffset int
-	var rulePriority int
-	found := false
-	for _, r := range e.ruleExecutionIndex {
-		if r.RuleName == ruleName {
-			ruleOffset = r.ByteOffset
-			rulePriority = r.Priority
-			found = true
-			break
+	if event := e.log().Debug(); event.Enabled() {
+		event.Interface("facts", e.factsSnapshot()).Msg("Current facts")
+	}
+
+	position, ok := e.rulePositions[ruleName]
+	if !ok {
+		return false, logging.NewError(logging.ErrorTypeRuntime, "Rule not found in ruleExecutionIndex", nil, map[string]interface{}{"ruleName": ruleName})
+	}
+
+	var fired bool
+	var err error
+	if e.rules[position].native != nil {
+		fired, err = e.runNative(ev, ruleName, position)
+	} else if e.compiled != nil {
+		fired, err = e.runCompiled(ev, ruleName, position)
+	} else {
+		fired, err = e.interpret(ev, ruleName, position)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	e.log().Debug().
+		Str("ruleName", ruleName).
+		Bool("fired", fired).
+		Msg("Finished rule evaluation")
+
+	return fired, nil
+}
+
+// interpret runs the decoded instructions of the rule at position.
+func (e *Engine) interpret(ev *evaluation, ruleName string, position int) (bool, error) {
+	// The state stays on the stack, since execute does not keep it
+	s := ruleState{ev: ev, ruleName: ruleName, rule: &e.rules[position], actionIndex: -1}
+	var err error
+	for pc := 0; pc < len(s.rule.instructions); {
+		if pc, err = e.execute(&s, pc); err != nil {
+			return false, err
 		}
 	}
+	return s.actionIndex >= 0, nil
+}
 
-	if !found {
-		return logging.NewError(logging.ErrorTypeRuntime, "Rule not found in ruleExecutionIndex", nil, map[string]interface{}{"ruleName": ruleName})
+// runCompiled runs the closures of the rule at position. Their state is kept
+// in ev, since closures make it escape to the heap, so that it is allocated
+// once per update rather than once per rule.
+func (e *Engine) runCompiled(ev *evaluation, ruleName string, position int) (bool, error) {
+	s := &ev.state
+	*s = ruleState{ev: ev, ruleName: ruleName, rule: &e.rules[position], actionIndex: -1}
+	steps := e.compiled[position]
+	var err error
+	for pc := 0; pc < len(steps); {
+		if pc, err = steps[pc](e, s); err != nil {
+			return false, err
+		}
 	}
+	return s.actionIndex >= 0, nil
+}
 
-	logging.Logger.Debug().Str("ruleName", ruleName).Int("offset", ruleOffset).Int("priority", rulePriority).Msg("Found rule in ruleExecutionIndex")
+// execute runs the instruction at pc of the rule being evaluated and returns
+// the index of the instruction to run next.
+func (e *Engine) execute(s *ruleState, pc int) (int, error) {
+	in := &s.rule.instructions[pc]
 
-	offset := ruleOffset
-	var action compiler.Action
+	switch in.opcode {
+	case compiler.RULE_END:
+		return len(s.rule.instructions), e.endRule(s)
 
-	var factValue interface{}
-	var constValue interface{}
-	var comparisonResult bool
+	case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL:
+		s.factValue, _ = e.Fact(e.facts[in.slot])
 
-	relevantFacts := make(map[string]interface{})
-	ruleTriggered := false
+	case compiler.LOAD_CONST_FLOAT, compiler.LOAD_CONST_STRING, compiler.LOAD_CONST_BOOL:
+		s.constValue = in.value
 
-	for offset < len(e.bytecode) {
-		opcode := compiler.Opcode(e.bytecode[offset])
-		offset++
+	case compiler.CONDITION_NODE:
+		s.comparisonResult = e.evaluateCondition(in.node)
+		if s.comparisonResult {
+			s.ruleTriggered = true
+		}
 
-		logging.Logger.Debug().Uint8("opcode", uint8(opcode)).Int("offset", offset-1).Msg("Executing opcode")
+	case compiler.EQ_FLOAT, compiler.EQ_STRING, compiler.EQ_BOOL,
+		compiler.NEQ_FLOAT, compiler.NEQ_STRING, compiler.NEQ_BOOL,
+		compiler.LT_FLOAT, compiler.LTE_FLOAT, compiler.GT_FLOAT, compiler.GTE_FLOAT,
+		compiler.CONTAINS_STRING, compiler.NOT_CONTAINS_STRING:
+		s.comparisonResult = e.compare(s.factValue, s.constValue, in.opcode)
+		if s.comparisonResult {
+			s.ruleTriggered = true
+		}
 
-		switch opcode {
-		case compiler.RULE_START:
-			ruleNameLength := int(e.bytecode[offset])
-			logging.Logger.Debug().Msg("Encountered RULE_START opcode")
-			offset++
-			ruleName := string(e.bytecode[offset : offset+ruleNameLength])
-			offset += ruleNameLength
-			logging.Logger.Debug().Str("ruleName", ruleName).Msg("Encountered rule name")
-			continue
+	case compiler.JUMP_IF_FALSE:
+		if !s.comparisonResult {
+			return in.target, nil
+		}
 
-		case compiler.PRIORITY:
-			bits := binary.LittleEndian.Uint32(e.bytecode[offset : offset+5])
-			rulePriority = int(bits)
-			offset += 4
-			logging.Logger.Debug().Int("priority", rulePriority).Msg("Encountered PRIORITY opcode")
-			continue
+	case compiler.JUMP_IF_TRUE:
+		if s.comparisonResult {
+			return in.target, nil
+		}
 
-		case compiler.RULE_END:
-			if ruleTriggered && rulePriority <= e.priorityThreshold {
-				logging.Logger.Info().
-					Str("ruleName", ruleName).
-					Int("priority", rulePriority).
-					Interface("relevantFacts", relevantFacts).
-					Msg("High-priority rule triggered")
-			}
-			return nil
-
-		case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL:
-			nameLen := int(e.bytecode[offset])
-			offset++
-			factName := string(e.bytecode[offset : offset+nameLen])
-			offset += nameLen
-
-			factValue = e.Facts[factName]
-			relevantFacts[factName] = factValue
-			logging.Logger.Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Loaded fact")
-
-		case compiler.LOAD_CONST_FLOAT:
-			bits := binary.LittleEndian.Uint64(e.bytecode[offset : offset+8])
-			constValue = math.Float64frombits(bits)
-			offset += 8
-			logging.Logger.Debug().Float64("constValue", constValue.(float64)).Msg("Encountered LOAD_CONST_FLOAT opcode")
-
-		case compiler.LOAD_CONST_STRING:
-			nameLen := int(e.bytecode[offset])
-			offset++
-			constValue = string(e.bytecode[offset : offset+nameLen])
-			offset += nameLen
-			logging.Logger.Debug().Str("constValue", constValue.(string)).Msg("Encountered LOAD_CONST_STRING opcode")
-
-		case compiler.LOAD_CONST_BOOL:
-			constValue = e.bytecode[offset] == 1
-			offset++
-			logging.Logger.Debug().Bool("constValue", constValue.(bool)).Msg("Encountered LOAD_CONST_BOOL opcode")
-
-		case compiler.EQ_FLOAT, compiler.EQ_STRING, compiler.EQ_BOOL,
-			compiler.NEQ_FLOAT, compiler.NEQ_STRING, compiler.NEQ_BOOL,
-			compiler.LT_FLOAT, compiler.LTE_FLOAT, compiler.GT_FLOAT, compiler.GTE_FLOAT,
-			compiler.CONTAINS_STRING, compiler.NOT_CONTAINS_STRING:
-			comparisonResult = e.compare(factValue, constValue, opcode)
-			if comparisonResult {
-				ruleTriggered = true
-			}
-			logging.Logger.Debug().Bool("comparisonResult", comparisonResult).Msg("Comparison result")
-
-		case compiler.JUMP_IF_FALSE:
-			jumpOffset := int(binary.LittleEndian.Uint32(e.bytecode[offset : offset+4]))
-			offset += 4
-			logging.Logger.Debug().Int("jumpOffset", jumpOffset).Msg("Encountered JUMP_IF_FALSE opcode")
-			if !comparisonResult {
-				offset = offset + jumpOffset
-			}
+	case compiler.ACTION_VALUE_FLOAT, compiler.ACTION_VALUE_STRING, compiler.ACTION_VALUE_BOOL,
+		compiler.ACTION_VALUE_ARRAY, compiler.ACTION_VALUE_OBJECT, compiler.ACTION_VALUE_TEMPLATE,
+		compiler.SCRIPT_CALL:
+		value, err := e.actionValue(s, in)
+		if err != nil {
+			return 0, err
+		}
+		// The script of a call runs once, when the action ends, so a
+		// delayed action schedules its result rather than writing it now
+		s.action.Value = value
 
-		case compiler.JUMP_IF_TRUE:
-			jumpOffset := int(binary.LittleEndian.Uint32(e.bytecode[offset : offset+4]))
-			offset += 4
-			logging.Logger.Debug().Int("jumpOffset", jumpOffset).Msg("Encountered JUMP_IF_TRUE opcode")
-			if comparisonResult {
-				offset = offset + jumpOffset
-			}
+	case compiler.ACTION_DELAY:
+		s.actionDelay = in.delay
+		s.cancelIfFalse = in.flag
 
-		case compiler.ACTION_VALUE_FLOAT:
-			bits := binary.LittleEndian.Uint64(e.bytecode[offset : offset+8])
-			actionValue := math.Float64frombits(bits)
-			offset += 8
-			action.Value = actionValue
-			logging.Logger.Debug().Float64("actionValue", actionValue).Msg("Encountered ACTION_VALUE_FLOAT opcode")
-
-		case compiler.ACTION_VALUE_STRING:
-			nameLen := int(e.bytecode[offset])
-			offset++
-			actionValue := string(e.bytecode[offset : offset+nameLen])
-			offset += nameLen
-			action.Value = actionValue
-			logging.Logger.Debug().Str("actionValue", actionValue).Msg("Encountered ACTION_VALUE_STRING opcode")
-
-		case compiler.ACTION_VALUE_BOOL:
-			actionValue := e.bytecode[offset] == 1
-			offset++
-			action.Value = actionValue
-			logging.Logger.Debug().Bool("actionValue", actionValue).Msg("Encountered ACTION_VALUE_BOOL opcode")
-
-		case compiler.ACTION_START:
-			logging.Logger.Debug().Msg("Encountered ACTION_START opcode")
-
-		case compiler.ACTION_END:
-			logging.Logger.Debug().Msg("Encountered ACTION_END opcode")
-			err := e.executeAction(action)
-			if err != nil {
-				logging.Logger.Error().Err(err).Msg("Failed to execute action")
-				return err
-			}
+	case compiler.ACTION_ONLY_IF_CHANGED:
+		onlyIfChanged := in.flag
+		s.action.OnlyIfChanged = &onlyIfChanged
 
-		case compiler.LABEL:
-			offset += 4
-			logging.Logger.Debug().Msg("Encountered LABEL opcode")
-
-		case compiler.ACTION_TYPE:
-			nameLen := int(e.bytecode[offset])
-			offset++
-			action.Type = string(e.bytecode[offset : offset+nameLen])
-			offset += nameLen
-			logging.Logger.Debug().Str("actionType", action.Type).Msg("Encountered ACTION_TYPE opcode")
-
-		case compiler.ACTION_TARGET:
-			nameLen := int(e.bytecode[offset])
-			offset++
-			action.Target = string(e.bytecode[offset : offset+nameLen])
-			offset += nameLen
-			logging.Logger.Debug().Str("actionTarget", action.Target).Msg("Encountered ACTION_TARGET opcode")
-
-		case compiler.SCRIPT_DEF:
-			logging.Logger.Debug().Msg("Encountered SCRIPT_DEF opcode")
-			scriptNameLen := int(e.bytecode[offset])
-			offset++
-			scriptName := string(e.bytecode[offset : offset+scriptNameLen])
-			offset += scriptNameLen
-
-			paramsCount := int(e.bytecode[offset])
-			offset++
-			params := make([]string, paramsCount)
-			for i := 0; i < paramsCount; i++ {
-				paramLen := int(e.bytecode[offset])
-				offset++
-				params[i] = string(e.bytecode[offset : offset+paramLen])
-				offset += paramLen
-			}
+	case compiler.ACTION_START:
+		s.startAction()
 
-			bodyLen := int(e.bytecode[offset])
-			offset++
-			body := string(e.bytecode[offset : offset+bodyLen])
-			offset += bodyLen
+	case compiler.ACTION_END:
+		if err := e.endAction(s); err != nil {
+			return 0, err
+		}
 
-			script := compiler.Script{
-				Params: params,
-				Body:   body,
-			}
-			err := e.ScriptEngine.SetScript(scriptName, script)
-			if err != nil {
-				return logging.NewError(logging.ErrorTypeRuntime, "Failed to set script", err, map[string]interface{}{"ruleName": ruleName, "scriptName": scriptName})
-			}
-			logging.Logger.Debug().Str("scriptName", scriptName).Str("body", body).Strs("params", params).Msg("Script defined")
-
-		case compiler.SCRIPT_CALL:
-			logging.Logger.Debug().Msg("Encountered SCRIPT_CALL opcode")
-			scriptNameLen := int(e.bytecode[offset])
-			offset++
-			scriptName := string(e.bytecode[offset : offset+scriptNameLen])
-			offset += scriptNameLen
-
-			logging.Logger.Debug().Str("scriptName", scriptName).Msg("Calling script")
-
-			paramsCount := int(e.bytecode[offset])
-			offset++
-			params := make(map[string]interface{})
-			for i := 0; i < paramsCount; i++ {
-				paramNameLen := int(e.bytecode[offset])
-				offset++
-				paramName := string(e.bytecode[offset : offset+paramNameLen])
-				offset += paramNameLen
-
-				params[paramName] = e.Facts[paramName]
-			}
+	case compiler.ACTION_TYPE:
+		s.action.Type = in.str
 
-			logging.Logger.Debug().Interface("scriptName", scriptName).Interface("params", params).Msg("Script parameters")
+	case compiler.ACTION_TARGET:
+		s.action.Target = in.str
 
-			action.Value = map[string]interface{}{
-				"scriptName": scriptName,
-				"params":     params,
-			}
+	case compiler.SCRIPT_DEF:
+		err := e.ScriptEngine.SetScript(in.script.name, in.script.definition)
+		if err != nil {
+			return 0, logging.NewError(logging.ErrorTypeRuntime, "Failed to set script", err, map[string]interface{}{"ruleName": s.ruleName, "scriptName": in.script.name})
+		}
 
-			err := e.executeAction(action)
-			if err != nil {
-				logging.Logger.Error().Err(err).Str("scriptName", scriptName).Interface("params", params).Msg("Failed to run script")
-				return logging.NewError(logging.ErrorTypeRuntime, "Failed to run script", err, map[string]interface{}{"ruleName": ruleName, "scriptName": scriptName})
-			}
+	default:
+		err := logging.NewError(logging.ErrorTypeRuntime, "Unknown opcode encountered", nil, map[string]interface{}{"opcode": in.opcode})
+		e.log().Warn().Err(err).Msg("Unknown opcode")
+		return 0, err
+	}
+	return pc + 1, nil
+}
 
-		default:
-			err := logging.NewError(logging.ErrorTypeRuntime, "Unknown opcode encountered", nil, map[string]interface{}{"opcode": opcode})
-			logging.Logger.Warn().Err(err).Msg("Unknown opcode")
-			return err
+// actionValue returns the value an ACTION_VALUE_* or SCRIPT_CALL instruction
+// sets on the action being built.
+func (e *Engine) actionValue(s *ruleState, in *instruction) (interface{}, error) {
+	switch in.opcode {
+	case compiler.ACTION_VALUE_ARRAY, compiler.ACTION_VALUE_OBJECT:
+		var value interface{}
+		if err := json.Unmarshal(in.raw, &value); err != nil {
+			return nil, logging.NewError(logging.ErrorTypeRuntime, "Failed to decode structured action value", err, map[string]interface{}{"ruleName": s.ruleName, "opcode": in.opcode.String()})
+		}
+		return value, nil
+
+	case compiler.ACTION_VALUE_TEMPLATE:
+		return e.renderTemplate(in.template), nil
+
+	case compiler.SCRIPT_CALL:
+		params := make(map[string]interface{}, len(in.script.params))
+		for _, slot := range in.script.params {
+			params[e.facts[slot]], _ = e.Fact(e.facts[slot])
 		}
+		return scriptCall{name: in.script.name, params: params}, nil
+
+	default:
+		return in.value, nil
 	}
+}
 
-	logging.Logger.Debug().
-		Str("ruleName", ruleName).
-		Bool("ruleTriggered", ruleTriggered).
-		Msg("Finished rule evaluation")
+// startAction starts building the next action of the rule.
+func (s *ruleState) startAction() {
+	s.action = compiler.Action{}
+	s.actionDelay = 0
+	s.cancelIfFalse = false
+	s.actionIndex++
+}
 
+// endAction runs the action that was built, schedules it if it is delayed,
+// or adds it to the batch of an atomic rule.
+func (e *Engine) endAction(s *ruleState) error {
+	var err error
+	if s.actionDelay > 0 {
+		err = e.scheduleAction(s.ruleName, s.actionIndex, s.action, s.actionDelay, s.cancelIfFalse)
+	} else if s.rule.atomic && s.action.Type == "updateStore" {
+		value, err := e.resolveActionValue(s.action.Value)
+		if err != nil {
+			// Returning the error abandons the rule, so its batch is never
+			// committed
+			e.log().Error().Err(err).Msg("Failed to execute action")
+			return err
+		}
+		if cached, ok := e.Fact(s.action.Target); ok && e.onlyIfChanged(s.action) && reflect.DeepEqual(cached, value) {
+			e.log().Debug().Str("factName", s.action.Target).Msg("Fact unchanged, skipped write")
+		} else {
+			s.batch = append(s.batch, store.FactUpdate{Key: s.action.Target, Value: value})
+		}
+	} else {
+		err = e.executeAction(s.ev, s.ruleName, s.action)
+	}
+	if err != nil {
+		e.log().Error().Err(err).Msg("Failed to execute action")
+	}
+	return err
+}
+
+// endRule commits the writes of an atomic rule and cancels the delayed
+// actions of a rule whose conditions were false.
+func (e *Engine) endRule(s *ruleState) error {
+	if len(s.batch) > 0 {
+		if err := e.commitFactUpdates(s.ev, s.ruleName, s.batch); err != nil {
+			return logging.NewError(logging.ErrorTypeRuntime, "Failed to commit atomic rule updates", err, map[string]interface{}{"ruleName": s.ruleName})
+		}
+	}
+	if s.actionIndex < 0 {
+		// The conditions jumped past the actions, so the rule is false
+		e.cancelPendingActions(s.ruleName)
+	}
+	if s.ruleTriggered && s.rule.priority <= e.priorityThreshold {
+		relevantFacts := make(map[string]interface{}, len(s.rule.facts))
+		for _, slot := range s.rule.facts {
+			relevantFacts[e.facts[slot]], _ = e.Fact(e.facts[slot])
+		}
+		e.log().Info().
+			Str("ruleName", s.ruleName).
+			Int("priority", s.rule.priority).
+			Interface("relevantFacts", relevantFacts).
+			Msg("High-priority rule triggered")
+	}
 	return nil
 }
 
 // compare compares the given `factValue` and `constValue` based on the provided `opcode`.
-// It returns true if the comparison is successful, otherwise false.
+// It returns true if the comparison is successful, otherwise false. A fact
+// value of another type than the constant is never equal, unequal, less or
+// greater, as with rules compiled to Go.
 func (e *Engine) compare(factValue, constValue interface{}, opcode compiler.Opcode) bool {
 	if factValue == nil || constValue == nil {
-		logging.Logger.Warn().Msgf("Nil value encountered in comparison: factValue=%v, constValue=%v", factValue, constValue)
+		e.log().Warn().Msgf("Nil value encountered in comparison: factValue=%v, constValue=%v", factValue, constValue)
+		return false
+	}
+	if reflect.TypeOf(factValue) != reflect.TypeOf(constValue) {
+		e.log().Warn().Msgf("Mismatched types in comparison: factValue=%v (%T), constValue=%v (%T)", factValue, factValue, constValue, constValue)
 		return false
 	}
 
@@ -547,76 +710,89 @@ func (e *Engine) compare(factValue, constValue interface{}, opcode compiler.Opco
 	case compiler.NOT_CONTAINS_STRING:
 		return !strings.Contains(factValue.(string), constValue.(string))
 	default:
-		logging.Logger.Warn().Uint8("opcode", uint8(opcode)).Msg("Unknown comparison opcode")
+		e.log().Warn().Uint8("opcode", uint8(opcode)).Msg("Unknown comparison opcode")
 		return false
 	}
 }
 
-func (e *Engine) executeAction(action compiler.Action) error {
-	logging.Logger.Debug().
+// executeAction runs an action of a rule. Facts it writes are recorded in ev,
+// which is nil for actions run outside of a rule evaluation.
+func (e *Engine) executeAction(ev *evaluation, ruleName string, action compiler.Action) error {
+	e.log().Debug().
 		Str("actionType", action.Type).
 		Str("actionTarget", action.Target).
 		Interface("actionValue", action.Value).
 		Msg("Executing action")
 
+	if handler, ok := e.actionHandlers[action.Type]; ok {
+		value, err := e.resolveActionValue(action.Value)
+		if err != nil {
+			return err
+		}
+		if err := handler(ruleName, action, value); err != nil {
+			e.log().Error().Err(err).Str("actionType", action.Type).Str("ruleName", ruleName).Msg("Action handler failed")
+			return err
+		}
+		return nil
+	}
+
 	switch action.Type {
 	case "updateStore":
 		factName := action.Target
-		factValue := action.Value
-
-		// Check if the factValue is a script call
-		if scriptInfo, ok := factValue.(map[string]interface{}); ok {
-			if scriptName, ok := scriptInfo["scriptName"].(string); ok {
-				params := scriptInfo["params"].(map[string]interface{})
-				logging.Logger.Debug().
-					Str("scriptName", scriptName).
-					Interface("params", params).
-					Msg("Executing script")
-				result, err := e.ScriptEngine.RunScript(scriptName, params, 100*time.Millisecond)
-				if err != nil {
-					logging.Logger.Error().Err(err).Str("scriptName", scriptName).Msg("Failed to run script")
-					return err
-				}
-				factValue = result
-				logging.Logger.Debug().
-					Str("scriptName", scriptName).
-					Interface("scriptResult", result).
-					Msg("Script executed")
-			}
+		factValue, err := e.resolveActionValue(action.Value)
+		if err != nil {
+			return err
 		}
 
 		// Update the fact value in the local fact store
-		e.Facts[factName] = factValue
+		e.setFact(factName, factValue)
 
-		logging.Logger.Debug().
+		e.log().Debug().
 			Str("factName", factName).
 			Interface("factValue", factValue).
 			Msg("Fact updated in local store")
 
-		// Send the fact update to the store via a set and publish command
-		err := e.store.SetAndPublishFact(factName, factValue)
-		if err != nil {
-			logging.Logger.Error().Err(err).Str("factName", factName).Interface("factValue", factValue).Msg("Failed to update fact in Redis store")
-			return err
-		}
-
-		logging.Logger.Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Updated fact in Redis store")
-
-		// Verify the fact was stored correctly
-		storedValue, err := e.store.GetFact(factName)
-		if err != nil {
-			logging.Logger.Error().Err(err).Str("factName", factName).Msg("Failed to retrieve fact from Redis store")
+		// Send the fact update to the store via a set and publish command,
+		// skipping it if the store already holds the value
+		e.expectEcho(ev, factName, factValue)
+		if e.onlyIfChanged(action) {
+			written, err := e.store.SetAndPublishFactIfChanged(factName, factValue)
+			if err != nil {
+				e.forgetEcho(factName)
+				e.log().Error().Err(err).Str("factName", factName).Interface("factValue", factValue).Msg("Failed to update fact in Redis store")
+				e.deadLetterWrite(ruleName, []store.FactUpdate{{Key: factName, Value: factValue}}, err)
+				return err
+			}
+			if !written {
+				e.forgetEcho(factName)
+				e.log().Debug().Str("factName", factName).Msg("Fact unchanged in Redis store, skipped write")
+				break
+			}
 		} else {
-			logging.Logger.Debug().Str("factName", factName).Interface("storedValue", storedValue).Msg("Retrieved fact from Redis store")
+			var publishErr *store.PublishError
+			if err = e.store.SetAndPublishFact(factName, factValue); errors.As(err, &publishErr) {
+				// The fact is stored, so the write took effect, but no echo
+				// will come back
+				e.forgetEcho(factName)
+				e.log().Error().Err(err).Str("factName", factName).Msg("Updated fact but failed to publish it")
+			} else if err != nil {
+				e.forgetEcho(factName)
+				e.log().Error().Err(err).Str("factName", factName).Interface("factValue", factValue).Msg("Failed to update fact in Redis store")
+				e.deadLetterWrite(ruleName, []store.FactUpdate{{Key: factName, Value: factValue}}, err)
+				return err
+			}
 		}
 
+		e.recordWrite(ev, factName)
+		e.log().Debug().Str("factName", factName).Interface("factValue", factValue).Msg("Updated fact in Redis store")
+
 	default:
 		err := logging.NewError(logging.ErrorTypeRuntime, "Unknown action type encountered", nil, map[string]interface{}{"type": action.Type})
-		logging.Logger.Warn().Err(err).Msg("Unknown action type")
+		e.log().Warn().Err(err).Msg("Unknown action type")
 		return err
 	}
 
-	logging.Logger.Debug().
+	e.log().Debug().
 		Str("actionType", action.Type).
 		Str("actionTarget", action.Target).
 		Msg("Finished executing action")
@@ -624,45 +800,225 @@ func (e *Engine) executeAction(action compiler.Action) error {
 	return nil
 }
 
+// onlyIfChanged reports whether an action should skip unchanged writes, using
+// the action's own setting if it has one and the engine default otherwise.
+func (e *Engine) onlyIfChanged(action compiler.Action) bool {
+	if action.OnlyIfChanged != nil {
+		return *action.OnlyIfChanged
+	}
+	return e.OnlyIfChanged
+}
+
+// commitFactUpdates writes a batch of fact updates of a rule in a single store
+// transaction and, once it commits, updates the local fact store.
+func (e *Engine) commitFactUpdates(ev *evaluation, ruleName string, updates []store.FactUpdate) error {
+	for _, update := range updates {
+		e.expectEcho(ev, update.Key, update.Value)
+	}
+	var publishErr *store.PublishError
+	if err := e.store.SetAndPublishFacts(updates); errors.As(err, &publishErr) {
+		// The facts are stored, so the rule's writes took effect, but no
+		// echoes will come back
+		for _, update := range updates {
+			e.forgetEcho(update.Key)
+		}
+		e.log().Error().Err(err).Int("count", len(updates)).Msg("Committed fact updates but failed to publish them")
+	} else if err != nil {
+		for _, update := range updates {
+			e.forgetEcho(update.Key)
+		}
+		e.log().Error().Err(err).Int("count", len(updates)).Msg("Failed to commit fact updates")
+		e.deadLetterWrite(ruleName, updates, err)
+		return err
+	}
+	for _, update := range updates {
+		e.setFact(update.Key, update.Value)
+		e.recordWrite(ev, update.Key)
+	}
+	e.log().Debug().Int("count", len(updates)).Msg("Committed fact updates")
+	return nil
+}
+
+// resolveActionValue returns the value an action writes. Script calls are run
+// and replaced by their result; any other value is returned as-is.
+func (e *Engine) resolveActionValue(value interface{}) (interface{}, error) {
+	call, ok := value.(scriptCall)
+	if !ok {
+		return value, nil
+	}
+
+	e.log().Debug().
+		Str("scriptName", call.name).
+		Interface("params", call.params).
+		Msg("Executing script")
+	timeout := e.scriptTimeout
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+	result, err := e.ScriptEngine.RunScript(call.name, call.params, timeout)
+	if err != nil {
+		e.log().Error().Err(err).Str("scriptName", call.name).Msg("Failed to run script")
+		return nil, err
+	}
+	e.log().Debug().
+		Str("scriptName", call.name).
+		Interface("scriptResult", result).
+		Msg("Script executed")
+	return result, nil
+}
+
+// StartFactProcessing queues fact updates published to the store for
+// evaluation, until the fact channel is closed or Shutdown is called.
 func (e *Engine) StartFactProcessing() {
-	logging.Logger.Info().Msg("Starting fact processing loop")
+	e.log().Info().Msg("Starting fact processing loop")
 	factChan := e.store.ReceiveFacts()
 
-	for msg := range factChan {
-		logging.Logger.Debug().
-			Str("channel", msg.Channel).
-			Str("payload", msg.Payload).
-			Msg("Received fact update")
-
-		parts := strings.SplitN(msg.Payload, "=", 2)
-		if len(parts) != 2 {
-			logging.Logger.Warn().
+	for {
+		select {
+		case msg, ok := <-factChan:
+			if !ok {
+				e.log().Info().Msg("Fact channel closed, stopping fact processing loop")
+				return
+			}
+			e.log().Debug().
+				Str("channel", msg.Channel).
 				Str("payload", msg.Payload).
-				Msg("Invalid fact update format")
-			continue
+				Msg("Received fact update")
+			// Invalid payloads are logged and dead-lettered by IngestMessage
+			_ = e.IngestMessage(msg.Channel, msg.Payload)
+
+		case <-e.stop:
+			e.log().Info().Msg("Stopping fact processing loop")
+			return
 		}
+	}
+}
 
-		factName := parts[0]
-		factValue := parts[1]
+// Fact returns the engine's local value of a fact. It is safe to call while
+// the engine processes updates.
+func (e *Engine) Fact(name string) (interface{}, bool) {
+	e.factsMu.RLock()
+	defer e.factsMu.RUnlock()
+	value, ok := e.Facts[name]
+	return value, ok
+}
 
-		// Convert factValue to appropriate type
-		var value interface{}
-		if floatVal, err := strconv.ParseFloat(factValue, 64); err == nil {
-			value = floatVal
-		} else if boolVal, err := strconv.ParseBool(factValue); err == nil {
-			value = boolVal
-		} else {
-			value = factValue
-		}
+// setFact sets the local value of a fact.
+func (e *Engine) setFact(name string, value interface{}) {
+	e.factsMu.Lock()
+	defer e.factsMu.Unlock()
+	e.setFactLocked(name, value)
+}
 
-		e.ProcessFactUpdate(factName, value)
+// setFactLocked sets the local value of a fact with factsMu held, counting a
+// new version of the fact if the value changed.
+func (e *Engine) setFactLocked(name string, value interface{}) {
+	if e.Facts == nil {
+		e.Facts = make(map[string]interface{})
+	}
+	if e.factVersions == nil {
+		e.factVersions = make(map[string]uint64)
+	}
+	if old, ok := e.Facts[name]; !ok || !sameFactValue(old, value) {
+		e.factVersions[name]++
 	}
+	e.Facts[name] = value
 }
 
-func (e *Engine) Shutdown() {
-	logging.Logger.Info().Msg("Initiating engine shutdown")
+// deleteFactLocked removes the local value of a fact with factsMu held,
+// counting a new version of the fact if it had a value.
+func (e *Engine) deleteFactLocked(name string) {
+	if _, ok := e.Facts[name]; !ok {
+		return
+	}
+	if e.factVersions == nil {
+		e.factVersions = make(map[string]uint64)
+	}
+	delete(e.Facts, name)
+	e.factVersions[name]++
+}
 
-	// Shutdown performance monitoring
+// factsSnapshot returns a copy of the local fact values.
+func (e *Engine) factsSnapshot() map[string]interface{} {
+	e.factsMu.RLock()
+	defer e.factsMu.RUnlock()
+	snapshot := make(map[string]interface{}, len(e.Facts))
+	for name, value := range e.Facts {
+		snapshot[name] = value
+	}
+	return snapshot
+}
 
-	logging.Logger.Info().Msg("Engine shutdown complete")
+// ParseFactValue converts the value half of a "key=value" fact update into
+// the most specific type it represents: a float64, a bool, a decoded JSON
+// array or object, or otherwise the raw string. Bools are parsed by
+// strconv.ParseBool, as rexd always has, so "t", "T", "True" and "TRUE" are
+// true like "true", and likewise for false; "1" and "0" are numbers.
+func ParseFactValue(raw string) interface{} {
+	if floatVal, err := strconv.ParseFloat(raw, 64); err == nil {
+		return floatVal
+	}
+	if boolVal, err := strconv.ParseBool(raw); err == nil {
+		return boolVal
+	}
+	if strings.HasPrefix(raw, "[") || strings.HasPrefix(raw, "{") {
+		var structured interface{}
+		if err := json.Unmarshal([]byte(raw), &structured); err == nil {
+			return structured
+		}
+	}
+	return raw
+}
+
+// Shutdown stops the engine gracefully. It stops taking in fact updates and
+// delayed actions, then waits for the queued updates to be evaluated, the
+// delayed actions already running to complete, and the store writes of their
+// actions to complete. If ctx is done first, the updates still queued are
+// discarded, and ctx's error is returned once the updates being evaluated and
+// the delayed actions running complete. Pending delayed actions stay
+// persisted in the store and are restored by the next engine. The store
+// itself is left open. Updates queued on an engine that was never started are
+// discarded.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	e.log().Info().Msg("Initiating engine shutdown")
+
+	// Stop intake
+	started := e.started.Load()
+	if e.stop != nil {
+		e.stopOnce.Do(func() { close(e.stop) })
+		if started {
+			<-e.loopDone
+		}
+	}
+	e.stopPendingActions()
+	if e.queue != nil {
+		e.queue.close()
+	}
+
+	// Drain the queue and the workers
+	drained := make(chan struct{})
+	go func() {
+		if started {
+			<-e.dispatchDone
+		}
+		e.StopWorkers()
+		e.pendingRuns.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		e.log().Info().Msg("Engine shutdown complete")
+		return nil
+	case <-ctx.Done():
+	}
+
+	e.discarding.Store(true)
+	discarded := 0
+	if e.queue != nil {
+		discarded = e.queue.discard()
+	}
+	e.log().Warn().Int("discarded", discarded).Msg("Engine shutdown deadline reached, discarded queued updates")
+	<-drained
+	return ctx.Err()
 }
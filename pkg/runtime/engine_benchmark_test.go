@@ -1,6 +1,8 @@
 package runtime
 
 import (
+	"fmt"
+	"os"
 	"runtime"
 	"testing"
 	"time"
@@ -65,14 +67,16 @@ func createMockEngine(b *testing.B, redisStore *store.RedisStore) *Engine {
 		},
 	}
 
-	// Generate bytecode
-	bytecodeFile := compiler.GenerateBytecode(ruleset)
+	// Generate and load the bytecode
+	filename := createTestBytecodeFile(b, ruleset)
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	if err != nil {
+		b.Fatalf("Failed to load bytecode: %v", err)
+	}
 
 	engine := &Engine{
-		bytecode:            bytecodeFile.Instructions,
-		ruleExecutionIndex:  bytecodeFile.RuleExecIndex,
-		factRuleIndex:       bytecodeFile.FactRuleLookupIndex,
-		factDependencyIndex: bytecodeFile.FactDependencyIndex,
+		program: program.program,
 		Facts: map[string]interface{}{
 			"temperature":        25.0,
 			"humidity":           60.0,
@@ -92,7 +96,7 @@ func createMockEngine(b *testing.B, redisStore *store.RedisStore) *Engine {
 	}
 
 	// Add the script to the engine
-	err := engine.ScriptEngine.SetScript("calculate_heat_index", compiler.Script{
+	err = engine.ScriptEngine.SetScript("calculate_heat_index", compiler.Script{
 		Params: []string{"temperature", "humidity"},
 		Body:   "return temperature * 1.8 + 32 + (humidity / 100) * 10;",
 	})
@@ -121,9 +125,24 @@ func BenchmarkEvaluateRule(b *testing.B) {
 
 	engine := createMockEngine(b, redisStore)
 
+	ev := &evaluation{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.evaluateRule(ev, "temperature_alert")
+	}
+}
+
+func BenchmarkEvaluateRuleCompiled(b *testing.B) {
+	s, redisStore := setupMiniRedis(b)
+	defer s.Close()
+
+	engine := createMockEngine(b, redisStore)
+	engine.compileRules()
+
+	ev := &evaluation{}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		engine.evaluateRule("temperature_alert")
+		engine.evaluateRule(ev, "temperature_alert")
 	}
 }
 
@@ -152,7 +171,7 @@ func BenchmarkExecuteAction(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		engine.executeAction(action)
+		engine.executeAction(nil, "benchmark", action)
 	}
 }
 
@@ -211,3 +230,170 @@ func BenchmarkRunScript(b *testing.B) {
 		}
 	}
 }
+
+// createLargeEngine creates an engine for a ruleset of n rules. Rule i
+// depends on sensor:<i/10> and zone:<i%10>, so every sensor fact triggers 10
+// rules however large the ruleset. The thresholds are never reached, so no
+// rule fires. With native set, the rules run native conditions like those
+// generated by rexc -emit go.
+func createLargeEngine(b *testing.B, redisStore *store.RedisStore, n int, native bool, opts ...Option) *Engine {
+	rules := make([]compiler.Rule, n)
+	for i := range rules {
+		rules[i] = compiler.Rule{
+			Name:     fmt.Sprintf("rule_%d", i),
+			Priority: i % 10,
+			Conditions: compiler.ConditionGroup{
+				All: []*compiler.ConditionOrGroup{
+					{Fact: fmt.Sprintf("sensor:%d", i/10), Operator: "GT", Value: float64(1000 + i)},
+					{Fact: fmt.Sprintf("zone:%d", i%10), Operator: "EQ", Value: "alarm"},
+				},
+			},
+			Actions: []compiler.Action{
+				{Type: "updateStore", Target: fmt.Sprintf("alerts:%d", i), Value: true},
+			},
+		}
+	}
+
+	filename := createTestBytecodeFile(b, &compiler.Ruleset{Rules: rules})
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	if native {
+		var bytecode []byte
+		bytecode, err = os.ReadFile(filename)
+		if err == nil {
+			program, err = LoadNativeProgram(bytecode, largeConditions(n))
+		}
+	}
+	if err != nil {
+		b.Fatalf("Failed to load bytecode: %v", err)
+	}
+	engine, err := NewEngine(program, redisStore, opts...)
+	if err != nil {
+		b.Fatalf("Failed to create engine: %v", err)
+	}
+
+	for i := 0; i < n/10; i++ {
+		fact := fmt.Sprintf("sensor:%d", i)
+		if err := redisStore.SetFact(fact, 0.0); err != nil {
+			b.Fatalf("Failed to set fact in Redis store: %v", err)
+		}
+		engine.setFact(fact, 0.0)
+	}
+	for i := 0; i < 10; i++ {
+		fact := fmt.Sprintf("zone:%d", i)
+		if err := redisStore.SetFact(fact, "normal"); err != nil {
+			b.Fatalf("Failed to set fact in Redis store: %v", err)
+		}
+		engine.setFact(fact, "normal")
+	}
+	return engine
+}
+
+// largeConditions returns the native conditions of the rules of
+// createLargeEngine.
+func largeConditions(n int) map[string]Condition {
+	conditions := make(map[string]Condition, n)
+	for i := 0; i < n; i++ {
+		sensor, threshold, zone := fmt.Sprintf("sensor:%d", i/10), float64(1000+i), fmt.Sprintf("zone:%d", i%10)
+		conditions[fmt.Sprintf("rule_%d", i)] = func(facts Facts) bool {
+			sensorValue, _ := facts.Fact(sensor)
+			if v, ok := sensorValue.(float64); !ok || !(v > threshold) {
+				return false
+			}
+			zoneValue, _ := facts.Fact(zone)
+			v, ok := zoneValue.(string)
+			return ok && v == "alarm"
+		}
+	}
+	return conditions
+}
+
+var ruleCounts = []int{1000, 10000, 100000}
+
+func BenchmarkProcessFactUpdateRules(b *testing.B) {
+	for _, n := range ruleCounts {
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			s, redisStore := setupMiniRedis(b)
+			defer s.Close()
+			engine := createLargeEngine(b, redisStore, n, false)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				engine.ProcessFactUpdate(fmt.Sprintf("sensor:%d", i%(n/10)), float64(i%500))
+			}
+		})
+	}
+}
+
+func BenchmarkEvaluateRuleRules(b *testing.B) {
+	for _, mode := range []string{string(ExecutionInterpreted), string(ExecutionCompiled), "native"} {
+		for _, n := range ruleCounts {
+			b.Run(fmt.Sprintf("mode=%s/rules=%d", mode, n), func(b *testing.B) {
+				s, redisStore := setupMiniRedis(b)
+				defer s.Close()
+				var engine *Engine
+				if mode == "native" {
+					engine = createLargeEngine(b, redisStore, n, true)
+				} else {
+					engine = createLargeEngine(b, redisStore, n, false, WithExecutionMode(ExecutionMode(mode)))
+				}
+				ruleName := fmt.Sprintf("rule_%d", n-1)
+
+				ev := &evaluation{}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					engine.evaluateRule(ev, ruleName)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSharedConditions evaluates 1000 rules that all test the same
+// temperature condition, which is evaluated once and then read from the cache.
+func BenchmarkSharedConditions(b *testing.B) {
+	const n = 1000
+	rules := make([]compiler.Rule, n)
+	ruleNames := make([]string, n)
+	for i := range rules {
+		ruleNames[i] = fmt.Sprintf("rule_%d", i)
+		rules[i] = compiler.Rule{
+			Name: ruleNames[i],
+			Conditions: compiler.ConditionGroup{
+				All: []*compiler.ConditionOrGroup{
+					{Fact: "weather:temperature", Operator: "GT", Value: 30.0},
+					{Fact: fmt.Sprintf("sensor:%d", i), Operator: "GT", Value: float64(i)},
+				},
+			},
+			Actions: []compiler.Action{
+				{Type: "updateStore", Target: fmt.Sprintf("alerts:%d", i), Value: true},
+			},
+		}
+	}
+
+	for _, mode := range []ExecutionMode{ExecutionInterpreted, ExecutionCompiled} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			s, redisStore := setupMiniRedis(b)
+			defer s.Close()
+			filename := createTestBytecodeFile(b, &compiler.Ruleset{Rules: rules})
+			defer os.Remove(filename)
+			program, err := LoadProgramFile(filename)
+			if err != nil {
+				b.Fatalf("Failed to load bytecode: %v", err)
+			}
+			engine, err := NewEngine(program, redisStore, WithExecutionMode(mode))
+			if err != nil {
+				b.Fatalf("Failed to create engine: %v", err)
+			}
+			engine.setFact("weather:temperature", 20.0)
+
+			ev := &evaluation{}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, ruleName := range ruleNames {
+					engine.evaluateRule(ev, ruleName)
+				}
+			}
+		})
+	}
+}
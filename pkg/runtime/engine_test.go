@@ -24,7 +24,7 @@ func setupMiniredis(t *testing.T) (*miniredis.Miniredis, *store.RedisStore) {
 	return s, redisStore
 }
 
-func createTestBytecodeFile(t *testing.T, ruleset *compiler.Ruleset) string {
+func createTestBytecodeFile(t testing.TB, ruleset *compiler.Ruleset) string {
 	bytecode := compiler.GenerateBytecode(ruleset)
 	filename := "test_bytecode.bin"
 	err := compiler.WriteBytecodeToFile(filename, bytecode)
@@ -63,7 +63,7 @@ func TestProcessFactUpdate(t *testing.T) {
 	filename := createTestBytecodeFile(t, ruleset)
 	defer os.Remove(filename)
 
-	engine, err := NewEngineFromFile(filename, redisStore, 0)
+	engine, err := NewEngineFromFile(filename, redisStore)
 	assert.NoError(t, err)
 
 	engine.ProcessFactUpdate("temperature", 35.0)
@@ -124,7 +124,7 @@ func TestMultipleRules(t *testing.T) {
 	filename := createTestBytecodeFile(t, ruleset)
 	defer os.Remove(filename)
 
-	engine, err := NewEngineFromFile(filename, redisStore, 0)
+	engine, err := NewEngineFromFile(filename, redisStore)
 	assert.NoError(t, err)
 
 	engine.ProcessFactUpdate("temperature", 35.0)
@@ -138,6 +138,79 @@ func TestMultipleRules(t *testing.T) {
 	assert.Equal(t, "true", humidifierValue)
 }
 
+func TestStructuredActionValues(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	engine := createTestEngine(redisStore, `{
+        "rules": [{
+            "name": "structured_rule",
+            "conditions": {
+                "all": [{
+                    "fact": "temperature",
+                    "operator": "GT",
+                    "value": 30
+                }]
+            },
+            "actions": [
+                {
+                    "type": "updateStore",
+                    "target": "fan_speeds",
+                    "value": [1, 2, 3]
+                },
+                {
+                    "type": "updateStore",
+                    "target": "fan_config",
+                    "value": {"mode": "eco", "scriptName": "not_a_script"}
+                }
+            ]
+        }]
+    }`)
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+
+	// Both values are stored as JSON in Redis
+	speeds, err := s.Get("fan_speeds")
+	assert.NoError(t, err)
+	assert.Equal(t, `[1,2,3]`, speeds)
+
+	config, err := s.Get("fan_config")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"mode": "eco", "scriptName": "not_a_script"}`, config)
+
+	// And decoded back into their structured form in the engine
+	assert.Equal(t, []interface{}{1.0, 2.0, 3.0}, engine.Facts["fan_speeds"])
+	assert.Equal(t, map[string]interface{}{"mode": "eco", "scriptName": "not_a_script"}, engine.Facts["fan_config"])
+}
+
+func TestParseFactValue(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected interface{}
+	}{
+		{"35.5", 35.5},
+		{"true", true},
+		{"True", true},
+		{"TRUE", true},
+		{"t", true},
+		{"false", false},
+		{"F", false},
+		{"1", 1.0},
+		{"0", 0.0},
+		{"yes", "yes"},
+		{"hot", "hot"},
+		{"[1,2]", []interface{}{1.0, 2.0}},
+		{`{"mode":"eco"}`, map[string]interface{}{"mode": "eco"}},
+		{"[not json", "[not json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ParseFactValue(tt.raw))
+		})
+	}
+}
+
 // Add more tests here...
 
 func TestCompare(t *testing.T) {
@@ -303,7 +376,7 @@ func createTestEngine(redisStore *store.RedisStore, jsonRuleset string) *Engine
 	compiler.WriteBytecodeToFile(filename, bytecodeFile)
 	defer os.Remove(filename)
 
-	engine, _ := NewEngineFromFile(filename, redisStore, 0)
+	engine, _ := NewEngineFromFile(filename, redisStore)
 
 	// Synchronize engine's fact store with Redis store
 	facts, _ := redisStore.MGetFacts("temperature", "humidity", "pressure", "status")
@@ -358,7 +431,7 @@ func TestNestedScriptCalls(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(tempFile)
 
-	engine, err := NewEngineFromFile(tempFile, redisStore, 0)
+	engine, err := NewEngineFromFile(tempFile, redisStore)
 	assert.NoError(t, err)
 
 	// Register the nested script as a global function
@@ -432,7 +505,7 @@ func TestScriptErrorHandling(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(tempFile)
 
-	engine, err := NewEngineFromFile(tempFile, redisStore, 0)
+	engine, err := NewEngineFromFile(tempFile, redisStore)
 	assert.NoError(t, err)
 
 	err = engine.ScriptEngine.SetScript("error_script", compiler.Script{
@@ -493,7 +566,7 @@ func TestEdgeCases(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(tempFile)
 
-	engine, err := NewEngineFromFile(tempFile, redisStore, 0)
+	engine, err := NewEngineFromFile(tempFile, redisStore)
 	assert.NoError(t, err)
 
 	err = engine.ScriptEngine.SetScript("edge_case_script", compiler.Script{
@@ -513,3 +586,151 @@ func TestEdgeCases(t *testing.T) {
 	assert.False(t, exists, "Edge case script execution should not result in a status fact")
 	assert.Nil(t, status)
 }
+
+func atomicRuleset(secondValue interface{}) *compiler.Ruleset {
+	return &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name:   "AtomicRule",
+				Atomic: true,
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 30.0},
+					},
+				},
+				Actions: []compiler.Action{
+					{Type: "updateStore", Target: "system:fan_speed", Value: 3.0},
+					{Type: "updateStore", Target: "system:mode", Value: secondValue},
+				},
+				Scripts: map[string]compiler.Script{
+					"broken": {
+						Params: []string{"temperature"},
+						Body:   "return temperature.unknownMethod();",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestAtomicRule(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, atomicRuleset("cooling"))
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+
+	speed, err := s.Get("system:fan_speed")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", speed)
+	mode, err := s.Get("system:mode")
+	assert.NoError(t, err)
+	assert.Equal(t, `"cooling"`, mode)
+	assert.Equal(t, 3.0, engine.Facts["system:fan_speed"])
+	assert.Equal(t, "cooling", engine.Facts["system:mode"])
+}
+
+func TestAtomicRuleFailureWritesNothing(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// The second action fails, so the first write must not happen either
+	filename := createTestBytecodeFile(t, atomicRuleset("{broken}"))
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+
+	assert.False(t, s.Exists("system:fan_speed"))
+	assert.False(t, s.Exists("system:mode"))
+	_, exists := engine.Facts["system:fan_speed"]
+	assert.False(t, exists)
+}
+
+func TestAtomicRuleUnresolvedValueWritesNothing(t *testing.T) {
+	for _, mode := range []ExecutionMode{ExecutionInterpreted, ExecutionCompiled} {
+		t.Run(string(mode), func(t *testing.T) {
+			s, redisStore := setupMiniredis(t)
+			defer s.Close()
+
+			// The first action's value cannot be resolved, so the rule fails
+			// before the second action and commits neither
+			ruleset := atomicRuleset(3.0)
+			ruleset.Rules[0].Actions = []compiler.Action{
+				{Type: "updateStore", Target: "system:mode", Value: "{broken}"},
+				{Type: "updateStore", Target: "system:fan_speed", Value: 3.0},
+			}
+			engine, err := NewEngine(loadTestProgram(t, ruleset), redisStore, WithExecutionMode(mode), WithOnlyIfChanged(true))
+			assert.NoError(t, err)
+
+			engine.ProcessFactUpdate("temperature", 35.0)
+
+			assert.False(t, s.Exists("system:mode"))
+			assert.False(t, s.Exists("system:fan_speed"))
+			_, exists := engine.Fact("system:mode")
+			assert.False(t, exists)
+			assert.Equal(t, map[string]int{"AtomicRule": 1}, engine.RuleErrorCounts())
+		})
+	}
+}
+
+func TestOnlyIfChanged(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	never := false
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name: "CoolingRule",
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{
+						{Fact: "temperature", Operator: "GT", Value: 30.0},
+					},
+				},
+				Actions: []compiler.Action{
+					{Type: "updateStore", Target: "system:mode", Value: "cooling"},
+					{Type: "updateStore", Target: "system:heartbeat", Value: true, OnlyIfChanged: &never},
+				},
+			},
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	engine.OnlyIfChanged = true
+
+	pubsub := redisStore.Subscribe("system")
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+	engine.ProcessFactUpdate("temperature", 36.0)
+
+	// The mode is published once; the heartbeat opts out and is published every time
+	var payloads []string
+	timeout := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case msg := <-messages:
+			payloads = append(payloads, msg.Payload)
+		case <-timeout:
+			done = true
+		}
+	}
+	assert.Equal(t, []string{
+		`system:mode="cooling"`,
+		"system:heartbeat=true",
+		"system:heartbeat=true",
+	}, payloads)
+}
@@ -0,0 +1,112 @@
+// rex/pkg/runtime/errorpolicy.go
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ErrorPolicy decides what happens to the remaining rules of an update when a
+// rule fails to evaluate.
+type ErrorPolicy string
+
+const (
+	// ErrorPolicyContinue logs the error and evaluates the remaining rules.
+	ErrorPolicyContinue ErrorPolicy = "continue"
+	// ErrorPolicyAbort skips the remaining rules of the update.
+	ErrorPolicyAbort ErrorPolicy = "abort"
+	// ErrorPolicyQuarantine evaluates the remaining rules and stops evaluating
+	// a rule altogether once it has failed QuarantineAfter times.
+	ErrorPolicyQuarantine ErrorPolicy = "quarantine"
+)
+
+// DefaultQuarantineAfter is the number of errors after which the quarantine
+// policy stops evaluating a rule.
+const DefaultQuarantineAfter = 5
+
+// ParseErrorPolicy returns the error policy with the given name. An empty
+// name selects ErrorPolicyContinue.
+func ParseErrorPolicy(name string) (ErrorPolicy, error) {
+	switch policy := ErrorPolicy(name); policy {
+	case "":
+		return ErrorPolicyContinue, nil
+	case ErrorPolicyContinue, ErrorPolicyAbort, ErrorPolicyQuarantine:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown error policy %q: must be continue, abort or quarantine", name)
+	}
+}
+
+// handleRuleError counts an evaluation error of a rule and applies the error
+// policy. It reports whether the remaining rules of the update are skipped.
+func (e *Engine) handleRuleError(ruleName string, err error) bool {
+	e.errorsMu.Lock()
+	if e.ruleErrors == nil {
+		e.ruleErrors = make(map[string]int)
+	}
+	e.ruleErrors[ruleName]++
+	count := e.ruleErrors[ruleName]
+
+	quarantine := e.ErrorPolicy == ErrorPolicyQuarantine && count >= e.QuarantineAfter
+	if quarantine {
+		if e.quarantinedRules == nil {
+			e.quarantinedRules = make(map[string]struct{})
+		}
+		e.quarantinedRules[ruleName] = struct{}{}
+	}
+	e.errorsMu.Unlock()
+
+	e.log().Error().Err(err).Str("ruleName", ruleName).Int("errorCount", count).Str("errorPolicy", string(e.ErrorPolicy)).Msg("Failed to evaluate rule")
+	if quarantine {
+		e.log().Error().Str("ruleName", ruleName).Int("errorCount", count).Msg("Rule quarantined, it will no longer be evaluated")
+	}
+
+	return e.ErrorPolicy == ErrorPolicyAbort
+}
+
+// isQuarantined reports whether a rule was quarantined by the error policy.
+func (e *Engine) isQuarantined(ruleName string) bool {
+	e.errorsMu.Lock()
+	defer e.errorsMu.Unlock()
+	_, ok := e.quarantinedRules[ruleName]
+	return ok
+}
+
+// RuleErrorCounts returns the number of evaluation errors of every rule that
+// has failed at least once.
+func (e *Engine) RuleErrorCounts() map[string]int {
+	e.errorsMu.Lock()
+	defer e.errorsMu.Unlock()
+
+	counts := make(map[string]int, len(e.ruleErrors))
+	for ruleName, count := range e.ruleErrors {
+		counts[ruleName] = count
+	}
+	return counts
+}
+
+// QuarantinedRules returns the names of the rules quarantined by the error
+// policy, sorted.
+func (e *Engine) QuarantinedRules() []string {
+	e.errorsMu.Lock()
+	defer e.errorsMu.Unlock()
+
+	var ruleNames []string
+	for ruleName := range e.quarantinedRules {
+		ruleNames = append(ruleNames, ruleName)
+	}
+	sort.Strings(ruleNames)
+	return ruleNames
+}
+
+// forgetRuleErrors drops the error counts and quarantine of rules.
+func (e *Engine) forgetRuleErrors(ruleNames map[string]struct{}) {
+	e.errorsMu.Lock()
+	defer e.errorsMu.Unlock()
+
+	for ruleName := range ruleNames {
+		delete(e.ruleErrors, ruleName)
+		delete(e.quarantinedRules, ruleName)
+	}
+}
@@ -0,0 +1,82 @@
+// rex/pkg/runtime/errorpolicy_test.go
+
+package runtime
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// brokenRuleset has a high-priority rule whose script always fails, followed
+// by an unrelated rule on the same fact.
+func brokenRuleset() *compiler.Ruleset {
+	broken := priorityRule("broken", 1, "temperature", 0, "broken_fired")
+	broken.Actions[0].Value = "{fail}"
+	broken.Scripts = map[string]compiler.Script{
+		"fail": {Params: []string{"temperature"}, Body: "return temperature.unknownMethod();"},
+	}
+	return &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			broken,
+			priorityRule("healthy", 2, "temperature", 0, "healthy_fired"),
+		},
+	}
+}
+
+func TestParseErrorPolicy(t *testing.T) {
+	for name, expected := range map[string]ErrorPolicy{
+		"":           ErrorPolicyContinue,
+		"continue":   ErrorPolicyContinue,
+		"abort":      ErrorPolicyAbort,
+		"quarantine": ErrorPolicyQuarantine,
+	} {
+		policy, err := ParseErrorPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := ParseErrorPolicy("retry")
+	assert.Error(t, err)
+}
+
+func TestErrorPolicy(t *testing.T) {
+	testCases := []struct {
+		policy          ErrorPolicy
+		healthyFired    bool
+		errorCount      int
+		quarantined     []string
+		quarantineAfter int
+	}{
+		{ErrorPolicyContinue, true, 3, nil, DefaultQuarantineAfter},
+		{ErrorPolicyAbort, false, 3, nil, DefaultQuarantineAfter},
+		{ErrorPolicyQuarantine, true, 2, []string{"broken"}, 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			s, redisStore := setupMiniredis(t)
+			defer s.Close()
+
+			filename := createTestBytecodeFile(t, brokenRuleset())
+			defer os.Remove(filename)
+
+			engine, err := NewEngineFromFile(filename, redisStore)
+			assert.NoError(t, err)
+			engine.ErrorPolicy = tc.policy
+			engine.QuarantineAfter = tc.quarantineAfter
+
+			for i := 0; i < 3; i++ {
+				engine.ProcessFactUpdate("temperature", float64(10+i))
+			}
+
+			assert.False(t, s.Exists("broken_fired"))
+			assert.Equal(t, tc.healthyFired, s.Exists("healthy_fired"))
+			assert.Equal(t, map[string]int{"broken": tc.errorCount}, engine.RuleErrorCounts())
+			assert.Equal(t, tc.quarantined, engine.QuarantinedRules())
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// rex/pkg/runtime/missingfacts.go
+
+package runtime
+
+import (
+	"fmt"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// MissingFactPolicy decides what happens to the rules of an update that
+// depend on a fact the store does not hold.
+type MissingFactPolicy string
+
+const (
+	// MissingFactSkip skips the rules.
+	MissingFactSkip MissingFactPolicy = "skip"
+	// MissingFactEvaluate evaluates the rules, with conditions on the
+	// missing fact false.
+	MissingFactEvaluate MissingFactPolicy = "evaluate"
+	// MissingFactError skips the rules and reports each as failed to the
+	// error policy.
+	MissingFactError MissingFactPolicy = "error"
+)
+
+// ParseMissingFactPolicy returns the missing-fact policy with the given name.
+// An empty name selects MissingFactSkip.
+func ParseMissingFactPolicy(name string) (MissingFactPolicy, error) {
+	switch policy := MissingFactPolicy(name); policy {
+	case "":
+		return MissingFactSkip, nil
+	case MissingFactSkip, MissingFactEvaluate, MissingFactError:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown missing fact policy %q: must be skip, evaluate or error", name)
+	}
+}
+
+// applyMissingFactPolicy returns the rules to evaluate after some of the facts
+// they depend on were found missing from the store. It reports false if the
+// error policy skips the remaining rules of the update.
+func (e *Engine) applyMissingFactPolicy(ruleNames []string, missingFacts []string) ([]string, bool) {
+	if len(missingFacts) == 0 || e.missingFactPolicy == MissingFactEvaluate {
+		return ruleNames, true
+	}
+
+	missing := make(map[string]struct{}, len(missingFacts))
+	for _, fact := range missingFacts {
+		missing[fact] = struct{}{}
+	}
+
+	// Work on a copy so the fact rule index itself is left intact
+	kept := make([]string, 0, len(ruleNames))
+	for _, ruleName := range ruleNames {
+		missingFact, ok := e.missingDependency(ruleName, missing)
+		if !ok {
+			kept = append(kept, ruleName)
+			continue
+		}
+
+		if e.missingFactPolicy == MissingFactError {
+			err := logging.NewError(logging.ErrorTypeRuntime, "Fact not found in store", nil, map[string]interface{}{"ruleName": ruleName, "fact": missingFact})
+			if e.handleRuleError(ruleName, err) {
+				return nil, false
+			}
+			continue
+		}
+		e.log().Warn().
+			Str("ruleName", ruleName).
+			Str("missingFact", missingFact).
+			Msg("Removing rule due to missing fact")
+	}
+	return kept, true
+}
+
+// missingDependency returns a fact a rule depends on that is missing.
+func (e *Engine) missingDependency(ruleName string, missing map[string]struct{}) (string, bool) {
+	rule, ok := e.rule(ruleName)
+	if !ok {
+		return "", false
+	}
+	for _, fact := range rule.dependencies {
+		if _, ok := missing[fact]; ok {
+			return fact, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+// rex/pkg/runtime/native.go
+
+package runtime
+
+import (
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// Facts is what native conditions read facts from. Engine implements it.
+type Facts interface {
+	Fact(name string) (interface{}, bool)
+}
+
+// Condition is the conditions of a rule compiled ahead of time into Go, as
+// generated by rexc -emit go. It reports whether the conditions hold.
+type Condition func(facts Facts) bool
+
+// nativeRule is how a rule with a native condition runs its instructions:
+// those before conditionsStart define its scripts, those from actionsStart
+// to the RULE_END run its actions, and the condition replaces the ones in
+// between.
+type nativeRule struct {
+	condition       Condition
+	conditionsStart int
+	actionsStart    int
+}
+
+// LoadNativeProgram validates the bytecode produced by rexc, like
+// LoadProgramBytes, and replaces the conditions of its rules with native
+// conditions, by rule name. Every rule must have a condition. The engine
+// still runs the rules' actions, and finds and orders the rules, from the
+// bytecode.
+func LoadNativeProgram(bytecode []byte, conditions map[string]Condition) (*Program, error) {
+	program, err := LoadProgramBytes(bytecode)
+	if err != nil {
+		return nil, err
+	}
+
+	for ruleName := range conditions {
+		if _, ok := program.rulePositions[ruleName]; !ok {
+			return nil, logging.NewError(logging.ErrorTypeRuntime, "Native condition for a rule not in the bytecode", nil, map[string]interface{}{"ruleName": ruleName})
+		}
+	}
+	for ruleName, position := range program.rulePositions {
+		condition, ok := conditions[ruleName]
+		if !ok {
+			return nil, logging.NewError(logging.ErrorTypeRuntime, "Rule has no native condition", nil, map[string]interface{}{"ruleName": ruleName})
+		}
+		native, err := newNativeRule(&program.rules[position], condition)
+		if err != nil {
+			return nil, logging.NewError(logging.ErrorTypeRuntime, "Rule cannot run natively", err, map[string]interface{}{"ruleName": ruleName})
+		}
+		program.rules[position].native = native
+	}
+
+	logging.Logger.Debug().Int("rules", len(conditions)).Msg("Loaded native conditions")
+	return program, nil
+}
+
+// newNativeRule finds the instructions of a rule's conditions, which must be
+// the comparisons and jumps between its script definitions and its actions.
+func newNativeRule(rule *decodedRule, condition Condition) (*nativeRule, error) {
+	native := &nativeRule{condition: condition}
+	for native.conditionsStart < len(rule.instructions) && rule.instructions[native.conditionsStart].opcode == compiler.SCRIPT_DEF {
+		native.conditionsStart++
+	}
+	native.actionsStart = native.conditionsStart
+	for ; native.actionsStart < len(rule.instructions); native.actionsStart++ {
+		switch opcode := rule.instructions[native.actionsStart].opcode; opcode {
+		case compiler.ACTION_START, compiler.RULE_END:
+			return native, nil
+		case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL,
+			compiler.LOAD_CONST_FLOAT, compiler.LOAD_CONST_STRING, compiler.LOAD_CONST_BOOL,
+			compiler.EQ_FLOAT, compiler.EQ_STRING, compiler.EQ_BOOL,
+			compiler.NEQ_FLOAT, compiler.NEQ_STRING, compiler.NEQ_BOOL,
+			compiler.LT_FLOAT, compiler.LTE_FLOAT, compiler.GT_FLOAT, compiler.GTE_FLOAT,
+			compiler.CONTAINS_STRING, compiler.NOT_CONTAINS_STRING,
+			compiler.CONDITION_NODE, compiler.JUMP_IF_FALSE, compiler.JUMP_IF_TRUE:
+		default:
+			return nil, logging.NewError(logging.ErrorTypeRuntime, "Unexpected instruction in conditions", nil, map[string]interface{}{"opcode": opcode.String()})
+		}
+	}
+	return nil, logging.NewError(logging.ErrorTypeRuntime, "Rule has no RULE_END", nil, nil)
+}
+
+// runNative runs the rule at position with its native condition in place of
+// the instructions of its conditions.
+func (e *Engine) runNative(ev *evaluation, ruleName string, position int) (bool, error) {
+	s := ruleState{ev: ev, ruleName: ruleName, rule: &e.rules[position], actionIndex: -1}
+	native := s.rule.native
+
+	var err error
+	for pc := 0; pc < native.conditionsStart; {
+		if pc, err = e.execute(&s, pc); err != nil {
+			return false, err
+		}
+	}
+
+	pc := native.actionsStart
+	if native.condition(e) {
+		s.ruleTriggered = true
+	} else {
+		// Skip the actions, as the conditions' last jump would
+		pc = len(s.rule.instructions) - 1
+	}
+	for pc < len(s.rule.instructions) {
+		if pc, err = e.execute(&s, pc); err != nil {
+			return false, err
+		}
+	}
+	return s.actionIndex >= 0, nil
+}
@@ -0,0 +1,281 @@
+// rex/pkg/runtime/native_test.go
+
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// loadTestNativeProgram compiles a ruleset and loads it with native
+// conditions.
+func loadTestNativeProgram(t *testing.T, ruleset *compiler.Ruleset, conditions map[string]Condition) (*Program, error) {
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+	bytecode, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	return LoadNativeProgram(bytecode, conditions)
+}
+
+// treeCondition returns a native condition that walks the rule's condition
+// tree, with conditions typed like their bytecode, as the code generated by
+// rexc -emit go does.
+func treeCondition(rule compiler.Rule) Condition {
+	var holds func(facts Facts, c *compiler.ConditionOrGroup) bool
+	holds = func(facts Facts, c *compiler.ConditionOrGroup) bool {
+		switch {
+		case c.Fact != "":
+			factValue, _ := facts.Fact(c.Fact)
+			text := fmt.Sprintf("%v", c.Value)
+			if value, err := strconv.ParseFloat(text, 64); err == nil {
+				v, ok := factValue.(float64)
+				switch c.Operator {
+				case "EQ":
+					return ok && v == value
+				case "NEQ":
+					return ok && v != value
+				case "LT":
+					return ok && v < value
+				case "LTE":
+					return ok && v <= value
+				case "GT":
+					return ok && v > value
+				default:
+					return ok && v >= value
+				}
+			}
+			if value, err := strconv.ParseBool(text); err == nil {
+				v, ok := factValue.(bool)
+				if c.Operator == "EQ" {
+					return ok && v == value
+				}
+				return ok && v != value
+			}
+			v, ok := factValue.(string)
+			switch c.Operator {
+			case "EQ":
+				return ok && v == text
+			case "NEQ":
+				return ok && v != text
+			case "CONTAINS":
+				return ok && strings.Contains(v, text)
+			default:
+				return ok && !strings.Contains(v, text)
+			}
+		case len(c.All) > 0:
+			for _, child := range c.All {
+				if !holds(facts, child) {
+					return false
+				}
+			}
+			return true
+		default:
+			for _, child := range c.Any {
+				if holds(facts, child) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	root := &compiler.ConditionOrGroup{All: rule.Conditions.All, Any: rule.Conditions.Any}
+	return func(facts Facts) bool {
+		return len(root.All) == 0 && len(root.Any) == 0 || holds(facts, root)
+	}
+}
+
+func TestLoadNativeProgram(t *testing.T) {
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("heat", 1, "temperature", 30, "alerts:heat"),
+			priorityRule("frost", 2, "temperature", -5, "alerts:frost"),
+		},
+	}
+	always := func(Facts) bool { return true }
+
+	_, err := loadTestNativeProgram(t, ruleset, map[string]Condition{"heat": always})
+	assert.Error(t, err, "frost has no condition")
+
+	_, err = loadTestNativeProgram(t, ruleset, map[string]Condition{"heat": always, "frost": always, "flood": always})
+	assert.Error(t, err, "flood is not a rule")
+
+	program, err := loadTestNativeProgram(t, ruleset, map[string]Condition{"heat": always, "frost": always})
+	require.NoError(t, err)
+	for _, rule := range program.rules {
+		assert.NotNil(t, rule.native)
+	}
+}
+
+func TestRunNative(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	rule := priorityRule("heat", 1, "temperature", 30, "alerts:heat")
+	rule.Actions = append(rule.Actions, compiler.Action{Type: "updateStore", Target: "alerts:level", Value: "{level}"})
+	rule.Scripts = map[string]compiler.Script{
+		"level": {Params: []string{"temperature"}, Body: "return temperature - 30;"},
+	}
+	// The native condition deliberately differs from the rule's, to show it
+	// replaces it
+	program, err := loadTestNativeProgram(t, &compiler.Ruleset{Rules: []compiler.Rule{rule}}, map[string]Condition{
+		"heat": func(facts Facts) bool {
+			temperature, _ := facts.Fact("temperature")
+			v, ok := temperature.(float64)
+			return ok && v > 40
+		},
+	})
+	require.NoError(t, err)
+	engine, err := NewEngine(program, redisStore)
+	require.NoError(t, err)
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+	assert.False(t, s.Exists("alerts:heat"))
+
+	engine.ProcessFactUpdate("temperature", 45.0)
+	value, err := s.Get("alerts:level")
+	require.NoError(t, err)
+	assert.Equal(t, "15", value)
+	assert.True(t, s.Exists("alerts:heat"))
+	assert.Empty(t, engine.RuleErrorCounts())
+}
+
+// TestNativeMatchesInterpreted runs random rulesets with native conditions and
+// interpreted, and checks that every update leaves the same store behind.
+func TestNativeMatchesInterpreted(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			g := newRandomRuleset(seed)
+			ruleset := g.ruleset(5 + g.rng.Intn(20))
+			conditions := make(map[string]Condition, len(ruleset.Rules))
+			for _, rule := range ruleset.Rules {
+				conditions[rule.Name] = treeCondition(rule)
+			}
+
+			interpretedRedis, interpretedStore := setupMiniredis(t)
+			defer interpretedRedis.Close()
+			nativeRedis, nativeStore := setupMiniredis(t)
+			defer nativeRedis.Close()
+
+			program, err := loadTestNativeProgram(t, ruleset, conditions)
+			require.NoError(t, err)
+			opts := []Option{WithLogger(zerolog.Nop()), WithMaxChainDepth(3)}
+			native, err := NewEngine(program, nativeStore, opts...)
+			require.NoError(t, err)
+			interpreted, err := NewEngine(loadTestProgram(t, ruleset), interpretedStore, opts...)
+			require.NoError(t, err)
+
+			for i, update := range append(g.updates(50), g.mismatchedUpdates(25)...) {
+				require.NoError(t, interpretedStore.SetFact(update.fact, update.value))
+				require.NoError(t, nativeStore.SetFact(update.fact, update.value))
+				interpreted.ProcessFactUpdate(update.fact, update.value)
+				native.ProcessFactUpdate(update.fact, update.value)
+
+				require.Equal(t, interpretedRedis.Dump(), nativeRedis.Dump(), "update %d: %s = %v", i, update.fact, update.value)
+				require.Equal(t, interpreted.RuleErrorCounts(), native.RuleErrorCounts(), "update %d: %s = %v", i, update.fact, update.value)
+			}
+		})
+	}
+}
+
+// generatedTest is the test of a package generated from a random ruleset,
+// which checks that its native conditions update the store as the
+// interpreted bytecode does. It is formatted with the package name and the
+// updates.
+const generatedTest = `package %s
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/runtime"
+	"rgehrsitz/rex/pkg/store"
+)
+
+func TestNativeMatchesInterpreted(t *testing.T) {
+	interpretedRedis := miniredis.RunT(t)
+	nativeRedis := miniredis.RunT(t)
+	interpretedStore := store.NewRedisStore(interpretedRedis.Addr(), "", 0)
+	nativeStore := store.NewRedisStore(nativeRedis.Addr(), "", 0)
+
+	opts := []runtime.Option{runtime.WithLogger(zerolog.Nop()), runtime.WithMaxChainDepth(3)}
+	program, err := runtime.LoadProgramBytes(bytecode)
+	require.NoError(t, err)
+	interpreted, err := runtime.NewEngine(program, interpretedStore, opts...)
+	require.NoError(t, err)
+	native, err := NewEngine(nativeStore, opts...)
+	require.NoError(t, err)
+
+	updates := []struct {
+		fact  string
+		value interface{}
+	}{
+%s	}
+	for i, update := range updates {
+		require.NoError(t, interpretedStore.SetFact(update.fact, update.value))
+		require.NoError(t, nativeStore.SetFact(update.fact, update.value))
+		interpreted.ProcessFactUpdate(update.fact, update.value)
+		native.ProcessFactUpdate(update.fact, update.value)
+		require.Equal(t, interpretedRedis.Dump(), nativeRedis.Dump(), "update %%d: %%s = %%v", i, update.fact, update.value)
+		require.Equal(t, interpreted.RuleErrorCounts(), native.RuleErrorCounts(), "update %%d: %%s = %%v", i, update.fact, update.value)
+	}
+}
+`
+
+// TestGeneratedMatchesInterpreted generates Go packages from random rulesets,
+// as rexc -emit go does, and runs them against the interpreter.
+func TestGeneratedMatchesInterpreted(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+
+	// The packages are generated inside the module, so they can import the
+	// runtime. Directories starting with _ are left out of ./...
+	dir, err := os.MkdirTemp(".", "_generated")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := []string{"test", "-count=1"}
+	for seed := int64(1); seed <= 5; seed++ {
+		g := newRandomRuleset(seed)
+		ruleset := g.ruleset(5 + g.rng.Intn(20))
+		packageName := fmt.Sprintf("seed%d", seed)
+		source, err := compiler.GenerateGo(ruleset, packageName)
+		require.NoError(t, err, "seed %d", seed)
+
+		var updates strings.Builder
+		for _, update := range append(g.updates(50), g.mismatchedUpdates(25)...) {
+			value := fmt.Sprintf("%v", update.value)
+			switch v := update.value.(type) {
+			case float64:
+				value = fmt.Sprintf("float64(%s)", strconv.FormatFloat(v, 'g', -1, 64))
+			case string:
+				value = strconv.Quote(v)
+			}
+			fmt.Fprintf(&updates, "\t\t{%s, %s},\n", strconv.Quote(update.fact), value)
+		}
+
+		packageDir := filepath.Join(dir, packageName)
+		require.NoError(t, os.Mkdir(packageDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(packageDir, "rules.go"), source, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(packageDir, "rules_test.go"), []byte(fmt.Sprintf(generatedTest, packageName, updates.String())), 0644))
+		args = append(args, "./"+packageDir)
+	}
+
+	out, err := exec.Command(goTool, args...).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
@@ -0,0 +1,84 @@
+// rex/pkg/runtime/network.go
+
+package runtime
+
+import (
+	"math"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// conditionNode is a condition shared by every rule that tests it, as tagged
+// by the condition network rexc builds. Engines cache its result per version
+// of its fact, so an update only evaluates the conditions on facts that
+// changed, once however many rules test them.
+type conditionNode struct {
+	slot   int
+	value  interface{}
+	opcode compiler.Opcode
+	// compare compares a value of the fact with the constant
+	compare func(e *Engine, factValue interface{}) bool
+}
+
+// newConditionNode returns node with its comparison built in, handling
+// values like the interpreter does.
+func newConditionNode(node conditionNode) conditionNode {
+	node.compare = comparator(node.opcode, node.value)
+	if node.compare == nil {
+		value, opcode := node.value, node.opcode
+		node.compare = func(e *Engine, factValue interface{}) bool {
+			return e.compare(factValue, value, opcode)
+		}
+	}
+	return node
+}
+
+// evaluateCondition returns the result of the shared condition at index. The
+// result is cached until the condition's fact changes, so the rules testing
+// the condition after the first reuse it. A cached result is the version of
+// the fact it was computed at, plus one so that zero is no result, shifted
+// above the result bit.
+func (e *Engine) evaluateCondition(index int) bool {
+	node := &e.conditions[index]
+	fact := e.facts[node.slot]
+	e.factsMu.RLock()
+	value, version := e.Facts[fact], e.factVersions[fact]
+	e.factsMu.RUnlock()
+
+	if index >= len(e.conditionResults) {
+		// The engine was not made by NewEngine, so it has no cache
+		return node.compare(e, value)
+	}
+	tag := (version + 1) << 1
+	if cached := e.conditionResults[index].Load(); cached&^1 == tag {
+		return cached&1 == 1
+	}
+	result := node.compare(e, value)
+	if result {
+		e.conditionResults[index].Store(tag | 1)
+	} else {
+		e.conditionResults[index].Store(tag)
+	}
+	return result
+}
+
+// sameFactValue reports whether a fact's new value is the same as its old
+// one, so the fact's version is kept. Only scalar values are compared; a new
+// array or object always changes the fact.
+func sameFactValue(old, value interface{}) bool {
+	switch old.(type) {
+	case float64, string, bool:
+		return sameConstant(old, value)
+	}
+	return false
+}
+
+// sameConstant reports whether two scalar values are the same. Floats are the
+// same if their bits are, so NaN is the same as itself.
+func sameConstant(a, b interface{}) bool {
+	if x, ok := a.(float64); ok {
+		y, ok := b.(float64)
+		return ok && math.Float64bits(x) == math.Float64bits(y)
+	}
+	return a == b
+}
@@ -0,0 +1,116 @@
+// rex/pkg/runtime/network_test.go
+
+package runtime
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// conditionNodes returns the shared conditions a rule tests, in order.
+func conditionNodes(p *Program, ruleName string) []int {
+	rule, _ := p.rule(ruleName)
+	var nodes []int
+	for _, in := range rule.instructions {
+		if in.opcode == compiler.CONDITION_NODE {
+			nodes = append(nodes, in.node)
+		}
+	}
+	return nodes
+}
+
+func TestSharedConditions(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	fans := priorityRule("fans", 2, "temperature", 30, "fans:on")
+	fans.Conditions.All = append(fans.Conditions.All, &compiler.ConditionOrGroup{Fact: "zone:mode", Operator: "EQ", Value: "cooling"})
+	program := loadTestProgram(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("heat", 1, "temperature", 30, "alerts:heat"), fans},
+	})
+
+	// Both rules test the same temperature condition
+	require.Len(t, program.conditions, 2)
+	heatNodes, fansNodes := conditionNodes(program, "heat"), conditionNodes(program, "fans")
+	require.Len(t, heatNodes, 1)
+	require.Len(t, fansNodes, 2)
+	temperature := heatNodes[0]
+	assert.Equal(t, temperature, fansNodes[0])
+
+	engine, err := NewEngine(program, redisStore)
+	require.NoError(t, err)
+	require.NoError(t, redisStore.SetFact("temperature", 35.0))
+	require.NoError(t, redisStore.SetFact("zone:mode", "cooling"))
+	engine.ProcessFactUpdate("temperature", 35.0)
+	assert.True(t, s.Exists("alerts:heat"))
+	assert.True(t, s.Exists("fans:on"))
+	cached := engine.conditionResults[temperature].Load()
+	assert.Equal(t, uint64(1), cached&1)
+
+	// The temperature has not changed since, so its cached result is used
+	// rather than evaluated again. Falsify it to tell.
+	engine.conditionResults[temperature].Store(cached &^ 1)
+	s.Del("fans:on")
+	engine.ProcessFactUpdate("zone:mode", "cooling")
+	assert.False(t, s.Exists("fans:on"))
+
+	// A new temperature is evaluated again
+	require.NoError(t, redisStore.SetFact("temperature", 36.0))
+	engine.ProcessFactUpdate("temperature", 36.0)
+	assert.True(t, s.Exists("fans:on"))
+	assert.Empty(t, engine.RuleErrorCounts())
+}
+
+func TestConditionNodesMustMatch(t *testing.T) {
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("heat", 1, "temperature", 30, "alerts:heat"),
+			priorityRule("damp", 2, "humidity", 30, "alerts:damp"),
+		},
+	})
+	defer os.Remove(filename)
+	bytecode, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	_, err = LoadProgramBytes(bytecode)
+	require.NoError(t, err)
+
+	// Tag the humidity condition with the temperature condition's node
+	tag := []byte{byte(compiler.CONDITION_NODE), 1, 0, 0, 0, byte(compiler.LOAD_FACT_FLOAT)}
+	offset := bytes.Index(bytecode, tag)
+	require.NotEqual(t, -1, offset)
+	bytecode[offset+1] = 0
+	_, err = LoadProgramBytes(bytecode)
+	assert.Error(t, err)
+}
+
+func TestReloadSharedConditions(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	engine, err := NewEngine(loadTestProgram(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("heat", 1, "temperature", 30, "alerts:heat")},
+	}), redisStore)
+	require.NoError(t, err)
+
+	// The condition of frost comes first, so the node of heat's is renumbered
+	summary := engine.ReloadProgram(loadTestProgram(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("heat", 1, "temperature", 30, "alerts:heat"),
+			priorityRule("frost", 0, "temperature", -5, "alerts:frost"),
+		},
+	}))
+	assert.Equal(t, []string{"frost"}, summary.Added)
+	assert.Equal(t, []string{"heat"}, summary.Unchanged)
+	assert.Len(t, engine.conditionResults, 2)
+
+	require.NoError(t, redisStore.SetFact("temperature", 35.0))
+	engine.ProcessFactUpdate("temperature", 35.0)
+	assert.True(t, s.Exists("alerts:heat"))
+	assert.True(t, s.Exists("alerts:frost"))
+}
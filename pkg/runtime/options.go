@@ -0,0 +1,174 @@
+// rex/pkg/runtime/options.go
+
+package runtime
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+	"rgehrsitz/rex/pkg/scripting"
+)
+
+// DefaultScriptTimeout is how long a script may run before it is interrupted,
+// unless configured otherwise with WithScriptTimeout.
+const DefaultScriptTimeout = 100 * time.Millisecond
+
+// Option configures an engine created by NewEngine.
+type Option func(*Engine)
+
+// ActionHandler runs an action of a rule. value is the action's value with
+// templates and script calls resolved. Facts a handler writes are not chained.
+type ActionHandler func(ruleName string, action compiler.Action, value interface{}) error
+
+// WithPriorityThreshold makes the engine log, with the facts it read, every
+// triggered rule whose priority is at most threshold. It does not change which
+// rules run.
+func WithPriorityThreshold(threshold int) Option {
+	return func(e *Engine) {
+		e.priorityThreshold = threshold
+	}
+}
+
+// WithScriptTimeout sets how long a script may run before it is interrupted
+// and its action fails. The default is DefaultScriptTimeout.
+func WithScriptTimeout(timeout time.Duration) Option {
+	return func(e *Engine) {
+		e.scriptTimeout = timeout
+	}
+}
+
+// WithScriptEngine sets the VM scripts run in.
+func WithScriptEngine(vm *scripting.SafeVM) Option {
+	return func(e *Engine) {
+		e.ScriptEngine = vm
+	}
+}
+
+// WithClock sets the clock delayed actions, dead letters and the ingestion
+// queue's drop logs are timed with. The default is the system clock.
+func WithClock(clock Clock) Option {
+	return func(e *Engine) {
+		e.clock = clock
+	}
+}
+
+// WithLogger sets the logger the engine logs to. The default is
+// logging.Logger.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(e *Engine) {
+		e.logger = &logger
+	}
+}
+
+// WithMissingFactPolicy sets what happens to rules that depend on a fact the
+// store does not hold. The default is MissingFactSkip.
+func WithMissingFactPolicy(policy MissingFactPolicy) Option {
+	return func(e *Engine) {
+		e.missingFactPolicy = policy
+	}
+}
+
+// WithExecutionMode sets how the engine runs the instructions of its rules.
+// The default is ExecutionInterpreted.
+func WithExecutionMode(mode ExecutionMode) Option {
+	return func(e *Engine) {
+		e.executionMode = mode
+	}
+}
+
+// WithMaxChainDepth sets MaxChainDepth, how many levels of rules are chained
+// in-process from a single fact update.
+func WithMaxChainDepth(depth int) Option {
+	return func(e *Engine) {
+		e.MaxChainDepth = depth
+	}
+}
+
+// WithMaxCausationDepth sets MaxCausationDepth, how many rules may fire in a
+// row as a result of a single external fact update.
+func WithMaxCausationDepth(depth int) Option {
+	return func(e *Engine) {
+		e.MaxCausationDepth = depth
+	}
+}
+
+// WithActionHandler makes the engine run actions of the given type with
+// handler, instead of failing them as unknown or, for updateStore, writing
+// them to the store.
+func WithActionHandler(actionType string, handler ActionHandler) Option {
+	return func(e *Engine) {
+		if e.actionHandlers == nil {
+			e.actionHandlers = make(map[string]ActionHandler)
+		}
+		e.actionHandlers[actionType] = handler
+	}
+}
+
+// WithOnlyIfChanged sets OnlyIfChanged, the default for whether updateStore
+// actions skip writes that would not change the stored value.
+func WithOnlyIfChanged(onlyIfChanged bool) Option {
+	return func(e *Engine) {
+		e.OnlyIfChanged = onlyIfChanged
+	}
+}
+
+// WithErrorPolicy sets the ErrorPolicy and the QuarantineAfter count of the
+// quarantine policy.
+func WithErrorPolicy(policy ErrorPolicy, quarantineAfter int) Option {
+	return func(e *Engine) {
+		e.ErrorPolicy = policy
+		e.QuarantineAfter = quarantineAfter
+	}
+}
+
+// WithDeadLetterKey sets DeadLetterKey, the Redis list unprocessable messages
+// and failed action writes are recorded in. Empty disables dead-lettering.
+func WithDeadLetterKey(key string) Option {
+	return func(e *Engine) {
+		e.DeadLetterKey = key
+	}
+}
+
+// WithCoalesceWindow sets CoalesceWindow, how long each worker merges the
+// updates it receives before evaluating them as one batch.
+func WithCoalesceWindow(window time.Duration) Option {
+	return func(e *Engine) {
+		e.CoalesceWindow = window
+	}
+}
+
+// WithQueue sets the capacity and overflow policy of the ingestion queue, like
+// ConfigureQueue.
+func WithQueue(capacity int, policy OverflowPolicy) Option {
+	return func(e *Engine) {
+		e.ConfigureQueue(capacity, policy)
+	}
+}
+
+// WithOwnSubscription keeps Start from subscribing to the fact updates
+// published to the store, for embedders that subscribe to the store
+// themselves and pass the messages they receive to IngestMessage. Each
+// message is then taken in once, however the subscriptions overlap.
+func WithOwnSubscription() Option {
+	return func(e *Engine) {
+		e.ownSubscription = true
+	}
+}
+
+// WithWorkers makes Start start n workers, like StartWorkers.
+func WithWorkers(n int) Option {
+	return func(e *Engine) {
+		e.workerCount = n
+	}
+}
+
+// log returns the engine's logger.
+func (e *Engine) log() *zerolog.Logger {
+	if e.logger == nil {
+		return &logging.Logger
+	}
+	return e.logger
+}
@@ -0,0 +1,229 @@
+// rex/pkg/runtime/options_test.go
+
+package runtime
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward and runs the functions that became due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	for _, timer := range c.timers {
+		if !timer.stopped && !timer.at.After(c.now) {
+			timer.stopped = true
+			due = append(due, timer.f)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, f := range due {
+		f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func TestWithClock(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, delayedActionRuleset("1h", false))
+	defer os.Remove(filename)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	engine, err := NewEngineFromFile(filename, redisStore, WithClock(clock))
+	require.NoError(t, err)
+
+	engine.ProcessFactUpdate("system:temperature", 15.0)
+	pending, err := redisStore.GetPendingActions()
+	require.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, clock.Now().Add(time.Hour), pending[0].RunAt.UTC())
+	}
+
+	clock.Advance(59 * time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, s.Exists("system:fan_speed"))
+
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		return s.Exists("system:fan_speed")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWithScriptTimeout(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	rule := priorityRule("looping", 1, "temperature", 0, "result")
+	rule.Actions[0].Value = "{loop}"
+	rule.Scripts = map[string]compiler.Script{
+		"loop": {Params: []string{"temperature"}, Body: "while (true) {} return temperature;"},
+	}
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{Rules: []compiler.Rule{rule}})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore, WithScriptTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Millisecond, engine.scriptTimeout)
+
+	engine.ProcessFactUpdate("temperature", 25.0)
+	assert.False(t, s.Exists("result"))
+	assert.Equal(t, map[string]int{"looping": 1}, engine.RuleErrorCounts())
+}
+
+func TestWithLogger(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("alert", 1, "temperature", 30, "alerts:heat")},
+	})
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	_, err = NewEngine(program, redisStore, WithLogger(zerolog.New(&out)))
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "Engine initialized from bytecode")
+}
+
+func TestParseMissingFactPolicy(t *testing.T) {
+	for name, expected := range map[string]MissingFactPolicy{
+		"":         MissingFactSkip,
+		"skip":     MissingFactSkip,
+		"evaluate": MissingFactEvaluate,
+		"error":    MissingFactError,
+	} {
+		policy, err := ParseMissingFactPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := ParseMissingFactPolicy("default")
+	assert.Error(t, err)
+}
+
+func TestWithMissingFactPolicy(t *testing.T) {
+	testCases := []struct {
+		policy MissingFactPolicy
+		fired  bool
+		errors map[string]int
+	}{
+		{MissingFactSkip, false, map[string]int{}},
+		{MissingFactEvaluate, true, map[string]int{}},
+		{MissingFactError, false, map[string]int{"comfort": 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			s, redisStore := setupMiniredis(t)
+			defer s.Close()
+
+			// The rule holds on temperature alone, but also depends on
+			// humidity, which the store does not hold
+			filename := createTestBytecodeFile(t, &compiler.Ruleset{
+				Rules: []compiler.Rule{
+					{
+						Name: "comfort",
+						Conditions: compiler.ConditionGroup{
+							Any: []*compiler.ConditionOrGroup{
+								{Fact: "temperature", Operator: "GT", Value: 20.0},
+								{Fact: "humidity", Operator: "GT", Value: 60.0},
+							},
+						},
+						Actions: []compiler.Action{
+							{Type: "updateStore", Target: "comfort_alert", Value: true},
+						},
+					},
+				},
+			})
+			defer os.Remove(filename)
+
+			engine, err := NewEngineFromFile(filename, redisStore, WithMissingFactPolicy(tc.policy))
+			require.NoError(t, err)
+
+			engine.ProcessFactUpdate("temperature", 25.0)
+			assert.Equal(t, tc.fired, s.Exists("comfort_alert"))
+			assert.Equal(t, tc.errors, engine.RuleErrorCounts())
+		})
+	}
+}
+
+func TestWithActionHandler(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	rule := priorityRule("notify", 1, "temperature", 30, "alert-service")
+	rule.Actions = []compiler.Action{
+		{Type: "sendMessage", Target: "alert-service", Value: "Temperature is ${temperature}"},
+		{Type: "updateStore", Target: "notified", Value: true},
+	}
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{Rules: []compiler.Rule{rule}})
+	defer os.Remove(filename)
+
+	type message struct {
+		rule, target string
+		value        interface{}
+	}
+	var messages []message
+	engine, err := NewEngineFromFile(filename, redisStore,
+		WithActionHandler("sendMessage", func(ruleName string, action compiler.Action, value interface{}) error {
+			messages = append(messages, message{ruleName, action.Target, value})
+			return nil
+		}))
+	require.NoError(t, err)
+
+	engine.ProcessFactUpdate("temperature", 35.0)
+	assert.Equal(t, []message{{"notify", "alert-service", "Temperature is 35"}}, messages)
+	assert.True(t, s.Exists("notified"))
+	assert.Empty(t, engine.RuleErrorCounts())
+}
@@ -0,0 +1,102 @@
+// rex/pkg/runtime/ordering.go
+
+package runtime
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// ruleHeader holds the rule metadata that decides which rules are evaluated
+// for an update.
+type ruleHeader struct {
+	group          string
+	exclusiveGroup string
+	stopProcessing bool
+}
+
+// readRuleHeaders reads the priority, groups and flags of every rule from the
+// opcodes that follow its RULE_START.
+func (p *program) readRuleHeaders() error {
+	p.ruleHeaders = make(map[string]ruleHeader)
+
+	for i, rule := range p.ruleExecutionIndex {
+		offset := rule.ByteOffset
+		if offset+2 > len(p.bytecode) || compiler.Opcode(p.bytecode[offset]) != compiler.RULE_START {
+			return logging.NewError(logging.ErrorTypeRuntime, "Rule execution index does not point at a rule", nil, map[string]interface{}{"ruleName": rule.RuleName, "offset": offset})
+		}
+		offset += 2 + int(p.bytecode[offset+1])
+
+		var header ruleHeader
+	opcodes:
+		for offset < len(p.bytecode) {
+			switch compiler.Opcode(p.bytecode[offset]) {
+			case compiler.PRIORITY:
+				if offset+5 > len(p.bytecode) {
+					break opcodes
+				}
+				p.ruleExecutionIndex[i].Priority = int(binary.LittleEndian.Uint32(p.bytecode[offset+1:]))
+				offset += 5
+			case compiler.RULE_FLAGS:
+				if offset+2 > len(p.bytecode) {
+					break opcodes
+				}
+				header.stopProcessing = p.bytecode[offset+1]&compiler.RuleFlagStopProcessing != 0
+				offset += 2
+			case compiler.RULE_GROUP, compiler.RULE_EXCLUSIVE_GROUP:
+				if offset+2 > len(p.bytecode) {
+					break opcodes
+				}
+				groupLen := int(p.bytecode[offset+1])
+				if offset+2+groupLen > len(p.bytecode) {
+					break opcodes
+				}
+				group := string(p.bytecode[offset+2 : offset+2+groupLen])
+				if compiler.Opcode(p.bytecode[offset]) == compiler.RULE_GROUP {
+					header.group = group
+				} else {
+					header.exclusiveGroup = group
+				}
+				offset += 2 + groupLen
+			default:
+				break opcodes
+			}
+		}
+		p.ruleHeaders[rule.RuleName] = header
+
+		logging.Logger.Debug().
+			Str("ruleName", rule.RuleName).
+			Int("priority", p.ruleExecutionIndex[i].Priority).
+			Str("group", header.group).
+			Str("exclusiveGroup", header.exclusiveGroup).
+			Bool("stopProcessing", header.stopProcessing).
+			Msg("Read rule header")
+	}
+	return nil
+}
+
+// sortRulesByExecutionOrder orders the rules of every fact in the fact rule
+// index the way the rule execution index does. The compiler emits rules in
+// evaluation order: by priority, lowest number first, with every rule after
+// the rules it names in its after field.
+func (p *program) sortRulesByExecutionOrder() {
+	p.rulePositions = make(map[string]int, len(p.ruleExecutionIndex))
+	for i, rule := range p.ruleExecutionIndex {
+		p.rulePositions[rule.RuleName] = i
+	}
+
+	for _, ruleNames := range p.factRuleIndex {
+		p.sortByExecutionOrder(ruleNames)
+	}
+}
+
+// sortByExecutionOrder sorts rule names by their position in the rule
+// execution index.
+func (p *program) sortByExecutionOrder(ruleNames []string) {
+	sort.SliceStable(ruleNames, func(i, j int) bool {
+		return p.rulePositions[ruleNames[i]] < p.rulePositions[ruleNames[j]]
+	})
+}
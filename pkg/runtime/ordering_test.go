@@ -0,0 +1,197 @@
+// rex/pkg/runtime/ordering_test.go
+
+package runtime
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// priorityRule returns a rule that writes `target` when `fact` is greater
+// than `threshold`.
+func priorityRule(name string, priority int, fact string, threshold float64, target string) compiler.Rule {
+	return compiler.Rule{
+		Name:     name,
+		Priority: priority,
+		Conditions: compiler.ConditionGroup{
+			All: []*compiler.ConditionOrGroup{
+				{Fact: fact, Operator: "GT", Value: threshold},
+			},
+		},
+		Actions: []compiler.Action{
+			{Type: "updateStore", Target: target, Value: name},
+		},
+	}
+}
+
+func TestRulesEvaluatedByPriority(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("low", 5, "temperature", 0, "result"),
+			priorityRule("high", 1, "temperature", 0, "result"),
+			priorityRule("medium", 3, "temperature", 0, "result"),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"high", "medium", "low"}, engine.factRuleIndex["temperature"])
+
+	// All matching rules fire, the lowest-priority one last
+	engine.ProcessFactUpdate("temperature", 10.0)
+
+	result, err := s.Get("result")
+	assert.NoError(t, err)
+	assert.Equal(t, `"low"`, result)
+}
+
+func TestRulesEvaluatedAfterDependencies(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// "report" has the higher priority but must run after "compute"
+	report := priorityRule("report", 1, "temperature", 0, "result")
+	report.After = []string{"compute"}
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			report,
+			priorityRule("compute", 5, "temperature", 0, "result"),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"compute", "report"}, engine.factRuleIndex["temperature"])
+
+	engine.ProcessFactUpdate("temperature", 10.0)
+
+	result, err := s.Get("result")
+	assert.NoError(t, err)
+	assert.Equal(t, `"report"`, result)
+}
+
+func TestFirstMatchStrategy(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Strategy: compiler.StrategyFirstMatch,
+		Rules: []compiler.Rule{
+			priorityRule("low", 5, "temperature", 0, "low_fired"),
+			priorityRule("high", 1, "temperature", 20, "high_fired"),
+			priorityRule("medium", 3, "temperature", 0, "medium_fired"),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	// The highest-priority rule does not match, so the next one fires alone
+	engine.ProcessFactUpdate("temperature", 10.0)
+	assert.False(t, s.Exists("high_fired"))
+	assert.True(t, s.Exists("medium_fired"))
+	assert.False(t, s.Exists("low_fired"))
+
+	// Each update gets its own first match
+	engine.ProcessFactUpdate("temperature", 30.0)
+	assert.True(t, s.Exists("high_fired"))
+	assert.False(t, s.Exists("low_fired"))
+}
+
+func TestExclusiveGroup(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	heat := priorityRule("heat", 2, "temperature", 0, "heat_fired")
+	heat.ExclusiveGroup = "hvac"
+	cool := priorityRule("cool", 1, "temperature", 0, "cool_fired")
+	cool.ExclusiveGroup = "hvac"
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			heat,
+			cool,
+			priorityRule("log", 3, "temperature", 0, "log_fired"),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	assert.Equal(t, "hvac", engine.ruleHeaders["heat"].exclusiveGroup)
+	assert.Equal(t, "hvac", engine.ruleHeaders["cool"].exclusiveGroup)
+	assert.Equal(t, "", engine.ruleHeaders["log"].exclusiveGroup)
+
+	engine.ProcessFactUpdate("temperature", 10.0)
+
+	// Only one member of the group fires; rules outside it are unaffected
+	assert.True(t, s.Exists("cool_fired"))
+	assert.False(t, s.Exists("heat_fired"))
+	assert.True(t, s.Exists("log_fired"))
+}
+
+func TestStopProcessing(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	rule := func(name string, priority int, group string, threshold float64, stop bool) compiler.Rule {
+		r := priorityRule(name, priority, "temperature", threshold, name+"_fired")
+		r.Group = group
+		r.StopProcessing = stop
+		return r
+	}
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			rule("alarm", 1, "safety", 50, true),
+			rule("warn", 2, "safety", 30, false),
+			rule("log", 3, "safety", 0, false),
+			rule("stats", 2, "", 0, false),
+			rule("override", 1, "", 60, true),
+		},
+	}
+
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	assert.Equal(t, ruleHeader{group: "safety", stopProcessing: true}, engine.ruleHeaders["alarm"])
+
+	// The stopping rule does not match, so the whole group runs
+	engine.ProcessFactUpdate("temperature", 40.0)
+	assert.False(t, s.Exists("alarm_fired"))
+	assert.True(t, s.Exists("warn_fired"))
+	assert.True(t, s.Exists("log_fired"))
+	s.FlushAll()
+
+	// The stopping rule fires and skips the rest of its group only
+	engine.ProcessFactUpdate("temperature", 55.0)
+	assert.True(t, s.Exists("alarm_fired"))
+	assert.False(t, s.Exists("warn_fired"))
+	assert.False(t, s.Exists("log_fired"))
+	assert.True(t, s.Exists("stats_fired"))
+	s.FlushAll()
+
+	// Rules without a group form the default group
+	engine.ProcessFactUpdate("temperature", 65.0)
+	assert.True(t, s.Exists("override_fired"))
+	assert.False(t, s.Exists("stats_fired"))
+	assert.True(t, s.Exists("alarm_fired"))
+}
@@ -0,0 +1,322 @@
+// rex/pkg/runtime/program.go
+
+package runtime
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"sync/atomic"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// Program is a compiled ruleset loaded from bytecode, ready to be evaluated by
+// an engine. A Program is read-only and may be shared by several engines.
+type Program struct {
+	program
+}
+
+// LoadProgram reads and validates the bytecode produced by rexc from r.
+func LoadProgram(r io.Reader) (*Program, error) {
+	bytecode, err := io.ReadAll(r)
+	if err != nil {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Failed to read bytecode", err, nil)
+	}
+	return LoadProgramBytes(bytecode)
+}
+
+// LoadProgramBytes validates the bytecode produced by rexc. The program keeps
+// a reference to bytecode, which must not be modified afterwards.
+func LoadProgramBytes(bytecode []byte) (*Program, error) {
+	p, err := parseProgram(bytecode)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{program: *p}, nil
+}
+
+// LoadProgramFile reads and validates a bytecode file.
+func LoadProgramFile(filename string) (*Program, error) {
+	bytecode, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Failed to read bytecode file", err, map[string]interface{}{"filename": filename})
+	}
+	logging.Logger.Debug().Int("bytecodeLength", len(bytecode)).Msg("Read bytecode file")
+	return LoadProgramBytes(bytecode)
+}
+
+// Rules returns the names of the program's rules in execution order.
+func (p *Program) Rules() []string {
+	ruleNames := make([]string, len(p.ruleExecutionIndex))
+	for i, rule := range p.ruleExecutionIndex {
+		ruleNames[i] = rule.RuleName
+	}
+	return ruleNames
+}
+
+// program is a parsed bytecode file: the instructions of the rules, decoded
+// for evaluation, and the indices the engine finds and orders them with.
+type program struct {
+	bytecode            []byte
+	ruleExecutionIndex  []compiler.RuleExecutionIndex
+	factRuleIndex       map[string][]string
+	factDependencyIndex []compiler.FactDependencyIndex
+
+	ruleHeaders   map[string]ruleHeader
+	rulePositions map[string]int
+
+	// rules are the decoded rules, in the order of the rule execution index,
+	// so a rule's position in rulePositions is also its index in rules.
+	// facts is the fact table their instructions refer to facts by.
+	rules []decodedRule
+	facts []string
+
+	// conditions are the conditions shared by the rules, which their
+	// CONDITION_NODE instructions refer to by index
+	conditions []conditionNode
+
+	// compiled holds the rules compiled into closures, in the order of rules,
+	// if the engine runs in ExecutionCompiled mode
+	compiled []compiledRule
+	// conditionResults are the engine's cached results of conditions, in
+	// the order of conditions
+	conditionResults []atomic.Uint64
+
+	// instructionsEnd is the offset the rule instructions end at
+	instructionsEnd int
+}
+
+// indexReader reads the entries of the bytecode indices and the operands of
+// instructions, remembering the first read past the end of the bytecode.
+type indexReader struct {
+	bytecode []byte
+	offset   int
+	err      error
+}
+
+func (r *indexReader) uint32(what string) int {
+	if r.err != nil {
+		return 0
+	}
+	if r.offset < 0 || r.offset+4 > len(r.bytecode) {
+		r.err = logging.NewError(logging.ErrorTypeRuntime, "Unexpected end of bytecode while reading "+what, nil, map[string]interface{}{"offset": r.offset})
+		return 0
+	}
+	value := int(binary.LittleEndian.Uint32(r.bytecode[r.offset:]))
+	r.offset += 4
+	return value
+}
+
+func (r *indexReader) string(what string) string {
+	length := r.uint32(what)
+	if r.err != nil {
+		return ""
+	}
+	if r.offset+length > len(r.bytecode) {
+		r.err = logging.NewError(logging.ErrorTypeRuntime, "Unexpected end of bytecode while reading "+what, nil, map[string]interface{}{"offset": r.offset})
+		return ""
+	}
+	value := string(r.bytecode[r.offset : r.offset+length])
+	r.offset += length
+	return value
+}
+
+// parseProgram parses and validates a bytecode file. It fails if the file is
+// truncated, has an unsupported version, or its indices name rules or offsets
+// that are not in the file, so a program it returns is safe to evaluate.
+func parseProgram(bytecode []byte) (*program, error) {
+	p := &program{
+		bytecode:            bytecode,
+		ruleExecutionIndex:  make([]compiler.RuleExecutionIndex, 0),
+		factRuleIndex:       make(map[string][]string),
+		factDependencyIndex: make([]compiler.FactDependencyIndex, 0),
+	}
+
+	// Read header
+	if len(bytecode) < compiler.HeaderSize {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Bytecode file too short for header", nil, nil)
+	}
+	header := &indexReader{bytecode: bytecode}
+	version := header.uint32("header")
+	logging.Logger.Debug().Uint32("version", uint32(version)).Msg("Read bytecode version")
+	if version != compiler.Version {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Unsupported bytecode version", nil, map[string]interface{}{"version": version, "supported": compiler.Version})
+	}
+	checksum := header.uint32("header")
+	logging.Logger.Debug().Uint32("checksum", uint32(checksum)).Msg("Read bytecode checksum")
+	constPoolSize := header.uint32("header")
+	logging.Logger.Debug().Uint32("constPoolSize", uint32(constPoolSize)).Msg("Read constant pool size")
+	numRules := header.uint32("header")
+	logging.Logger.Debug().Uint32("numRules", uint32(numRules)).Msg("Read number of rules")
+	ruleExecIndexOffset := header.uint32("header")
+	logging.Logger.Debug().Uint32("ruleExecIndexOffset", uint32(ruleExecIndexOffset)).Msg("Read rule execution index offset")
+	factRuleIndexOffset := header.uint32("header")
+	logging.Logger.Debug().Uint32("factRuleIndexOffset", uint32(factRuleIndexOffset)).Msg("Read fact rule index offset")
+	factDepIndexOffset := header.uint32("header")
+	logging.Logger.Debug().Uint32("factDepIndexOffset", uint32(factDepIndexOffset)).Msg("Read fact dependency index offset")
+
+	if ruleExecIndexOffset < compiler.HeaderSize || ruleExecIndexOffset > factRuleIndexOffset ||
+		factRuleIndexOffset > factDepIndexOffset || factDepIndexOffset > len(bytecode) {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Bytecode index offsets are out of order", nil, map[string]interface{}{
+			"ruleExecIndexOffset": ruleExecIndexOffset,
+			"factRuleIndexOffset": factRuleIndexOffset,
+			"factDepIndexOffset":  factDepIndexOffset,
+			"length":              len(bytecode),
+		})
+	}
+	p.instructionsEnd = ruleExecIndexOffset
+
+	// Read rule execution index
+	r := &indexReader{bytecode: bytecode, offset: ruleExecIndexOffset}
+	logging.Logger.Debug().Int("offset", r.offset).Msg("Starting to read rule execution index")
+	for i := 0; i < numRules; i++ {
+		name := r.string("rule execution index")
+		byteOffset := r.uint32("rule execution index")
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		// Adjust the byte offset by adding the size of the header
+		adjustedByteOffset := byteOffset + compiler.HeaderSize
+
+		p.ruleExecutionIndex = append(p.ruleExecutionIndex, compiler.RuleExecutionIndex{
+			RuleName:   name,
+			ByteOffset: adjustedByteOffset,
+		})
+		logging.Logger.Debug().Str("ruleName", name).Int("byteOffset", adjustedByteOffset).Msg("Read rule execution index entry")
+	}
+
+	// Read fact rule index
+	r.offset = factRuleIndexOffset
+	for r.offset < factDepIndexOffset {
+		fact := r.string("fact rule index")
+		rulesCount := r.uint32("fact rule index")
+		var rules []string
+		for j := 0; j < rulesCount && r.err == nil; j++ {
+			rules = append(rules, r.string("fact rule index"))
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		p.factRuleIndex[fact] = rules
+		logging.Logger.Debug().Str("fact", fact).Strs("rules", rules).Msg("Read fact rule index entry")
+	}
+
+	// Read fact dependency index
+	r.offset = factDepIndexOffset
+	for r.offset < len(bytecode) {
+		rule := r.string("fact dependency index")
+		factsCount := r.uint32("fact dependency index")
+		var facts []string
+		for j := 0; j < factsCount && r.err == nil; j++ {
+			facts = append(facts, r.string("fact dependency index"))
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		p.factDependencyIndex = append(p.factDependencyIndex, compiler.FactDependencyIndex{
+			RuleName: rule,
+			Facts:    facts,
+		})
+		logging.Logger.Debug().Str("rule", rule).Strs("facts", facts).Msg("Read fact dependency index entry")
+	}
+
+	if err := p.readRuleHeaders(); err != nil {
+		return nil, err
+	}
+	p.sortRulesByExecutionOrder()
+	if err := p.decodeRules(); err != nil {
+		return nil, err
+	}
+
+	for _, dep := range p.factDependencyIndex {
+		position, ok := p.rulePositions[dep.RuleName]
+		if !ok {
+			return nil, logging.NewError(logging.ErrorTypeRuntime, "Fact dependency index names an unknown rule", nil, map[string]interface{}{"ruleName": dep.RuleName})
+		}
+		p.rules[position].dependencies = dep.Facts
+	}
+
+	for fact, ruleNames := range p.factRuleIndex {
+		for _, ruleName := range ruleNames {
+			if _, ok := p.rulePositions[ruleName]; !ok {
+				return nil, logging.NewError(logging.ErrorTypeRuntime, "Fact rule index names an unknown rule", nil, map[string]interface{}{"fact": fact, "ruleName": ruleName})
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// rule returns the decoded rule with the given name.
+func (p *program) rule(ruleName string) (*decodedRule, bool) {
+	position, ok := p.rulePositions[ruleName]
+	if !ok {
+		return nil, false
+	}
+	return &p.rules[position], true
+}
+
+// sameRule reports whether a rule runs the same instructions, with the same
+// header, in p and in other. Fact slots and condition nodes are numbered
+// across the whole program, so they are compared by the facts and conditions
+// they stand for, and a rule compares the same however the rules before it
+// changed.
+func (p *program) sameRule(other *program, ruleName string) bool {
+	rule, ok := p.rule(ruleName)
+	otherRule, otherOK := other.rule(ruleName)
+	if !ok || !otherOK {
+		return ok == otherOK
+	}
+	if rule.priority != otherRule.priority || rule.atomic != otherRule.atomic ||
+		p.ruleHeaders[ruleName] != other.ruleHeaders[ruleName] ||
+		len(rule.instructions) != len(otherRule.instructions) {
+		return false
+	}
+	for i, in := range rule.instructions {
+		if !p.sameInstruction(in, other, otherRule.instructions[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameInstruction reports whether instruction in of p does the same as
+// instruction otherIn of other.
+func (p *program) sameInstruction(in instruction, other *program, otherIn instruction) bool {
+	if in.opcode != otherIn.opcode || in.target != otherIn.target || in.str != otherIn.str ||
+		!sameConstant(in.value, otherIn.value) || !bytes.Equal(in.raw, otherIn.raw) ||
+		!reflect.DeepEqual(in.template, otherIn.template) ||
+		in.delay != otherIn.delay || in.flag != otherIn.flag {
+		return false
+	}
+
+	switch in.opcode {
+	case compiler.LOAD_FACT_FLOAT, compiler.LOAD_FACT_STRING, compiler.LOAD_FACT_BOOL:
+		return p.facts[in.slot] == other.facts[otherIn.slot]
+
+	case compiler.CONDITION_NODE:
+		node, otherNode := p.conditions[in.node], other.conditions[otherIn.node]
+		return p.facts[node.slot] == other.facts[otherNode.slot] &&
+			node.opcode == otherNode.opcode && sameConstant(node.value, otherNode.value)
+
+	case compiler.SCRIPT_DEF:
+		return in.script.name == otherIn.script.name &&
+			reflect.DeepEqual(in.script.definition, otherIn.script.definition)
+
+	case compiler.SCRIPT_CALL:
+		if in.script.name != otherIn.script.name || len(in.script.params) != len(otherIn.script.params) {
+			return false
+		}
+		for i, slot := range in.script.params {
+			if p.facts[slot] != other.facts[otherIn.script.params[i]] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+// rex/pkg/runtime/program_test.go
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+func TestLoadProgram(t *testing.T) {
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("second", 2, "temperature", 0, "result"),
+			priorityRule("first", 1, "temperature", 0, "result"),
+		},
+	})
+	defer os.Remove(filename)
+	bytecode, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	program, err := LoadProgram(bytes.NewReader(bytecode))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, program.Rules())
+
+	program, err = LoadProgramBytes(bytecode)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, program.Rules())
+
+	_, err = LoadProgramBytes(bytecode[:compiler.HeaderSize+2])
+	assert.Error(t, err)
+	_, err = LoadProgram(iotest.ErrReader(errors.New("disk failure")))
+	assert.Error(t, err)
+	_, err = LoadProgramFile("does_not_exist.bin")
+	assert.Error(t, err)
+}
+
+func TestNewEngineStart(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("alert", 1, "weather:temperature", 30, "alerts:heat")},
+	})
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+
+	_, err = NewEngine(nil, redisStore)
+	assert.Error(t, err)
+
+	engine, err := NewEngine(program, redisStore, WithPriorityThreshold(3))
+	require.NoError(t, err)
+	assert.Equal(t, 3, engine.priorityThreshold)
+
+	// Updates published before Start are not taken in
+	s.Publish("weather", "weather:temperature=35")
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, s.Exists("alerts:heat"))
+
+	engine.Start()
+	engine.Start()
+	time.Sleep(50 * time.Millisecond)
+	s.Publish("weather", "weather:temperature=35")
+	assert.Eventually(t, func() bool {
+		return s.Exists("alerts:heat")
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, engine.Shutdown(context.Background()))
+}
+
+func TestLoadProgramManyRules(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// More rules than label numbers fit in three digits across a ruleset
+	rules := make([]compiler.Rule, 1500)
+	for i := range rules {
+		rules[i] = priorityRule(fmt.Sprintf("rule_%d", i), 1, fmt.Sprintf("sensor:%d", i), 30, fmt.Sprintf("alerts:%d", i))
+	}
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{Rules: rules})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	require.NoError(t, err)
+	assert.Len(t, engine.rules, 1500)
+
+	engine.ProcessFactUpdate("sensor:1499", 35.0)
+	assert.True(t, s.Exists("alerts:1499"))
+	assert.False(t, s.Exists("alerts:1498"))
+}
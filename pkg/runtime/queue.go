@@ -0,0 +1,320 @@
+// rex/pkg/runtime/queue.go
+
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"rgehrsitz/rex/pkg/logging"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// OverflowPolicy decides what happens to a fact update received while the
+// ingestion queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits until there is room, pushing back on the store
+	// subscription.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest drops the oldest queued update to make room.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDropNewest drops the received update.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowKeepLatest replaces the queued update of the same fact with the
+	// received one, and waits for room if no update of the fact is queued.
+	OverflowKeepLatest OverflowPolicy = "keep-latest-per-fact"
+)
+
+// DefaultQueueSize is the capacity of the ingestion queue engines start with.
+const DefaultQueueSize = 1024
+
+// queueDropLogInterval is how often the ingestion queue logs how many updates
+// it dropped while it keeps shedding load.
+const queueDropLogInterval = 10 * time.Second
+
+// ParseOverflowPolicy parses an overflow policy name. An empty name is
+// OverflowBlock.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case "":
+		return OverflowBlock, nil
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowKeepLatest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q: expected block, drop-oldest, drop-newest or keep-latest-per-fact", name)
+	}
+}
+
+// QueueStats is a snapshot of the ingestion queue.
+type QueueStats struct {
+	Depth    int            `json:"depth"`
+	Capacity int            `json:"capacity"`
+	Policy   OverflowPolicy `json:"policy"`
+	// Dropped counts the updates dropped or replaced because the queue was
+	// full.
+	Dropped uint64 `json:"dropped"`
+}
+
+// updateQueue is a bounded FIFO queue of fact updates between ingestion and
+// evaluation.
+type updateQueue struct {
+	mu          sync.Mutex
+	notEmpty    *sync.Cond
+	notFull     *sync.Cond
+	items       []factUpdate
+	capacity    int
+	policy      OverflowPolicy
+	dropped     uint64
+	overflowing bool
+	// droppedLogged is the drop count last logged, at droppedLoggedAt
+	droppedLogged   uint64
+	droppedLoggedAt time.Time
+	closed          bool
+	logger          *zerolog.Logger
+	clock           Clock
+}
+
+// log returns the queue's logger.
+func (q *updateQueue) log() *zerolog.Logger {
+	if q.logger == nil {
+		return &logging.Logger
+	}
+	return q.logger
+}
+
+func newUpdateQueue(capacity int, policy OverflowPolicy) *updateQueue {
+	q := &updateQueue{capacity: capacity, policy: policy}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// configure changes the capacity and overflow policy. Updates already queued
+// beyond a smaller capacity are kept.
+func (q *updateQueue) configure(capacity int, policy OverflowPolicy) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.capacity = capacity
+	q.policy = policy
+	q.notFull.Broadcast()
+}
+
+// push adds an update, applying the overflow policy if the queue is full. It
+// reports false if the update was dropped or the queue is closed.
+func (q *updateQueue) push(update factUpdate) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !q.closed && q.full() {
+		switch q.policy {
+		case OverflowDropOldest:
+			q.drop(q.items[0], "Ingestion queue full, dropped oldest update")
+			q.items = q.items[1:]
+		case OverflowDropNewest:
+			q.drop(update, "Ingestion queue full, dropped update")
+			return false
+		case OverflowKeepLatest:
+			for i := range q.items {
+				if q.items[i].fact == update.fact {
+					q.drop(q.items[i], "Ingestion queue full, replaced queued update")
+					q.items[i] = update
+					return true
+				}
+			}
+			q.notFull.Wait()
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		return false
+	}
+
+	q.items = append(q.items, update)
+	q.notEmpty.Signal()
+	return true
+}
+
+// pop removes the oldest update, waiting for one. It reports false once the
+// queue is closed and empty.
+func (q *updateQueue) pop() (factUpdate, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 {
+		if q.closed {
+			return factUpdate{}, false
+		}
+		q.notEmpty.Wait()
+	}
+	update := q.items[0]
+	q.items = q.items[1:]
+	q.notFull.Signal()
+
+	if q.overflowing && len(q.items) == 0 {
+		q.overflowing = false
+		q.log().Info().Uint64("dropped", q.dropped).Msg("Ingestion queue drained")
+	}
+	return update, true
+}
+
+// close stops the queue from accepting updates. Queued updates can still be
+// popped.
+func (q *updateQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// discard drops the queued updates and returns how many there were.
+func (q *updateQueue) discard() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	discarded := len(q.items)
+	q.items = nil
+	q.notFull.Broadcast()
+	return discarded
+}
+
+func (q *updateQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{Depth: len(q.items), Capacity: q.capacity, Policy: q.policy, Dropped: q.dropped}
+}
+
+// full reports whether the queue is at capacity. The caller must hold q.mu.
+func (q *updateQueue) full() bool {
+	return q.capacity > 0 && len(q.items) >= q.capacity
+}
+
+// drop counts a dropped update, logging a warning when the queue starts
+// shedding load, and the updates dropped since every queueDropLogInterval
+// while it keeps shedding. The caller must hold q.mu.
+func (q *updateQueue) drop(update factUpdate, msg string) {
+	q.dropped++
+	now := q.now()
+	if !q.overflowing {
+		q.overflowing = true
+		q.droppedLogged, q.droppedLoggedAt = q.dropped-1, now
+		q.log().Warn().Str("policy", string(q.policy)).Int("capacity", q.capacity).Msg("Ingestion queue full, shedding load")
+	} else if now.Sub(q.droppedLoggedAt) >= queueDropLogInterval {
+		q.log().Warn().
+			Uint64("dropped", q.dropped-q.droppedLogged).
+			Uint64("totalDropped", q.dropped).
+			Dur("since", now.Sub(q.droppedLoggedAt)).
+			Msg("Ingestion queue still full, shedding load")
+		q.droppedLogged, q.droppedLoggedAt = q.dropped, now
+	}
+	q.log().Debug().Str("factName", update.fact).Uint64("dropped", q.dropped).Msg(msg)
+}
+
+// now returns the time of the queue's clock, or of the system clock if none
+// is set.
+func (q *updateQueue) now() time.Time {
+	if q.clock == nil {
+		return systemClock{}.Now()
+	}
+	return q.clock.Now()
+}
+
+// ConfigureQueue sets the capacity and overflow policy of the ingestion queue
+// that fact updates received from the store, and those passed to Enqueue, wait
+// in until they are evaluated. A capacity of zero or less makes the queue
+// unbounded.
+func (e *Engine) ConfigureQueue(capacity int, policy OverflowPolicy) {
+	if e.queue != nil {
+		e.queue.configure(capacity, policy)
+	}
+}
+
+// QueueStats returns the depth, capacity, overflow policy and drop count of
+// the ingestion queue.
+func (e *Engine) QueueStats() QueueStats {
+	if e.queue == nil {
+		return QueueStats{}
+	}
+	return e.queue.stats()
+}
+
+// Enqueue queues a fact update for evaluation like an update received from
+// the store. An update that echoes one of the engine's own writes carries the
+// causation of the write, and is not evaluated again if the write was already
+// chained in-process. Engines without an ingestion queue evaluate it like
+// Submit.
+func (e *Engine) Enqueue(factName string, factValue interface{}) {
+	cause, chained := e.attributeUpdate(factName, factValue)
+	e.enqueue(factUpdate{fact: factName, value: factValue, cause: cause, chained: chained})
+}
+
+// IngestMessage takes in a fact update message published on a channel, as the
+// fact processing loop does for the messages it receives. The payload is
+// either "key=value", with the value parsed by ParseFactValue, or a JSON
+// object of facts, which are queued in key order. Payloads in neither format
+// are dead-lettered and returned as an error.
+func (e *Engine) IngestMessage(channel, payload string) error {
+	facts, err := parseFactMessage(payload)
+	if err != nil {
+		e.log().Warn().Str("channel", channel).Str("payload", payload).Msg("Invalid fact update format")
+		e.deadLetterMessage(channel, payload, err)
+		return err
+	}
+	for _, fact := range facts {
+		e.Enqueue(fact.Key, fact.Value)
+	}
+	return nil
+}
+
+// parseFactMessage returns the fact updates of a message payload.
+func parseFactMessage(payload string) ([]store.FactUpdate, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &object); err == nil && object != nil {
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		facts := make([]store.FactUpdate, len(keys))
+		for i, key := range keys {
+			facts[i] = store.FactUpdate{Key: key, Value: object[key]}
+		}
+		return facts, nil
+	}
+
+	// Only the first '=' separates the key, since structured (JSON) values
+	// may contain more
+	parts := strings.SplitN(payload, "=", 2)
+	if len(parts) != 2 {
+		return nil, logging.NewError(logging.ErrorTypeRuntime, "Invalid fact update format", nil, map[string]interface{}{"payload": payload})
+	}
+	return []store.FactUpdate{{Key: parts[0], Value: ParseFactValue(parts[1])}}, nil
+}
+
+func (e *Engine) enqueue(update factUpdate) {
+	if e.queue == nil {
+		e.submit(update)
+		return
+	}
+	e.queue.push(update)
+}
+
+// dispatchUpdates hands queued updates to the workers, or evaluates them when
+// no workers run, until the queue is closed and empty.
+func (e *Engine) dispatchUpdates() {
+	for {
+		update, ok := e.queue.pop()
+		if !ok {
+			return
+		}
+		e.submit(update)
+	}
+}
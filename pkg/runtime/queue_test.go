@@ -0,0 +1,195 @@
+// rex/pkg/runtime/queue_test.go
+
+package runtime
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/store"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	policy, err := ParseOverflowPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, OverflowBlock, policy)
+
+	for _, name := range []string{"block", "drop-oldest", "drop-newest", "keep-latest-per-fact"} {
+		policy, err := ParseOverflowPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, OverflowPolicy(name), policy)
+	}
+
+	_, err = ParseOverflowPolicy("drop-all")
+	assert.Error(t, err)
+}
+
+// queuedFacts pops every queued update and returns their facts and values.
+func queuedFacts(q *updateQueue) []factUpdate {
+	q.close()
+	var updates []factUpdate
+	for {
+		update, ok := q.pop()
+		if !ok {
+			return updates
+		}
+		updates = append(updates, factUpdate{fact: update.fact, value: update.value})
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy   OverflowPolicy
+		expected []factUpdate
+		dropped  uint64
+	}{
+		{
+			policy:   OverflowDropOldest,
+			expected: []factUpdate{{fact: "humidity", value: 50.0}, {fact: "temperature", value: 2.0}},
+			dropped:  1,
+		},
+		{
+			policy:   OverflowDropNewest,
+			expected: []factUpdate{{fact: "temperature", value: 1.0}, {fact: "humidity", value: 50.0}},
+			dropped:  1,
+		},
+		{
+			policy:   OverflowKeepLatest,
+			expected: []factUpdate{{fact: "temperature", value: 2.0}, {fact: "humidity", value: 50.0}},
+			dropped:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			q := newUpdateQueue(2, tt.policy)
+			q.push(factUpdate{fact: "temperature", value: 1.0})
+			q.push(factUpdate{fact: "humidity", value: 50.0})
+			q.push(factUpdate{fact: "temperature", value: 2.0})
+
+			assert.Equal(t, QueueStats{Depth: 2, Capacity: 2, Policy: tt.policy, Dropped: tt.dropped}, q.stats())
+			assert.Equal(t, tt.expected, queuedFacts(q))
+		})
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	q := newUpdateQueue(1, OverflowBlock)
+	q.push(factUpdate{fact: "temperature", value: 1.0})
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(factUpdate{fact: "temperature", value: 2.0})
+	}()
+
+	// The second update waits until the first is taken
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	update, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, update.value)
+	assert.True(t, <-pushed)
+	assert.Equal(t, QueueStats{Depth: 1, Capacity: 1, Policy: OverflowBlock}, q.stats())
+
+	// Closing the queue releases blocked pushes
+	go func() {
+		pushed <- q.push(factUpdate{fact: "temperature", value: 3.0})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	assert.False(t, <-pushed)
+}
+
+func TestQueueLogsDropsWhileShedding(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	clock := &fakeClock{}
+	q := newUpdateQueue(1, OverflowDropNewest)
+	q.logger, q.clock = &logger, clock
+
+	for i := 0; i < 3; i++ {
+		q.push(factUpdate{fact: "temperature", value: float64(i)})
+	}
+	assert.Equal(t, 1, strings.Count(logs.String(), "Ingestion queue full, shedding load"))
+	assert.NotContains(t, logs.String(), "still full")
+
+	// Every interval the drops since the last report are logged
+	clock.Advance(queueDropLogInterval)
+	q.push(factUpdate{fact: "temperature", value: 3.0})
+	assert.Contains(t, logs.String(), `"dropped":3,"totalDropped":3`)
+
+	clock.Advance(queueDropLogInterval / 2)
+	q.push(factUpdate{fact: "temperature", value: 4.0})
+	clock.Advance(queueDropLogInterval / 2)
+	q.push(factUpdate{fact: "temperature", value: 5.0})
+	assert.Contains(t, logs.String(), `"dropped":2,"totalDropped":5`)
+	assert.Equal(t, 2, strings.Count(logs.String(), "still full"))
+}
+
+func TestEnqueue(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("hot", 1, "temperature", 30, "alerts:hot")},
+	})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+	engine.ConfigureQueue(10, OverflowDropNewest)
+
+	engine.Enqueue("temperature", 35.0)
+	assert.Eventually(t, func() bool {
+		value, _ := engine.Fact("alerts:hot")
+		return value == "hot"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, QueueStats{Capacity: 10, Policy: OverflowDropNewest}, engine.QueueStats())
+}
+
+func TestIngestMessage(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	engine := &Engine{Facts: map[string]interface{}{}, store: redisStore, DeadLetterKey: "rex:dead_letters"}
+
+	// Only the first '=' separates the key
+	assert.NoError(t, engine.IngestMessage("system", `system:fan_config={"mode":"eco","expr":"a=b"}`))
+	assert.Equal(t, map[string]interface{}{"mode": "eco", "expr": "a=b"}, engine.Facts["system:fan_config"])
+
+	// A JSON object updates each of its facts
+	assert.NoError(t, engine.IngestMessage("system", `{"system:mode":"idle","system:fan_speed":2}`))
+	assert.Equal(t, "idle", engine.Facts["system:mode"])
+	assert.Equal(t, 2.0, engine.Facts["system:fan_speed"])
+
+	// Anything else is dead-lettered
+	assert.Error(t, engine.IngestMessage("system", "garbage"))
+	assert.Error(t, engine.IngestMessage("system", "[1,2]"))
+	letters, err := redisStore.GetDeadLetters("rex:dead_letters")
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, store.DeadLetterMessage, letters[0].Kind)
+		assert.Equal(t, "system", letters[0].Channel)
+		assert.Equal(t, "garbage", letters[0].Payload)
+	}
+}
+
+func TestEnqueueAttributesEchoes(t *testing.T) {
+	engine := &Engine{Facts: map[string]interface{}{}}
+	engine.expectEcho(&evaluation{cause: causation{root: "system:temperature"}, rule: "ModeRule", chained: true}, "system:mode", "cooling")
+
+	// The echo of a write already chained in-process is only applied
+	engine.Enqueue("system:mode", "cooling")
+	assert.Equal(t, "cooling", engine.Facts["system:mode"])
+	assert.Empty(t, engine.recentWrites)
+}
@@ -0,0 +1,95 @@
+// rex/pkg/runtime/reload.go
+
+package runtime
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ReloadSummary lists how the rules of a reloaded program differ from the
+// rules they replaced. Rule names are sorted.
+type ReloadSummary struct {
+	Added     []string `json:"added"`
+	Changed   []string `json:"changed"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// Reload validates compiled bytecode and swaps it in for the running rules,
+// like ReloadProgram. If the bytecode is invalid, the running rules are kept
+// and the error is returned.
+func (e *Engine) Reload(bytecode []byte) (ReloadSummary, error) {
+	program, err := LoadProgramBytes(bytecode)
+	if err != nil {
+		e.log().Error().Err(err).Msg("Invalid bytecode, keeping the running rules")
+		return ReloadSummary{}, err
+	}
+	return e.ReloadProgram(program), nil
+}
+
+// ReloadFromFile reloads the bytecode in a file, like Reload.
+func (e *Engine) ReloadFromFile(filename string) (ReloadSummary, error) {
+	program, err := LoadProgramFile(filename)
+	if err != nil {
+		e.log().Error().Err(err).Msg("Invalid bytecode, keeping the running rules")
+		return ReloadSummary{}, err
+	}
+	return e.ReloadProgram(program), nil
+}
+
+// ReloadProgram swaps a program in for the running rules. The swap waits for
+// the evaluations in progress and happens before the next one starts, so
+// every evaluation sees either the old rules or the new ones. Rules whose
+// instructions are unchanged keep their error counts, quarantine and pending
+// delayed actions; those of changed and removed rules are dropped. Local facts
+// are kept.
+func (e *Engine) ReloadProgram(program *Program) ReloadSummary {
+	next := program.program
+	if e.executionMode == ExecutionCompiled {
+		next.compileRules()
+	}
+	next.conditionResults = make([]atomic.Uint64, len(next.conditions))
+
+	e.programMu.Lock()
+	defer e.programMu.Unlock()
+
+	var summary ReloadSummary
+	for _, rule := range next.ruleExecutionIndex {
+		_, ok := e.rulePositions[rule.RuleName]
+		switch {
+		case !ok:
+			summary.Added = append(summary.Added, rule.RuleName)
+		case !next.sameRule(&e.program, rule.RuleName):
+			summary.Changed = append(summary.Changed, rule.RuleName)
+		default:
+			summary.Unchanged = append(summary.Unchanged, rule.RuleName)
+		}
+	}
+	for _, rule := range e.ruleExecutionIndex {
+		if _, ok := next.rulePositions[rule.RuleName]; !ok {
+			summary.Removed = append(summary.Removed, rule.RuleName)
+		}
+	}
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Changed)
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.Unchanged)
+
+	e.program = next
+
+	dropped := make(map[string]struct{}, len(summary.Changed)+len(summary.Removed))
+	for _, ruleName := range append(summary.Changed, summary.Removed...) {
+		dropped[ruleName] = struct{}{}
+	}
+	e.forgetRuleErrors(dropped)
+	e.discardPendingActions(dropped)
+
+	e.log().Info().
+		Strs("added", summary.Added).
+		Strs("changed", summary.Changed).
+		Strs("removed", summary.Removed).
+		Int("unchanged", len(summary.Unchanged)).
+		Msg("Reloaded bytecode")
+	return summary
+}
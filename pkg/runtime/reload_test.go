@@ -0,0 +1,190 @@
+// rex/pkg/runtime/reload_test.go
+
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+// failingRule is a rule on temperature whose script always fails.
+func failingRule(name string, priority int, target string) compiler.Rule {
+	rule := priorityRule(name, priority, "temperature", 0, target)
+	rule.Actions[0].Value = "{fail}"
+	rule.Scripts = map[string]compiler.Script{
+		"fail": {Params: []string{"temperature"}, Body: "return temperature.unknownMethod();"},
+	}
+	return rule
+}
+
+func TestReload(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	retired := priorityRule("retired", 4, "temperature", 0, "retired_fired")
+	retired.Actions[0].Delay = "1h"
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			failingRule("kept", 1, "kept_fired"),
+			failingRule("edited", 2, "edited_fired"),
+			retired,
+		},
+	})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	require.NoError(t, err)
+	engine.ProcessFactUpdate("temperature", 25.0)
+	assert.Equal(t, map[string]int{"kept": 1, "edited": 1}, engine.RuleErrorCounts())
+	pending, err := redisStore.GetPendingActions()
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	// The added rule comes first, shifting the offsets and labels of the rest
+	createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("added", 0, "temperature", 0, "added_fired"),
+			failingRule("kept", 1, "kept_fired"),
+			failingRule("edited", 2, "edited_target"),
+		},
+	})
+	summary, err := engine.ReloadFromFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, ReloadSummary{
+		Added:     []string{"added"},
+		Changed:   []string{"edited"},
+		Removed:   []string{"retired"},
+		Unchanged: []string{"kept"},
+	}, summary)
+
+	// The unchanged rule keeps its errors, the others start afresh
+	assert.Equal(t, map[string]int{"kept": 1}, engine.RuleErrorCounts())
+	pending, err = redisStore.GetPendingActions()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	engine.ProcessFactUpdate("temperature", 30.0)
+	assert.True(t, s.Exists("added_fired"))
+	assert.Equal(t, map[string]int{"kept": 2, "edited": 1}, engine.RuleErrorCounts())
+}
+
+func TestReloadInvalidBytecode(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("running", 1, "temperature", 0, "result")},
+	})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	require.NoError(t, err)
+	bytecode, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	wrongVersion := append([]byte(nil), bytecode...)
+	wrongVersion[0] = 9
+	previousVersion := append([]byte(nil), bytecode...)
+	previousVersion[0] = compiler.Version - 1
+	for name, invalid := range map[string][]byte{
+		"empty":            nil,
+		"truncated":        bytecode[:len(bytecode)-3],
+		"wrong version":    wrongVersion,
+		"previous version": previousVersion,
+	} {
+		_, err := engine.Reload(invalid)
+		assert.Error(t, err, name)
+	}
+
+	engine.ProcessFactUpdate("temperature", 25.0)
+	result, err := s.Get("result")
+	require.NoError(t, err)
+	assert.Equal(t, `"running"`, result)
+}
+
+func TestReloadWhileProcessing(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	var filename string
+	rulesets := make([][]byte, 2)
+	for i := range rulesets {
+		filename = createTestBytecodeFile(t, &compiler.Ruleset{
+			Rules: []compiler.Rule{priorityRule(fmt.Sprintf("version%d", i), 1, "temperature", 0, "alerts:version")},
+		})
+		bytecode, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		rulesets[i] = bytecode
+	}
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	require.NoError(t, err)
+	engine.StartWorkers(4)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			engine.Submit("temperature", float64(i))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := engine.Reload(rulesets[i%2])
+		assert.NoError(t, err)
+	}
+	wg.Wait()
+	engine.StopWorkers()
+
+	engine.ProcessFactUpdate("temperature", 1.0)
+	version, err := s.Get("alerts:version")
+	require.NoError(t, err)
+	assert.Equal(t, `"version1"`, version)
+}
+
+func TestReloadOperandsLikeLabels(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// Action values whose bytes look like a label, or like a condition node
+	// tagging a fact load, differ only where the label number or node ID
+	// would be.
+	label := string([]byte{byte(compiler.LABEL), 'L'})
+	node := string([]byte{byte(compiler.CONDITION_NODE)})
+	load := string([]byte{byte(compiler.LOAD_FACT_FLOAT)})
+	for name, values := range map[string][2]string{
+		"label":          {label + "123", label + "456"},
+		"condition node": {node + "abcd" + load, node + "wxyz" + load},
+	} {
+		withValue := func(value string) *compiler.Ruleset {
+			rule := priorityRule("rule", 1, "temperature", 0, "result")
+			rule.Actions[0].Value = value
+			return &compiler.Ruleset{Rules: []compiler.Rule{rule}}
+		}
+		filename := createTestBytecodeFile(t, withValue(values[0]))
+		engine, err := NewEngineFromFile(filename, redisStore)
+		require.NoError(t, err, name)
+
+		createTestBytecodeFile(t, withValue(values[1]))
+		summary, err := engine.ReloadFromFile(filename)
+		require.NoError(t, err, name)
+		assert.Equal(t, []string{"rule"}, summary.Changed, name)
+
+		engine.ProcessFactUpdate("temperature", 25.0)
+		result, err := s.Get("result")
+		require.NoError(t, err, name)
+		expected, err := json.Marshal(values[1])
+		require.NoError(t, err, name)
+		assert.Equal(t, string(expected), result, name)
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,299 @@
+// rex/pkg/runtime/scheduler.go
+
+package runtime
+
+import (
+	"fmt"
+	"time"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// pendingAction is a delayed action that has been scheduled but not yet run.
+// Its timer is nil while the action is being persisted.
+type pendingAction struct {
+	store.PendingAction
+	timer Timer
+	// retiring is set once the action is being run or cancelled. The action
+	// stays pending until it is removed from the store, so its rule cannot
+	// persist it again in between and have the new action removed instead.
+	retiring bool
+}
+
+// pendingActionID identifies a delayed action by its rule and its position in
+// the rule, so a rule that fires again while the action is pending does not
+// schedule it twice.
+func pendingActionID(ruleName string, actionIndex int) string {
+	return fmt.Sprintf("%s#%d", ruleName, actionIndex)
+}
+
+// scheduleAction persists a delayed action and arms a timer for it. The action
+// value is resolved now, so templates and scripts see the facts that triggered
+// the rule. If the action is already pending it is left untouched.
+func (e *Engine) scheduleAction(ruleName string, actionIndex int, action compiler.Action, delay time.Duration, cancelIfFalse bool) error {
+	id := pendingActionID(ruleName, actionIndex)
+
+	// Reserve the action, so it is scheduled once however many evaluations
+	// of the rule race to schedule it, without holding pendingMu while its
+	// value is resolved and persisted
+	reserved := &pendingAction{PendingAction: store.PendingAction{ID: id, Rule: ruleName, CancelIfFalse: cancelIfFalse}}
+	e.pendingMu.Lock()
+	if _, ok := e.pendingActions[id]; ok {
+		e.pendingMu.Unlock()
+		e.log().Debug().Str("id", id).Msg("Delayed action already pending")
+		return nil
+	}
+	e.addPendingLocked(reserved)
+	e.pendingMu.Unlock()
+
+	value, err := e.resolveActionValue(action.Value)
+	if err != nil {
+		e.releasePending(reserved)
+		return err
+	}
+
+	pending := store.PendingAction{
+		ID:            id,
+		Rule:          ruleName,
+		Type:          action.Type,
+		Target:        action.Target,
+		Value:         value,
+		RunAt:         e.now().Add(delay),
+		CancelIfFalse: cancelIfFalse,
+		OnlyIfChanged: action.OnlyIfChanged,
+	}
+	if err := e.store.AddPendingAction(pending); err != nil {
+		e.releasePending(reserved)
+		return logging.NewError(logging.ErrorTypeRuntime, "Failed to persist pending action", err, map[string]interface{}{"id": id})
+	}
+
+	e.pendingMu.Lock()
+	if e.pendingActions[id] != reserved {
+		// Pending actions were stopped while it was persisted, which leaves
+		// it in the store
+		e.pendingMu.Unlock()
+		return nil
+	}
+	if reserved.retiring {
+		// The action was cancelled while it was persisted
+		e.pendingMu.Unlock()
+		e.retirePending(reserved)
+		return nil
+	}
+	if e.pendingStopped {
+		// The engine is shutting down, so the action is left in the store for
+		// the next engine rather than armed
+		e.removePendingLocked(reserved)
+		e.pendingMu.Unlock()
+		return nil
+	}
+	e.armPendingAction(pending)
+	e.pendingMu.Unlock()
+
+	e.log().Info().Str("id", id).Dur("delay", delay).Time("runAt", pending.RunAt).Msg("Scheduled delayed action")
+	return nil
+}
+
+// releasePending drops the reservation of an action that failed to schedule.
+func (e *Engine) releasePending(reserved *pendingAction) {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	if e.pendingActions[reserved.ID] == reserved {
+		e.removePendingLocked(reserved)
+	}
+}
+
+// addPendingLocked records a pending action and indexes it by its rule.
+// Callers must hold pendingMu.
+func (e *Engine) addPendingLocked(pending *pendingAction) {
+	if e.pendingActions == nil {
+		e.pendingActions = make(map[string]*pendingAction)
+	}
+	if e.pendingByRule == nil {
+		e.pendingByRule = make(map[string]map[string]*pendingAction)
+	}
+	if old, ok := e.pendingActions[pending.ID]; ok {
+		e.removePendingLocked(old)
+	}
+	e.pendingActions[pending.ID] = pending
+	actions := e.pendingByRule[pending.Rule]
+	if actions == nil {
+		actions = make(map[string]*pendingAction)
+		e.pendingByRule[pending.Rule] = actions
+	}
+	actions[pending.ID] = pending
+}
+
+// removePendingLocked forgets a pending action and stops its timer. Callers
+// must hold pendingMu.
+func (e *Engine) removePendingLocked(pending *pendingAction) {
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	delete(e.pendingActions, pending.ID)
+	if actions := e.pendingByRule[pending.Rule]; actions != nil {
+		delete(actions, pending.ID)
+		if len(actions) == 0 {
+			delete(e.pendingByRule, pending.Rule)
+		}
+	}
+}
+
+// retireLocked marks a pending action as being removed and stops its timer.
+// It reports whether the caller should remove the action with retirePending:
+// actions already being removed are left alone, and so are actions still
+// being persisted, which scheduleAction removes once they are. Callers must
+// hold pendingMu.
+func (e *Engine) retireLocked(pending *pendingAction) bool {
+	if pending.retiring {
+		return false
+	}
+	pending.retiring = true
+	if pending.timer == nil {
+		return false
+	}
+	pending.timer.Stop()
+	return true
+}
+
+// retirePending removes a pending action from the store, and only then
+// forgets it, so a new action with the same ID is never removed in its
+// place.
+func (e *Engine) retirePending(pending *pendingAction) {
+	e.removeStoredAction(pending.ID)
+
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	if e.pendingActions[pending.ID] == pending {
+		e.removePendingLocked(pending)
+	}
+}
+
+// removeStoredAction removes a pending action from the store.
+func (e *Engine) removeStoredAction(id string) {
+	if err := e.store.RemovePendingAction(id); err != nil {
+		e.log().Error().Err(err).Str("id", id).Msg("Failed to remove pending action from store")
+	}
+}
+
+// armPendingAction starts the timer for a pending action. The action runs on
+// the timer's goroutine when it becomes due, so it does not wait on the fact
+// processing loop. Callers must hold pendingMu.
+func (e *Engine) armPendingAction(pending store.PendingAction) {
+	entry := &pendingAction{PendingAction: pending}
+	e.addPendingLocked(entry)
+	entry.timer = e.clockOrDefault().AfterFunc(pending.RunAt.Sub(e.now()), func() {
+		e.runPendingAction(entry)
+	})
+}
+
+// runPendingAction removes a due delayed action from the store and executes
+// it. Actions cancelled, stopped or rescheduled after their timer fired are
+// skipped. The action is removed first, so its rule can schedule it again
+// while it runs. Shutdown waits for the actions running.
+func (e *Engine) runPendingAction(entry *pendingAction) {
+	id := entry.ID
+	e.pendingMu.Lock()
+	ok := !e.pendingStopped && e.pendingActions[id] == entry && e.retireLocked(entry)
+	if ok {
+		e.pendingRuns.Add(1)
+	}
+	e.pendingMu.Unlock()
+
+	if !ok {
+		e.log().Debug().Str("id", id).Msg("Delayed action no longer pending")
+		return
+	}
+	defer e.pendingRuns.Done()
+	e.retirePending(entry)
+
+	action := compiler.Action{
+		Type:          entry.Type,
+		Target:        entry.Target,
+		Value:         entry.Value,
+		OnlyIfChanged: entry.OnlyIfChanged,
+	}
+	if err := e.executeAction(nil, entry.Rule, action); err != nil {
+		e.log().Error().Err(err).Str("id", id).Msg("Failed to execute delayed action")
+	}
+}
+
+// cancelPendingActions cancels the pending actions of a rule that asked to be
+// cancelled when the rule becomes false. It is called whenever a rule
+// evaluates false, so it returns early for the common rule with nothing
+// pending, and removes the cancelled actions from the store outside pendingMu.
+func (e *Engine) cancelPendingActions(ruleName string) {
+	e.pendingMu.Lock()
+	actions := e.pendingByRule[ruleName]
+	if len(actions) == 0 {
+		e.pendingMu.Unlock()
+		return
+	}
+	var cancelled []*pendingAction
+	for _, pending := range actions {
+		if pending.CancelIfFalse && e.retireLocked(pending) {
+			cancelled = append(cancelled, pending)
+		}
+	}
+	e.pendingMu.Unlock()
+
+	for _, pending := range cancelled {
+		e.retirePending(pending)
+		e.log().Info().Str("id", pending.ID).Str("ruleName", ruleName).Msg("Cancelled delayed action because the rule became false")
+	}
+}
+
+// stopPendingActions stops the timers of the pending actions, leaving them
+// persisted in the store, and keeps timers that already fired and actions
+// scheduled from now on from running.
+func (e *Engine) stopPendingActions() {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+
+	e.pendingStopped = true
+
+	for _, pending := range e.pendingActions {
+		e.removePendingLocked(pending)
+	}
+}
+
+// discardPendingActions cancels the pending actions of rules and removes them
+// from the store.
+func (e *Engine) discardPendingActions(ruleNames map[string]struct{}) {
+	var discarded []*pendingAction
+	e.pendingMu.Lock()
+	for ruleName := range ruleNames {
+		for _, pending := range e.pendingByRule[ruleName] {
+			if e.retireLocked(pending) {
+				discarded = append(discarded, pending)
+			}
+		}
+	}
+	e.pendingMu.Unlock()
+
+	for _, pending := range discarded {
+		e.retirePending(pending)
+		e.log().Info().Str("id", pending.ID).Str("ruleName", pending.Rule).Msg("Cancelled delayed action of a reloaded rule")
+	}
+}
+
+// restorePendingActions re-arms the pending actions persisted in the store, so
+// delayed actions survive a restart. Actions that became due while the engine
+// was down run right away.
+func (e *Engine) restorePendingActions() error {
+	actions, err := e.store.GetPendingActions()
+	if err != nil {
+		return err
+	}
+
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+
+	for _, pending := range actions {
+		e.armPendingAction(pending)
+		e.log().Info().Str("id", pending.ID).Time("runAt", pending.RunAt).Msg("Restored pending action")
+	}
+	return nil
+}
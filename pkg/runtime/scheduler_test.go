@@ -0,0 +1,288 @@
+// rex/pkg/runtime/scheduler_test.go
+
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/store"
+)
+
+func delayedActionRuleset(delay string, cancelIfFalse bool) *compiler.Ruleset {
+	return &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name: "FanOffRule",
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{
+						{Fact: "system:temperature", Operator: "LT", Value: 20.0},
+					},
+				},
+				Actions: []compiler.Action{
+					{Type: "updateStore", Target: "system:fan_speed", Value: 0.0, Delay: delay, CancelIfFalse: cancelIfFalse},
+					{Type: "updateStore", Target: "system:mode", Value: "cooling_down"},
+				},
+			},
+		},
+	}
+}
+
+func TestDelayedAction(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, delayedActionRuleset("100ms", false))
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	engine.ProcessFactUpdate("system:temperature", 15.0)
+
+	// The immediate action runs right away, the delayed one is only persisted
+	mode, err := s.Get("system:mode")
+	assert.NoError(t, err)
+	assert.Equal(t, `"cooling_down"`, mode)
+	assert.False(t, s.Exists("system:fan_speed"))
+
+	pending, err := redisStore.GetPendingActions()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "FanOffRule#0", pending[0].ID)
+		assert.Equal(t, "system:fan_speed", pending[0].Target)
+	}
+
+	// Firing the rule again while the action is pending does not reschedule it
+	engine.ProcessFactUpdate("system:temperature", 14.0)
+	pending, err = redisStore.GetPendingActions()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	assert.Eventually(t, func() bool {
+		speed, err := s.Get("system:fan_speed")
+		return err == nil && speed == "0"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		pending, err := redisStore.GetPendingActions()
+		return err == nil && len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDelayedActionCancelledWhenRuleFalse(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, delayedActionRuleset("150ms", true))
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	engine.ProcessFactUpdate("system:temperature", 15.0)
+	pending, err := redisStore.GetPendingActions()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	// The rule becomes false before the delay elapses
+	engine.ProcessFactUpdate("system:temperature", 25.0)
+	pending, err = redisStore.GetPendingActions()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, s.Exists("system:fan_speed"))
+}
+
+func TestPendingActionsRestoredOnStartup(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	// A pending action left behind by a previous run, already overdue
+	err := redisStore.AddPendingAction(store.PendingAction{
+		ID:     "FanOffRule#0",
+		Rule:   "FanOffRule",
+		Type:   "updateStore",
+		Target: "system:fan_speed",
+		Value:  0.0,
+		RunAt:  time.Now().Add(-time.Minute),
+	})
+	assert.NoError(t, err)
+
+	filename := createTestBytecodeFile(t, delayedActionRuleset("10m", false))
+	defer os.Remove(filename)
+
+	_, err = NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		speed, err := s.Get("system:fan_speed")
+		return err == nil && speed == "0"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		pending, err := redisStore.GetPendingActions()
+		return err == nil && len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDelayedActionsRunWithoutFactProcessing(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, delayedActionRuleset("1h", false))
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+
+	// The engine is never started, so no fact processing loop takes in the
+	// due actions. More actions than used to fit in its buffer are due at once.
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	engine, err := NewEngine(program, redisStore, WithClock(clock))
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		action := compiler.Action{Type: "updateStore", Target: fmt.Sprintf("system:fan_%d", i), Value: 0.0}
+		require.NoError(t, engine.scheduleAction("FanOffRule", i, action, time.Hour, false))
+	}
+
+	clock.Advance(time.Hour)
+	for i := 0; i < 100; i++ {
+		assert.True(t, s.Exists(fmt.Sprintf("system:fan_%d", i)))
+	}
+	pending, err := redisStore.GetPendingActions()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Empty(t, engine.pendingActions)
+	assert.Empty(t, engine.pendingByRule)
+}
+
+func TestCancelPendingActionsOfOtherRules(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, delayedActionRuleset("1h", true))
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+	engine, err := NewEngine(program, redisStore, WithClock(&fakeClock{}))
+	require.NoError(t, err)
+
+	action := compiler.Action{Type: "updateStore", Target: "system:fan_speed", Value: 0.0}
+	require.NoError(t, engine.scheduleAction("FanOffRule", 0, action, time.Hour, true))
+	require.NoError(t, engine.scheduleAction("HeaterRule", 0, action, time.Hour, true))
+
+	// Only the actions of the rule that became false are cancelled
+	engine.cancelPendingActions("FanOffRule")
+	engine.cancelPendingActions("UnknownRule")
+	pending, err := redisStore.GetPendingActions()
+	require.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "HeaterRule#0", pending[0].ID)
+	}
+	assert.Len(t, engine.pendingByRule, 1)
+	assert.Contains(t, engine.pendingByRule, "HeaterRule")
+}
+
+func TestDelayedScriptActionResolvedWhenScheduled(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	script := compiler.Script{Params: []string{"temperature"}, Body: "return 20 - temperature;"}
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name: "FanOffRule",
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{{Fact: "temperature", Operator: "LT", Value: 20.0}},
+				},
+				Actions: []compiler.Action{{Type: "updateStore", Target: "system:fan_speed", Value: "{fan_speed}", Delay: "1h"}},
+				Scripts: map[string]compiler.Script{"fan_speed": script},
+			},
+		},
+	}
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	engine, err := NewEngine(program, redisStore, WithClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, engine.ScriptEngine.SetScript("fan_speed", script))
+
+	// The script runs when its action does, so a delayed action with a script
+	// value is not written right away but scheduled with the script's result
+	require.NoError(t, redisStore.SetFact("temperature", 15.0))
+	engine.ProcessFactUpdate("temperature", 15.0)
+	assert.False(t, s.Exists("system:fan_speed"))
+	pending, err := redisStore.GetPendingActions()
+	require.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, 5.0, pending[0].Value)
+	}
+
+	clock.Advance(time.Hour)
+	speed, err := s.Get("system:fan_speed")
+	require.NoError(t, err)
+	assert.Equal(t, "5", speed)
+	assert.Empty(t, engine.RuleErrorCounts())
+}
+
+func TestDelayedActionRescheduledWhileRunning(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			{
+				Name: "FanOffRule",
+				Conditions: compiler.ConditionGroup{
+					All: []*compiler.ConditionOrGroup{{Fact: "temperature", Operator: "LT", Value: 20.0}},
+				},
+				Actions: []compiler.Action{{Type: "sendMessage", Target: "fan", Value: "off", Delay: "1h"}},
+			},
+		},
+	}
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	require.NoError(t, err)
+
+	// The rule fires again while its delayed action runs, which schedules
+	// the action again under the same ID
+	var engine *Engine
+	sent := 0
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	engine, err = NewEngine(program, redisStore, WithClock(clock),
+		WithActionHandler("sendMessage", func(ruleName string, action compiler.Action, value interface{}) error {
+			sent++
+			if sent == 1 {
+				engine.ProcessFactUpdate("temperature", 15.0)
+			}
+			return nil
+		}))
+	require.NoError(t, err)
+	require.NoError(t, redisStore.SetFact("temperature", 15.0))
+	engine.ProcessFactUpdate("temperature", 15.0)
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 1, sent)
+	pending, err := redisStore.GetPendingActions()
+	require.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "FanOffRule#0", pending[0].ID)
+	}
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 2, sent)
+	pending, err = redisStore.GetPendingActions()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
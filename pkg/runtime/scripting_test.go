@@ -68,7 +68,7 @@ func TestScriptingEndToEnd(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.Remove(tempFile)
 
-	engine, err := NewEngineFromFile(tempFile, redisStore, 0)
+	engine, err := NewEngineFromFile(tempFile, redisStore)
 	assert.NoError(t, err)
 
 	// Set the script in the engine's script engine
@@ -0,0 +1,195 @@
+// rex/pkg/runtime/shutdown_test.go
+
+package runtime
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/store"
+)
+
+// slowStore is a Redis store whose fact writes take a while.
+type slowStore struct {
+	*store.RedisStore
+	writes atomic.Int32
+}
+
+func (s *slowStore) SetAndPublishFact(key string, value interface{}) error {
+	time.Sleep(20 * time.Millisecond)
+	s.writes.Add(1)
+	return s.RedisStore.SetAndPublishFact(key, value)
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("hot", 1, "temperature", 30, "alerts:hot")},
+	})
+	defer os.Remove(filename)
+
+	slow := &slowStore{RedisStore: redisStore}
+	engine, err := NewEngineFromFile(filename, slow)
+	assert.NoError(t, err)
+	engine.StartWorkers(2)
+
+	for i := 0; i < 5; i++ {
+		engine.Enqueue("temperature", float64(31+i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, engine.Shutdown(ctx))
+
+	// Every queued update was evaluated and its write completed
+	assert.Equal(t, int32(5), slow.writes.Load())
+	assert.Equal(t, 0, engine.QueueStats().Depth)
+	select {
+	case <-engine.loopDone:
+	default:
+		t.Fatal("fact processing loop still running")
+	}
+
+	// Updates enqueued after shutdown are not evaluated
+	engine.Enqueue("temperature", 40.0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(5), slow.writes.Load())
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("hot", 1, "temperature", 30, "alerts:hot")},
+	})
+	defer os.Remove(filename)
+
+	slow := &slowStore{RedisStore: redisStore}
+	engine, err := NewEngineFromFile(filename, slow)
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		engine.Enqueue("temperature", float64(31+i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, engine.Shutdown(ctx), context.DeadlineExceeded)
+
+	// The updates still queued at the deadline were discarded
+	assert.Equal(t, 0, engine.QueueStats().Depth)
+	assert.Less(t, slow.writes.Load(), int32(20))
+}
+
+func TestShutdownKeepsPendingActions(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("hot", 1, "temperature", 30, "alerts:hot")},
+	})
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	action := compiler.Action{Type: "updateStore", Target: "alerts:fan", Value: true}
+	assert.NoError(t, engine.scheduleAction("hot", 0, action, time.Hour, false))
+	assert.NoError(t, engine.Shutdown(context.Background()))
+
+	assert.Empty(t, engine.pendingActions)
+	pending, err := redisStore.GetPendingActions()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestShutdownWithoutBackgroundProcessing(t *testing.T) {
+	engine := &Engine{Facts: map[string]interface{}{}}
+	assert.NoError(t, engine.Shutdown(context.Background()))
+}
+
+func TestShutdownWithoutStart(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	filename := createTestBytecodeFile(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("alert", 1, "temperature", 30, "alerts:heat")},
+	})
+	defer os.Remove(filename)
+	program, err := LoadProgramFile(filename)
+	assert.NoError(t, err)
+
+	engine, err := NewEngine(program, redisStore)
+	assert.NoError(t, err)
+
+	// Updates can be evaluated directly without starting the engine
+	engine.ProcessFactUpdate("temperature", 35.0)
+	assert.True(t, s.Exists("alerts:heat"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, engine.Shutdown(ctx))
+}
+
+// blockingStore is a Redis store whose fact writes wait to be released.
+type blockingStore struct {
+	*store.RedisStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) SetAndPublishFact(key string, value interface{}) error {
+	s.started <- struct{}{}
+	<-s.release
+	return s.RedisStore.SetAndPublishFact(key, value)
+}
+
+func TestShutdownWaitsForDelayedActions(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	program := loadTestProgram(t, &compiler.Ruleset{
+		Rules: []compiler.Rule{priorityRule("hot", 1, "temperature", 30, "alerts:hot")},
+	})
+	blocking := &blockingStore{RedisStore: redisStore, started: make(chan struct{}, 1), release: make(chan struct{})}
+	clock := &fakeClock{}
+	engine, err := NewEngine(program, blocking, WithClock(clock))
+	assert.NoError(t, err)
+
+	fan := compiler.Action{Type: "updateStore", Target: "alerts:fan", Value: true}
+	assert.NoError(t, engine.scheduleAction("hot", 0, fan, time.Minute, false))
+	go clock.Advance(time.Minute)
+	<-blocking.started
+
+	done := make(chan error)
+	go func() { done <- engine.Shutdown(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the delayed action being run")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocking.release)
+	assert.NoError(t, <-done)
+	assert.True(t, s.Exists("alerts:fan"))
+
+	// Actions scheduled once shutdown began are left in the store, unarmed
+	pump := compiler.Action{Type: "updateStore", Target: "alerts:pump", Value: true}
+	assert.NoError(t, engine.scheduleAction("hot", 1, pump, time.Minute, false))
+	clock.Advance(time.Minute)
+	assert.False(t, s.Exists("alerts:pump"))
+	assert.Empty(t, engine.pendingActions)
+	pending, err := redisStore.GetPendingActions()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "alerts:pump", pending[0].Target)
+	}
+}
@@ -0,0 +1,91 @@
+// rex/pkg/runtime/template.go
+
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"rgehrsitz/rex/pkg/compiler"
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// renderTemplate renders parsed template parts, substituting each fact
+// reference with the current value of the fact. Missing facts render as an
+// empty string.
+func (e *Engine) renderTemplate(parts []compiler.TemplatePart) string {
+	var sb strings.Builder
+	for _, part := range parts {
+		if !part.IsFactRef() {
+			sb.WriteString(part.Literal)
+			continue
+		}
+		value, ok := e.Fact(part.Fact)
+		if !ok || value == nil {
+			e.log().Warn().Str("fact", part.Fact).Msg("Template references a fact with no value")
+			continue
+		}
+		sb.WriteString(formatTemplateValue(value, part.Format))
+	}
+	return sb.String()
+}
+
+// formatTemplateValue formats a single fact value for a template.
+//
+// Without a format, numbers are written in their shortest exact form (30, 30.5),
+// bools as true/false, strings as-is and anything else as JSON. A format
+// starting with '%' is applied with fmt.Sprintf if its verb formats the
+// value's type; a "yes/no" style format picks one of the two labels for bools.
+// Values a format does not apply to are written as without it.
+func formatTemplateValue(value interface{}, format string) string {
+	if strings.HasPrefix(format, "%") {
+		if verbFormats(format[len(format)-1], value) {
+			return fmt.Sprintf(format, value)
+		}
+		logging.Logger.Warn().Interface("value", value).Str("format", format).Msg("Template format verb does not apply to the value's type")
+	}
+
+	if trueLabel, falseLabel, ok := strings.Cut(format, "/"); ok {
+		if b, isBool := value.(bool); isBool {
+			if b {
+				return trueLabel
+			}
+			return falseLabel
+		}
+		logging.Logger.Warn().Interface("value", value).Str("format", format).Msg("Boolean template format applied to non-boolean value")
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+// verbFormats reports whether a template format verb formats a value: f, g
+// and e format numbers, s strings and t bools, and v any value.
+func verbFormats(verb byte, value interface{}) bool {
+	var ok bool
+	switch verb {
+	case 'f', 'g', 'e':
+		_, ok = value.(float64)
+	case 's':
+		_, ok = value.(string)
+	case 't':
+		_, ok = value.(bool)
+	default:
+		ok = true
+	}
+	return ok
+}
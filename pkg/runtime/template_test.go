@@ -0,0 +1,86 @@
+// rex/pkg/runtime/template_test.go
+
+package runtime
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+func TestFormatTemplateValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		format   string
+		expected string
+	}{
+		{"Integral number", 30.0, "", "30"},
+		{"Fractional number", 30.25, "", "30.25"},
+		{"Number with precision", 30.25, "%.1f", "30.2"},
+		{"Bool", true, "", "true"},
+		{"Bool labels true", true, "on/off", "on"},
+		{"Bool labels false", false, "on/off", "off"},
+		{"String", "north", "", "north"},
+		{"Padded string", "n", "%3s", "  n"},
+		{"Array", []interface{}{1.0, 2.0}, "", "[1,2]"},
+		{"Labels on non-bool", 5.0, "on/off", "5"},
+		{"Any value", 5.5, "%6v", "   5.5"},
+		{"Number verb on string", "north", "%.1f", "north"},
+		{"String verb on number", 30.25, "%s", "30.25"},
+		{"Bool verb on string", "yes", "%t", "yes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, formatTemplateValue(tt.value, tt.format))
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	engine := &Engine{
+		Facts: map[string]interface{}{
+			"weather:temperature": 31.47,
+			"weather:station":     "north",
+		},
+	}
+
+	parts, err := compiler.ParseTemplate("Temp is ${weather:temperature|%.1f}C at ${weather:station}${weather:missing}")
+	assert.NoError(t, err)
+	assert.Equal(t, "Temp is 31.5C at north", engine.renderTemplate(parts))
+}
+
+func TestTemplateActionValueEndToEnd(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	engine := createTestEngine(redisStore, `{
+        "rules": [{
+            "name": "template_rule",
+            "conditions": {
+                "all": [{
+                    "fact": "weather:temperature",
+                    "operator": "GT",
+                    "value": 30
+                }]
+            },
+            "actions": [{
+                "type": "updateStore",
+                "target": "weather:summary",
+                "value": "Temp is ${weather:temperature}C at ${weather:station}"
+            }]
+        }]
+    }`)
+
+	err := redisStore.SetFact("weather:station", "north")
+	assert.NoError(t, err)
+
+	engine.ProcessFactUpdate("weather:temperature", 35.0)
+
+	summary, err := redisStore.GetFact("weather:summary")
+	assert.NoError(t, err)
+	assert.Equal(t, "Temp is 35C at north", summary)
+}
@@ -0,0 +1,114 @@
+// rex/pkg/runtime/workers.go
+
+package runtime
+
+import "hash/fnv"
+
+// DefaultWorkers is the number of evaluation workers rexd starts with.
+const DefaultWorkers = 4
+
+// workerQueueSize bounds how many updates can wait for a worker before
+// submitting more blocks.
+const workerQueueSize = 256
+
+// factUpdate is a fact update waiting for a worker. A chained update is the
+// echo of a write already evaluated in-process, so only its value is applied.
+type factUpdate struct {
+	fact    string
+	value   interface{}
+	cause   causation
+	chained bool
+}
+
+// StartWorkers starts n workers that process the updates passed to Submit
+// and received from the store concurrently. Updates to the same fact always
+// go to the same worker, so they are applied in the order they arrived, while
+// updates to different facts are evaluated in parallel. Call StopWorkers to
+// stop them. Starting workers again, or starting fewer than one, does nothing.
+// Set CoalesceWindow before starting the workers.
+func (e *Engine) StartWorkers(n int) {
+	e.workersMu.Lock()
+	defer e.workersMu.Unlock()
+	if n < 1 || e.workers != nil {
+		return
+	}
+
+	e.workers = make([]chan factUpdate, n)
+	for i := range e.workers {
+		updates := make(chan factUpdate, workerQueueSize)
+		e.workers[i] = updates
+		e.workersWG.Add(1)
+		go e.runWorker(updates)
+	}
+	e.log().Info().Int("workers", n).Msg("Started evaluation workers")
+}
+
+// StopWorkers stops the workers once they have processed the updates already
+// submitted. Updates submitted afterwards are processed by the caller.
+func (e *Engine) StopWorkers() {
+	e.workersMu.Lock()
+	workers := e.workers
+	e.workers = nil
+	for _, updates := range workers {
+		close(updates)
+	}
+	e.workersMu.Unlock()
+
+	e.workersWG.Wait()
+	if workers != nil {
+		e.log().Info().Int("workers", len(workers)).Msg("Stopped evaluation workers")
+	}
+}
+
+// Submit applies a fact update and evaluates the rules that reference the
+// fact like ProcessFactUpdate, handing it to a worker if workers are running.
+func (e *Engine) Submit(factName string, factValue interface{}) {
+	e.submit(factUpdate{fact: factName, value: factValue, cause: causation{root: factName}})
+}
+
+// submit hands an update to the worker for its fact, or processes it in the
+// calling goroutine when no workers are running. The read lock is held while
+// the update is queued, so StopWorkers cannot close the queue in between.
+func (e *Engine) submit(update factUpdate) {
+	e.workersMu.RLock()
+	if len(e.workers) == 0 {
+		e.workersMu.RUnlock()
+		e.applyUpdate(update)
+		return
+	}
+	e.workers[workerIndex(update.fact, len(e.workers))] <- update
+	e.workersMu.RUnlock()
+}
+
+// runWorker processes updates until the channel is closed.
+func (e *Engine) runWorker(updates <-chan factUpdate) {
+	defer e.workersWG.Done()
+	for update := range updates {
+		if e.discarding.Load() {
+			e.log().Debug().Str("factName", update.fact).Msg("Discarding update on shutdown")
+			continue
+		}
+		if e.CoalesceWindow > 0 {
+			e.applyBatch(e.collectBatch(update, updates))
+			continue
+		}
+		e.applyUpdate(update)
+	}
+}
+
+// applyUpdate applies a single update.
+func (e *Engine) applyUpdate(update factUpdate) {
+	if update.chained {
+		e.setFact(update.fact, update.value)
+		e.log().Debug().Str("factName", update.fact).Msg("Skipping update already chained in-process")
+		return
+	}
+	e.processFactUpdate(update.fact, update.value, update.cause)
+}
+
+// workerIndex picks the worker for a fact.
+func workerIndex(fact string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(fact))
+	return int(h.Sum32() % uint32(workers))
+}
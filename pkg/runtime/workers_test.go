@@ -0,0 +1,105 @@
+// rex/pkg/runtime/workers_test.go
+
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rgehrsitz/rex/pkg/compiler"
+)
+
+func TestWorkersApplyUpdatesInOrder(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("hot", 1, "temperature", 30, "alerts:alert"),
+			priorityRule("humid", 1, "humidity", 80, "alerts:warning"),
+		},
+	}
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	engine.StartWorkers(4)
+	facts := []string{"temperature", "humidity", "pressure", "flow_rate"}
+	for i := 0; i < 100; i++ {
+		for _, fact := range facts {
+			engine.Submit(fact, float64(i))
+		}
+	}
+	engine.StopWorkers()
+
+	// Each fact holds the last value submitted for it
+	for _, fact := range facts {
+		value, ok := engine.Fact(fact)
+		assert.True(t, ok)
+		assert.Equal(t, 99.0, value, fact)
+	}
+	alert, _ := engine.Fact("alerts:alert")
+	assert.Equal(t, "hot", alert)
+	warning, _ := engine.Fact("alerts:warning")
+	assert.Equal(t, "humid", warning)
+
+	// Once the workers are stopped, updates are processed by the caller
+	engine.Submit("temperature", 12.0)
+	value, _ := engine.Fact("temperature")
+	assert.Equal(t, 12.0, value)
+}
+
+func TestConcurrentFactUpdates(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	ruleset := &compiler.Ruleset{
+		Rules: []compiler.Rule{
+			priorityRule("hot", 1, "temperature", 30, "alerts:alert"),
+			priorityRule("humid", 1, "humidity", 80, "alerts:alert"),
+		},
+	}
+	filename := createTestBytecodeFile(t, ruleset)
+	defer os.Remove(filename)
+
+	engine, err := NewEngineFromFile(filename, redisStore)
+	assert.NoError(t, err)
+
+	// Updates arriving from several goroutines at once, with readers in
+	// between, must not race
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				engine.ProcessFactUpdate("temperature", float64(25+i))
+				engine.ProcessFactUpdate("humidity", float64(70+i))
+				engine.ProcessFactUpdate(fmt.Sprintf("sensor:%d", g), float64(i))
+				engine.Fact("alerts:alert")
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	alert, ok := engine.Fact("alerts:alert")
+	assert.True(t, ok)
+	assert.Contains(t, []interface{}{"hot", "humid"}, alert)
+}
+
+func TestWorkerIndex(t *testing.T) {
+	// A fact always maps to the same worker
+	for _, fact := range []string{"temperature", "humidity", "alerts:alert"} {
+		index := workerIndex(fact, 4)
+		assert.GreaterOrEqual(t, index, 0)
+		assert.Less(t, index, 4)
+		assert.Equal(t, index, workerIndex(fact, 4))
+	}
+	assert.Equal(t, 0, workerIndex("temperature", 1))
+}
@@ -6,12 +6,16 @@ import (
 	"rgehrsitz/rex/pkg/compiler"
 	"rgehrsitz/rex/pkg/logging"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robertkrimen/otto"
 )
 
+// SafeVM runs scripts in a sandboxed JavaScript VM. It is safe for concurrent
+// use; scripts run one at a time.
 type SafeVM struct {
+	mu      sync.Mutex
 	vm      *otto.Otto
 	scripts map[string]compiler.Script
 }
@@ -39,11 +43,16 @@ func NewSafeVM() *SafeVM {
 
 func (s *SafeVM) SetScript(name string, script compiler.Script) error {
 	logging.Logger.Debug().Str("scriptName", name).Msg("Setting script")
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.scripts[name] = script
 	return nil
 }
 
 func (s *SafeVM) RunScript(name string, params map[string]interface{}, timeout time.Duration) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	script, ok := s.scripts[name]
 	if !ok {
 		logging.Logger.Error().Str("scriptName", name).Msg("Script not found")
@@ -119,12 +128,21 @@ func (s *SafeVM) RunScript(name string, params map[string]interface{}, timeout t
 		return nil, err
 	case <-time.After(timeout + 10*time.Millisecond):
 		logging.Logger.Error().Str("scriptName", name).Msg("Script execution timed out")
+		// Interrupt the script and wait for it to stop, so it no longer uses
+		// the VM once the next script runs
+		s.vm.Interrupt <- func() { panic("Execution timeout") }
+		select {
+		case <-done:
+		case <-errChan:
+		}
 		return nil, fmt.Errorf("script execution timed out")
 	}
 }
 
 func (s *SafeVM) RegisterGlobalFunction(name string, script compiler.Script) error {
 	funcDef := fmt.Sprintf("function %s(%s) { %s }", name, strings.Join(script.Params, ","), script.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	_, err := s.vm.Run(funcDef)
 	if err != nil {
 		return fmt.Errorf("failed to register global function: %w", err)
@@ -0,0 +1,104 @@
+// rex/pkg/store/dead_letters.go
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// DefaultDeadLetterKey is the Redis list dead letters are written to unless
+// another key is configured.
+const DefaultDeadLetterKey = "rex:dead_letters"
+
+// Kinds of dead letters.
+const (
+	// DeadLetterMessage is a received message that could not be processed.
+	DeadLetterMessage = "message"
+	// DeadLetterAction is a failed store write of a rule's action. The writes
+	// of an atomic rule are dead-lettered together.
+	DeadLetterAction = "action"
+)
+
+// DeadLetter is a message or action that could not be processed, with the
+// context needed to inspect and replay it.
+type DeadLetter struct {
+	ID        string       `json:"id"`
+	Kind      string       `json:"kind"`
+	Channel   string       `json:"channel,omitempty"`
+	Payload   string       `json:"payload,omitempty"`
+	Rule      string       `json:"rule,omitempty"`
+	Updates   []FactUpdate `json:"updates,omitempty"`
+	Error     string       `json:"error"`
+	Timestamp time.Time    `json:"timestamp"`
+
+	// raw is the stored encoding, used to remove the entry from the list
+	raw string
+}
+
+// AddDeadLetter appends a dead letter to the list at key, assigning it an ID
+// unique within the list.
+func (s *RedisStore) AddDeadLetter(key string, letter DeadLetter) error {
+	id, err := s.client.Incr(ctx, key+":seq").Result()
+	if err != nil {
+		return err
+	}
+	letter.ID = strconv.FormatInt(id, 10)
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("kind", letter.Kind).Msg("Failed to marshal dead letter")
+		return err
+	}
+	return s.client.RPush(ctx, key, data).Err()
+}
+
+// GetDeadLetters returns the dead letters in the list at key, oldest first.
+// Entries that cannot be decoded are logged and skipped.
+func (s *RedisStore) GetDeadLetters(key string) ([]DeadLetter, error) {
+	entries, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(entries))
+	for _, data := range entries {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(data), &letter); err != nil {
+			logging.Logger.Error().Err(err).Str("key", key).Msg("Failed to unmarshal dead letter")
+			continue
+		}
+		letter.raw = data
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// RemoveDeadLetter removes a dead letter returned by GetDeadLetters from the
+// list at key.
+func (s *RedisStore) RemoveDeadLetter(key string, letter DeadLetter) error {
+	return s.client.LRem(ctx, key, 1, letter.raw).Err()
+}
+
+// ReplayDeadLetter replays a dead letter returned by GetDeadLetters and, if
+// that succeeds, removes it from the list at key. Messages are published again
+// on their channel; action writes are applied again in a single transaction.
+func (s *RedisStore) ReplayDeadLetter(key string, letter DeadLetter) error {
+	var err error
+	switch letter.Kind {
+	case DeadLetterMessage:
+		err = s.client.Publish(ctx, letter.Channel, letter.Payload).Err()
+	case DeadLetterAction:
+		err = s.SetAndPublishFacts(letter.Updates)
+	default:
+		err = fmt.Errorf("unknown dead letter kind %q", letter.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	return s.RemoveDeadLetter(key, letter)
+}
@@ -0,0 +1,69 @@
+// rex/pkg/store/pending_actions.go
+
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// PendingActionsKey is the Redis hash holding delayed actions that have been
+// scheduled but not yet run, keyed by action ID.
+const PendingActionsKey = "rex:pending_actions"
+
+// PendingAction is a delayed action waiting for its run time. The value is
+// resolved when the action is scheduled, so it can be run without the rule.
+type PendingAction struct {
+	ID            string      `json:"id"`
+	Rule          string      `json:"rule"`
+	Type          string      `json:"type"`
+	Target        string      `json:"target"`
+	Value         interface{} `json:"value"`
+	RunAt         time.Time   `json:"runAt"`
+	CancelIfFalse bool        `json:"cancelIfFalse,omitempty"`
+	OnlyIfChanged *bool       `json:"onlyIfChanged,omitempty"`
+}
+
+// AddPendingAction persists a pending action, replacing any pending action
+// with the same ID.
+func (s *RedisStore) AddPendingAction(action PendingAction) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("id", action.ID).Msg("Failed to marshal pending action")
+		return err
+	}
+	return s.client.HSet(ctx, PendingActionsKey, action.ID, data).Err()
+}
+
+// RemovePendingAction deletes a pending action. Removing an unknown ID is not
+// an error.
+func (s *RedisStore) RemovePendingAction(id string) error {
+	return s.client.HDel(ctx, PendingActionsKey, id).Err()
+}
+
+// GetPendingActions returns all persisted pending actions ordered by run time.
+// Entries that cannot be decoded are logged and skipped.
+func (s *RedisStore) GetPendingActions() ([]PendingAction, error) {
+	entries, err := s.client.HGetAll(ctx, PendingActionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	actions := make([]PendingAction, 0, len(entries))
+	for id, data := range entries {
+		var action PendingAction
+		if err := json.Unmarshal([]byte(data), &action); err != nil {
+			logging.Logger.Error().Err(err).Str("id", id).Msg("Failed to unmarshal pending action")
+			continue
+		}
+		actions = append(actions, action)
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].RunAt.Before(actions[j].RunAt)
+	})
+	return actions, nil
+}
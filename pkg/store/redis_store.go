@@ -9,6 +9,7 @@ import (
 	"log"
 	"rgehrsitz/rex/pkg/logging"
 	"strings"
+	"sync"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -17,6 +18,9 @@ var ctx = context.Background()
 
 type RedisStore struct {
 	client *redis.Client
+
+	mu            sync.Mutex
+	subscriptions []*redis.PubSub
 }
 
 // NewRedisStore creates a new instance of RedisStore with the given address, password, and database number.
@@ -117,6 +121,12 @@ func (s *RedisStore) Subscribe(channels ...string) *redis.PubSub {
 	return pubsub
 }
 
+// Publish publishes a message on a channel and returns the number of
+// subscribers that received it.
+func (s *RedisStore) Publish(channel, message string) (int64, error) {
+	return s.client.Publish(ctx, channel, message).Result()
+}
+
 func (s *RedisStore) ReceiveFacts() <-chan *redis.Message {
 	logging.Logger.Info().Msg("Setting up fact reception from Redis")
 	pubsub := s.client.Subscribe(ctx, "weather", "system", "network", "energy", "water")
@@ -130,9 +140,32 @@ func (s *RedisStore) ReceiveFacts() <-chan *redis.Message {
 
 	logging.Logger.Info().Msg("Successfully subscribed to Redis channels")
 
+	s.mu.Lock()
+	s.subscriptions = append(s.subscriptions, pubsub)
+	s.mu.Unlock()
+
 	return pubsub.Channel()
 }
 
+// Close closes the subscriptions opened by ReceiveFacts, which closes their
+// channels, and then the connection to Redis.
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	subscriptions := s.subscriptions
+	s.subscriptions = nil
+	s.mu.Unlock()
+
+	for _, pubsub := range subscriptions {
+		if err := pubsub.Close(); err != nil {
+			logging.Logger.Warn().Err(err).Msg("Failed to close Redis subscription")
+		}
+	}
+	logging.Logger.Info().Msg("Closing connection to Redis")
+	return s.client.Close()
+}
+
+// SetAndPublishFact sets a fact and then publishes the update. If the fact is
+// set but publishing fails, the error is a *PublishError.
 func (s *RedisStore) SetAndPublishFact(key string, value interface{}) error {
 	data, err := json.Marshal(value)
 	if err != nil {
@@ -146,14 +179,144 @@ func (s *RedisStore) SetAndPublishFact(key string, value interface{}) error {
 		return err
 	}
 
-	// Need to break apart the key to get the group
-	group := strings.Split(key, ":")[0]
 	// Publish the value to a channel
-	err = s.client.Publish(ctx, group, fmt.Sprintf("%s=%s", key, string(data))).Err()
+	group, payload := factUpdateMessage(key, data)
+	err = s.client.Publish(ctx, group, payload).Err()
 	if err != nil {
 		logging.Logger.Error().Err(err).Str("group", group).Str("key", key).Str("data", string(data)).Msg("Failed to publish fact update")
-		return err
+		return &PublishError{Err: err}
 	}
+
 	log.Printf("Published update to group %s: %s=%s", group, key, string(data))
 	return nil
 }
+
+// PublishError is returned by SetAndPublishFact and SetAndPublishFacts when
+// the facts were written but publishing the updates failed. The facts are
+// stored, but subscribers were not told about them.
+type PublishError struct {
+	Err error
+}
+
+func (e *PublishError) Error() string {
+	return "facts committed but not published: " + e.Err.Error()
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// SetAndPublishFacts sets several facts in a single MULTI/EXEC transaction, so
+// either all of them are written or none are. The updates are published only
+// after the transaction commits, in the order given. If publishing fails, the
+// error is a *PublishError.
+func (s *RedisStore) SetAndPublishFacts(updates []FactUpdate) error {
+	encoded, err := encodeFactUpdates(updates)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, update := range updates {
+			pipe.Set(ctx, update.Key, encoded[i], 0)
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Logger.Error().Err(err).Int("count", len(updates)).Msg("Failed to set facts in Redis transaction")
+		return err
+	}
+
+	if err := s.publishFacts(updates, encoded); err != nil {
+		return &PublishError{Err: err}
+	}
+	logging.Logger.Debug().Int("count", len(updates)).Msg("Set and published facts atomically")
+	return nil
+}
+
+// PublishFacts publishes fact updates, in the order given, without setting
+// the facts. It publishes the updates of a SetAndPublishFact or
+// SetAndPublishFacts call that wrote the facts but failed to publish them.
+func (s *RedisStore) PublishFacts(updates []FactUpdate) error {
+	encoded, err := encodeFactUpdates(updates)
+	if err != nil {
+		return err
+	}
+	return s.publishFacts(updates, encoded)
+}
+
+// encodeFactUpdates encodes the values of fact updates as JSON.
+func encodeFactUpdates(updates []FactUpdate) ([][]byte, error) {
+	encoded := make([][]byte, len(updates))
+	for i, update := range updates {
+		data, err := json.Marshal(update.Value)
+		if err != nil {
+			logging.Logger.Error().Err(err).Str("key", update.Key).Interface("value", update.Value).Msg("Failed to marshal fact value")
+			return nil, err
+		}
+		encoded[i] = data
+	}
+	return encoded, nil
+}
+
+// publishFacts publishes encoded fact updates in a single pipeline.
+func (s *RedisStore) publishFacts(updates []FactUpdate, encoded [][]byte) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, update := range updates {
+			group, payload := factUpdateMessage(update.Key, encoded[i])
+			pipe.Publish(ctx, group, payload)
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Logger.Error().Err(err).Int("count", len(updates)).Msg("Failed to publish fact updates")
+	}
+	return err
+}
+
+// setAndPublishIfChangedScript sets a fact and publishes the update only if
+// the stored encoding differs from the new one. It returns 1 if the fact was
+// written and 0 if it was left unchanged.
+var setAndPublishIfChangedScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current == ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('PUBLISH', ARGV[2], ARGV[3])
+return 1
+`)
+
+// SetAndPublishFactIfChanged sets and publishes a fact like SetAndPublishFact,
+// but skips both when the store already holds the same value. The comparison
+// and the write happen atomically in Redis. It reports whether the fact was
+// written.
+func (s *RedisStore) SetAndPublishFactIfChanged(key string, value interface{}) (bool, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("key", key).Interface("value", value).Msg("Failed to marshal fact value")
+		return false, err
+	}
+
+	group, payload := factUpdateMessage(key, data)
+	written, err := setAndPublishIfChangedScript.Run(ctx, s.client, []string{key}, data, group, payload).Int()
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("key", key).Str("data", string(data)).Msg("Failed to compare and set fact in Redis")
+		return false, err
+	}
+
+	if written == 0 {
+		logging.Logger.Debug().Str("key", key).Msg("Fact unchanged, skipped write")
+		return false, nil
+	}
+	logging.Logger.Debug().Str("group", group).Str("payload", payload).Msg("Published changed fact")
+	return true, nil
+}
+
+// factUpdateMessage returns the channel and payload announcing a fact update.
+// The channel is the group part of the key, i.e. everything before the first
+// colon.
+func factUpdateMessage(key string, data []byte) (string, string) {
+	group := strings.Split(key, ":")[0]
+	return group, fmt.Sprintf("%s=%s", key, string(data))
+}
@@ -0,0 +1,401 @@
+// rex/pkg/store/resilient_store.go
+
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"rgehrsitz/rex/pkg/logging"
+)
+
+// ErrCircuitOpen is returned by a ResilientStore while its circuit breaker is
+// open, without calling the underlying store.
+var ErrCircuitOpen = errors.New("store circuit breaker is open")
+
+// RetryPolicy controls how a ResilientStore retries operations that fail with
+// a transient error. The delay before each retry starts at InitialBackoff and
+// doubles up to MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is tried, including
+	// the first attempt. Values below 1 are treated as 1.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy rexd starts with.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+// BreakerPolicy controls the circuit breaker of a ResilientStore. The breaker
+// opens after FailureThreshold operations in a row failed with a transient
+// error, even after retries. While open, operations fail with ErrCircuitOpen.
+// After ResetTimeout the breaker lets a single trial operation through and
+// closes again if it succeeds. A FailureThreshold of zero disables the
+// breaker.
+type BreakerPolicy struct {
+	FailureThreshold int
+	ResetTimeout     time.Duration
+}
+
+// DefaultBreakerPolicy is the breaker policy rexd starts with.
+var DefaultBreakerPolicy = BreakerPolicy{
+	FailureThreshold: 5,
+	ResetTimeout:     10 * time.Second,
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed lets operations through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects operations.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single trial operation through.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// ResilienceMetrics is a snapshot of the counters of a ResilientStore.
+type ResilienceMetrics struct {
+	State BreakerState `json:"state"`
+	// Retries counts the attempts retried after a transient error.
+	Retries uint64 `json:"retries"`
+	// Failures counts the operations that failed with a transient error
+	// after all retries.
+	Failures uint64 `json:"failures"`
+	// Rejected counts the operations rejected while the breaker was open.
+	Rejected uint64 `json:"rejected"`
+	// Trips counts how often the breaker opened.
+	Trips uint64 `json:"trips"`
+}
+
+// ResilientStore wraps a Store, retrying operations that fail with a
+// transient Redis error and failing fast with a circuit breaker while Redis
+// stays unavailable, e.g. during a failover. Errors that are not transient,
+// such as values that cannot be encoded, are returned as they are.
+type ResilientStore struct {
+	store   Store
+	retry   RetryPolicy
+	breaker BreakerPolicy
+
+	mu                  sync.Mutex
+	state               BreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	trialRunning        bool
+	metrics             ResilienceMetrics
+}
+
+// NewResilientStore wraps store with the given retry and breaker policies.
+func NewResilientStore(store Store, retry RetryPolicy, breaker BreakerPolicy) *ResilientStore {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	return &ResilientStore{
+		store:   store,
+		retry:   retry,
+		breaker: breaker,
+		state:   BreakerClosed,
+	}
+}
+
+// Metrics returns a snapshot of the store's counters and breaker state.
+func (s *ResilientStore) Metrics() ResilienceMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := s.metrics
+	metrics.State = s.currentState()
+	return metrics
+}
+
+// do runs op under the retry and breaker policies.
+func (s *ResilientStore) do(name string, op func() error) error {
+	if !s.allow() {
+		logging.Logger.Debug().Str("operation", name).Msg("Store circuit breaker is open, rejected operation")
+		return ErrCircuitOpen
+	}
+
+	backoff := s.retry.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil || !IsTransient(err) {
+			s.succeeded()
+			return err
+		}
+		if attempt >= s.retry.MaxAttempts || s.breakerOpen() {
+			break
+		}
+
+		logging.Logger.Warn().Err(err).
+			Str("operation", name).
+			Int("attempt", attempt).
+			Dur("backoff", backoff).
+			Msg("Transient store error, retrying")
+		s.mu.Lock()
+		s.metrics.Retries++
+		s.mu.Unlock()
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if s.retry.MaxBackoff > 0 && backoff > s.retry.MaxBackoff {
+			backoff = s.retry.MaxBackoff
+		}
+	}
+
+	s.failed(name, err)
+	return err
+}
+
+// allow reports whether an operation may run, moving an open breaker to
+// half-open once its reset timeout has passed.
+func (s *ResilientStore) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.currentState() {
+	case BreakerOpen:
+		s.metrics.Rejected++
+		return false
+	case BreakerHalfOpen:
+		if s.trialRunning {
+			s.metrics.Rejected++
+			return false
+		}
+		if s.state != BreakerHalfOpen {
+			s.setState(BreakerHalfOpen)
+		}
+		s.trialRunning = true
+	}
+	return true
+}
+
+// breakerOpen reports whether another operation opened the breaker while an
+// operation was being retried.
+func (s *ResilientStore) breakerOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == BreakerOpen
+}
+
+// succeeded records an operation that did not fail with a transient error.
+func (s *ResilientStore) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consecutiveFailures = 0
+	s.trialRunning = false
+	if s.state != BreakerClosed {
+		s.setState(BreakerClosed)
+	}
+}
+
+// failed records an operation that failed with a transient error after all
+// retries, opening the breaker if the failure threshold is reached or the
+// operation was the trial of a half-open breaker.
+func (s *ResilientStore) failed(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.Failures++
+	s.consecutiveFailures++
+	logging.Logger.Error().Err(err).
+		Str("operation", name).
+		Int("consecutiveFailures", s.consecutiveFailures).
+		Msg("Store operation failed after retries")
+
+	if s.breaker.FailureThreshold <= 0 {
+		return
+	}
+	if s.state == BreakerHalfOpen || (s.state == BreakerClosed && s.consecutiveFailures >= s.breaker.FailureThreshold) {
+		s.trialRunning = false
+		s.openedAt = time.Now()
+		s.metrics.Trips++
+		s.setState(BreakerOpen)
+	}
+}
+
+// currentState returns the breaker state, reporting an open breaker whose
+// reset timeout has passed as half-open. The caller must hold s.mu.
+func (s *ResilientStore) currentState() BreakerState {
+	if s.state == BreakerOpen && time.Since(s.openedAt) >= s.breaker.ResetTimeout {
+		return BreakerHalfOpen
+	}
+	return s.state
+}
+
+// setState changes the breaker state and logs the transition. The caller must
+// hold s.mu.
+func (s *ResilientStore) setState(state BreakerState) {
+	previous := s.state
+	s.state = state
+
+	event := logging.Logger.Info()
+	if state == BreakerOpen {
+		event = logging.Logger.Error()
+	}
+	event.Str("from", string(previous)).
+		Str("to", string(state)).
+		Int("consecutiveFailures", s.consecutiveFailures).
+		Uint64("trips", s.metrics.Trips).
+		Uint64("rejected", s.metrics.Rejected).
+		Msg("Store circuit breaker changed state")
+}
+
+// IsTransient reports whether err is a store error that may go away when the
+// operation is retried, such as a lost connection or a Redis server that is
+// loading, read-only or failing over.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, redis.ErrClosed) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		for _, prefix := range []string{"LOADING", "READONLY", "MASTERDOWN", "TRYAGAIN", "CLUSTERDOWN"} {
+			if strings.HasPrefix(redisErr.Error(), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *ResilientStore) SetFact(key string, value interface{}) error {
+	return s.do("SetFact", func() error {
+		return s.store.SetFact(key, value)
+	})
+}
+
+// SetAndPublishFact retries setting the fact until it is set, and then only
+// publishing the update, like SetAndPublishFacts.
+func (s *ResilientStore) SetAndPublishFact(key string, value interface{}) error {
+	return s.publishOnceWritten("SetAndPublishFact", []FactUpdate{{Key: key, Value: value}}, func() error {
+		return s.store.SetAndPublishFact(key, value)
+	})
+}
+
+// SetAndPublishFacts retries the transaction until it commits. Once it has
+// committed, only publishing the updates is retried, since committing the
+// transaction again could overwrite later writes to the facts. If the updates
+// still cannot be published, the error is a *PublishError.
+func (s *ResilientStore) SetAndPublishFacts(updates []FactUpdate) error {
+	return s.publishOnceWritten("SetAndPublishFacts", updates, func() error {
+		return s.store.SetAndPublishFacts(updates)
+	})
+}
+
+// publishOnceWritten retries write, which sets and publishes updates, until
+// it fails with something other than a transient error or sets the facts.
+// If the facts were set but not published, it then retries only publishing
+// the updates.
+func (s *ResilientStore) publishOnceWritten(operation string, updates []FactUpdate, write func() error) error {
+	var publishErr *PublishError
+	err := s.do(operation, func() error {
+		err := write()
+		if errors.As(err, &publishErr) {
+			return nil
+		}
+		return err
+	})
+	if err != nil || publishErr == nil {
+		return err
+	}
+
+	publisher, ok := s.store.(interface{ PublishFacts([]FactUpdate) error })
+	if !ok {
+		return publishErr
+	}
+	if err := s.do("PublishFacts", func() error {
+		return publisher.PublishFacts(updates)
+	}); err != nil {
+		return &PublishError{Err: err}
+	}
+	return nil
+}
+
+func (s *ResilientStore) SetAndPublishFactIfChanged(key string, value interface{}) (bool, error) {
+	var written bool
+	err := s.do("SetAndPublishFactIfChanged", func() error {
+		var err error
+		written, err = s.store.SetAndPublishFactIfChanged(key, value)
+		return err
+	})
+	return written, err
+}
+
+func (s *ResilientStore) GetFact(key string) (interface{}, error) {
+	var value interface{}
+	err := s.do("GetFact", func() error {
+		var err error
+		value, err = s.store.GetFact(key)
+		return err
+	})
+	return value, err
+}
+
+func (s *ResilientStore) MGetFacts(keys ...string) (map[string]interface{}, error) {
+	var facts map[string]interface{}
+	err := s.do("MGetFacts", func() error {
+		var err error
+		facts, err = s.store.MGetFacts(keys...)
+		return err
+	})
+	return facts, err
+}
+
+// ReceiveFacts is passed through to the underlying store, which keeps its
+// subscription alive on its own.
+func (s *ResilientStore) ReceiveFacts() <-chan *redis.Message {
+	return s.store.ReceiveFacts()
+}
+
+// Close is passed through to the underlying store.
+func (s *ResilientStore) Close() error {
+	return s.store.Close()
+}
+
+func (s *ResilientStore) AddPendingAction(action PendingAction) error {
+	return s.do("AddPendingAction", func() error {
+		return s.store.AddPendingAction(action)
+	})
+}
+
+func (s *ResilientStore) RemovePendingAction(id string) error {
+	return s.do("RemovePendingAction", func() error {
+		return s.store.RemovePendingAction(id)
+	})
+}
+
+func (s *ResilientStore) GetPendingActions() ([]PendingAction, error) {
+	var actions []PendingAction
+	err := s.do("GetPendingActions", func() error {
+		var err error
+		actions, err = s.store.GetPendingActions()
+		return err
+	})
+	return actions, err
+}
+
+func (s *ResilientStore) AddDeadLetter(key string, letter DeadLetter) error {
+	return s.do("AddDeadLetter", func() error {
+		return s.store.AddDeadLetter(key, letter)
+	})
+}
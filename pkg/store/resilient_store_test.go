@@ -0,0 +1,163 @@
+// rex/pkg/store/resilient_store_test.go
+
+package store
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStore is a Redis store whose fact writes fail with a connection error
+// while failures is positive, counting down with each failed write.
+type flakyStore struct {
+	*RedisStore
+	failures int
+}
+
+func (s *flakyStore) SetAndPublishFact(key string, value interface{}) error {
+	if s.failures != 0 {
+		s.failures--
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return s.RedisStore.SetAndPublishFact(key, value)
+}
+
+func TestResilientStoreRetries(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	flaky := &flakyStore{RedisStore: redisStore, failures: 2}
+	resilient := NewResilientStore(flaky, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}, DefaultBreakerPolicy)
+
+	assert.NoError(t, resilient.SetAndPublishFact("system:mode", "eco"))
+	value, err := s.Get("system:mode")
+	assert.NoError(t, err)
+	assert.Equal(t, `"eco"`, value)
+	assert.Equal(t, ResilienceMetrics{State: BreakerClosed, Retries: 2}, resilient.Metrics())
+
+	// An operation still failing after all attempts returns the last error
+	flaky.failures = 3
+	err = resilient.SetAndPublishFact("system:mode", "boost")
+	assert.True(t, IsTransient(err))
+	assert.Equal(t, ResilienceMetrics{State: BreakerClosed, Retries: 4, Failures: 1}, resilient.Metrics())
+
+	// Errors that are not transient are not retried
+	err = resilient.SetAndPublishFact("system:mode", make(chan int))
+	assert.Error(t, err)
+	assert.Equal(t, ResilienceMetrics{State: BreakerClosed, Retries: 4, Failures: 1}, resilient.Metrics())
+}
+
+func TestResilientStoreCircuitBreaker(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	flaky := &flakyStore{RedisStore: redisStore, failures: -1}
+	resilient := NewResilientStore(flaky, RetryPolicy{MaxAttempts: 1}, BreakerPolicy{FailureThreshold: 2, ResetTimeout: 20 * time.Millisecond})
+
+	// The breaker opens after two failed operations in a row
+	assert.Error(t, resilient.SetAndPublishFact("system:mode", "eco"))
+	assert.Equal(t, BreakerClosed, resilient.Metrics().State)
+	assert.Error(t, resilient.SetAndPublishFact("system:mode", "eco"))
+	assert.Equal(t, ResilienceMetrics{State: BreakerOpen, Failures: 2, Trips: 1}, resilient.Metrics())
+
+	// While open, operations are rejected without reaching the store
+	flaky.failures = 0
+	assert.ErrorIs(t, resilient.SetAndPublishFact("system:mode", "eco"), ErrCircuitOpen)
+	assert.False(t, s.Exists("system:mode"))
+	assert.Equal(t, uint64(1), resilient.Metrics().Rejected)
+
+	// After the reset timeout a failed trial opens the breaker again
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, resilient.Metrics().State)
+	flaky.failures = 1
+	assert.Error(t, resilient.SetAndPublishFact("system:mode", "eco"))
+	assert.Equal(t, ResilienceMetrics{State: BreakerOpen, Failures: 3, Rejected: 1, Trips: 2}, resilient.Metrics())
+
+	// and a successful trial closes it
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, resilient.SetAndPublishFact("system:mode", "eco"))
+	assert.Equal(t, BreakerClosed, resilient.Metrics().State)
+	assert.True(t, s.Exists("system:mode"))
+}
+
+// unpublishedStore is a Redis store whose transactions commit but whose
+// publishes fail with a connection error while failures is positive.
+type unpublishedStore struct {
+	*RedisStore
+	failures int
+	commits  int
+}
+
+func (s *unpublishedStore) SetAndPublishFacts(updates []FactUpdate) error {
+	s.commits++
+	if err := s.RedisStore.SetFact(updates[0].Key, updates[0].Value); err != nil {
+		return err
+	}
+	return s.PublishFacts(updates)
+}
+
+func (s *unpublishedStore) SetAndPublishFact(key string, value interface{}) error {
+	return s.SetAndPublishFacts([]FactUpdate{{Key: key, Value: value}})
+}
+
+func (s *unpublishedStore) PublishFacts(updates []FactUpdate) error {
+	if s.failures != 0 {
+		s.failures--
+		return &PublishError{Err: &net.OpError{Op: "write", Net: "tcp", Err: errors.New("connection reset")}}
+	}
+	return s.RedisStore.PublishFacts(updates)
+}
+
+func TestResilientStoreRetriesOnlyPublish(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+	defer s.Close()
+
+	unpublished := &unpublishedStore{RedisStore: redisStore, failures: 2}
+	resilient := NewResilientStore(unpublished, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, DefaultBreakerPolicy)
+	updates := []FactUpdate{{Key: "system:mode", Value: "eco"}}
+
+	// The transaction committed once; the publish is retried on its own
+	assert.NoError(t, resilient.SetAndPublishFacts(updates))
+	assert.Equal(t, 1, unpublished.commits)
+	assert.Equal(t, uint64(1), resilient.Metrics().Retries)
+
+	// A publish still failing after all attempts is reported as such
+	unpublished.failures = -1
+	err := resilient.SetAndPublishFacts(updates)
+	var publishErr *PublishError
+	assert.ErrorAs(t, err, &publishErr)
+	assert.Equal(t, 2, unpublished.commits)
+
+	// A single fact is set once and then published again the same way
+	unpublished.failures = 2
+	assert.NoError(t, resilient.SetAndPublishFact("system:mode", "boost"))
+	assert.Equal(t, 3, unpublished.commits)
+	value, err := redisStore.GetFact("system:mode")
+	assert.NoError(t, err)
+	assert.Equal(t, "boost", value)
+}
+
+func TestIsTransient(t *testing.T) {
+	s, redisStore := setupMiniredis(t)
+
+	s.SetError("READONLY You can't write against a read only replica.")
+	err := redisStore.SetFact("system:mode", "eco")
+	assert.True(t, IsTransient(err), "read-only replica: %v", err)
+
+	s.SetError("ERR wrong number of arguments")
+	err = redisStore.SetFact("system:mode", "eco")
+	assert.False(t, IsTransient(err), "command error: %v", err)
+	s.SetError("")
+
+	s.Close()
+	err = redisStore.SetFact("system:mode", "eco")
+	assert.True(t, IsTransient(err), "connection refused: %v", err)
+
+	assert.False(t, IsTransient(nil))
+	assert.False(t, IsTransient(ErrCircuitOpen))
+	assert.False(t, IsTransient(errors.New("json: unsupported type")))
+}
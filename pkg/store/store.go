@@ -7,7 +7,23 @@ import "github.com/redis/go-redis/v9"
 type Store interface {
 	SetFact(key string, value interface{}) error
 	SetAndPublishFact(key string, value interface{}) error
+	SetAndPublishFacts(updates []FactUpdate) error
+	SetAndPublishFactIfChanged(key string, value interface{}) (bool, error)
 	GetFact(key string) (interface{}, error)
 	MGetFacts(keys ...string) (map[string]interface{}, error)
 	ReceiveFacts() <-chan *redis.Message // Add this line
+
+	AddPendingAction(action PendingAction) error
+	RemovePendingAction(id string) error
+	GetPendingActions() ([]PendingAction, error)
+
+	AddDeadLetter(key string, letter DeadLetter) error
+
+	Close() error
+}
+
+// FactUpdate is a single fact write within a batch.
+type FactUpdate struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
 }
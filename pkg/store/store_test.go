@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
@@ -134,6 +135,25 @@ func TestSubscribe(t *testing.T) {
 	pubsub.Close()
 }
 
+func TestPublish(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	receivers, err := store.Publish("test_channel", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), receivers)
+
+	pubsub := store.Subscribe("test_channel")
+	defer pubsub.Close()
+	receivers, err = store.Publish("test_channel", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), receivers)
+
+	msg, err := pubsub.ReceiveMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.Payload)
+}
+
 func TestReceiveFacts(t *testing.T) {
 	s, store := setupMiniredis(t)
 	defer s.Close()
@@ -230,3 +250,193 @@ func TestSetAndPublishFactWithDifferentTypes(t *testing.T) {
 		})
 	}
 }
+
+func TestSetAndPublishStructuredFact(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	pubsub := store.Subscribe("test")
+	defer pubsub.Close()
+
+	value := map[string]interface{}{"mode": "eco", "speeds": []interface{}{1.0, 2.0}}
+	err := store.SetAndPublishFact("test:config", value)
+	assert.NoError(t, err)
+
+	// The value round-trips through its JSON encoding
+	result, err := store.GetFact("test:config")
+	assert.NoError(t, err)
+	assert.Equal(t, value, result)
+
+	msg, err := pubsub.ReceiveMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, `test:config={"mode":"eco","speeds":[1,2]}`, msg.Payload)
+}
+
+func TestPendingActions(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	later := PendingAction{ID: "rule_a#0", Rule: "rule_a", Type: "updateStore", Target: "system:fan_speed", Value: 0.0, RunAt: now.Add(10 * time.Minute), CancelIfFalse: true}
+	sooner := PendingAction{ID: "rule_b#1", Rule: "rule_b", Type: "updateStore", Target: "system:mode", Value: "eco", RunAt: now.Add(time.Minute)}
+
+	assert.NoError(t, store.AddPendingAction(later))
+	assert.NoError(t, store.AddPendingAction(sooner))
+
+	// Pending actions are returned ordered by run time
+	actions, err := store.GetPendingActions()
+	assert.NoError(t, err)
+	if assert.Len(t, actions, 2) {
+		assert.Equal(t, "rule_b#1", actions[0].ID)
+		assert.Equal(t, "eco", actions[0].Value)
+		assert.Equal(t, "rule_a#0", actions[1].ID)
+		assert.True(t, actions[1].RunAt.Equal(later.RunAt))
+		assert.True(t, actions[1].CancelIfFalse)
+	}
+
+	assert.NoError(t, store.RemovePendingAction("rule_a#0"))
+	assert.NoError(t, store.RemovePendingAction("unknown"))
+
+	actions, err = store.GetPendingActions()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+}
+
+func TestSetAndPublishFacts(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	pubsub := store.Subscribe("system")
+	defer pubsub.Close()
+
+	err := store.SetAndPublishFacts([]FactUpdate{
+		{Key: "system:fan_speed", Value: 3.0},
+		{Key: "system:mode", Value: "cooling"},
+	})
+	assert.NoError(t, err)
+
+	speed, err := store.GetFact("system:fan_speed")
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, speed)
+	mode, err := store.GetFact("system:mode")
+	assert.NoError(t, err)
+	assert.Equal(t, "cooling", mode)
+
+	// Updates are published after the commit, in order
+	msg, err := pubsub.ReceiveMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "system:fan_speed=3", msg.Payload)
+	msg, err = pubsub.ReceiveMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, `system:mode="cooling"`, msg.Payload)
+}
+
+func TestSetAndPublishFactsUnencodableValue(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	// A value that cannot be encoded aborts the whole batch
+	err := store.SetAndPublishFacts([]FactUpdate{
+		{Key: "system:fan_speed", Value: 3.0},
+		{Key: "system:broken", Value: make(chan int)},
+	})
+	assert.Error(t, err)
+	assert.False(t, s.Exists("system:fan_speed"))
+}
+
+func TestSetAndPublishFactIfChanged(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	pubsub := store.Subscribe("system")
+	defer pubsub.Close()
+
+	written, err := store.SetAndPublishFactIfChanged("system:fan_speed", 3.0)
+	assert.NoError(t, err)
+	assert.True(t, written)
+
+	// Writing the same value again is skipped
+	written, err = store.SetAndPublishFactIfChanged("system:fan_speed", 3.0)
+	assert.NoError(t, err)
+	assert.False(t, written)
+
+	written, err = store.SetAndPublishFactIfChanged("system:fan_speed", 4.0)
+	assert.NoError(t, err)
+	assert.True(t, written)
+
+	// Only the two changes were published
+	msg, err := pubsub.ReceiveMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "system:fan_speed=3", msg.Payload)
+	msg, err = pubsub.ReceiveMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "system:fan_speed=4", msg.Payload)
+
+	value, err := store.GetFact("system:fan_speed")
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, value)
+}
+
+func TestDeadLetters(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	key := DefaultDeadLetterKey
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	message := DeadLetter{Kind: DeadLetterMessage, Channel: "system", Payload: "garbage", Error: "invalid fact update format", Timestamp: now}
+	action := DeadLetter{Kind: DeadLetterAction, Rule: "FanRule", Updates: []FactUpdate{{Key: "system:fan_speed", Value: 3.0}}, Error: "connection refused", Timestamp: now}
+
+	assert.NoError(t, store.AddDeadLetter(key, message))
+	assert.NoError(t, store.AddDeadLetter(key, action))
+
+	// Dead letters come back oldest first, with IDs assigned
+	letters, err := store.GetDeadLetters(key)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "1", letters[0].ID)
+		assert.Equal(t, "garbage", letters[0].Payload)
+		assert.Equal(t, now, letters[0].Timestamp)
+		assert.Equal(t, "2", letters[1].ID)
+		assert.Equal(t, "FanRule", letters[1].Rule)
+		assert.Equal(t, []FactUpdate{{Key: "system:fan_speed", Value: 3.0}}, letters[1].Updates)
+	}
+
+	// Replaying an action applies its writes and removes it
+	assert.NoError(t, store.ReplayDeadLetter(key, letters[1]))
+	speed, err := s.Get("system:fan_speed")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", speed)
+
+	// Replaying a message publishes it again and removes it
+	assert.NoError(t, store.ReplayDeadLetter(key, letters[0]))
+
+	letters, err = store.GetDeadLetters(key)
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+
+	// Dead letters of an unknown kind are kept
+	assert.NoError(t, store.AddDeadLetter(key, DeadLetter{Kind: "unknown", Error: "?"}))
+	letters, err = store.GetDeadLetters(key)
+	assert.NoError(t, err)
+	assert.Error(t, store.ReplayDeadLetter(key, letters[0]))
+	letters, err = store.GetDeadLetters(key)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+}
+
+func TestClose(t *testing.T) {
+	s, store := setupMiniredis(t)
+	defer s.Close()
+
+	facts := store.ReceiveFacts()
+	assert.NoError(t, store.Close())
+
+	// Closing the store closes the subscription's channel
+	select {
+	case _, ok := <-facts:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("subscription channel was not closed")
+	}
+	assert.Error(t, store.SetFact("system:mode", "eco"))
+}